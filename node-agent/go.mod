@@ -1,3 +1,7 @@
 module node-agent
 
 go 1.22
+
+require zen-admin/pkg v0.0.0
+
+replace zen-admin/pkg => ../pkg
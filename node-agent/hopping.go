@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"zen-admin/pkg/porthop"
+)
+
+var (
+	portHoppingPath  = getEnv("PORT_HOPPING_STATE", filepath.Join(filepath.Dir(configPath), "port-hopping.json"))
+	portHoppingMu    sync.Mutex
+	portHoppingRules []porthop.Rule
+)
+
+// Восстанавливаем правила после перезапуска: nftables не переживает перезагрузку хоста
+func initPortHopping() {
+	data, err := os.ReadFile(portHoppingPath)
+	if err != nil {
+		return
+	}
+	var req porthop.Request
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("Port hopping: invalid state file: %v", err)
+		return
+	}
+	portHoppingRules = req.Rules
+	if len(req.Rules) == 0 {
+		return
+	}
+	if err := applyPortHopping(req.Rules); err != nil {
+		log.Printf("Port hopping: failed to restore rules: %v", err)
+		return
+	}
+	log.Printf("Port hopping: restored %d rule(s)", len(req.Rules))
+}
+
+// Получить/заменить правила port hopping (перенаправление UDP диапазонов на порт Hysteria2)
+func portHoppingHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		portHoppingMu.Lock()
+		rules := portHoppingRules
+		portHoppingMu.Unlock()
+		if rules == nil {
+			rules = []porthop.Rule{}
+		}
+		json.NewEncoder(w).Encode(porthop.Request{Rules: rules})
+
+	case "POST":
+		var req porthop.Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := porthop.Validate(req.Rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		portHoppingMu.Lock()
+		defer portHoppingMu.Unlock()
+
+		if err := applyPortHopping(req.Rules); err != nil {
+			log.Printf("Failed to apply port hopping: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		portHoppingRules = req.Rules
+
+		data, _ := json.MarshalIndent(req, "", "  ")
+		if err := os.WriteFile(portHoppingPath, data, 0644); err != nil {
+			log.Printf("Failed to save port hopping state: %v", err)
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Загружаем nftables скрипт в сетевом namespace хоста (nft из образа агента)
+func applyPortHopping(rules []porthop.Rule) error {
+	cmd := exec.Command("nsenter", "-t", "1", "-n", "--", "nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(porthop.NFTScript(rules))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
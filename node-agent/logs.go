@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Откуда читать логи sing-box: systemd (journalctl на хосте) или docker
+	logSource      = getEnv("LOG_SOURCE", "systemd")
+	singboxUnit    = getEnv("SINGBOX_UNIT", "sing-box")
+	singboxDocker  = getEnv("SINGBOX_CONTAINER", "singbox")
+	ansiEscape     = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+	singboxLevels  = map[string]int{"TRACE": 0, "DEBUG": 1, "INFO": 2, "WARN": 3, "ERROR": 4, "FATAL": 5, "PANIC": 6}
+	maxLogTailSize = 5000
+)
+
+// Логи sing-box: ?tail=100&follow=1&level=warn
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tail := 100
+	if v := r.URL.Query().Get("tail"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid tail", http.StatusBadRequest)
+			return
+		}
+		tail = n
+	}
+	if tail > maxLogTailSize {
+		tail = maxLogTailSize
+	}
+
+	follow, _ := strconv.ParseBool(r.URL.Query().Get("follow"))
+
+	minLevel := -1
+	if v := r.URL.Query().Get("level"); v != "" {
+		level, ok := singboxLevels[strings.ToUpper(v)]
+		if !ok {
+			http.Error(w, "Invalid level", http.StatusBadRequest)
+			return
+		}
+		minLevel = level
+	}
+
+	var args []string
+	switch logSource {
+	case "docker":
+		args = []string{"docker", "logs", "--tail", strconv.Itoa(tail)}
+		if follow {
+			args = append(args, "-f")
+		}
+		args = append(args, singboxDocker)
+	default:
+		// journalctl на хосте (nsenter в PID namespace хоста, как и для перезапуска)
+		args = []string{"nsenter", "-t", "1", "-m", "-u", "-i", "-n", "-p", "--",
+			"journalctl", "-u", singboxUnit, "-n", strconv.Itoa(tail), "--no-pager", "-o", "cat"}
+		if follow {
+			args = append(args, "-f")
+		}
+	}
+
+	// Контекст запроса отменяется, когда панель отключается — процесс будет убит
+	cmd := exec.CommandContext(r.Context(), args[0], args[1:]...)
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	if err := cmd.Start(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read logs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	go func() {
+		pw.CloseWithError(cmd.Wait())
+	}()
+	defer pr.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+
+	scanner := bufio.NewScanner(pr)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := ansiEscape.ReplaceAllString(scanner.Text(), "")
+		if minLevel >= 0 && logLineLevel(line) < minLevel {
+			continue
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// Уровень строки лога sing-box; строки без уровня (паники, вывод при старте) показываем всегда
+func logLineLevel(line string) int {
+	for _, field := range strings.Fields(line) {
+		if level, ok := singboxLevels[field]; ok {
+			return level
+		}
+	}
+	return singboxLevels["PANIC"]
+}
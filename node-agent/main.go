@@ -1,8 +1,6 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,13 +8,17 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"strings"
 	"time"
+
+	"zen-admin/pkg/reality"
 )
 
 var (
 	configPath = getEnv("CONFIG_PATH", "/etc/sing-box/config.json")
 	apiToken   = getEnv("API_TOKEN", "change-me")
 	listenAddr = getEnv("LISTEN_ADDR", ":8880")
+	clashAPI   = getEnv("CLASH_API", "http://127.0.0.1:9095")
 	startTime  = time.Now()
 )
 
@@ -50,7 +52,7 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"online":     true,
 		"singbox_up": singboxUp,
-		"version":    "1.0.0",
+		"version":    version,
 		"uptime":     int64(time.Since(startTime).Seconds()),
 	})
 }
@@ -116,33 +118,28 @@ func restartHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
-// Генерация REALITY ключей
+// Генерация REALITY ключей (X25519 нативно, без бинарника sing-box)
 func generateKeysHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Используем sing-box для генерации ключей
-	cmd := exec.Command("sing-box", "generate", "reality-keypair")
-	output, err := cmd.Output()
+	keys, err := reality.GenerateKeyPair()
 	if err != nil {
 		http.Error(w, "Failed to generate keys", http.StatusInternalServerError)
 		return
 	}
 
-	// Парсим вывод
-	var privateKey, publicKey string
-	fmt.Sscanf(string(output), "PrivateKey: %s\nPublicKey: %s", &privateKey, &publicKey)
-
-	// Генерируем short_id
-	shortIDBytes := make([]byte, 8)
-	rand.Read(shortIDBytes)
-	shortID := hex.EncodeToString(shortIDBytes)
+	shortID, err := reality.GenerateShortID(reality.MaxShortIDBytes)
+	if err != nil {
+		http.Error(w, "Failed to generate short_id", http.StatusInternalServerError)
+		return
+	}
 
 	json.NewEncoder(w).Encode(map[string]string{
-		"private_key": privateKey,
-		"public_key":  publicKey,
+		"private_key": keys.PrivateKey,
+		"public_key":  keys.PublicKey,
 		"short_id":    shortID,
 	})
 }
@@ -160,15 +157,66 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// Активные соединения sing-box (через Clash API), сгруппированные по тегу инбаунда
+func connectionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(clashAPI + "/connections")
+	if err != nil {
+		// 502 - агент работает, недоступен Clash API sing-box
+		http.Error(w, fmt.Sprintf("Clash API unavailable: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	var clashResp struct {
+		Connections []struct {
+			Metadata struct {
+				Type string `json:"type"`
+			} `json:"metadata"`
+		} `json:"connections"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&clashResp); err != nil {
+		http.Error(w, "Invalid Clash API response", http.StatusBadGateway)
+		return
+	}
+
+	// Тип соединения в sing-box: "протокол/тег инбаунда"
+	inbounds := map[string]int{}
+	for _, conn := range clashResp.Connections {
+		tag := conn.Metadata.Type
+		if idx := strings.Index(tag, "/"); idx >= 0 {
+			tag = tag[idx+1:]
+		}
+		inbounds[tag]++
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total":    len(clashResp.Connections),
+		"inbounds": inbounds,
+	})
+}
+
 func main() {
-	log.Printf("Node Agent starting on %s", listenAddr)
+	log.Printf("Node Agent %s starting on %s", version, listenAddr)
 	log.Printf("Config path: %s", configPath)
 
+	initPortHopping()
+
 	http.HandleFunc("/health", healthHandler)
 	http.HandleFunc("/config", authMiddleware(configHandler))
 	http.HandleFunc("/restart", authMiddleware(restartHandler))
 	http.HandleFunc("/generate-keys", authMiddleware(generateKeysHandler))
 	http.HandleFunc("/stats", authMiddleware(statsHandler))
+	http.HandleFunc("/connections", authMiddleware(connectionsHandler))
+	http.HandleFunc("/logs", authMiddleware(logsHandler))
+	http.HandleFunc("/version", authMiddleware(versionHandler))
+	http.HandleFunc("/update", authMiddleware(updateHandler))
+	http.HandleFunc("/port-hopping", authMiddleware(portHoppingHandler))
 
 	log.Fatal(http.ListenAndServe(listenAddr, nil))
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"zen-admin/pkg/agentupdate"
+)
+
+// Версия сборки, задаётся через -ldflags "-X main.version=..."
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+)
+
+const maxUpdateBinarySize = 100 << 20
+
+var (
+	updatePublicKey = loadUpdatePublicKey()
+	updateMu        sync.Mutex
+)
+
+// Публичный ключ ed25519 (base64) для проверки подписи релизов
+func loadUpdatePublicKey() ed25519.PublicKey {
+	key := os.Getenv("UPDATE_PUBLIC_KEY")
+	if key == "" {
+		return nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		log.Printf("Warning: invalid UPDATE_PUBLIC_KEY, self-update is disabled")
+		return nil
+	}
+	return ed25519.PublicKey(raw)
+}
+
+// Версия агента и информация о сборке
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version":    version,
+		"commit":     commit,
+		"build_time": buildTime,
+		"go_version": runtime.Version(),
+		"os":         runtime.GOOS,
+		"arch":       runtime.GOARCH,
+		"started_at": startTime,
+	})
+}
+
+// Самообновление: скачиваем подписанный бинарник, проверяем sha256 и подпись,
+// подменяем исполняемый файл и перезапускаемся. Образы не поддерживаются — только бинарник
+func updateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if updatePublicKey == nil {
+		http.Error(w, "Self-update is disabled: UPDATE_PUBLIC_KEY not set", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Version   string `json:"version"`
+		BinaryURL string `json:"binary_url"`
+		SHA256    string `json:"sha256"`
+		Image     string `json:"image"`
+		Downgrade bool   `json:"downgrade"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if req.Image != "" {
+		http.Error(w, "Image updates are not supported by this agent, use binary_url", http.StatusBadRequest)
+		return
+	}
+	sum := strings.ToLower(req.SHA256)
+	if req.Version == "" || req.BinaryURL == "" || len(sum) != sha256.Size*2 {
+		http.Error(w, "version, binary_url and sha256 are required", http.StatusBadRequest)
+		return
+	}
+
+	// Подпись проверяем до скачивания: "zen-agent-update:<версия>:<sha256>[:downgrade]"
+	signature, err := base64.StdEncoding.DecodeString(req.Signature)
+	payload := agentupdate.SigningPayload(req.Version, sum, req.Downgrade)
+	if err != nil || !ed25519.Verify(updatePublicKey, payload, signature) {
+		http.Error(w, "Signature verification failed", http.StatusForbidden)
+		return
+	}
+
+	// Иначе старый подписанный релиз с уязвимостью можно подсунуть повторно
+	if err := agentupdate.CheckVersion(version, req.Version, req.Downgrade); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if !updateMu.TryLock() {
+		http.Error(w, "Update already in progress", http.StatusConflict)
+		return
+	}
+
+	exe, err := installBinary(req.BinaryURL, sum)
+	if err != nil {
+		updateMu.Unlock()
+		log.Printf("Update failed: %v", err)
+		http.Error(w, fmt.Sprintf("Update failed: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	log.Printf("Agent updated from %s to %s, restarting", version, req.Version)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+
+	// Перезапуск после отправки ответа; мьютекс остаётся занятым до замены процесса
+	go func() {
+		time.Sleep(time.Second)
+		if err := syscall.Exec(exe, os.Args, os.Environ()); err != nil {
+			// Выходим — restart policy поднимет новый бинарник
+			log.Fatalf("Failed to exec new binary: %v", err)
+		}
+	}()
+}
+
+// Скачивает бинарник, сверяет sha256 и атомарно подменяет текущий (старый сохраняется как .old)
+func installBinary(url, expectedSHA256 string) (string, error) {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("download: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download returned status %d", resp.StatusCode)
+	}
+
+	binary, err := io.ReadAll(io.LimitReader(resp.Body, maxUpdateBinarySize+1))
+	if err != nil {
+		return "", fmt.Errorf("download: %w", err)
+	}
+	if len(binary) > maxUpdateBinarySize {
+		return "", fmt.Errorf("binary exceeds %d bytes", maxUpdateBinarySize)
+	}
+
+	hash := sha256.Sum256(binary)
+	if hex.EncodeToString(hash[:]) != expectedSHA256 {
+		return "", fmt.Errorf("sha256 mismatch: got %s", hex.EncodeToString(hash[:]))
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		return "", fmt.Errorf("locate executable: %w", err)
+	}
+
+	if current, err := os.ReadFile(exe); err == nil {
+		os.WriteFile(exe+".old", current, 0755)
+	}
+
+	newPath := exe + ".new"
+	if err := os.WriteFile(newPath, binary, 0755); err != nil {
+		return "", fmt.Errorf("write binary: %w", err)
+	}
+	if err := os.Rename(newPath, exe); err != nil {
+		os.Remove(newPath)
+		return "", fmt.Errorf("replace binary: %w", err)
+	}
+
+	return exe, nil
+}
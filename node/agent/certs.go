@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	defaultCertDir         = "/etc/sing-box/certs"
+	defaultACMEDirectory   = "https://acme-v02.api.letsencrypt.org/directory"
+	defaultACMEHTTPAddr    = ":80"
+	defaultRenewBeforeDays = 30
+	certRenewalInterval    = 12 * time.Hour
+	acmeIssueTimeout       = 3 * time.Minute
+	certSourceACME         = "acme"
+	certSourceUpload       = "upload"
+	certMetaFile           = "meta.json"
+	acmeAccountKeyFile     = "acme-account.key"
+	certFileName           = "cert.pem"
+	keyFileName            = "key.pem"
+)
+
+var (
+	certDir         string
+	acmeDirectory   string
+	acmeHTTPAddr    string
+	acmeHTTPClient  *http.Client
+	renewBeforeDays int
+
+	// acmeMu serializes ACME issuance: the HTTP-01 listener can only be bound once
+	acmeMu sync.Mutex
+	certMu sync.RWMutex
+
+	domainPattern = regexp.MustCompile(`^(\*\.)?([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]{2,63}$`)
+)
+
+// CertInfo describes a certificate stored on the node
+type CertInfo struct {
+	Domain        string     `json:"domain"`
+	Source        string     `json:"source"`
+	CertPath      string     `json:"cert_path"`
+	KeyPath       string     `json:"key_path"`
+	Issuer        string     `json:"issuer,omitempty"`
+	Subject       string     `json:"subject,omitempty"`
+	DNSNames      []string   `json:"dns_names,omitempty"`
+	NotBefore     *time.Time `json:"not_before,omitempty"`
+	NotAfter      *time.Time `json:"not_after,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+}
+
+// certMeta is persisted next to each certificate
+type certMeta struct {
+	Source        string     `json:"source"`
+	Email         string     `json:"email,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+}
+
+type UploadCertRequest struct {
+	Domain      string `json:"domain"`
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"private_key"`
+}
+
+type ACMERequest struct {
+	Domain string `json:"domain"`
+	Email  string `json:"email"`
+}
+
+// initCerts loads certificate settings from environment
+func initCerts() {
+	certDir = os.Getenv("CERT_DIR")
+	if certDir == "" {
+		certDir = defaultCertDir
+	}
+
+	acmeDirectory = os.Getenv("ACME_DIRECTORY")
+	if acmeDirectory == "" {
+		acmeDirectory = defaultACMEDirectory
+	}
+
+	acmeHTTPAddr = os.Getenv("ACME_HTTP_ADDR")
+	if acmeHTTPAddr == "" {
+		acmeHTTPAddr = defaultACMEHTTPAddr
+	}
+
+	renewBeforeDays = defaultRenewBeforeDays
+	if v := os.Getenv("CERT_RENEW_BEFORE_DAYS"); v != "" {
+		if days, err := strconv.Atoi(v); err == nil && days > 0 {
+			renewBeforeDays = days
+		}
+	}
+
+	// ACME_CA_CERT allows trusting a local ACME server (e.g. Pebble) during testing
+	acmeHTTPClient = &http.Client{Timeout: 30 * time.Second}
+	if caPath := os.Getenv("ACME_CA_CERT"); caPath != "" {
+		caPEM, err := os.ReadFile(caPath)
+		if err != nil {
+			log.Printf("Warning: failed to read ACME_CA_CERT: %v", err)
+		} else {
+			pool := x509.NewCertPool()
+			pool.AppendCertsFromPEM(caPEM)
+			acmeHTTPClient.Transport = &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			}
+		}
+	}
+
+	if err := os.MkdirAll(certDir, 0755); err != nil {
+		log.Printf("Warning: failed to create cert dir %s: %v", certDir, err)
+	}
+}
+
+// handleCerts lists certificates stored on the node
+func handleCerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+		return
+	}
+
+	certs, err := listCerts()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, certs)
+}
+
+// handleCertUpload stores a certificate and key uploaded by the panel
+func handleCertUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+		return
+	}
+
+	var req UploadCertRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid JSON: " + err.Error()})
+		return
+	}
+
+	if !domainPattern.MatchString(req.Domain) {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid domain"})
+		return
+	}
+
+	// Make sure the pair is usable before replacing anything on disk
+	pair, err := tls.X509KeyPair([]byte(req.Certificate), []byte(req.PrivateKey))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid certificate or key: " + err.Error()})
+		return
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid certificate: " + err.Error()})
+		return
+	}
+	hostname := req.Domain
+	if strings.HasPrefix(hostname, "*.") {
+		hostname = "www" + hostname[1:]
+	}
+	if err := leaf.VerifyHostname(hostname); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "certificate does not match domain: " + err.Error()})
+		return
+	}
+
+	if err := storeCert(req.Domain, []byte(req.Certificate), []byte(req.PrivateKey), certMeta{Source: certSourceUpload}); err != nil {
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	info, err := readCertInfo(req.Domain)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	log.Printf("Certificate for %s uploaded", req.Domain)
+	writeJSON(w, http.StatusOK, info)
+}
+
+// handleCertACME obtains a certificate for the domain via ACME HTTP-01
+func handleCertACME(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+		return
+	}
+
+	var req ACMERequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid JSON: " + err.Error()})
+		return
+	}
+
+	// HTTP-01 cannot validate wildcard names
+	if !domainPattern.MatchString(req.Domain) || strings.HasPrefix(req.Domain, "*.") {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid domain"})
+		return
+	}
+
+	if err := obtainACMECert(req.Domain, req.Email); err != nil {
+		writeJSON(w, http.StatusBadGateway, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	info, err := readCertInfo(req.Domain)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+// obtainACMECert runs a full ACME order for the domain and stores the result.
+// The outcome is recorded in the certificate metadata so the panel can see failed renewals.
+func obtainACMECert(domain, email string) error {
+	acmeMu.Lock()
+	defer acmeMu.Unlock()
+
+	now := time.Now()
+	meta, _ := readCertMeta(domain)
+	meta.Source = certSourceACME
+	if email != "" {
+		meta.Email = email
+	}
+	meta.LastAttemptAt = &now
+
+	certPEM, keyPEM, err := issueACMECert(domain, meta.Email)
+	if err != nil {
+		meta.LastError = err.Error()
+		if writeErr := writeCertMeta(domain, meta); writeErr != nil {
+			log.Printf("Failed to save certificate metadata for %s: %v", domain, writeErr)
+		}
+		log.Printf("ACME issuance for %s failed: %v", domain, err)
+		return err
+	}
+
+	meta.LastError = ""
+	if err := storeCert(domain, certPEM, keyPEM, meta); err != nil {
+		return err
+	}
+
+	log.Printf("ACME certificate for %s obtained", domain)
+	return nil
+}
+
+// issueACMECert talks to the ACME server and returns PEM encoded chain and key
+func issueACMECert(domain, email string) ([]byte, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), acmeIssueTimeout)
+	defer cancel()
+
+	accountKey, err := loadAccountKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: acmeDirectory,
+		HTTPClient:   acmeHTTPClient,
+	}
+
+	account := &acme.Account{}
+	if email != "" {
+		account.Contact = []string{"mailto:" + email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, nil, fmt.Errorf("acme register: %w", err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme order: %w", err)
+	}
+
+	// Serve HTTP-01 challenges only for the duration of the order
+	challenges := &challengeStore{tokens: make(map[string]string)}
+	listener, err := net.Listen("tcp", acmeHTTPAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to listen on %s for HTTP-01: %w", acmeHTTPAddr, err)
+	}
+	server := &http.Server{Handler: challenges, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	defer server.Close()
+
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("acme authorization: %w", err)
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+
+		var challenge *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == "http-01" {
+				challenge = c
+				break
+			}
+		}
+		if challenge == nil {
+			return nil, nil, fmt.Errorf("acme server offered no http-01 challenge for %s", domain)
+		}
+
+		response, err := client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return nil, nil, fmt.Errorf("acme challenge response: %w", err)
+		}
+		challenges.set(client.HTTP01ChallengePath(challenge.Token), response)
+
+		if _, err := client.Accept(ctx, challenge); err != nil {
+			return nil, nil, fmt.Errorf("acme accept: %w", err)
+		}
+		if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+			return nil, nil, fmt.Errorf("acme authorization failed: %w", err)
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme order failed: %w", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme finalize: %w", err)
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyPEM, err := encodeECKey(certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return certPEM, keyPEM, nil
+}
+
+// challengeStore serves HTTP-01 key authorizations
+type challengeStore struct {
+	mu     sync.RWMutex
+	tokens map[string]string
+}
+
+func (s *challengeStore) set(path, response string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[path] = response
+}
+
+func (s *challengeStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	response, ok := s.tokens[r.URL.Path]
+	s.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(response))
+}
+
+// certRenewalLoop periodically renews ACME certificates that are close to expiry
+func certRenewalLoop() {
+	for {
+		renewDueCerts()
+		time.Sleep(certRenewalInterval)
+	}
+}
+
+// renewDueCerts renews ACME certificates expiring within renewBeforeDays and restarts sing-box
+func renewDueCerts() {
+	certs, err := listCerts()
+	if err != nil {
+		log.Printf("Certificate renewal: failed to list certificates: %v", err)
+		return
+	}
+
+	renewed := false
+	threshold := time.Now().Add(time.Duration(renewBeforeDays) * 24 * time.Hour)
+	for _, cert := range certs {
+		if cert.Source != certSourceACME {
+			continue
+		}
+		if cert.NotAfter != nil && cert.NotAfter.After(threshold) {
+			continue
+		}
+		if err := obtainACMECert(cert.Domain, ""); err != nil {
+			continue
+		}
+		renewed = true
+	}
+
+	if renewed {
+		if err := restartSingbox(); err != nil {
+			log.Printf("Certificate renewal: failed to restart sing-box: %v", err)
+		}
+	}
+}
+
+// listCerts returns info about every certificate directory under certDir
+func listCerts() ([]CertInfo, error) {
+	entries, err := os.ReadDir(certDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []CertInfo{}, nil
+		}
+		return nil, fmt.Errorf("failed to read cert dir: %w", err)
+	}
+
+	certs := make([]CertInfo, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := readCertInfo(entry.Name())
+		if err != nil {
+			log.Printf("Skipping certificate %s: %v", entry.Name(), err)
+			continue
+		}
+		certs = append(certs, *info)
+	}
+
+	return certs, nil
+}
+
+// readCertInfo parses the stored certificate for the domain
+func readCertInfo(domain string) (*CertInfo, error) {
+	certMu.RLock()
+	defer certMu.RUnlock()
+
+	dir := filepath.Join(certDir, domain)
+	meta, _ := readCertMeta(domain)
+	info := &CertInfo{
+		Domain:        domain,
+		Source:        meta.Source,
+		CertPath:      filepath.Join(dir, certFileName),
+		KeyPath:       filepath.Join(dir, keyFileName),
+		LastError:     meta.LastError,
+		LastAttemptAt: meta.LastAttemptAt,
+	}
+
+	data, err := os.ReadFile(info.CertPath)
+	if err != nil {
+		// A failed first ACME attempt leaves only metadata behind; still report it
+		if os.IsNotExist(err) && meta.Source != "" {
+			return info, nil
+		}
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", info.CertPath)
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Issuer = leaf.Issuer.String()
+	info.Subject = leaf.Subject.String()
+	info.DNSNames = leaf.DNSNames
+	info.NotBefore = &leaf.NotBefore
+	info.NotAfter = &leaf.NotAfter
+	return info, nil
+}
+
+// storeCert atomically writes certificate, key and metadata for the domain
+func storeCert(domain string, certPEM, keyPEM []byte, meta certMeta) error {
+	certMu.Lock()
+	defer certMu.Unlock()
+
+	dir := filepath.Join(certDir, domain)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cert dir: %w", err)
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, keyFileName), keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write key: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, certFileName), certPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+
+	return writeCertMeta(domain, meta)
+}
+
+func readCertMeta(domain string) (certMeta, error) {
+	var meta certMeta
+	data, err := os.ReadFile(filepath.Join(certDir, domain, certMetaFile))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+func writeCertMeta(domain string, meta certMeta) error {
+	dir := filepath.Join(certDir, domain)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, certMetaFile), data, 0644)
+}
+
+// loadAccountKey loads or creates the ACME account key
+func loadAccountKey() (crypto.Signer, error) {
+	path := filepath.Join(certDir, acmeAccountKeyFile)
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid ACME account key in %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, keyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("failed to save ACME account key: %w", err)
+	}
+	return key, nil
+}
+
+func encodeECKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// writeFileAtomic writes data to a temp file and renames it over the target
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// acmeStub is a minimal in-process RFC 8555 server. It validates HTTP-01
+// challenges by fetching them from the agent's challenge listener and signs
+// certificates with its own CA. JWS signatures are not verified.
+type acmeStub struct {
+	t      *testing.T
+	server *httptest.Server
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu            sync.Mutex
+	challengeAddr string
+	thumbprint    string
+	rejectAll     bool
+	orders        map[string]*stubOrder
+	issued        int
+}
+
+type stubOrder struct {
+	domain    string
+	token     string
+	authzOK   bool
+	authzFail bool
+	certPEM   []byte
+}
+
+func newACMEStub(t *testing.T, challengeAddr string) *acmeStub {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ACME stub CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &acmeStub{
+		t:             t,
+		caKey:         caKey,
+		caCert:        caCert,
+		challengeAddr: challengeAddr,
+		orders:        make(map[string]*stubOrder),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /directory", s.handleDirectory)
+	mux.HandleFunc("/nonce", s.handleNonce)
+	mux.HandleFunc("POST /account", s.handleAccount)
+	mux.HandleFunc("POST /order", s.handleNewOrder)
+	mux.HandleFunc("POST /order/{id}", s.handleOrder)
+	mux.HandleFunc("POST /authz/{id}", s.handleAuthz)
+	mux.HandleFunc("POST /challenge/{id}", s.handleChallenge)
+	mux.HandleFunc("POST /finalize/{id}", s.handleFinalize)
+	mux.HandleFunc("POST /cert/{id}", s.handleCert)
+	s.server = httptest.NewServer(mux)
+	t.Cleanup(s.server.Close)
+
+	return s
+}
+
+func (s *acmeStub) url(path string) string {
+	return s.server.URL + path
+}
+
+func (s *acmeStub) issuedCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issued
+}
+
+func (s *acmeStub) setRejectAll(reject bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejectAll = reject
+}
+
+// readJWS decodes a flattened JWS request and returns its protected header and payload
+func (s *acmeStub) readJWS(r *http.Request) (map[string]json.RawMessage, []byte) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		s.t.Errorf("stub: invalid JWS: %v", err)
+		return nil, nil
+	}
+
+	var header map[string]json.RawMessage
+	raw, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err := json.Unmarshal(raw, &header); err != nil {
+		s.t.Errorf("stub: invalid JWS header: %v", err)
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return header, payload
+}
+
+func (s *acmeStub) reply(w http.ResponseWriter, status int, location string, body interface{}) {
+	w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 36))
+	w.Header().Set("Content-Type", "application/json")
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (s *acmeStub) order(r *http.Request) (string, *stubOrder) {
+	id := r.PathValue("id")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return id, s.orders[id]
+}
+
+func (s *acmeStub) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	s.reply(w, http.StatusOK, "", map[string]string{
+		"newNonce":   s.url("/nonce"),
+		"newAccount": s.url("/account"),
+		"newOrder":   s.url("/order"),
+		"revokeCert": s.url("/revoke"),
+		"keyChange":  s.url("/key-change"),
+	})
+}
+
+func (s *acmeStub) handleNonce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 36))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *acmeStub) handleAccount(w http.ResponseWriter, r *http.Request) {
+	header, _ := s.readJWS(r)
+
+	var jwk struct {
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(header["jwk"], &jwk); err != nil || jwk.Crv != "P-256" {
+		s.t.Errorf("stub: unexpected account JWK %s", header["jwk"])
+		return
+	}
+	x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+	y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+	thumbprint, err := acme.JWKThumbprint(&ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	})
+	if err != nil {
+		s.t.Errorf("stub: thumbprint: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	s.thumbprint = thumbprint
+	s.mu.Unlock()
+
+	s.reply(w, http.StatusCreated, s.url("/account/1"), map[string]string{"status": "valid"})
+}
+
+func (s *acmeStub) handleNewOrder(w http.ResponseWriter, r *http.Request) {
+	_, payload := s.readJWS(r)
+
+	var req struct {
+		Identifiers []acme.AuthzID `json:"identifiers"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil || len(req.Identifiers) != 1 {
+		s.t.Errorf("stub: unexpected order %s", payload)
+		return
+	}
+
+	s.mu.Lock()
+	id := strconv.Itoa(len(s.orders) + 1)
+	order := &stubOrder{domain: req.Identifiers[0].Value, token: "token-" + id}
+	s.orders[id] = order
+	s.mu.Unlock()
+
+	s.reply(w, http.StatusCreated, s.url("/order/"+id), s.orderBody(id, order))
+}
+
+func (s *acmeStub) orderBody(id string, order *stubOrder) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := acme.StatusPending
+	switch {
+	case order.certPEM != nil:
+		status = acme.StatusValid
+	case order.authzFail:
+		status = acme.StatusInvalid
+	case order.authzOK:
+		status = acme.StatusReady
+	}
+
+	body := map[string]interface{}{
+		"status":         status,
+		"identifiers":    []acme.AuthzID{{Type: "dns", Value: order.domain}},
+		"authorizations": []string{s.url("/authz/" + id)},
+		"finalize":       s.url("/finalize/" + id),
+	}
+	if order.certPEM != nil {
+		body["certificate"] = s.url("/cert/" + id)
+	}
+	return body
+}
+
+func (s *acmeStub) handleOrder(w http.ResponseWriter, r *http.Request) {
+	id, order := s.order(r)
+	s.reply(w, http.StatusOK, s.url("/order/"+id), s.orderBody(id, order))
+}
+
+func (s *acmeStub) authzBody(id string, order *stubOrder) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := acme.StatusPending
+	switch {
+	case order.authzOK:
+		status = acme.StatusValid
+	case order.authzFail:
+		status = acme.StatusInvalid
+	}
+	return map[string]interface{}{
+		"status":     status,
+		"identifier": acme.AuthzID{Type: "dns", Value: order.domain},
+		"challenges": []map[string]string{{
+			"type":   "http-01",
+			"url":    s.url("/challenge/" + id),
+			"token":  order.token,
+			"status": status,
+		}},
+	}
+}
+
+func (s *acmeStub) handleAuthz(w http.ResponseWriter, r *http.Request) {
+	id, order := s.order(r)
+	s.reply(w, http.StatusOK, "", s.authzBody(id, order))
+}
+
+// handleChallenge validates HTTP-01 right away, as a real CA would do shortly after Accept
+func (s *acmeStub) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	id, order := s.order(r)
+
+	s.mu.Lock()
+	expected := order.token + "." + s.thumbprint
+	reject := s.rejectAll
+	s.mu.Unlock()
+
+	valid := false
+	if !reject {
+		resp, err := http.Get("http://" + s.challengeAddr + "/.well-known/acme-challenge/" + order.token)
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			valid = resp.StatusCode == http.StatusOK && string(body) == expected
+		}
+	}
+
+	s.mu.Lock()
+	order.authzOK = valid
+	order.authzFail = !valid
+	s.mu.Unlock()
+
+	s.reply(w, http.StatusOK, "", s.authzBody(id, order)["challenges"].([]map[string]string)[0])
+}
+
+func (s *acmeStub) handleFinalize(w http.ResponseWriter, r *http.Request) {
+	id, order := s.order(r)
+	_, payload := s.readJWS(r)
+
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	json.Unmarshal(payload, &req)
+	der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil || len(csr.DNSNames) != 1 || csr.DNSNames[0] != order.domain {
+		s.t.Errorf("stub: unexpected CSR for %s: %v", order.domain, err)
+		return
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	leaf, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: order.domain},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		s.t.Errorf("stub: sign: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	order.certPEM = append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...,
+	)
+	s.issued++
+	s.mu.Unlock()
+
+	s.reply(w, http.StatusOK, s.url("/order/"+id), s.orderBody(id, order))
+}
+
+func (s *acmeStub) handleCert(w http.ResponseWriter, r *http.Request) {
+	_, order := s.order(r)
+	w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 36))
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Write(order.certPEM)
+}
+
+// setupACMEStub points the agent's certificate settings at a fresh stub and temp dir
+func setupACMEStub(t *testing.T) *acmeStub {
+	t.Helper()
+
+	// Reserve a free port for the agent's HTTP-01 listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	challengeAddr := l.Addr().String()
+	l.Close()
+
+	stub := newACMEStub(t, challengeAddr)
+
+	certDir = t.TempDir()
+	acmeDirectory = stub.url("/directory")
+	acmeHTTPAddr = challengeAddr
+	acmeHTTPClient = &http.Client{Timeout: 10 * time.Second}
+	renewBeforeDays = defaultRenewBeforeDays
+
+	return stub
+}
+
+func serialOf(t *testing.T, domain string) string {
+	t.Helper()
+	pair, err := tls.LoadX509KeyPair(
+		fmt.Sprintf("%s/%s/%s", certDir, domain, certFileName),
+		fmt.Sprintf("%s/%s/%s", certDir, domain, keyFileName),
+	)
+	if err != nil {
+		t.Fatalf("stored key pair is unusable: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.String()
+}
+
+func TestObtainACMECert(t *testing.T) {
+	stub := setupACMEStub(t)
+	const domain = "node.example.com"
+
+	if err := obtainACMECert(domain, "admin@example.com"); err != nil {
+		t.Fatalf("obtainACMECert: %v", err)
+	}
+
+	info, err := readCertInfo(domain)
+	if err != nil {
+		t.Fatalf("readCertInfo: %v", err)
+	}
+	if info.Source != certSourceACME {
+		t.Errorf("source = %q, want %q", info.Source, certSourceACME)
+	}
+	if len(info.DNSNames) != 1 || info.DNSNames[0] != domain {
+		t.Errorf("DNS names = %v, want [%s]", info.DNSNames, domain)
+	}
+	if info.NotAfter == nil || time.Until(*info.NotAfter) < 80*24*time.Hour {
+		t.Errorf("unexpected expiry %v", info.NotAfter)
+	}
+	if info.LastError != "" || info.LastAttemptAt == nil {
+		t.Errorf("unexpected attempt state: error %q, attempt %v", info.LastError, info.LastAttemptAt)
+	}
+	serialOf(t, domain)
+
+	meta, err := readCertMeta(domain)
+	if err != nil || meta.Email != "admin@example.com" {
+		t.Errorf("meta = %+v, %v; want email stored", meta, err)
+	}
+	if stub.issuedCount() != 1 {
+		t.Errorf("issued %d certificates, want 1", stub.issuedCount())
+	}
+}
+
+func TestRenewDueCerts(t *testing.T) {
+	stub := setupACMEStub(t)
+	const domain = "node.example.com"
+
+	if err := obtainACMECert(domain, "admin@example.com"); err != nil {
+		t.Fatalf("obtainACMECert: %v", err)
+	}
+	first := serialOf(t, domain)
+
+	// 90 day certificate, 30 day window: nothing to renew yet
+	renewDueCerts()
+	if stub.issuedCount() != 1 {
+		t.Fatalf("certificate renewed too early: issued %d", stub.issuedCount())
+	}
+
+	// A window wider than the lifetime makes the certificate due
+	renewBeforeDays = 120
+	renewDueCerts()
+	if stub.issuedCount() != 2 {
+		t.Fatalf("certificate not renewed: issued %d", stub.issuedCount())
+	}
+	if serialOf(t, domain) == first {
+		t.Error("renewal kept the old certificate")
+	}
+
+	meta, err := readCertMeta(domain)
+	if err != nil || meta.Email != "admin@example.com" || meta.LastError != "" {
+		t.Errorf("meta after renewal = %+v, %v", meta, err)
+	}
+}
+
+func TestRenewalFailureKeepsCertificate(t *testing.T) {
+	stub := setupACMEStub(t)
+	const domain = "node.example.com"
+
+	if err := obtainACMECert(domain, ""); err != nil {
+		t.Fatalf("obtainACMECert: %v", err)
+	}
+	first := serialOf(t, domain)
+
+	stub.setRejectAll(true)
+	renewBeforeDays = 120
+	renewDueCerts()
+
+	if serialOf(t, domain) != first {
+		t.Error("failed renewal replaced the certificate")
+	}
+	info, err := readCertInfo(domain)
+	if err != nil {
+		t.Fatalf("readCertInfo: %v", err)
+	}
+	if info.LastError == "" {
+		t.Error("failed renewal was not recorded")
+	}
+}
+
+func TestObtainACMECertFailureRecorded(t *testing.T) {
+	stub := setupACMEStub(t)
+	stub.setRejectAll(true)
+	const domain = "node.example.com"
+
+	if err := obtainACMECert(domain, ""); err == nil {
+		t.Fatal("obtainACMECert succeeded with a rejected challenge")
+	}
+
+	info, err := readCertInfo(domain)
+	if err != nil {
+		t.Fatalf("readCertInfo: %v", err)
+	}
+	if info.LastError == "" || info.NotAfter != nil {
+		t.Errorf("unexpected info after failure: %+v", info)
+	}
+}
@@ -2,7 +2,11 @@ module zen-admin/node-agent
 
 go 1.22
 
-require github.com/docker/docker v27.3.1+incompatible
+require (
+	github.com/docker/docker v27.3.1+incompatible
+	golang.org/x/crypto v0.27.0
+	zen-admin/pkg v0.0.0
+)
 
 require (
 	github.com/Microsoft/go-winio v0.6.2 // indirect
@@ -30,3 +34,5 @@ require (
 	golang.org/x/time v0.6.0 // indirect
 	gotest.tools/v3 v3.5.1 // indirect
 )
+
+replace zen-admin/pkg => ../../pkg
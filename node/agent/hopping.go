@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	"zen-admin/pkg/porthop"
+)
+
+const (
+	portHoppingStateFile  = "port-hopping.json"
+	portHoppingRetryDelay = 10 * time.Second
+	portHoppingRetries    = 30
+)
+
+var (
+	portHoppingPath  string
+	portHoppingMu    sync.Mutex
+	portHoppingRules []porthop.Rule
+)
+
+// initPortHopping loads the saved rules and re-applies them in the background:
+// nftables rules do not survive a host reboot, and sing-box may not be up yet
+func initPortHopping() {
+	portHoppingPath = os.Getenv("PORT_HOPPING_STATE")
+	if portHoppingPath == "" {
+		portHoppingPath = filepath.Join(filepath.Dir(configPath), portHoppingStateFile)
+	}
+
+	data, err := os.ReadFile(portHoppingPath)
+	if err != nil {
+		return
+	}
+	var req porthop.Request
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("Port hopping: ignoring invalid state file: %v", err)
+		return
+	}
+	portHoppingRules = req.Rules
+	if len(req.Rules) == 0 {
+		return
+	}
+
+	go func() {
+		for attempt := 1; attempt <= portHoppingRetries; attempt++ {
+			portHoppingMu.Lock()
+			err := applyPortHopping(portHoppingRules)
+			portHoppingMu.Unlock()
+			if err == nil {
+				log.Printf("Port hopping: restored %d rule(s)", len(req.Rules))
+				return
+			}
+			log.Printf("Port hopping: restore attempt %d failed: %v", attempt, err)
+			time.Sleep(portHoppingRetryDelay)
+		}
+	}()
+}
+
+// handlePortHopping returns (GET) or replaces (POST) the port hopping rules
+func handlePortHopping(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		portHoppingMu.Lock()
+		rules := portHoppingRules
+		portHoppingMu.Unlock()
+		if rules == nil {
+			rules = []porthop.Rule{}
+		}
+		writeJSON(w, http.StatusOK, porthop.Request{Rules: rules})
+	case http.MethodPost:
+		setPortHopping(w, r)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+	}
+}
+
+// setPortHopping applies the new rule set and persists it
+func setPortHopping(w http.ResponseWriter, r *http.Request) {
+	var req porthop.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid JSON: " + err.Error()})
+		return
+	}
+	if err := porthop.Validate(req.Rules); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	portHoppingMu.Lock()
+	defer portHoppingMu.Unlock()
+
+	if err := applyPortHopping(req.Rules); err != nil {
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+	portHoppingRules = req.Rules
+
+	data, _ := json.MarshalIndent(req, "", "  ")
+	if err := writeFileAtomic(portHoppingPath, data, 0644); err != nil {
+		log.Printf("Port hopping: failed to save state: %v", err)
+	}
+
+	writeJSON(w, http.StatusOK, SuccessResponse{Message: fmt.Sprintf("%d port hopping rule(s) applied", len(req.Rules))})
+}
+
+// applyPortHopping loads the nftables script inside the sing-box container.
+// It runs with host networking and NET_ADMIN, so the rules land in the host namespace
+func applyPortHopping(rules []porthop.Rule) error {
+	if dockerClient == nil {
+		return fmt.Errorf("docker client not initialized")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	containerID, err := findSingboxContainer(ctx)
+	if err != nil {
+		return err
+	}
+
+	exec, err := dockerClient.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		Cmd:          []string{"nft", "-f", "-"},
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create exec: %w", err)
+	}
+
+	attach, err := dockerClient.ContainerExecAttach(ctx, exec.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to attach exec: %w", err)
+	}
+	defer attach.Close()
+
+	if _, err := io.WriteString(attach.Conn, porthop.NFTScript(rules)); err != nil {
+		return fmt.Errorf("failed to send nft script: %w", err)
+	}
+	attach.CloseWrite()
+
+	var output bytes.Buffer
+	if _, err := stdcopy.StdCopy(&output, &output, attach.Reader); err != nil {
+		return fmt.Errorf("failed to read nft output: %w", err)
+	}
+
+	inspect, err := dockerClient.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect exec: %w", err)
+	}
+	if inspect.ExitCode != 0 {
+		return fmt.Errorf("nft exited with code %d: %s", inspect.ExitCode, strings.TrimSpace(output.String()))
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+const (
+	defaultLogTail = 100
+	maxLogTail     = 5000
+)
+
+// logLevels maps sing-box log levels to their severity
+var logLevels = map[string]int{
+	"TRACE": 0,
+	"DEBUG": 1,
+	"INFO":  2,
+	"WARN":  3,
+	"ERROR": 4,
+	"FATAL": 5,
+	"PANIC": 6,
+}
+
+// ansiEscape matches terminal color sequences in sing-box output
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// handleLogs streams sing-box container logs
+// Query params: tail (number of lines), follow (1/true), level (minimum level)
+func handleLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+		return
+	}
+
+	tail := defaultLogTail
+	if v := r.URL.Query().Get("tail"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid tail"})
+			return
+		}
+		tail = n
+	}
+	if tail > maxLogTail {
+		tail = maxLogTail
+	}
+
+	follow, _ := strconv.ParseBool(r.URL.Query().Get("follow"))
+
+	minLevel := -1
+	if v := r.URL.Query().Get("level"); v != "" {
+		level, ok := logLevels[strings.ToUpper(v)]
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid level"})
+			return
+		}
+		minLevel = level
+	}
+
+	if dockerClient == nil {
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "docker client not initialized"})
+		return
+	}
+
+	// The request context is cancelled when the panel disconnects, which stops following
+	ctx := r.Context()
+	containerID, err := findSingboxContainer(ctx)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	logs, err := dockerClient.ContainerLogs(ctx, containerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     follow,
+		Tail:       strconv.Itoa(tail),
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to read logs: " + err.Error()})
+		return
+	}
+	defer logs.Close()
+
+	// Container is started without a TTY, so stdout and stderr are multiplexed
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(pw, pw, logs)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	streamLogLines(w, pr, minLevel)
+}
+
+// streamLogLines copies log lines to the response, filtering by level and flushing after each line
+func streamLogLines(w http.ResponseWriter, src io.Reader, minLevel int) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := ansiEscape.ReplaceAllString(scanner.Text(), "")
+		if minLevel >= 0 && logLineLevel(line) < minLevel {
+			continue
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// logLineLevel returns the severity of a sing-box log line
+// Lines without a recognizable level (e.g. panics, startup output) are always shown
+func logLineLevel(line string) int {
+	for _, field := range strings.Fields(line) {
+		if level, ok := logLevels[field]; ok {
+			return level
+		}
+	}
+	return logLevels["PANIC"]
+}
+
+// findSingboxContainer returns the ID of the sing-box container
+func findSingboxContainer(ctx context.Context) (string, error) {
+	containers, err := dockerClient.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return "", fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	for _, c := range containers {
+		for _, name := range c.Names {
+			if strings.TrimPrefix(name, "/") == singboxContainerName || strings.Contains(name, singboxContainerName) {
+				return c.ID, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("sing-box container not found")
+}
@@ -9,19 +9,21 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+
+	"zen-admin/pkg/reality"
 )
 
 const (
 	defaultConfigPath     = "/etc/sing-box/config.json"
 	defaultListenAddr     = ":9090"
 	defaultSingboxAPI     = "http://127.0.0.1:10085"
+	defaultClashAPI       = "http://127.0.0.1:9095"
 	singboxContainerName  = "singbox"
 )
 
@@ -29,14 +31,18 @@ var (
 	apiToken     string
 	configPath   string
 	singboxAPI   string
+	clashAPI     string
 	dockerClient *client.Client
 	configMu     sync.RWMutex
 )
 
 // Response types
 type HealthResponse struct {
-	Status  string `json:"status"`
-	Singbox string `json:"singbox"`
+	Status    string `json:"status"`
+	Singbox   string `json:"singbox"`
+	SingboxUp bool   `json:"singbox_up"`
+	Version   string `json:"version"`
+	Uptime    int64  `json:"uptime"`
 }
 
 type ErrorResponse struct {
@@ -63,6 +69,23 @@ type StatsResponse struct {
 	Users []UserStats `json:"users"`
 }
 
+type ConnectionsResponse struct {
+	Total    int            `json:"total"`
+	Inbounds map[string]int `json:"inbounds"`
+}
+
+// Clash API response types
+type ClashConnectionsResponse struct {
+	Connections []ClashConnection `json:"connections"`
+}
+
+type ClashConnection struct {
+	ID       string `json:"id"`
+	Metadata struct {
+		Type string `json:"type"`
+	} `json:"metadata"`
+}
+
 // V2Ray API response types
 type V2RayStatsResponse struct {
 	Stat []V2RayStat `json:"stat"`
@@ -90,11 +113,19 @@ func main() {
 		singboxAPI = defaultSingboxAPI
 	}
 
+	clashAPI = os.Getenv("CLASH_API")
+	if clashAPI == "" {
+		clashAPI = defaultClashAPI
+	}
+
 	listenAddr := os.Getenv("LISTEN_ADDR")
 	if listenAddr == "" {
 		listenAddr = defaultListenAddr
 	}
 
+	initCerts()
+	initUpdate()
+
 	// Initialize Docker client
 	var err error
 	dockerClient, err = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
@@ -103,6 +134,8 @@ func main() {
 		log.Println("Some features may not work properly")
 	}
 
+	initPortHopping()
+
 	// Setup HTTP routes
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", authMiddleware(handleHealth))
@@ -110,9 +143,20 @@ func main() {
 	mux.HandleFunc("/restart", authMiddleware(handleRestart))
 	mux.HandleFunc("/stats", authMiddleware(handleStats))
 	mux.HandleFunc("/generate-keys", authMiddleware(handleGenerateKeys))
+	mux.HandleFunc("/connections", authMiddleware(handleConnections))
+	mux.HandleFunc("/logs", authMiddleware(handleLogs))
+	mux.HandleFunc("/certs", authMiddleware(handleCerts))
+	mux.HandleFunc("/certs/upload", authMiddleware(handleCertUpload))
+	mux.HandleFunc("/certs/acme", authMiddleware(handleCertACME))
+	mux.HandleFunc("/version", authMiddleware(handleVersion))
+	mux.HandleFunc("/update", authMiddleware(handleUpdate))
+	mux.HandleFunc("/port-hopping", authMiddleware(handlePortHopping))
+
+	// Renew ACME certificates in the background
+	go certRenewalLoop()
 
 	// Start server
-	log.Printf("Node agent starting on %s", listenAddr)
+	log.Printf("Node agent %s starting on %s", version, listenAddr)
 	log.Printf("Config path: %s", configPath)
 	if err := http.ListenAndServe(listenAddr, mux); err != nil {
 		log.Fatal(err)
@@ -144,8 +188,11 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 	}
 
 	writeJSON(w, http.StatusOK, HealthResponse{
-		Status:  "ok",
-		Singbox: status,
+		Status:    "ok",
+		Singbox:   status,
+		SingboxUp: status == "running",
+		Version:   version,
+		Uptime:    int64(time.Since(startedAt).Seconds()),
 	})
 }
 
@@ -261,6 +308,23 @@ func handleGenerateKeys(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, keyPair)
 }
 
+// handleConnections returns the number of active sing-box connections grouped by inbound tag
+func handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+		return
+	}
+
+	conns, err := getSingboxConnections()
+	if err != nil {
+		// 502: the agent is up, but sing-box's Clash API is not
+		writeJSON(w, http.StatusBadGateway, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, conns)
+}
+
 // isSingboxRunning checks if the sing-box container is running
 func isSingboxRunning() bool {
 	if dockerClient == nil {
@@ -297,26 +361,9 @@ func restartSingbox() error {
 	defer cancel()
 
 	// Find the sing-box container
-	containers, err := dockerClient.ContainerList(ctx, container.ListOptions{All: true})
+	containerID, err := findSingboxContainer(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to list containers: %w", err)
-	}
-
-	var containerID string
-	for _, c := range containers {
-		for _, name := range c.Names {
-			if strings.TrimPrefix(name, "/") == singboxContainerName || strings.Contains(name, singboxContainerName) {
-				containerID = c.ID
-				break
-			}
-		}
-		if containerID != "" {
-			break
-		}
-	}
-
-	if containerID == "" {
-		return fmt.Errorf("sing-box container not found")
+		return err
 	}
 
 	// Restart the container
@@ -405,6 +452,44 @@ func queryV2RayAPI(path string) (*V2RayStatsResponse, error) {
 	return &result, nil
 }
 
+// getSingboxConnections fetches active connections from the sing-box Clash API
+func getSingboxConnections() (*ConnectionsResponse, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(clashAPI + "/connections")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query clash API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("clash API returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var clashResp ClashConnectionsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&clashResp); err != nil {
+		return nil, err
+	}
+
+	result := &ConnectionsResponse{
+		Total:    len(clashResp.Connections),
+		Inbounds: make(map[string]int),
+	}
+	for _, conn := range clashResp.Connections {
+		result.Inbounds[extractInboundTag(conn.Metadata.Type)]++
+	}
+
+	return result, nil
+}
+
+// extractInboundTag extracts inbound tag from connection type (format: protocol/tag)
+func extractInboundTag(connType string) string {
+	if idx := strings.Index(connType, "/"); idx >= 0 {
+		return connType[idx+1:]
+	}
+	return connType
+}
+
 // extractUserName extracts user name from stat name (format: user>>>username>>>traffic>>>uplink/downlink)
 func extractUserName(statName string) string {
 	parts := strings.Split(statName, ">>>")
@@ -414,67 +499,23 @@ func extractUserName(statName string) string {
 	return ""
 }
 
-// generateRealityKeys generates a new REALITY keypair using sing-box
+// generateRealityKeys generates a new REALITY keypair and short ID natively
 func generateRealityKeys() (*KeyPair, error) {
-	// Try using sing-box command directly first
-	cmd := exec.Command("sing-box", "generate", "reality-keypair")
-	output, err := cmd.CombinedOutput()
-
+	keys, err := reality.GenerateKeyPair()
 	if err != nil {
-		// Try via docker if direct command fails
-		cmd = exec.Command("docker", "exec", singboxContainerName, "sing-box", "generate", "reality-keypair")
-		output, err = cmd.CombinedOutput()
-		if err != nil {
-			return nil, fmt.Errorf("failed to generate keys: %w, output: %s", err, string(output))
-		}
-	}
-
-	// Parse output (format: PrivateKey: xxx\nPublicKey: xxx)
-	lines := strings.Split(string(output), "\n")
-	keyPair := &KeyPair{}
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "PrivateKey:") {
-			keyPair.PrivateKey = strings.TrimSpace(strings.TrimPrefix(line, "PrivateKey:"))
-		} else if strings.HasPrefix(line, "PublicKey:") {
-			keyPair.PublicKey = strings.TrimSpace(strings.TrimPrefix(line, "PublicKey:"))
-		}
-	}
-
-	if keyPair.PrivateKey == "" || keyPair.PublicKey == "" {
-		return nil, fmt.Errorf("failed to parse key output: %s", string(output))
+		return nil, err
 	}
 
-	// Generate short_id
-	shortIDCmd := exec.Command("sing-box", "generate", "rand", "--hex", "8")
-	shortIDOutput, err := shortIDCmd.CombinedOutput()
+	shortID, err := reality.GenerateShortID(reality.MaxShortIDBytes)
 	if err != nil {
-		shortIDCmd = exec.Command("docker", "exec", singboxContainerName, "sing-box", "generate", "rand", "--hex", "8")
-		shortIDOutput, err = shortIDCmd.CombinedOutput()
-		if err != nil {
-			// Generate a simple hex short_id as fallback
-			keyPair.ShortID = generateHexShortID()
-		} else {
-			keyPair.ShortID = strings.TrimSpace(string(shortIDOutput))
-		}
-	} else {
-		keyPair.ShortID = strings.TrimSpace(string(shortIDOutput))
+		return nil, err
 	}
 
-	return keyPair, nil
-}
-
-// generateHexShortID generates a random 8-character hex string
-func generateHexShortID() string {
-	b := make([]byte, 4)
-	f, err := os.Open("/dev/urandom")
-	if err != nil {
-		return "deadbeef"
-	}
-	defer f.Close()
-	f.Read(b)
-	return fmt.Sprintf("%02x%02x%02x%02x", b[0], b[1], b[2], b[3])
+	return &KeyPair{
+		PrivateKey: keys.PrivateKey,
+		PublicKey:  keys.PublicKey,
+		ShortID:    shortID,
+	}, nil
 }
 
 // writeJSON writes a JSON response
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"zen-admin/pkg/agentupdate"
+)
+
+const (
+	defaultImageBinaryPath = "/usr/local/bin/node-agent"
+	updateDownloadTimeout  = 5 * time.Minute
+	maxUpdateBinarySize    = 100 << 20
+)
+
+// Build info, injected at build time via -ldflags "-X main.version=..."
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+	startedAt = time.Now()
+)
+
+var (
+	updatePublicKey ed25519.PublicKey
+	imageBinaryPath string
+	updateMu        sync.Mutex
+)
+
+type VersionResponse struct {
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit,omitempty"`
+	BuildTime string    `json:"build_time,omitempty"`
+	GoVersion string    `json:"go_version"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// UpdateRequest describes a signed agent release.
+// Exactly one of BinaryURL (with SHA256) or Image must be set.
+// Downgrade is covered by the signature and allows installing an older version.
+type UpdateRequest struct {
+	Version   string `json:"version"`
+	BinaryURL string `json:"binary_url,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	Image     string `json:"image,omitempty"`
+	Downgrade bool   `json:"downgrade,omitempty"`
+	Signature string `json:"signature"`
+}
+
+// initUpdate loads self-update settings from environment
+func initUpdate() {
+	imageBinaryPath = os.Getenv("AGENT_IMAGE_BINARY")
+	if imageBinaryPath == "" {
+		imageBinaryPath = defaultImageBinaryPath
+	}
+
+	key := os.Getenv("UPDATE_PUBLIC_KEY")
+	if key == "" {
+		log.Println("UPDATE_PUBLIC_KEY not set, self-update is disabled")
+		return
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		log.Printf("Warning: invalid UPDATE_PUBLIC_KEY, self-update is disabled")
+		return
+	}
+	updatePublicKey = ed25519.PublicKey(raw)
+}
+
+// handleVersion returns agent version and build info
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, VersionResponse{
+		Version:   version,
+		Commit:    commit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		StartedAt: startedAt,
+	})
+}
+
+// handleUpdate verifies a signed release, swaps the agent binary and re-executes it
+func handleUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "method not allowed"})
+		return
+	}
+
+	if updatePublicKey == nil {
+		writeJSON(w, http.StatusForbidden, ErrorResponse{Error: "self-update is disabled: UPDATE_PUBLIC_KEY not set"})
+		return
+	}
+
+	var req UpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid JSON: " + err.Error()})
+		return
+	}
+
+	if req.Version == "" {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "version is required"})
+		return
+	}
+	if (req.BinaryURL == "") == (req.Image == "") {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "exactly one of binary_url or image is required"})
+		return
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid signature encoding"})
+		return
+	}
+
+	// Verify the signature before downloading anything
+	artifact := strings.ToLower(req.SHA256)
+	if req.Image != "" {
+		// Only digest-pinned references are immutable, a tag could be moved after signing
+		if !strings.Contains(req.Image, "@sha256:") {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "image must be pinned by digest (name@sha256:...)"})
+			return
+		}
+		artifact = req.Image
+	} else if len(artifact) != sha256.Size*2 {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "sha256 is required for binary updates"})
+		return
+	}
+	if !ed25519.Verify(updatePublicKey, agentupdate.SigningPayload(req.Version, artifact, req.Downgrade), signature) {
+		writeJSON(w, http.StatusForbidden, ErrorResponse{Error: "signature verification failed"})
+		return
+	}
+
+	// A valid signature alone would let an old, vulnerable release be replayed
+	if err := agentupdate.CheckVersion(version, req.Version, req.Downgrade); err != nil {
+		writeJSON(w, http.StatusConflict, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	if !updateMu.TryLock() {
+		writeJSON(w, http.StatusConflict, ErrorResponse{Error: "update already in progress"})
+		return
+	}
+
+	var binary []byte
+	if req.Image != "" {
+		binary, err = extractBinaryFromImage(req.Image)
+	} else {
+		binary, err = downloadBinary(req.BinaryURL, artifact)
+	}
+	if err != nil {
+		updateMu.Unlock()
+		writeJSON(w, http.StatusBadGateway, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	exe, err := replaceExecutable(binary)
+	if err != nil {
+		updateMu.Unlock()
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	log.Printf("Agent updated from %s to %s, restarting", version, req.Version)
+	writeJSON(w, http.StatusOK, SuccessResponse{Message: "update installed, agent is restarting"})
+
+	// Re-exec after the response has been sent; updateMu stays locked until the process is replaced
+	go func() {
+		time.Sleep(time.Second)
+		restartSelf(exe)
+	}()
+}
+
+// downloadBinary downloads the release binary and checks its SHA-256
+func downloadBinary(url, expectedSHA256 string) ([]byte, error) {
+	client := &http.Client{Timeout: updateDownloadTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download binary: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("binary download returned status %d", resp.StatusCode)
+	}
+
+	binary, err := io.ReadAll(io.LimitReader(resp.Body, maxUpdateBinarySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download binary: %w", err)
+	}
+	if len(binary) > maxUpdateBinarySize {
+		return nil, fmt.Errorf("binary exceeds %d bytes", maxUpdateBinarySize)
+	}
+
+	sum := sha256.Sum256(binary)
+	if hex.EncodeToString(sum[:]) != expectedSHA256 {
+		return nil, fmt.Errorf("sha256 mismatch: got %s", hex.EncodeToString(sum[:]))
+	}
+
+	return binary, nil
+}
+
+// extractBinaryFromImage pulls the image and copies the agent binary out of a stopped container
+func extractBinaryFromImage(ref string) ([]byte, error) {
+	if dockerClient == nil {
+		return nil, fmt.Errorf("docker client not initialized")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), updateDownloadTimeout)
+	defer cancel()
+
+	pull, err := dockerClient.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull image: %w", err)
+	}
+	// The pull only completes once the progress stream is drained
+	_, err = io.Copy(io.Discard, pull)
+	pull.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull image: %w", err)
+	}
+
+	created, err := dockerClient.ContainerCreate(ctx, &container.Config{Image: ref}, nil, nil, nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container from image: %w", err)
+	}
+	defer dockerClient.ContainerRemove(context.Background(), created.ID, container.RemoveOptions{Force: true})
+
+	archive, _, err := dockerClient.CopyFromContainer(ctx, created.ID, imageBinaryPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy %s from image: %w", imageBinaryPath, err)
+	}
+	defer archive.Close()
+
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || filepath.Base(hdr.Name) != filepath.Base(imageBinaryPath) {
+			continue
+		}
+		binary, err := io.ReadAll(io.LimitReader(tr, maxUpdateBinarySize))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read binary from image: %w", err)
+		}
+		return binary, nil
+	}
+
+	return nil, fmt.Errorf("%s not found in image", imageBinaryPath)
+}
+
+// replaceExecutable atomically swaps the running binary, keeping the previous one as .old.
+// Returns the path of the installed binary. In Docker this is the container's writable layer:
+// recreating the container brings back the binary from the image.
+func replaceExecutable(binary []byte) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate executable: %w", err)
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return "", fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	newPath := exe + ".new"
+	if err := os.WriteFile(newPath, binary, 0755); err != nil {
+		return "", fmt.Errorf("failed to write new binary: %w", err)
+	}
+
+	current, err := os.ReadFile(exe)
+	if err == nil {
+		os.WriteFile(exe+".old", current, 0755)
+	}
+
+	if err := os.Rename(newPath, exe); err != nil {
+		os.Remove(newPath)
+		return "", fmt.Errorf("failed to replace binary: %w", err)
+	}
+
+	return exe, nil
+}
+
+// restartSelf replaces the current process with the freshly installed binary
+func restartSelf(exe string) {
+	if err := syscall.Exec(exe, os.Args, os.Environ()); err != nil {
+		// Exiting lets the container restart policy bring the new binary up
+		log.Fatalf("Failed to exec new binary: %v", err)
+	}
+}
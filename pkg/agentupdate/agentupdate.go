@@ -0,0 +1,154 @@
+// Package agentupdate holds the parts of signed agent releases that the panel and the
+// node agents must agree on: the signed payload and the downgrade check.
+package agentupdate
+
+import (
+	"cmp"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SigningPayload returns the message covered by a release signature.
+// artifact is the hex SHA-256 of the binary or the digest-pinned image reference.
+// A downgrade release carries its own suffix, so the signature of a regular release
+// cannot be replayed to install an older build.
+func SigningPayload(version, artifact string, downgrade bool) []byte {
+	payload := "zen-agent-update:" + version + ":" + artifact
+	if downgrade {
+		payload += ":downgrade"
+	}
+	return []byte(payload)
+}
+
+// CheckVersion decides whether an agent running version current may install target.
+// Without a signed downgrade flag the target must be newer than the running version.
+// Builds without a release version (e.g. "dev") accept any release.
+func CheckVersion(current, target string, downgrade bool) error {
+	if _, err := parseVersion(target); err != nil {
+		return err
+	}
+	if downgrade {
+		return nil
+	}
+	if _, err := parseVersion(current); err != nil {
+		return nil
+	}
+
+	order, _ := CompareVersions(target, current)
+	if order <= 0 {
+		return fmt.Errorf("version %s is not newer than the running %s; a downgrade needs a release signed as a downgrade", target, current)
+	}
+	return nil
+}
+
+// ValidateVersion checks that version is a release version CheckVersion can compare
+func ValidateVersion(version string) error {
+	_, err := parseVersion(version)
+	return err
+}
+
+// CompareVersions compares two versions of the form [v]MAJOR[.MINOR[.PATCH]][-PRERELEASE][+BUILD].
+// A pre-release sorts before its release, build metadata is ignored.
+func CompareVersions(a, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range va.parts {
+		if va.parts[i] != vb.parts[i] {
+			if va.parts[i] < vb.parts[i] {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+
+	switch {
+	case va.pre == vb.pre:
+		return 0, nil
+	case va.pre == "":
+		return 1, nil
+	case vb.pre == "":
+		return -1, nil
+	}
+	return comparePrerelease(va.pre, vb.pre), nil
+}
+
+// comparePrerelease compares dot-separated pre-release identifiers the semver way:
+// numeric identifiers as numbers and below alphanumeric ones, so rc.9 < rc.10 < rc.a.
+// When all shared identifiers are equal, the shorter list sorts first.
+func comparePrerelease(a, b string) int {
+	ia, ib := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(ia) && i < len(ib); i++ {
+		if c := compareIdentifier(ia[i], ib[i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(ia), len(ib))
+}
+
+func compareIdentifier(a, b string) int {
+	na, nb := isNumeric(a), isNumeric(b)
+	switch {
+	case na && nb:
+		// Without leading zeros a longer number is larger; this also works past uint64
+		if c := cmp.Compare(len(a), len(b)); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	case na:
+		return -1
+	case nb:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+func isNumeric(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+type version struct {
+	parts [3]int
+	pre   string
+}
+
+func parseVersion(s string) (version, error) {
+	var v version
+	core := strings.TrimPrefix(s, "v")
+	core, _, _ = strings.Cut(core, "+")
+	core, pre, hasPre := strings.Cut(core, "-")
+	v.pre = pre
+
+	fields := strings.Split(core, ".")
+	if core == "" || len(fields) > len(v.parts) {
+		return v, fmt.Errorf("invalid version %q (expected MAJOR.MINOR.PATCH)", s)
+	}
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %q (expected MAJOR.MINOR.PATCH)", s)
+		}
+		v.parts[i] = n
+	}
+	if hasPre {
+		for _, id := range strings.Split(v.pre, ".") {
+			if id == "" || (isNumeric(id) && len(id) > 1 && id[0] == '0') {
+				return v, fmt.Errorf("invalid pre-release in version %q", s)
+			}
+		}
+	}
+	return v, nil
+}
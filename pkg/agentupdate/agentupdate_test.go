@@ -0,0 +1,75 @@
+package agentupdate
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2", "1.2.0", 0},
+		{"1.2.3+build.7", "1.2.3+build.8", 0},
+		{"1.2.3", "1.2.4", -1},
+		{"1.10.0", "1.9.0", 1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0", "1.0.0-rc.1", 1},
+		{"1.0.0-rc.9", "1.0.0-rc.10", -1},
+		{"1.0.0-rc.10", "1.0.0-rc.9", 1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-alpha.beta", "1.0.0-beta", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-beta.11", "1.0.0-rc.1", -1},
+		{"1.0.0-rc.1", "1.0.0-rc.1", 0},
+		{"1.0.0-rc.99999999999999999999", "1.0.0-rc.100000000000000000000", -1},
+	}
+	for _, tt := range tests {
+		got, err := CompareVersions(tt.a, tt.b)
+		if err != nil {
+			t.Errorf("CompareVersions(%q, %q): %v", tt.a, tt.b, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCompareVersionsInvalid(t *testing.T) {
+	for _, v := range []string{"", "v", "dev", "1.2.3.4", "1.x.0", "1.-1.0", "1.0.0-", "1.0.0-rc..1", "1.0.0-rc.01"} {
+		if _, err := CompareVersions(v, "1.0.0"); err == nil {
+			t.Errorf("CompareVersions(%q, ...) accepted an invalid version", v)
+		}
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	tests := []struct {
+		current, target string
+		downgrade       bool
+		wantErr         bool
+	}{
+		{"1.0.0", "1.0.1", false, false},
+		{"1.0.0-rc.9", "1.0.0-rc.10", false, false},
+		{"1.0.0-rc.10", "1.0.0", false, false},
+		{"1.0.0", "1.0.0", false, true},
+		{"1.0.0", "v1.0.0+rebuild", false, true},
+		{"1.0.0-rc.10", "1.0.0-rc.9", false, true},
+		{"1.2.0", "1.1.9", false, true},
+		{"1.2.0", "1.1.9", true, false},
+		{"1.0.0", "1.0.0", true, false},
+		{"dev", "0.0.1", false, false},
+		{"", "1.0.0", false, false},
+		{"1.0.0", "latest", false, true},
+		{"1.0.0", "latest", true, true},
+	}
+	for _, tt := range tests {
+		err := CheckVersion(tt.current, tt.target, tt.downgrade)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CheckVersion(%q, %q, %v) = %v, want error %v", tt.current, tt.target, tt.downgrade, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Package ech generates Encrypted Client Hello key material natively, in the format
+// produced by `sing-box generate ech-keypair`. It is shared by the panel and the node agents.
+package ech
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+const (
+	// PEM block types used by sing-box for the server key and the client config list
+	keysBlockType    = "ECH KEYS"
+	configsBlockType = "ECH CONFIGS"
+
+	extensionEncryptedClientHello = 0xfe0d
+	kemX25519HKDFSHA256           = 0x0020
+	kdfHKDFSHA256                 = 0x0001
+	aeadAES128GCM                 = 0x0001
+	aeadChaCha20Poly1305          = 0x0003
+)
+
+// KeyPair holds the PEM encoded server key and the client config list
+type KeyPair struct {
+	Key    string `json:"key"`
+	Config string `json:"config"`
+}
+
+// GenerateKeyPair creates an X25519 ECH key for the given public (outer) server name
+func GenerateKeyPair(publicName string) (*KeyPair, error) {
+	if publicName == "" || len(publicName) > 255 {
+		return nil, errors.New("public name must be 1-255 bytes")
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate x25519 key: %w", err)
+	}
+	config := marshalConfig(0, key.PublicKey().Bytes(), publicName)
+
+	keys := appendPrefixed16(nil, key.Bytes())
+	keys = appendPrefixed16(keys, config)
+
+	return &KeyPair{
+		Key:    string(pem.EncodeToMemory(&pem.Block{Type: keysBlockType, Bytes: keys})),
+		Config: string(pem.EncodeToMemory(&pem.Block{Type: configsBlockType, Bytes: appendPrefixed16(nil, config)})),
+	}, nil
+}
+
+// ConfigList decodes the PEM config into the raw ECHConfigList, the value of
+// the ech= parameter of a DNS HTTPS record
+func ConfigList(configPEM string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(configPEM))
+	if block == nil || block.Type != configsBlockType {
+		return nil, fmt.Errorf("expected a %q PEM block", configsBlockType)
+	}
+	if len(block.Bytes) < 2 || int(binary.BigEndian.Uint16(block.Bytes))+2 != len(block.Bytes) {
+		return nil, errors.New("malformed ECH config list")
+	}
+	return block.Bytes, nil
+}
+
+// PublicName returns the public name of the first config in the PEM config list
+func PublicName(configPEM string) (string, error) {
+	list, err := ConfigList(configPEM)
+	if err != nil {
+		return "", err
+	}
+
+	// ECHConfig: version(2) length(2) config_id(1) kem_id(2) public_key<2> cipher_suites<2> max_name_length(1) public_name<1>
+	b := list[2:]
+	if len(b) < 7 || binary.BigEndian.Uint16(b) != extensionEncryptedClientHello {
+		return "", errors.New("unsupported ECH config version")
+	}
+	b = b[7:]
+	for i := 0; i < 2; i++ {
+		if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+			return "", errors.New("malformed ECH config")
+		}
+		b = b[2+int(binary.BigEndian.Uint16(b)):]
+	}
+	if len(b) < 2 || len(b) < 2+int(b[1]) {
+		return "", errors.New("malformed ECH config")
+	}
+	return string(b[2 : 2+int(b[1])]), nil
+}
+
+// marshalConfig encodes an ECHConfig (draft-ietf-tls-esni-18) the same way sing-box does
+func marshalConfig(id uint8, publicKey []byte, publicName string) []byte {
+	var contents []byte
+	contents = append(contents, id)
+	contents = binary.BigEndian.AppendUint16(contents, kemX25519HKDFSHA256)
+	contents = appendPrefixed16(contents, publicKey)
+
+	var suites []byte
+	for _, aead := range []uint16{aeadAES128GCM, aeadChaCha20Poly1305} {
+		suites = binary.BigEndian.AppendUint16(suites, kdfHKDFSHA256)
+		suites = binary.BigEndian.AppendUint16(suites, aead)
+	}
+	contents = appendPrefixed16(contents, suites)
+
+	contents = append(contents, 0) // maximum_name_length
+	contents = append(contents, uint8(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = binary.BigEndian.AppendUint16(contents, 0) // no extensions
+
+	config := binary.BigEndian.AppendUint16(nil, extensionEncryptedClientHello)
+	return appendPrefixed16(config, contents)
+}
+
+func appendPrefixed16(b, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
@@ -0,0 +1,3 @@
+module zen-admin/pkg
+
+go 1.22
@@ -0,0 +1,67 @@
+// Package porthop builds the nftables rules for Hysteria2 port hopping: a range of UDP
+// ports is redirected to the port sing-box listens on. It is shared by the panel and the node agents.
+package porthop
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TableName is the nftables table owned by the agent. It is replaced as a whole on every apply
+const TableName = "zen_port_hopping"
+
+// Rule redirects UDP ports Start..End to Port
+type Rule struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+	Port  int `json:"port"`
+}
+
+// Request is the full rule set of a node; the agent replaces the previous one
+type Request struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Validate checks port bounds and that ranges do not overlap
+func Validate(rules []Rule) error {
+	for i, r := range rules {
+		if r.Start < 1 || r.End > 65535 || r.Start >= r.End {
+			return fmt.Errorf("rule %d: invalid range %d-%d", i, r.Start, r.End)
+		}
+		if r.Port < 1 || r.Port > 65535 {
+			return fmt.Errorf("rule %d: invalid port %d", i, r.Port)
+		}
+		if r.Port >= r.Start && r.Port <= r.End {
+			return fmt.Errorf("rule %d: port %d is inside its own range", i, r.Port)
+		}
+		for j := 0; j < i; j++ {
+			if r.Start <= rules[j].End && rules[j].Start <= r.End {
+				return fmt.Errorf("rule %d: range %d-%d overlaps rule %d", i, r.Start, r.End, j)
+			}
+		}
+	}
+	return nil
+}
+
+// NFTScript returns an `nft -f` script that atomically replaces the table with the given rules.
+// With no rules the table is just removed
+func NFTScript(rules []Rule) string {
+	var b strings.Builder
+
+	// Declaring the table first makes the delete succeed even if it does not exist yet
+	fmt.Fprintf(&b, "table inet %s\n", TableName)
+	fmt.Fprintf(&b, "delete table inet %s\n", TableName)
+	if len(rules) == 0 {
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "table inet %s {\n", TableName)
+	b.WriteString("\tchain prerouting {\n")
+	b.WriteString("\t\ttype nat hook prerouting priority dstnat; policy accept;\n")
+	for _, r := range rules {
+		fmt.Fprintf(&b, "\t\tudp dport %d-%d redirect to :%d\n", r.Start, r.End, r.Port)
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,121 @@
+// Package reality generates REALITY key material natively, without the sing-box binary.
+// It is shared by the panel and the node agents.
+package reality
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// MaxShortIDBytes is the longest short ID accepted by sing-box and Xray (16 hex characters)
+const MaxShortIDBytes = 8
+
+// keyEncoding matches the output of `sing-box generate reality-keypair` and `xray x25519`
+var keyEncoding = base64.RawURLEncoding
+
+// KeyPair is an X25519 keypair encoded the way sing-box and clients expect it
+type KeyPair struct {
+	PrivateKey string `json:"private_key"`
+	PublicKey  string `json:"public_key"`
+}
+
+// GenerateKeyPair creates a new X25519 keypair
+func GenerateKeyPair() (*KeyPair, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate x25519 key: %w", err)
+	}
+
+	return &KeyPair{
+		PrivateKey: keyEncoding.EncodeToString(key.Bytes()),
+		PublicKey:  keyEncoding.EncodeToString(key.PublicKey().Bytes()),
+	}, nil
+}
+
+// PublicKeyFromPrivate derives the public key for an encoded private key
+func PublicKeyFromPrivate(privateKey string) (string, error) {
+	public, err := derivePublicKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return keyEncoding.EncodeToString(public), nil
+}
+
+// ValidateKeyPair checks that both keys decode and belong together.
+// Keys are compared as bytes, so any base64 variant accepted by decodeKey matches.
+func ValidateKeyPair(privateKey, publicKey string) error {
+	derived, err := derivePublicKey(privateKey)
+	if err != nil {
+		return err
+	}
+	public, err := decodeKey(publicKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(derived, public) {
+		return fmt.Errorf("public key does not match private key")
+	}
+	return nil
+}
+
+// NormalizeKey re-encodes a key in the encoding sing-box and clients expect
+func NormalizeKey(key string) (string, error) {
+	raw, err := decodeKey(key)
+	if err != nil {
+		return "", err
+	}
+	return keyEncoding.EncodeToString(raw), nil
+}
+
+// derivePublicKey returns the raw public key for an encoded private key
+func derivePublicKey(privateKey string) ([]byte, error) {
+	raw, err := decodeKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	return key.PublicKey().Bytes(), nil
+}
+
+// GenerateShortID returns a random short ID of n bytes (2n hex characters)
+func GenerateShortID(n int) (string, error) {
+	if n < 1 || n > MaxShortIDBytes {
+		return "", fmt.Errorf("short id length must be 1-%d bytes", MaxShortIDBytes)
+	}
+
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate short id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ValidateShortID checks a short ID: up to 16 hex characters, even length.
+// An empty short ID is valid and lets clients connect without one.
+func ValidateShortID(shortID string) error {
+	if len(shortID) > MaxShortIDBytes*2 || len(shortID)%2 != 0 {
+		return fmt.Errorf("short id must be an even number of hex characters, at most %d", MaxShortIDBytes*2)
+	}
+	if _, err := hex.DecodeString(shortID); err != nil {
+		return fmt.Errorf("short id must be hex: %w", err)
+	}
+	return nil
+}
+
+// decodeKey accepts both the unpadded URL-safe encoding used by sing-box and standard base64
+func decodeKey(key string) ([]byte, error) {
+	for _, enc := range []*base64.Encoding{base64.RawURLEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.StdEncoding} {
+		if raw, err := enc.DecodeString(key); err == nil && len(raw) == 32 {
+			return raw, nil
+		}
+	}
+	return nil, fmt.Errorf("key must be 32 bytes, base64 encoded")
+}
@@ -0,0 +1,479 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"zen-admin/models"
+	"zen-admin/services"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// AgentUpdateHandler обрабатывает релизы агентов и раскатку обновлений
+type AgentUpdateHandler struct {
+	db         *gorm.DB
+	nodeClient *services.NodeClient
+	updater    *services.AgentUpdater
+}
+
+// NewAgentUpdateHandler создаёт новый обработчик обновлений агентов
+func NewAgentUpdateHandler(db *gorm.DB) *AgentUpdateHandler {
+	return &AgentUpdateHandler{
+		db:         db,
+		nodeClient: services.NewNodeClient(),
+		updater:    services.NewAgentUpdater(db),
+	}
+}
+
+// CreateReleaseRequest - запрос на регистрацию релиза агента
+type CreateReleaseRequest struct {
+	Version   string `json:"version"`
+	BinaryURL string `json:"binary_url"`
+	SHA256    string `json:"sha256"`
+	Image     string `json:"image"`
+	Downgrade bool   `json:"downgrade"` // Разрешает откат на более старую версию, входит в подпись
+	Signature string `json:"signature"` // base64 ed25519
+	Notes     string `json:"notes"`
+}
+
+// CreateRolloutRequest - запрос на запуск раскатки
+type CreateRolloutRequest struct {
+	ReleaseID            uint   `json:"release_id"`
+	NodeIDs              []uint `json:"node_ids"` // Порядок обновления; пусто - все включённые ноды
+	BatchSize            int    `json:"batch_size"`
+	BatchIntervalSeconds int    `json:"batch_interval_seconds"`
+	HealthTimeoutSeconds int    `json:"health_timeout_seconds"`
+}
+
+// UpdateNodeAgentRequest - запрос на обновление агента одной ноды
+type UpdateNodeAgentRequest struct {
+	ReleaseID uint `json:"release_id"`
+}
+
+// ListReleases - GET /api/agent/releases
+func (h *AgentUpdateHandler) ListReleases(c *fiber.Ctx) error {
+	var releases []models.AgentRelease
+	if err := h.db.Order("created_at DESC").Find(&releases).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения релизов",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    releases,
+	})
+}
+
+// CreateRelease - POST /api/agent/releases
+// Регистрация подписанного релиза агента
+func (h *AgentUpdateHandler) CreateRelease(c *fiber.Ctx) error {
+	var req CreateReleaseRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный формат запроса",
+		})
+	}
+
+	release := models.AgentRelease{
+		Version:   strings.TrimSpace(req.Version),
+		BinaryURL: req.BinaryURL,
+		SHA256:    strings.ToLower(req.SHA256),
+		ImageRef:  req.Image,
+		Downgrade: req.Downgrade,
+		Signature: req.Signature,
+		Notes:     req.Notes,
+	}
+
+	if err := h.updater.VerifyRelease(&release); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Некорректный релиз: " + err.Error(),
+		})
+	}
+
+	var count int64
+	h.db.Model(&models.AgentRelease{}).Where("version = ?", release.Version).Count(&count)
+	if count > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"error":   "Релиз с такой версией уже существует",
+		})
+	}
+
+	if err := h.db.Create(&release).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка создания релиза",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"success": true,
+		"data":    release,
+	})
+}
+
+// DeleteRelease - DELETE /api/agent/releases/:id
+func (h *AgentUpdateHandler) DeleteRelease(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный ID релиза",
+		})
+	}
+
+	var count int64
+	h.db.Model(&models.AgentRollout{}).Where("release_id = ?", id).Count(&count)
+	if count > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"error":   "Релиз используется в раскатках",
+		})
+	}
+
+	result := h.db.Delete(&models.AgentRelease{}, id)
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка удаления релиза",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"success": false,
+			"error":   "Релиз не найден",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Релиз удалён",
+	})
+}
+
+// ListRollouts - GET /api/agent/rollouts
+func (h *AgentUpdateHandler) ListRollouts(c *fiber.Ctx) error {
+	var rollouts []models.AgentRollout
+	if err := h.db.Preload("Release").Order("created_at DESC").Find(&rollouts).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения раскаток",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    rollouts,
+	})
+}
+
+// GetRollout - GET /api/agent/rollouts/:id
+// Раскатка с состоянием каждой ноды
+func (h *AgentUpdateHandler) GetRollout(c *fiber.Ctx) error {
+	rollout, err := h.findRollout(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    rollout,
+	})
+}
+
+// CreateRollout - POST /api/agent/rollouts
+// Запуск поэтапной раскатки релиза. Одновременно может идти только одна раскатка
+func (h *AgentUpdateHandler) CreateRollout(c *fiber.Ctx) error {
+	var req CreateRolloutRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный формат запроса",
+		})
+	}
+
+	var release models.AgentRelease
+	if err := h.db.First(&release, req.ReleaseID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"success": false,
+			"error":   "Релиз не найден",
+		})
+	}
+
+	var running int64
+	h.db.Model(&models.AgentRollout{}).Where("status = ?", models.RolloutStatusRunning).Count(&running)
+	if running > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"error":   "Уже идёт другая раскатка, остановите её или дождитесь завершения",
+		})
+	}
+
+	// Порядок нод: как передан, либо все включённые по ID
+	var nodes []models.Node
+	if len(req.NodeIDs) > 0 {
+		if err := h.db.Where("id IN ?", req.NodeIDs).Find(&nodes).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"success": false,
+				"error":   "Ошибка получения нод",
+			})
+		}
+		if len(nodes) != len(req.NodeIDs) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "Некоторые ноды не найдены",
+			})
+		}
+		position := make(map[uint]int, len(req.NodeIDs))
+		for i, id := range req.NodeIDs {
+			position[id] = i
+		}
+		ordered := make([]models.Node, len(nodes))
+		for _, node := range nodes {
+			ordered[position[node.ID]] = node
+		}
+		nodes = ordered
+	} else if err := h.db.Where("enabled = ?", true).Order("id").Find(&nodes).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения нод",
+		})
+	}
+
+	if len(nodes) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Нет нод для обновления",
+		})
+	}
+
+	rollout := models.AgentRollout{
+		ReleaseID:            release.ID,
+		Status:               models.RolloutStatusRunning,
+		BatchSize:            req.BatchSize,
+		BatchIntervalSeconds: req.BatchIntervalSeconds,
+		HealthTimeoutSeconds: req.HealthTimeoutSeconds,
+	}
+	if rollout.BatchSize <= 0 {
+		rollout.BatchSize = 1
+	}
+	if rollout.BatchIntervalSeconds <= 0 {
+		rollout.BatchIntervalSeconds = 60
+	}
+	if rollout.HealthTimeoutSeconds <= 0 {
+		rollout.HealthTimeoutSeconds = 120
+	}
+	for i, node := range nodes {
+		rollout.Nodes = append(rollout.Nodes, models.AgentRolloutNode{
+			NodeID:          node.ID,
+			Position:        i,
+			Status:          models.RolloutNodePending,
+			PreviousVersion: node.AgentVersion,
+		})
+	}
+
+	if err := h.db.Create(&rollout).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка создания раскатки",
+		})
+	}
+
+	rollout.Release = release
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"success": true,
+		"data":    rollout,
+	})
+}
+
+// HaltRollout - POST /api/agent/rollouts/:id/halt
+// Ручная остановка раскатки (текущая партия доработает)
+func (h *AgentUpdateHandler) HaltRollout(c *fiber.Ctx) error {
+	rollout, err := h.findRollout(c)
+	if err != nil {
+		return err
+	}
+
+	if rollout.Status != models.RolloutStatusRunning {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"error":   "Раскатка не выполняется",
+		})
+	}
+
+	h.db.Model(&models.AgentRollout{}).Where("id = ?", rollout.ID).Updates(map[string]interface{}{
+		"status":      models.RolloutStatusHalted,
+		"halt_reason": "Остановлена администратором",
+	})
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Раскатка остановлена",
+	})
+}
+
+// ResumeRollout - POST /api/agent/rollouts/:id/resume
+// Продолжение остановленной раскатки; ноды с ошибкой обновляются повторно
+func (h *AgentUpdateHandler) ResumeRollout(c *fiber.Ctx) error {
+	rollout, err := h.findRollout(c)
+	if err != nil {
+		return err
+	}
+
+	if rollout.Status != models.RolloutStatusHalted {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"error":   "Продолжить можно только остановленную раскатку",
+		})
+	}
+
+	var running int64
+	h.db.Model(&models.AgentRollout{}).Where("status = ?", models.RolloutStatusRunning).Count(&running)
+	if running > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"error":   "Уже идёт другая раскатка",
+		})
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.AgentRolloutNode{}).
+			Where("rollout_id = ? AND status IN ?", rollout.ID, []string{models.RolloutNodeFailed, models.RolloutNodeUpdating}).
+			Updates(map[string]interface{}{"status": models.RolloutNodePending, "error": ""}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.AgentRollout{}).Where("id = ?", rollout.ID).Updates(map[string]interface{}{
+			"status":        models.RolloutStatusRunning,
+			"halt_reason":   "",
+			"last_batch_at": nil,
+		}).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка возобновления раскатки",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Раскатка возобновлена",
+	})
+}
+
+// GetNodeVersion - GET /api/nodes/:id/version
+// Версия агента на ноде (запрашивается у агента)
+func (h *AgentUpdateHandler) GetNodeVersion(c *fiber.Ctx) error {
+	node, err := h.findNode(c)
+	if err != nil {
+		return err
+	}
+
+	version, err := h.nodeClient.GetVersion(node)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения версии агента: " + err.Error(),
+		})
+	}
+
+	now := time.Now()
+	h.db.Model(&models.Node{}).Where("id = ?", node.ID).Updates(map[string]interface{}{
+		"agent_version":    version.Version,
+		"agent_checked_at": now,
+	})
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    version,
+	})
+}
+
+// UpdateNodeAgent - POST /api/nodes/:id/update
+// Обновление агента одной ноды. Ждёт, пока агент вернётся с новой версией
+func (h *AgentUpdateHandler) UpdateNodeAgent(c *fiber.Ctx) error {
+	node, err := h.findNode(c)
+	if err != nil {
+		return err
+	}
+
+	var req UpdateNodeAgentRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный формат запроса",
+		})
+	}
+
+	var release models.AgentRelease
+	if err := h.db.First(&release, req.ReleaseID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"success": false,
+			"error":   "Релиз не найден",
+		})
+	}
+
+	previous, err := h.updater.UpdateNode(node, &release, 2*time.Minute)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка обновления агента: " + err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data": fiber.Map{
+			"node_id":          node.ID,
+			"previous_version": previous,
+			"version":          node.AgentVersion,
+		},
+	})
+}
+
+// findRollout загружает раскатку по :id вместе с нодами
+func (h *AgentUpdateHandler) findRollout(c *fiber.Ctx) (*models.AgentRollout, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Неверный ID раскатки")
+	}
+
+	var rollout models.AgentRollout
+	err = h.db.Preload("Release").
+		Preload("Nodes", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		Preload("Nodes.Node").
+		First(&rollout, id).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, fiber.NewError(fiber.StatusNotFound, "Раскатка не найдена")
+		}
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Ошибка получения раскатки")
+	}
+
+	return &rollout, nil
+}
+
+// findNode загружает ноду по :id. Ошибки оформляются через customErrorHandler
+func (h *AgentUpdateHandler) findNode(c *fiber.Ctx) (*models.Node, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Неверный ID ноды")
+	}
+
+	var node models.Node
+	if err := h.db.First(&node, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, fiber.NewError(fiber.StatusNotFound, "Нода не найдена")
+		}
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Ошибка получения ноды")
+	}
+
+	return &node, nil
+}
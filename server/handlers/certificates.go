@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"strconv"
+
+	"zen-admin/models"
+	"zen-admin/services"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// CertificateHandler обрабатывает запросы для TLS сертификатов
+type CertificateHandler struct {
+	db         *gorm.DB
+	nodeClient *services.NodeClient
+	monitor    *services.CertMonitor
+}
+
+// NewCertificateHandler создаёт новый обработчик сертификатов
+func NewCertificateHandler(db *gorm.DB) *CertificateHandler {
+	return &CertificateHandler{
+		db:         db,
+		nodeClient: services.NewNodeClient(),
+		monitor:    services.NewCertMonitor(db),
+	}
+}
+
+// UploadCertificateRequest - запрос на загрузку сертификата
+type UploadCertificateRequest struct {
+	Domain      string `json:"domain"`
+	Certificate string `json:"certificate"` // PEM, полная цепочка
+	PrivateKey  string `json:"private_key"` // PEM
+}
+
+// IssueCertificateRequest - запрос на выпуск ACME сертификата
+type IssueCertificateRequest struct {
+	Email string `json:"email"`
+}
+
+// CertificateView - сертификат с вычисленным статусом
+type CertificateView struct {
+	models.Certificate
+	Status string `json:"status"`
+}
+
+// List - GET /api/certificates
+// Все отслеживаемые сертификаты (по данным последней проверки)
+// Query params: status=ok|expiring|expired|renewal_failed|missing, problems=true
+func (h *CertificateHandler) List(c *fiber.Ctx) error {
+	var certs []models.Certificate
+	if err := h.db.Preload("Node").Order("not_after ASC").Find(&certs).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения сертификатов",
+		})
+	}
+
+	status := c.Query("status")
+	problemsOnly := c.QueryBool("problems", false)
+
+	result := []CertificateView{}
+	for _, cert := range certs {
+		view := CertificateView{Certificate: cert, Status: cert.Status(h.monitor.WarnBefore())}
+		if status != "" && view.Status != status {
+			continue
+		}
+		if problemsOnly && view.Status == models.CertStatusOK {
+			continue
+		}
+		result = append(result, view)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    result,
+	})
+}
+
+// ListByNode - GET /api/nodes/:id/certificates
+// Сертификаты ноды (запрашиваются у агента и сохраняются в базе)
+func (h *CertificateHandler) ListByNode(c *fiber.Ctx) error {
+	node, err := h.findNode(c)
+	if err != nil {
+		return err
+	}
+
+	certs, err := h.monitor.SyncNode(node)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения сертификатов с ноды: " + err.Error(),
+		})
+	}
+
+	result := make([]CertificateView, len(certs))
+	for i, cert := range certs {
+		result[i] = CertificateView{Certificate: cert, Status: cert.Status(h.monitor.WarnBefore())}
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    result,
+	})
+}
+
+// Upload - POST /api/nodes/:id/certificates
+// Загрузка своего сертификата на ноду
+func (h *CertificateHandler) Upload(c *fiber.Ctx) error {
+	node, err := h.findNode(c)
+	if err != nil {
+		return err
+	}
+
+	var req UploadCertificateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный формат запроса",
+		})
+	}
+
+	if req.Domain == "" || req.Certificate == "" || req.PrivateKey == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Домен, сертификат и ключ обязательны",
+		})
+	}
+
+	info, err := h.nodeClient.UploadCert(node, req.Domain, req.Certificate, req.PrivateKey)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка загрузки сертификата: " + err.Error(),
+		})
+	}
+
+	cert, err := h.monitor.SaveCertInfo(node.ID, info)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка сохранения сертификата",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"success": true,
+		"data":    CertificateView{Certificate: *cert, Status: cert.Status(h.monitor.WarnBefore())},
+	})
+}
+
+// IssueForInbound - POST /api/inbounds/:id/certificate
+// Выпуск ACME сертификата для SNI инбаунда. Пути к сертификату прописываются в инбаунд
+func (h *CertificateHandler) IssueForInbound(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный ID инбаунда",
+		})
+	}
+
+	var inbound models.Inbound
+	if err := h.db.Preload("Node").First(&inbound, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "Инбаунд не найден",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения инбаунда",
+		})
+	}
+
+	// REALITY заимствует чужой сертификат, свой ему не нужен
+	if inbound.Protocol == models.ProtocolReality {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "REALITY инбаунду не нужен сертификат",
+		})
+	}
+
+	if inbound.SNI == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "У инбаунда не задан SNI",
+		})
+	}
+
+	var req IssueCertificateRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "Неверный формат запроса",
+			})
+		}
+	}
+
+	info, err := h.nodeClient.RequestACMECert(&inbound.Node, inbound.SNI, req.Email)
+	if err != nil {
+		// Агент записывает неудачную попытку - подтягиваем её, чтобы ошибка была видна в списке
+		h.monitor.SyncNode(&inbound.Node)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка выпуска сертификата: " + err.Error(),
+		})
+	}
+
+	cert, err := h.monitor.SaveCertInfo(inbound.NodeID, info)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка сохранения сертификата",
+		})
+	}
+
+	inbound.CertPath = cert.CertPath
+	inbound.KeyPath = cert.KeyPath
+	if err := h.db.Save(&inbound).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка обновления инбаунда",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    CertificateView{Certificate: *cert, Status: cert.Status(h.monitor.WarnBefore())},
+		"message": "Сертификат выпущен. Синхронизируйте ноду, чтобы применить его",
+	})
+}
+
+// findNode загружает ноду по :id. Ошибки оформляются через customErrorHandler
+func (h *CertificateHandler) findNode(c *fiber.Ctx) (*models.Node, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Неверный ID ноды")
+	}
+
+	var node models.Node
+	if err := h.db.First(&node, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, fiber.NewError(fiber.StatusNotFound, "Нода не найдена")
+		}
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Ошибка получения ноды")
+	}
+
+	return &node, nil
+}
@@ -0,0 +1,322 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+
+	"zen-admin/models"
+	"zen-admin/services"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// ClientRoutingHandler обрабатывает шаблоны клиентской маршрутизации
+type ClientRoutingHandler struct {
+	db *gorm.DB
+}
+
+// NewClientRoutingHandler создаёт новый обработчик шаблонов клиентской маршрутизации
+func NewClientRoutingHandler(db *gorm.DB) *ClientRoutingHandler {
+	return &ClientRoutingHandler{db: db}
+}
+
+// ClientRoutingTemplateRequest - запрос на создание/обновление шаблона (правила заменяются целиком)
+type ClientRoutingTemplateRequest struct {
+	Name        string                     `json:"name"`
+	Description string                     `json:"description"`
+	IsDefault   bool                       `json:"is_default"`
+	Rules       []models.ClientRoutingRule `json:"rules"`
+	RuleSets    []models.RoutingRuleSet    `json:"rule_sets"`
+	DNSServers  []models.ClientDNSServer   `json:"dns_servers"`
+}
+
+// AssignClientRoutingRequest - запрос на назначение шаблона пользователю (null - шаблон по умолчанию)
+type AssignClientRoutingRequest struct {
+	TemplateID *uint `json:"template_id"`
+}
+
+// ClientRoutingTemplateResponse - шаблон с числом пользователей, которым он назначен,
+// и форматами подписки, в которых его правила не выражаются
+type ClientRoutingTemplateResponse struct {
+	models.ClientRoutingTemplate
+	UserCount          int64    `json:"user_count"`
+	UnsupportedFormats []string `json:"unsupported_formats,omitempty"`
+}
+
+// List - GET /api/routing/templates
+func (h *ClientRoutingHandler) List(c *fiber.Ctx) error {
+	var templates []models.ClientRoutingTemplate
+	if err := h.db.Order("name").Find(&templates).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения шаблонов",
+		})
+	}
+
+	response := make([]ClientRoutingTemplateResponse, len(templates))
+	for i := range templates {
+		response[i] = h.toResponse(&templates[i])
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    response,
+	})
+}
+
+// Get - GET /api/routing/templates/:id
+func (h *ClientRoutingHandler) Get(c *fiber.Ctx) error {
+	template, err := h.findTemplate(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    h.toResponse(template),
+	})
+}
+
+// Create - POST /api/routing/templates
+func (h *ClientRoutingHandler) Create(c *fiber.Ctx) error {
+	var req ClientRoutingTemplateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный формат запроса",
+		})
+	}
+
+	template := models.ClientRoutingTemplate{
+		Name:        strings.TrimSpace(req.Name),
+		Description: req.Description,
+		IsDefault:   req.IsDefault,
+		Rules:       req.Rules,
+		RuleSets:    req.RuleSets,
+		DNSServers:  req.DNSServers,
+	}
+
+	if err := services.ValidateClientRoutingTemplate(&template); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Некорректный шаблон: " + err.Error(),
+		})
+	}
+
+	var count int64
+	h.db.Model(&models.ClientRoutingTemplate{}).Where("name = ?", template.Name).Count(&count)
+	if count > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"error":   "Шаблон с таким названием уже существует",
+		})
+	}
+
+	if err := h.save(&template); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка создания шаблона",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"success": true,
+		"data":    h.toResponse(&template),
+	})
+}
+
+// Update - PUT /api/routing/templates/:id
+// Клиенты получат новые правила при следующем обновлении подписки
+func (h *ClientRoutingHandler) Update(c *fiber.Ctx) error {
+	template, err := h.findTemplate(c)
+	if err != nil {
+		return err
+	}
+
+	var req ClientRoutingTemplateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный формат запроса",
+		})
+	}
+
+	if name := strings.TrimSpace(req.Name); name != "" {
+		template.Name = name
+	}
+	template.Description = req.Description
+	template.IsDefault = req.IsDefault
+	template.Rules = req.Rules
+	template.RuleSets = req.RuleSets
+	template.DNSServers = req.DNSServers
+
+	if err := services.ValidateClientRoutingTemplate(template); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Некорректный шаблон: " + err.Error(),
+		})
+	}
+
+	var count int64
+	h.db.Model(&models.ClientRoutingTemplate{}).Where("name = ? AND id <> ?", template.Name, template.ID).Count(&count)
+	if count > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"error":   "Шаблон с таким названием уже существует",
+		})
+	}
+
+	if err := h.save(template); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка обновления шаблона",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    h.toResponse(template),
+	})
+}
+
+// Delete - DELETE /api/routing/templates/:id
+func (h *ClientRoutingHandler) Delete(c *fiber.Ctx) error {
+	template, err := h.findTemplate(c)
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	h.db.Model(&models.User{}).Where("routing_template_id = ?", template.ID).Count(&count)
+	if count > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"error":   "Шаблон назначен пользователям",
+		})
+	}
+
+	if err := h.db.Delete(template).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка удаления шаблона",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Шаблон удалён",
+	})
+}
+
+// AssignUser - PUT /api/users/:id/routing
+// Назначение пользователю шаблона клиентской маршрутизации
+func (h *ClientRoutingHandler) AssignUser(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный ID пользователя",
+		})
+	}
+
+	var user models.User
+	if err := h.db.First(&user, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "Пользователь не найден",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения пользователя",
+		})
+	}
+
+	var req AssignClientRoutingRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный формат запроса",
+		})
+	}
+
+	if req.TemplateID != nil {
+		var count int64
+		h.db.Model(&models.ClientRoutingTemplate{}).Where("id = ?", *req.TemplateID).Count(&count)
+		if count == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "Шаблон не найден",
+			})
+		}
+	}
+
+	user.RoutingTemplateID = req.TemplateID
+	if err := h.db.Model(&models.User{}).Where("id = ?", user.ID).Update("routing_template_id", req.TemplateID).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка обновления пользователя",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Шаблон назначен, клиенты получат его при обновлении подписки",
+		"data":    user,
+	})
+}
+
+// save сохраняет шаблон; шаблон по умолчанию может быть только один
+func (h *ClientRoutingHandler) save(template *models.ClientRoutingTemplate) error {
+	return h.db.Transaction(func(tx *gorm.DB) error {
+		if template.IsDefault {
+			if err := tx.Model(&models.ClientRoutingTemplate{}).
+				Where("is_default = ? AND id <> ?", true, template.ID).
+				Update("is_default", false).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Save(template).Error
+	})
+}
+
+// toResponse добавляет к шаблону число пользователей и заменяет nil на пустые списки
+func (h *ClientRoutingHandler) toResponse(template *models.ClientRoutingTemplate) ClientRoutingTemplateResponse {
+	if template.Rules == nil {
+		template.Rules = []models.ClientRoutingRule{}
+	}
+	if template.RuleSets == nil {
+		template.RuleSets = []models.RoutingRuleSet{}
+	}
+	if template.DNSServers == nil {
+		template.DNSServers = []models.ClientDNSServer{}
+	}
+
+	var userCount int64
+	h.db.Model(&models.User{}).Where("routing_template_id = ?", template.ID).Count(&userCount)
+
+	return ClientRoutingTemplateResponse{
+		ClientRoutingTemplate: *template,
+		UserCount:             userCount,
+		UnsupportedFormats:    services.ClientRoutingUnsupportedFormats(template),
+	}
+}
+
+// findTemplate загружает шаблон по :id
+func (h *ClientRoutingHandler) findTemplate(c *fiber.Ctx) (*models.ClientRoutingTemplate, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Неверный ID шаблона")
+	}
+
+	var template models.ClientRoutingTemplate
+	if err := h.db.First(&template, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, fiber.NewError(fiber.StatusNotFound, "Шаблон не найден")
+		}
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Ошибка получения шаблона")
+	}
+	return &template, nil
+}
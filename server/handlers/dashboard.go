@@ -12,15 +12,17 @@ import (
 
 // DashboardHandler обрабатывает запросы дашборда
 type DashboardHandler struct {
-	db         *gorm.DB
-	nodeClient *services.NodeClient
+	db          *gorm.DB
+	nodeClient  *services.NodeClient
+	certMonitor *services.CertMonitor
 }
 
 // NewDashboardHandler создаёт новый обработчик дашборда
 func NewDashboardHandler(db *gorm.DB) *DashboardHandler {
 	return &DashboardHandler{
-		db:         db,
-		nodeClient: services.NewNodeClient(),
+		db:          db,
+		nodeClient:  services.NewNodeClient(),
+		certMonitor: services.NewCertMonitor(db),
 	}
 }
 
@@ -31,6 +33,7 @@ type DashboardSummary struct {
 	Traffic     TrafficSummary     `json:"traffic"`
 	RecentUsers []RecentUser       `json:"recent_users"`
 	NodeStatus  []NodeStatusInfo   `json:"node_status"`
+	CertAlerts  []CertificateView  `json:"cert_alerts"`
 }
 
 // UsersSummary - сводка по пользователям
@@ -220,6 +223,17 @@ func (h *DashboardHandler) Get(c *fiber.Ctx) error {
 		}
 	}
 
+	// === Проблемные сертификаты (по данным последней фоновой проверки) ===
+	summary.CertAlerts = []CertificateView{}
+	var certs []models.Certificate
+	h.db.Preload("Node").Order("not_after ASC").Find(&certs)
+	for _, cert := range certs {
+		status := cert.Status(h.certMonitor.WarnBefore())
+		if status != models.CertStatusOK {
+			summary.CertAlerts = append(summary.CertAlerts, CertificateView{Certificate: cert, Status: status})
+		}
+	}
+
 	return c.JSON(fiber.Map{
 		"success": true,
 		"data":    summary,
@@ -1,11 +1,11 @@
 package handlers
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"errors"
 	"strconv"
 
 	"zen-admin/models"
+	"zen-admin/protocols"
 	"zen-admin/services"
 
 	"github.com/gofiber/fiber/v2"
@@ -16,6 +16,7 @@ import (
 type InboundHandler struct {
 	db         *gorm.DB
 	nodeClient *services.NodeClient
+	rotator    *services.RealityRotator
 }
 
 // NewInboundHandler создаёт новый обработчик инбаундов
@@ -23,47 +24,107 @@ func NewInboundHandler(db *gorm.DB) *InboundHandler {
 	return &InboundHandler{
 		db:         db,
 		nodeClient: services.NewNodeClient(),
+		rotator:    services.NewRealityRotator(db),
 	}
 }
 
 // CreateInboundRequest - запрос на создание инбаунда
 type CreateInboundRequest struct {
-	Name         string          `json:"name" validate:"required"`
-	Protocol     models.Protocol `json:"protocol" validate:"required"`
-	ListenPort   int             `json:"listen_port"`
-	SNI          string          `json:"sni"`
-	FallbackAddr string          `json:"fallback_addr"`
-	FallbackPort int             `json:"fallback_port"`
-	PrivateKey   string          `json:"private_key"`
-	PublicKey    string          `json:"public_key"`
-	ShortID      string          `json:"short_id"`
-	UpMbps       int             `json:"up_mbps"`
-	DownMbps     int             `json:"down_mbps"`
-	WSPath       string          `json:"ws_path"`
-	CertPath     string          `json:"cert_path"`
-	KeyPath      string          `json:"key_path"`
-	Fingerprint  string          `json:"fingerprint"`
-	Enabled      *bool           `json:"enabled"`
+	Name              string          `json:"name" validate:"required"`
+	Protocol          models.Protocol `json:"protocol" validate:"required"`
+	ListenPort        int             `json:"listen_port"`
+	SNI               string          `json:"sni"`
+	FallbackAddr      string          `json:"fallback_addr"`
+	FallbackPort      int             `json:"fallback_port"`
+	PrivateKey        string          `json:"private_key"`
+	PublicKey         string          `json:"public_key"`
+	ShortID           string          `json:"short_id"`
+	PerUserShortIDs   bool            `json:"per_user_short_ids"`
+	ServerNames       []string        `json:"server_names"`
+	SNIRelayPort      int             `json:"sni_relay_port"`
+	UpMbps            int             `json:"up_mbps"`
+	DownMbps          int             `json:"down_mbps"`
+	Obfs              string          `json:"obfs"`
+	ObfsPassword      string          `json:"obfs_password"`
+	HopPortStart      int             `json:"hop_port_start"`
+	HopPortEnd        int             `json:"hop_port_end"`
+	Transport         string          `json:"transport"`
+	WSPath            string          `json:"ws_path"`
+	GRPCServiceName   string          `json:"grpc_service_name"`
+	TransportHost     string          `json:"transport_host"`
+	MuxEnabled        bool            `json:"mux_enabled"`
+	MuxProtocol       string          `json:"mux_protocol"`
+	MuxMaxConnections int             `json:"mux_max_connections"`
+	MuxPadding        bool            `json:"mux_padding"`
+	BrutalUpMbps      int             `json:"brutal_up_mbps"`
+	BrutalDownMbps    int             `json:"brutal_down_mbps"`
+	AlterID           int             `json:"alter_id"`
+	SSMethod          string          `json:"ss_method"`
+	SSServerKey       string          `json:"ss_server_key"`
+	WGAddressPool     string          `json:"wg_address_pool"`
+	WGMTU             int             `json:"wg_mtu"`
+	WGDNS             string          `json:"wg_dns"`
+	CongestionControl string          `json:"congestion_control"`
+	ALPN              []string        `json:"alpn"`
+	CertPath          string          `json:"cert_path"`
+	KeyPath           string          `json:"key_path"`
+	Fingerprint       string          `json:"fingerprint"`
+	ECHEnabled        bool            `json:"ech_enabled"`
+	ECHPublicName     string          `json:"ech_public_name"`
+	Enabled           *bool           `json:"enabled"`
+}
+
+// RotationPolicyRequest - политика ротации REALITY short_id
+type RotationPolicyRequest struct {
+	IntervalHours int   `json:"interval_hours"` // 0 - выключить ротацию
+	GraceHours    int   `json:"grace_hours"`
+	RotateKeys    *bool `json:"rotate_keys"` // Не поддерживается: true отклоняется
 }
 
 // UpdateInboundRequest - запрос на обновление инбаунда
 type UpdateInboundRequest struct {
-	Name         string          `json:"name"`
-	Protocol     models.Protocol `json:"protocol"`
-	ListenPort   int             `json:"listen_port"`
-	SNI          string          `json:"sni"`
-	FallbackAddr string          `json:"fallback_addr"`
-	FallbackPort int             `json:"fallback_port"`
-	PrivateKey   string          `json:"private_key"`
-	PublicKey    string          `json:"public_key"`
-	ShortID      string          `json:"short_id"`
-	UpMbps       int             `json:"up_mbps"`
-	DownMbps     int             `json:"down_mbps"`
-	WSPath       string          `json:"ws_path"`
-	CertPath     string          `json:"cert_path"`
-	KeyPath      string          `json:"key_path"`
-	Fingerprint  string          `json:"fingerprint"`
-	Enabled      *bool           `json:"enabled"`
+	Name              string          `json:"name"`
+	Protocol          models.Protocol `json:"protocol"`
+	ListenPort        int             `json:"listen_port"`
+	SNI               string          `json:"sni"`
+	FallbackAddr      string          `json:"fallback_addr"`
+	FallbackPort      int             `json:"fallback_port"`
+	PrivateKey        string          `json:"private_key"`
+	PublicKey         string          `json:"public_key"`
+	ShortID           string          `json:"short_id"`
+	PerUserShortIDs   *bool           `json:"per_user_short_ids"`
+	ServerNames       []string        `json:"server_names"` // [] - оставить только sni
+	SNIRelayPort      int             `json:"sni_relay_port"`
+	UpMbps            int             `json:"up_mbps"`
+	DownMbps          int             `json:"down_mbps"`
+	Obfs              *string         `json:"obfs"` // "" - выключить обфускацию
+	ObfsPassword      string          `json:"obfs_password"`
+	HopPortStart      *int            `json:"hop_port_start"` // 0 - выключить port hopping
+	HopPortEnd        *int            `json:"hop_port_end"`
+	Transport         string          `json:"transport"`
+	WSPath            string          `json:"ws_path"`
+	GRPCServiceName   string          `json:"grpc_service_name"`
+	TransportHost     string          `json:"transport_host"`
+	MuxEnabled        *bool           `json:"mux_enabled"`
+	MuxProtocol       string          `json:"mux_protocol"`
+	MuxMaxConnections *int            `json:"mux_max_connections"`
+	MuxPadding        *bool           `json:"mux_padding"`
+	BrutalUpMbps      *int            `json:"brutal_up_mbps"` // 0 - выключить Brutal
+	BrutalDownMbps    *int            `json:"brutal_down_mbps"`
+	AlterID           *int            `json:"alter_id"`
+	SSMethod          string          `json:"ss_method"`
+	SSServerKey       string          `json:"ss_server_key"`
+	WGAddressPool     string          `json:"wg_address_pool"`
+	WGMTU             int             `json:"wg_mtu"`
+	WGDNS             string          `json:"wg_dns"`
+	CongestionControl string          `json:"congestion_control"`
+	ALPN              []string        `json:"alpn"`
+	CertPath          string          `json:"cert_path"`
+	KeyPath           string          `json:"key_path"`
+	Fingerprint       string          `json:"fingerprint"`
+	ECHEnabled        *bool           `json:"ech_enabled"`
+	ECHPublicName     *string         `json:"ech_public_name"` // "" - внешний SNI совпадает с sni
+	Enabled           *bool           `json:"enabled"`
 }
 
 // ListByNode - GET /api/nodes/:id/inbounds
@@ -187,69 +248,88 @@ func (h *InboundHandler) Create(c *fiber.Ctx) error {
 	}
 
 	// Проверка валидности протокола
-	switch req.Protocol {
-	case models.ProtocolReality, models.ProtocolWSTLS, models.ProtocolHysteria2:
-		// OK
-	default:
+	if _, ok := protocols.Get(req.Protocol); !ok {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"success": false,
-			"error":   "Неподдерживаемый протокол. Используйте: reality, ws-tls, hysteria2",
+			"error":   "Неподдерживаемый протокол. Используйте: " + protocols.Names(),
 		})
 	}
 
 	// Создаём инбаунд
 	inbound := models.Inbound{
-		NodeID:       uint(nodeID),
-		Name:         req.Name,
-		Protocol:     req.Protocol,
-		ListenPort:   req.ListenPort,
-		SNI:          req.SNI,
-		FallbackAddr: req.FallbackAddr,
-		FallbackPort: req.FallbackPort,
-		PrivateKey:   req.PrivateKey,
-		PublicKey:    req.PublicKey,
-		ShortID:      req.ShortID,
-		UpMbps:       req.UpMbps,
-		DownMbps:     req.DownMbps,
-		WSPath:       req.WSPath,
-		CertPath:     req.CertPath,
-		KeyPath:      req.KeyPath,
-		Fingerprint:  req.Fingerprint,
-		Enabled:      true,
+		NodeID:            uint(nodeID),
+		Name:              req.Name,
+		Protocol:          req.Protocol,
+		ListenPort:        req.ListenPort,
+		SNI:               req.SNI,
+		FallbackAddr:      req.FallbackAddr,
+		FallbackPort:      req.FallbackPort,
+		PrivateKey:        req.PrivateKey,
+		PublicKey:         req.PublicKey,
+		ShortID:           req.ShortID,
+		PerUserShortIDs:   req.PerUserShortIDs,
+		ServerNames:       req.ServerNames,
+		SNIRelayPort:      req.SNIRelayPort,
+		UpMbps:            req.UpMbps,
+		DownMbps:          req.DownMbps,
+		Obfs:              req.Obfs,
+		ObfsPassword:      req.ObfsPassword,
+		HopPortStart:      req.HopPortStart,
+		HopPortEnd:        req.HopPortEnd,
+		Transport:         req.Transport,
+		WSPath:            req.WSPath,
+		GRPCServiceName:   req.GRPCServiceName,
+		TransportHost:     req.TransportHost,
+		MuxEnabled:        req.MuxEnabled,
+		MuxProtocol:       req.MuxProtocol,
+		MuxMaxConnections: req.MuxMaxConnections,
+		MuxPadding:        req.MuxPadding,
+		BrutalUpMbps:      req.BrutalUpMbps,
+		BrutalDownMbps:    req.BrutalDownMbps,
+		AlterID:           req.AlterID,
+		SSMethod:          req.SSMethod,
+		SSServerKey:       req.SSServerKey,
+		WGAddressPool:     req.WGAddressPool,
+		WGMTU:             req.WGMTU,
+		WGDNS:             req.WGDNS,
+		CongestionControl: req.CongestionControl,
+		ALPN:              req.ALPN,
+		CertPath:          req.CertPath,
+		KeyPath:           req.KeyPath,
+		Fingerprint:       req.Fingerprint,
+		ECHEnabled:        req.ECHEnabled,
+		ECHPublicName:     req.ECHPublicName,
+		Enabled:           true,
+	}
+
+	// Если для SNI на ноде уже есть отслеживаемый сертификат - берём его пути
+	if inbound.SNI != "" && inbound.Protocol != models.ProtocolReality && inbound.CertPath == "" && inbound.KeyPath == "" {
+		var cert models.Certificate
+		if err := h.db.Where("node_id = ? AND domain = ?", nodeID, inbound.SNI).First(&cert).Error; err == nil {
+			inbound.CertPath = cert.CertPath
+			inbound.KeyPath = cert.KeyPath
+		}
 	}
 
-	// Значения по умолчанию
-	if inbound.ListenPort == 0 {
-		inbound.ListenPort = 443
-	}
-	if inbound.FallbackAddr == "" {
-		inbound.FallbackAddr = "127.0.0.1"
-	}
-	if inbound.FallbackPort == 0 {
-		inbound.FallbackPort = 8443
-	}
-	if inbound.Fingerprint == "" {
-		inbound.Fingerprint = "chrome"
-	}
-	if inbound.UpMbps == 0 {
-		inbound.UpMbps = 100
-	}
-	if inbound.DownMbps == 0 {
-		inbound.DownMbps = 100
-	}
-	if inbound.WSPath == "" {
-		inbound.WSPath = "/ws"
-	}
-	// Дефолтные пути для TLS сертификатов (Let's Encrypt стандартные пути)
-	if inbound.CertPath == "" && (inbound.Protocol == models.ProtocolWSTLS || inbound.Protocol == models.ProtocolHysteria2) {
-		inbound.CertPath = "/etc/ssl/certs/cert.pem"
+	if req.Enabled != nil {
+		inbound.Enabled = *req.Enabled
 	}
-	if inbound.KeyPath == "" && (inbound.Protocol == models.ProtocolWSTLS || inbound.Protocol == models.ProtocolHysteria2) {
-		inbound.KeyPath = "/etc/ssl/private/key.pem"
+
+	// Значения по умолчанию и проверки протокола. REALITY без ключей получает их сразу, даже если нода сейчас офлайн
+	if err := prepareInbound(&inbound); err != nil {
+		return err
 	}
 
-	if req.Enabled != nil {
-		inbound.Enabled = *req.Enabled
+	conflicts, err := h.portConflicts(&node, &inbound)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success":   false,
+			"error":     "Конфликт портов: " + conflicts[0].Error(),
+			"conflicts": conflicts,
+		})
 	}
 
 	if err := h.db.Create(&inbound).Error; err != nil {
@@ -304,15 +384,19 @@ func (h *InboundHandler) Update(c *fiber.Ctx) error {
 	}
 	if req.Protocol != "" {
 		// Проверка валидности протокола
-		switch req.Protocol {
-		case models.ProtocolReality, models.ProtocolWSTLS, models.ProtocolHysteria2:
-			inbound.Protocol = req.Protocol
-		default:
+		if _, ok := protocols.Get(req.Protocol); !ok {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"success": false,
 				"error":   "Неподдерживаемый протокол",
 			})
 		}
+		// Fallback прежнего протокола новому не подходит: локальный 127.0.0.1:8443 REALITY
+		// сломал бы handshake ShadowTLS. Без новых значений в запросе действуют умолчания протокола
+		if req.Protocol != inbound.Protocol {
+			inbound.FallbackAddr = ""
+			inbound.FallbackPort = 0
+		}
+		inbound.Protocol = req.Protocol
 	}
 	if req.ListenPort > 0 {
 		inbound.ListenPort = req.ListenPort
@@ -328,12 +412,29 @@ func (h *InboundHandler) Update(c *fiber.Ctx) error {
 	}
 	if req.PrivateKey != "" {
 		inbound.PrivateKey = req.PrivateKey
+		// Новый приватный ключ без публичного - публичный пересчитываем
+		if req.PublicKey == "" {
+			inbound.PublicKey = ""
+		}
 	}
 	if req.PublicKey != "" {
 		inbound.PublicKey = req.PublicKey
 	}
-	if req.ShortID != "" {
+	if req.ShortID != "" && req.ShortID != inbound.ShortID {
 		inbound.ShortID = req.ShortID
+		resetRotation(&inbound)
+	}
+	if req.PerUserShortIDs != nil && *req.PerUserShortIDs != inbound.PerUserShortIDs {
+		// С персональными short_id общий список и плановая ротация не используются
+		inbound.PerUserShortIDs = *req.PerUserShortIDs
+		inbound.RotationIntervalHours = 0
+		resetRotation(&inbound)
+	}
+	if req.ServerNames != nil {
+		inbound.ServerNames = req.ServerNames
+	}
+	if req.SNIRelayPort > 0 {
+		inbound.SNIRelayPort = req.SNIRelayPort
 	}
 	if req.UpMbps > 0 {
 		inbound.UpMbps = req.UpMbps
@@ -341,9 +442,83 @@ func (h *InboundHandler) Update(c *fiber.Ctx) error {
 	if req.DownMbps > 0 {
 		inbound.DownMbps = req.DownMbps
 	}
+	if req.Obfs != nil {
+		inbound.Obfs = *req.Obfs
+	}
+	if req.ObfsPassword != "" {
+		inbound.ObfsPassword = req.ObfsPassword
+	}
+	if req.HopPortStart != nil {
+		inbound.HopPortStart = *req.HopPortStart
+	}
+	if req.HopPortEnd != nil {
+		inbound.HopPortEnd = *req.HopPortEnd
+	}
+	if req.Transport != "" {
+		inbound.Transport = req.Transport
+	}
 	if req.WSPath != "" {
 		inbound.WSPath = req.WSPath
 	}
+	if req.GRPCServiceName != "" {
+		inbound.GRPCServiceName = req.GRPCServiceName
+	}
+	if req.TransportHost != "" {
+		inbound.TransportHost = req.TransportHost
+	}
+	if req.MuxEnabled != nil {
+		inbound.MuxEnabled = *req.MuxEnabled
+	}
+	if req.MuxProtocol != "" {
+		inbound.MuxProtocol = req.MuxProtocol
+	}
+	if req.MuxMaxConnections != nil {
+		inbound.MuxMaxConnections = *req.MuxMaxConnections
+	}
+	if req.MuxPadding != nil {
+		inbound.MuxPadding = *req.MuxPadding
+	}
+	if req.BrutalUpMbps != nil {
+		inbound.BrutalUpMbps = *req.BrutalUpMbps
+	}
+	if req.BrutalDownMbps != nil {
+		inbound.BrutalDownMbps = *req.BrutalDownMbps
+	}
+	if req.AlterID != nil {
+		inbound.AlterID = *req.AlterID
+	}
+	if req.SSMethod != "" && req.SSMethod != inbound.SSMethod {
+		inbound.SSMethod = req.SSMethod
+		// Длина PSK зависит от метода — старый ключ не подойдёт
+		inbound.SSServerKey = ""
+	}
+	if req.SSServerKey != "" {
+		inbound.SSServerKey = req.SSServerKey
+	}
+	if req.WGAddressPool != "" && req.WGAddressPool != inbound.WGAddressPool {
+		// Выданные адреса остались бы вне нового пула
+		var peers int64
+		h.db.Model(&models.WireGuardPeer{}).Where("inbound_id = ?", inbound.ID).Count(&peers)
+		if peers > 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"success": false,
+				"error":   "Пул адресов нельзя менять, пока пользователям выданы адреса",
+			})
+		}
+		inbound.WGAddressPool = req.WGAddressPool
+	}
+	if req.WGMTU != 0 {
+		inbound.WGMTU = req.WGMTU
+	}
+	if req.WGDNS != "" {
+		inbound.WGDNS = req.WGDNS
+	}
+	if req.CongestionControl != "" {
+		inbound.CongestionControl = req.CongestionControl
+	}
+	if req.ALPN != nil {
+		inbound.ALPN = req.ALPN
+	}
 	if req.CertPath != "" {
 		inbound.CertPath = req.CertPath
 	}
@@ -353,10 +528,39 @@ func (h *InboundHandler) Update(c *fiber.Ctx) error {
 	if req.Fingerprint != "" {
 		inbound.Fingerprint = req.Fingerprint
 	}
+	if req.ECHEnabled != nil {
+		inbound.ECHEnabled = *req.ECHEnabled
+	}
+	if req.ECHPublicName != nil {
+		inbound.ECHPublicName = *req.ECHPublicName
+	}
 	if req.Enabled != nil {
 		inbound.Enabled = *req.Enabled
 	}
 
+	if err := prepareInbound(&inbound); err != nil {
+		return err
+	}
+
+	var node models.Node
+	if err := h.db.First(&node, inbound.NodeID).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения ноды",
+		})
+	}
+	conflicts, err := h.portConflicts(&node, &inbound)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success":   false,
+			"error":     "Конфликт портов: " + conflicts[0].Error(),
+			"conflicts": conflicts,
+		})
+	}
+
 	if err := h.db.Save(&inbound).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"success": false,
@@ -395,8 +599,9 @@ func (h *InboundHandler) Delete(c *fiber.Ctx) error {
 		})
 	}
 
-	// Удаляем связи с пользователями
+	// Удаляем связи с пользователями и выданные адреса WireGuard
 	h.db.Model(&inbound).Association("Users").Clear()
+	h.db.Where("inbound_id = ?", inbound.ID).Delete(&models.WireGuardPeer{})
 
 	// Удаляем инбаунд (soft delete)
 	if err := h.db.Delete(&inbound).Error; err != nil {
@@ -445,25 +650,20 @@ func (h *InboundHandler) GenerateKeys(c *fiber.Ctx) error {
 		})
 	}
 
-	// Пытаемся сгенерировать ключи через агент на ноде
-	keys, err := h.nodeClient.GenerateKeys(&inbound.Node)
+	// Ключи генерируются в панели — агент ноды для этого не нужен
+	keys, shortID, err := protocols.GenerateRealityKeys()
 	if err != nil {
-		// Если агент недоступен, генерируем short_id локально
-		// Примечание: для полноценной генерации REALITY ключей нужен sing-box
-		shortID, _ := generateShortID()
-		return c.JSON(fiber.Map{
-			"success": true,
-			"data": fiber.Map{
-				"short_id": shortID,
-			},
-			"message": "Агент недоступен. Сгенерирован только short_id. Для генерации REALITY ключей используйте sing-box на ноде.",
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка генерации ключей",
 		})
 	}
 
 	// Обновляем инбаунд с новыми ключами
 	inbound.PrivateKey = keys.PrivateKey
 	inbound.PublicKey = keys.PublicKey
-	inbound.ShortID = keys.ShortID
+	inbound.ShortID = shortID
+	resetRotation(&inbound)
 
 	if err := h.db.Save(&inbound).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -477,19 +677,220 @@ func (h *InboundHandler) GenerateKeys(c *fiber.Ctx) error {
 		"data": fiber.Map{
 			"private_key": keys.PrivateKey,
 			"public_key":  keys.PublicKey,
-			"short_id":    keys.ShortID,
+			"short_id":    shortID,
 		},
-		"message": "Ключи успешно сгенерированы и сохранены",
+		"message": "Ключи успешно сгенерированы и сохранены. Синхронизируйте ноду, чтобы применить их",
+	})
+}
+
+// portConflicts проверяет порт инбаунда и ищет конфликты с остальными инбаундами ноды.
+// Ошибки оформляются через customErrorHandler
+func (h *InboundHandler) portConflicts(node *models.Node, inbound *models.Inbound) ([]services.PortConflict, error) {
+	if inbound.ListenPort < 1 || inbound.ListenPort > 65535 {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Порт должен быть в диапазоне 1-65535")
+	}
+
+	var others []models.Inbound
+	if err := h.db.Where("node_id = ?", node.ID).Find(&others).Error; err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Ошибка получения инбаундов")
+	}
+
+	return services.FindPortConflicts(node, inbound, others), nil
+}
+
+// SetRotationPolicy - PUT /api/inbounds/:id/rotation
+// Настройка плановой ротации REALITY short_id (и, опционально, ключей)
+func (h *InboundHandler) SetRotationPolicy(c *fiber.Ctx) error {
+	inbound, err := h.findRealityInbound(c)
+	if err != nil {
+		return err
+	}
+
+	var req RotationPolicyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный формат запроса",
+		})
+	}
+
+	// Сервер принимает только один private_key: сменить keypair без обрыва клиентов
+	// со старым public_key нельзя, поэтому ротация ключей не поддерживается
+	if req.RotateKeys != nil && *req.RotateKeys {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ротация keypair не поддерживается: сервер принимает только один ключ. Ротируется только short_id",
+		})
+	}
+
+	if req.IntervalHours < 0 || req.GraceHours < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Интервалы не могут быть отрицательными",
+		})
+	}
+
+	graceHours := req.GraceHours
+	if graceHours == 0 {
+		graceHours = inbound.RotationGraceHours
+	}
+	// Старый short_id должен уйти раньше, чем начнётся следующая ротация
+	if req.IntervalHours > 0 && graceHours >= req.IntervalHours {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Grace-период должен быть короче интервала ротации",
+		})
+	}
+
+	inbound.RotationIntervalHours = req.IntervalHours
+	inbound.RotationGraceHours = graceHours
+
+	if err := h.db.Save(inbound).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка сохранения политики ротации",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    inbound,
+	})
+}
+
+// Rotate - POST /api/inbounds/:id/rotate
+// Внеплановая ротация: новый short_id сразу добавляется на сервер
+func (h *InboundHandler) Rotate(c *fiber.Ctx) error {
+	inbound, err := h.findRealityInbound(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.rotator.RotateNow(inbound); err != nil {
+		if errors.Is(err, services.ErrRotationInProgress) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"success": false,
+				"error":   "Ротация уже идёт (фаза " + inbound.RotationPhase + ")",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка ротации: " + err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    inbound,
+		"message": "Новый short_id добавлен, нода синхронизируется",
 	})
 }
 
-// generateShortID генерирует случайный short_id для REALITY
-func generateShortID() (string, error) {
-	bytes := make([]byte, 8)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
+// findRealityInbound загружает REALITY инбаунд по :id. Ошибки оформляются через customErrorHandler
+func (h *InboundHandler) findRealityInbound(c *fiber.Ctx) (*models.Inbound, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Неверный ID инбаунда")
+	}
+
+	var inbound models.Inbound
+	if err := h.db.First(&inbound, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, fiber.NewError(fiber.StatusNotFound, "Инбаунд не найден")
+		}
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Ошибка получения инбаунда")
+	}
+
+	if inbound.Protocol != models.ProtocolReality {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Ротация доступна только для REALITY протокола")
+	}
+	if inbound.PerUserShortIDs {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "У инбаунда персональные short_id: чтобы выдать пользователю новый, сбросьте его UUID")
+	}
+
+	return &inbound, nil
+}
+
+// resetRotation сбрасывает незавершённую ротацию, когда short_id меняют вручную
+func resetRotation(inbound *models.Inbound) {
+	inbound.ShortIDs = nil
+	inbound.RotationPhase = models.RotationPhaseIdle
+	inbound.RotationNextShortID = ""
+	inbound.RotationGraceUntil = nil
+}
+
+// prepareInbound применяет значения по умолчанию протокола и проверяет настройки.
+// Ошибки оформляются через customErrorHandler
+func prepareInbound(inbound *models.Inbound) error {
+	err := protocols.Prepare(inbound)
+	if err == nil {
+		return nil
 	}
-	return hex.EncodeToString(bytes)[:8], nil
+
+	var invalid protocols.ValidationError
+	if errors.As(err, &invalid) {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return fiber.NewError(fiber.StatusInternalServerError, "Ошибка подготовки инбаунда: "+err.Error())
+}
+
+// ECH - GET /api/inbounds/:id/ech
+// ECHConfig инбаунда и HTTPS запись для DNS зоны его домена
+func (h *InboundHandler) ECH(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный ID инбаунда",
+		})
+	}
+
+	var inbound models.Inbound
+	if err := h.db.First(&inbound, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "Инбаунд не найден",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения инбаунда",
+		})
+	}
+
+	if !inbound.ECHEnabled || inbound.ECHConfig == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "ECH для инбаунда не включён",
+		})
+	}
+
+	record, err := protocols.ECHDNSRecord(&inbound)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data": fiber.Map{
+			"public_name": inbound.ECHOuterName(),
+			"config":      inbound.ECHConfig,
+			"dns_record":  record,
+		},
+	})
+}
+
+// Protocols - GET /api/protocols
+// Описание протоколов и их полей для UI
+func (h *InboundHandler) Protocols(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    protocols.Specs(),
+	})
 }
 
 // List - GET /api/inbounds
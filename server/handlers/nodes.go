@@ -1,12 +1,16 @@
 package handlers
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"log"
 	"strconv"
+	"strings"
+	"time"
 
 	"zen-admin/models"
 	"zen-admin/services"
-	"zen-admin/singbox"
 
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
@@ -14,17 +18,19 @@ import (
 
 // NodeHandler обрабатывает запросы для VPN нод
 type NodeHandler struct {
-	db          *gorm.DB
-	nodeClient  *services.NodeClient
-	templateGen *singbox.TemplateGenerator
+	db         *gorm.DB
+	nodeClient *services.NodeClient
+	syncer     *services.NodeSyncer
+	chain      *services.NodeChain
 }
 
 // NewNodeHandler создаёт новый обработчик нод
 func NewNodeHandler(db *gorm.DB) *NodeHandler {
 	return &NodeHandler{
-		db:          db,
-		nodeClient:  services.NewNodeClient(),
-		templateGen: singbox.NewTemplateGenerator(),
+		db:         db,
+		nodeClient: services.NewNodeClient(),
+		syncer:     services.NewNodeSyncer(db),
+		chain:      services.NewNodeChain(db),
 	}
 }
 
@@ -46,6 +52,19 @@ type UpdateNodeRequest struct {
 	Enabled  *bool  `json:"enabled"`
 }
 
+// SetUpstreamRequest - запрос на назначение вышестоящей ноды (null - трафик уходит напрямую).
+// ChainPort и ChainSNI задают служебный инбаунд на вышестоящей ноде
+type SetUpstreamRequest struct {
+	UpstreamNodeID *uint  `json:"upstream_node_id"`
+	ChainPort      int    `json:"chain_port"`
+	ChainSNI       string `json:"chain_sni"`
+}
+
+// MaintenanceRequest - запрос на перевод ноды в режим обслуживания
+type MaintenanceRequest struct {
+	GraceMinutes int `json:"grace_minutes"`
+}
+
 // List - GET /api/nodes
 // Список всех нод
 func (h *NodeHandler) List(c *fiber.Ctx) error {
@@ -219,6 +238,7 @@ func (h *NodeHandler) Update(c *fiber.Ctx) error {
 	}
 
 	// Обновляем поля
+	addressChanged := req.Address != "" && req.Address != node.Address
 	if req.Name != "" {
 		node.Name = req.Name
 	}
@@ -242,6 +262,11 @@ func (h *NodeHandler) Update(c *fiber.Ctx) error {
 		})
 	}
 
+	// Ноды-входы подключаются к выходу по адресу — обновляем их конфиг
+	if addressChanged && node.IsChainExit() {
+		h.chain.ResyncEntries(&node)
+	}
+
 	return c.JSON(fiber.Map{
 		"success": true,
 		"data":    node,
@@ -273,6 +298,25 @@ func (h *NodeHandler) Delete(c *fiber.Ctx) error {
 		})
 	}
 
+	// Нода-выход нужна своим входам: без неё они останутся без связи
+	entries, err := h.chain.Entries(&node)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения нод-входов",
+		})
+	}
+	if len(entries) > 0 {
+		names := make([]string, len(entries))
+		for i, entry := range entries {
+			names[i] = entry.Name
+		}
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"error":   "Нода используется как выход для: " + strings.Join(names, ", "),
+		})
+	}
+
 	// Удаляем ноду (soft delete, каскадно удалит инбаунды)
 	if err := h.db.Delete(&node).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -339,7 +383,7 @@ func (h *NodeHandler) Sync(c *fiber.Ctx) error {
 	}
 
 	var node models.Node
-	if err := h.db.Preload("Inbounds").First(&node, id).Error; err != nil {
+	if err := h.db.First(&node, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 				"success": false,
@@ -352,25 +396,16 @@ func (h *NodeHandler) Sync(c *fiber.Ctx) error {
 		})
 	}
 
-	// Собираем пользователей для каждого инбаунда
-	usersByInbound := make(map[uint][]models.User)
-	for _, inbound := range node.Inbounds {
-		var users []models.User
-		h.db.Model(&inbound).Association("Users").Find(&users)
-		usersByInbound[inbound.ID] = users
-	}
-
-	// Генерируем серверный конфиг
-	config, err := h.templateGen.GenerateServerConfig(node.Inbounds, usersByInbound)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Ошибка генерации конфига",
-		})
-	}
-
-	// Отправляем конфиг на ноду
-	if err := h.nodeClient.PushConfig(&node, config); err != nil {
+	// Генерируем серверный конфиг и отправляем на ноду
+	if err := h.syncer.PushConfig(&node); err != nil {
+		var conflictsErr *services.PortConflictsError
+		if errors.As(err, &conflictsErr) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"success":   false,
+				"error":     "Конфликт портов: " + conflictsErr.Conflicts[0].Error(),
+				"conflicts": conflictsErr.Conflicts,
+			})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"success": false,
 			"error":   "Ошибка отправки конфига: " + err.Error(),
@@ -432,3 +467,475 @@ func (h *NodeHandler) GetAllStatuses(c *fiber.Ctx) error {
 		"data":    results,
 	})
 }
+
+// EnterMaintenance - POST /api/nodes/:id/maintenance
+// Перевод ноды в режим обслуживания: нода убирается из клиентских конфигов и подписок,
+// серверный конфиг остаётся активным на время grace-периода
+func (h *NodeHandler) EnterMaintenance(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный ID ноды",
+		})
+	}
+
+	var node models.Node
+	if err := h.db.First(&node, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "Нода не найдена",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения ноды",
+		})
+	}
+
+	var req MaintenanceRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "Неверный формат запроса",
+			})
+		}
+	}
+
+	if req.GraceMinutes < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Grace-период не может быть отрицательным",
+		})
+	}
+
+	// Повторный вызов не сбрасывает время начала обслуживания
+	if !node.Maintenance {
+		now := time.Now()
+		node.Maintenance = true
+		node.MaintenanceSince = &now
+	}
+	if req.GraceMinutes > 0 {
+		node.DrainGraceMinutes = req.GraceMinutes
+	}
+	if node.DrainGraceMinutes == 0 {
+		node.DrainGraceMinutes = 60
+	}
+
+	if err := h.db.Save(&node).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка обновления ноды",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    node,
+		"message": "Нода переведена в режим обслуживания. Клиенты уйдут с неё при следующем обновлении подписки",
+	})
+}
+
+// ExitMaintenance - DELETE /api/nodes/:id/maintenance
+// Вывод ноды из режима обслуживания
+func (h *NodeHandler) ExitMaintenance(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный ID ноды",
+		})
+	}
+
+	var node models.Node
+	if err := h.db.First(&node, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "Нода не найдена",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения ноды",
+		})
+	}
+
+	node.Maintenance = false
+	node.MaintenanceSince = nil
+
+	if err := h.db.Save(&node).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка обновления ноды",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    node,
+		"message": "Нода выведена из режима обслуживания",
+	})
+}
+
+// GetDrainStatus - GET /api/nodes/:id/drain
+// Прогресс освобождения ноды: сколько соединений ещё осталось и истёк ли grace-период
+func (h *NodeHandler) GetDrainStatus(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный ID ноды",
+		})
+	}
+
+	var node models.Node
+	if err := h.db.First(&node, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "Нода не найдена",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения ноды",
+		})
+	}
+
+	if !node.Maintenance {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Нода не находится в режиме обслуживания",
+		})
+	}
+
+	deadline := node.DrainDeadline()
+	graceExpired := deadline != nil && time.Now().After(*deadline)
+
+	result := fiber.Map{
+		"node_id":           node.ID,
+		"maintenance_since": node.MaintenanceSince,
+		"grace_until":       deadline,
+		"grace_expired":     graceExpired,
+		"agent_online":      false,
+		"clash_api_online":  false,
+		"drained":           false,
+	}
+
+	// Количество соединений неизвестно - считаем ноду неосвобождённой.
+	// Агент мог ответить, но не достучаться до Clash API sing-box
+	conns, err := h.nodeClient.GetConnections(&node)
+	if err != nil {
+		log.Printf("Drain: ошибка получения соединений с ноды %s: %v", node.Name, err)
+		result["agent_online"] = errors.Is(err, services.ErrClashAPIUnavailable)
+		return c.JSON(fiber.Map{
+			"success": true,
+			"data":    result,
+		})
+	}
+
+	result["agent_online"] = true
+	result["clash_api_online"] = true
+	result["active_connections"] = conns.Total
+	result["connections_by_inbound"] = conns.Inbounds
+	result["drained"] = conns.Total == 0
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    result,
+	})
+}
+
+// Интервал SSE комментариев, по которым замечаем отключение клиента
+const logsHeartbeatInterval = 15 * time.Second
+
+// StreamLogs - GET /api/nodes/:id/logs
+// Поток логов sing-box с ноды в формате Server-Sent Events
+// Query params: tail=100, follow=true|false, level=trace|debug|info|warn|error
+func (h *NodeHandler) StreamLogs(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный ID ноды",
+		})
+	}
+
+	var node models.Node
+	if err := h.db.First(&node, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "Нода не найдена",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения ноды",
+		})
+	}
+
+	tail, err := strconv.Atoi(c.Query("tail", "100"))
+	if err != nil || tail < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверное значение tail",
+		})
+	}
+
+	level := strings.ToLower(c.Query("level"))
+	switch level {
+	case "", "trace", "debug", "info", "warn", "error", "fatal", "panic":
+		// OK
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный уровень логов. Используйте: trace, debug, info, warn, error",
+		})
+	}
+
+	logs, err := h.nodeClient.StreamLogs(&node, services.LogOptions{
+		Tail:   tail,
+		Follow: c.QueryBool("follow", false),
+		Level:  level,
+	})
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения логов: " + err.Error(),
+		})
+	}
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	// Отключаем буферизацию в nginx, иначе строки приходят пачками
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		// Закрытие потока с ноды завершает и горутину чтения
+		defer logs.Close()
+
+		lines := make(chan string)
+		done := make(chan struct{})
+		defer close(done)
+
+		var scanErr error
+		go func() {
+			defer close(lines)
+			scanner := bufio.NewScanner(logs)
+			scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+			for scanner.Scan() {
+				select {
+				case lines <- scanner.Text():
+				case <-done:
+					return
+				}
+			}
+			scanErr = scanner.Err()
+		}()
+
+		// На тихой ноде строк может не быть долго: без heartbeat отключение клиента
+		// не заметить, и поток с ноды при follow=true висел бы бесконечно
+		heartbeat := time.NewTicker(logsHeartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					if scanErr != nil {
+						log.Printf("Logs: ошибка чтения логов с ноды %s: %v", node.Name, scanErr)
+						fmt.Fprintf(w, "event: error\ndata: %s\n\n", scanErr.Error())
+					}
+					fmt.Fprint(w, "event: end\ndata: \n\n")
+					w.Flush()
+					return
+				}
+				fmt.Fprintf(w, "data: %s\n\n", line)
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+			}
+
+			// Ошибка flush означает, что клиент отключился — закрываем поток с ноды
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+// GetPortMap - GET /api/nodes/:id/ports
+// Карта портов ноды: служебные порты и порты включённых инбаундов, плюс найденные конфликты
+func (h *NodeHandler) GetPortMap(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный ID ноды",
+		})
+	}
+
+	var node models.Node
+	if err := h.db.Preload("Inbounds").First(&node, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "Нода не найдена",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения ноды",
+		})
+	}
+
+	conflicts := services.FindNodeConflicts(&node, node.Inbounds)
+	if conflicts == nil {
+		conflicts = []services.PortConflict{}
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data": fiber.Map{
+			"node_id":   node.ID,
+			"ports":     services.BuildPortMap(&node, node.Inbounds),
+			"conflicts": conflicts,
+		},
+	})
+}
+
+// GetChain - GET /api/nodes/:id/chain
+// Цепочка ноды: путь от неё до конечного выхода и ноды-входы, для которых она вышестоящая
+func (h *NodeHandler) GetChain(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный ID ноды",
+		})
+	}
+
+	var node models.Node
+	if err := h.db.First(&node, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "Нода не найдена",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения ноды",
+		})
+	}
+
+	path, err := h.chain.Path(&node)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка построения цепочки: " + err.Error(),
+		})
+	}
+
+	entries, err := h.chain.Entries(&node)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения нод-входов",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data": fiber.Map{
+			"node_id": node.ID,
+			"path":    path,
+			"entries": entries,
+		},
+	})
+}
+
+// SetUpstream - PUT /api/nodes/:id/upstream
+// Назначение вышестоящей ноды: весь трафик клиентов ноды уходит через неё
+func (h *NodeHandler) SetUpstream(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный ID ноды",
+		})
+	}
+
+	var node models.Node
+	if err := h.db.First(&node, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "Нода не найдена",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения ноды",
+		})
+	}
+
+	var req SetUpstreamRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный формат запроса",
+		})
+	}
+
+	if req.ChainPort < 0 || req.ChainPort > 65535 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Порт цепочки должен быть в диапазоне 1-65535",
+		})
+	}
+
+	settings := services.ChainExitSettings{Port: req.ChainPort, SNI: req.ChainSNI}
+	if err := h.chain.SetUpstream(&node, req.UpstreamNodeID, settings); err != nil {
+		var conflictsErr *services.PortConflictsError
+		switch {
+		case errors.As(err, &conflictsErr):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"success":   false,
+				"error":     "Конфликт портов: " + conflictsErr.Conflicts[0].Error(),
+				"conflicts": conflictsErr.Conflicts,
+			})
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "Вышестоящая нода не найдена",
+			})
+		case errors.Is(err, services.ErrChainSelf), errors.Is(err, services.ErrChainCycle), errors.Is(err, services.ErrChainExitDisabled):
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка настройки цепочки: " + err.Error(),
+		})
+	}
+
+	message := "Нода переключена на прямой выход, конфиги синхронизируются"
+	if req.UpstreamNodeID != nil {
+		message = "Вышестоящая нода назначена, конфиги синхронизируются"
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": message,
+		"data":    node,
+	})
+}
@@ -16,19 +16,23 @@ import (
 
 // PublicHandler обрабатывает публичные страницы для юзеров
 type PublicHandler struct {
-	db          *gorm.DB
-	configGen   *services.ConfigGenerator
-	publicURL   string
-	subPassword string
+	db           *gorm.DB
+	configGen    *services.ConfigGenerator
+	publicURL    string
+	subPassword  string
+	profileTitle string
+	supportURL   string
 }
 
 // NewPublicHandler создаёт новый обработчик
 func NewPublicHandler(db *gorm.DB) *PublicHandler {
 	return &PublicHandler{
-		db:          db,
-		configGen:   services.NewConfigGenerator(),
-		publicURL:   os.Getenv("PUBLIC_URL"),
-		subPassword: os.Getenv("SUB_PASSWORD"),
+		db:           db,
+		configGen:    services.NewConfigGenerator(),
+		publicURL:    os.Getenv("PUBLIC_URL"),
+		subPassword:  os.Getenv("SUB_PASSWORD"),
+		profileTitle: os.Getenv("SUB_PROFILE_TITLE"),
+		supportURL:   os.Getenv("SUPPORT_URL"),
 	}
 }
 
@@ -42,8 +46,13 @@ func (h *PublicHandler) checkSubPassword(c *fiber.Ctx) bool {
 }
 
 // UserConfigPage - GET /sub/:uuid
-// Публичная страница с конфигом пользователя (замаскирована под буддизм)
+// Публичная страница с конфигом пользователя (замаскирована под буддизм).
+// Приложениям по этой же ссылке отдаётся подписка
 func (h *PublicHandler) UserConfigPage(c *fiber.Ctx) error {
+	if isSubscriptionRequest(c) {
+		return h.RawSubscription(c)
+	}
+
 	userUUID := c.Params("uuid")
 	if userUUID == "" {
 		return c.Status(fiber.StatusNotFound).SendString("Page not found")
@@ -223,7 +232,7 @@ func (h *PublicHandler) renderConfigPage(c *fiber.Ctx, user *models.User, userUU
 
 	var inbounds []InboundData
 	for _, inbound := range user.Inbounds {
-		if !inbound.Enabled {
+		if !inbound.ClientVisible() {
 			continue
 		}
 
@@ -553,35 +562,27 @@ func (h *PublicHandler) renderConfigPage(c *fiber.Ctx, user *models.User, userUU
 }
 
 // RawSubscription - GET /sub/:uuid/raw
-// Raw subscription для импорта в приложения (защищён паролем)
+// Подписка для приложений: формат выбирается по User-Agent или ?format=
 func (h *PublicHandler) RawSubscription(c *fiber.Ctx) error {
-	if !h.checkSubPassword(c) {
-		return c.Status(fiber.StatusForbidden).SendString("Access denied")
-	}
-
-	userUUID := c.Params("uuid")
-	if userUUID == "" {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid request")
-	}
-
-	var user models.User
-	if err := h.db.Preload("Inbounds.Node").Where("uuid = ?", userUUID).First(&user).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).SendString("Not found")
-	}
+	return h.sendSubscription(c, h.negotiateFormat(c))
+}
 
-	if !user.Enabled {
-		return c.Status(fiber.StatusForbidden).SendString("Disabled")
-	}
+// SIP008Subscription - GET /sub/:uuid/sip008
+// Shadowsocks подписка в формате SIP008 для Outline (ssconf://) и совместимых клиентов
+func (h *PublicHandler) SIP008Subscription(c *fiber.Ctx) error {
+	return h.sendSubscription(c, SubFormatSIP008)
+}
 
-	subscription, err := h.configGen.GenerateSubscription(&user, user.Inbounds)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Error")
-	}
+// ClashSubscription - GET /sub/:uuid/clash
+// Подписка в формате Clash/Mihomo YAML (Clash Verge, FlClash и т.п.)
+func (h *PublicHandler) ClashSubscription(c *fiber.Ctx) error {
+	return h.sendSubscription(c, SubFormatClash)
+}
 
-	c.Set("Content-Type", "text/plain; charset=utf-8")
-	c.Set("Profile-Update-Interval", "12")
-	c.Set("Subscription-Userinfo", fmt.Sprintf("upload=0; download=%d; total=%d", user.DataUsed, user.DataLimit))
-	return c.SendString(subscription)
+// XraySubscription - GET /sub/:uuid/xray
+// Подписка Xray-core JSON: массив конфигов, по одному на сервер (v2rayNG, v2rayN)
+func (h *PublicHandler) XraySubscription(c *fiber.Ctx) error {
+	return h.sendSubscription(c, SubFormatXray)
 }
 
 func formatBytes(bytes int64) string {
@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"zen-admin/models"
+	"zen-admin/services"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// RoutingHandler обрабатывает серверные политики маршрутизации
+type RoutingHandler struct {
+	db     *gorm.DB
+	syncer *services.NodeSyncer
+}
+
+// NewRoutingHandler создаёт новый обработчик политик маршрутизации
+func NewRoutingHandler(db *gorm.DB) *RoutingHandler {
+	return &RoutingHandler{
+		db:     db,
+		syncer: services.NewNodeSyncer(db),
+	}
+}
+
+// RoutingPolicyRequest - запрос на создание/обновление политики (правила заменяются целиком)
+type RoutingPolicyRequest struct {
+	Name        string                  `json:"name"`
+	Description string                  `json:"description"`
+	Rules       []models.RoutingRule    `json:"rules"`
+	RuleSets    []models.RoutingRuleSet `json:"rule_sets"`
+	Egresses    []models.RoutingEgress  `json:"egresses"`
+}
+
+// AssignRoutingPolicyRequest - запрос на назначение политики ноде (null - без политики)
+type AssignRoutingPolicyRequest struct {
+	PolicyID *uint `json:"policy_id"`
+}
+
+// RoutingPolicyResponse - политика с нодами, которые её используют
+type RoutingPolicyResponse struct {
+	models.RoutingPolicy
+	NodeIDs []uint `json:"node_ids"`
+}
+
+// List - GET /api/routing/policies
+func (h *RoutingHandler) List(c *fiber.Ctx) error {
+	var policies []models.RoutingPolicy
+	if err := h.db.Order("name").Find(&policies).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения политик",
+		})
+	}
+
+	response := make([]RoutingPolicyResponse, len(policies))
+	for i := range policies {
+		response[i] = h.toResponse(&policies[i])
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    response,
+	})
+}
+
+// Get - GET /api/routing/policies/:id
+func (h *RoutingHandler) Get(c *fiber.Ctx) error {
+	policy, err := h.findPolicy(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    h.toResponse(policy),
+	})
+}
+
+// Create - POST /api/routing/policies
+func (h *RoutingHandler) Create(c *fiber.Ctx) error {
+	var req RoutingPolicyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный формат запроса",
+		})
+	}
+
+	policy := models.RoutingPolicy{
+		Name:        strings.TrimSpace(req.Name),
+		Description: req.Description,
+		Rules:       req.Rules,
+		RuleSets:    req.RuleSets,
+		Egresses:    req.Egresses,
+	}
+
+	if err := services.ValidateRoutingPolicy(&policy); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Некорректная политика: " + err.Error(),
+		})
+	}
+
+	var count int64
+	h.db.Model(&models.RoutingPolicy{}).Where("name = ?", policy.Name).Count(&count)
+	if count > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"error":   "Политика с таким названием уже существует",
+		})
+	}
+
+	if err := h.db.Create(&policy).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка создания политики",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"success": true,
+		"data":    h.toResponse(&policy),
+	})
+}
+
+// Update - PUT /api/routing/policies/:id
+// Обновление политики; ноды с этой политикой синхронизируются в фоне
+func (h *RoutingHandler) Update(c *fiber.Ctx) error {
+	policy, err := h.findPolicy(c)
+	if err != nil {
+		return err
+	}
+
+	var req RoutingPolicyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный формат запроса",
+		})
+	}
+
+	if name := strings.TrimSpace(req.Name); name != "" {
+		policy.Name = name
+	}
+	policy.Description = req.Description
+	policy.Rules = req.Rules
+	policy.RuleSets = req.RuleSets
+	policy.Egresses = req.Egresses
+
+	if err := services.ValidateRoutingPolicy(policy); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Некорректная политика: " + err.Error(),
+		})
+	}
+
+	var count int64
+	h.db.Model(&models.RoutingPolicy{}).Where("name = ? AND id <> ?", policy.Name, policy.ID).Count(&count)
+	if count > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"error":   "Политика с таким названием уже существует",
+		})
+	}
+
+	if err := h.db.Save(policy).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка обновления политики",
+		})
+	}
+
+	go h.syncPolicyNodes(policy.ID)
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    h.toResponse(policy),
+	})
+}
+
+// Delete - DELETE /api/routing/policies/:id
+func (h *RoutingHandler) Delete(c *fiber.Ctx) error {
+	policy, err := h.findPolicy(c)
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	h.db.Model(&models.Node{}).Where("routing_policy_id = ?", policy.ID).Count(&count)
+	if count > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"error":   "Политика назначена нодам",
+		})
+	}
+
+	if err := h.db.Delete(policy).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка удаления политики",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Политика удалена",
+	})
+}
+
+// AssignNode - PUT /api/nodes/:id/routing
+// Назначение ноде политики маршрутизации
+func (h *RoutingHandler) AssignNode(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный ID ноды",
+		})
+	}
+
+	var node models.Node
+	if err := h.db.First(&node, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "Нода не найдена",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка получения ноды",
+		})
+	}
+
+	var req AssignRoutingPolicyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Неверный формат запроса",
+		})
+	}
+
+	if req.PolicyID != nil {
+		var count int64
+		h.db.Model(&models.RoutingPolicy{}).Where("id = ?", *req.PolicyID).Count(&count)
+		if count == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "Политика не найдена",
+			})
+		}
+	}
+
+	node.RoutingPolicyID = req.PolicyID
+	if err := h.db.Model(&models.Node{}).Where("id = ?", node.ID).Update("routing_policy_id", req.PolicyID).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "Ошибка обновления ноды",
+		})
+	}
+
+	if node.Enabled {
+		go h.syncNode(&node)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Политика назначена, конфиг ноды синхронизируется",
+		"data":    node,
+	})
+}
+
+// syncPolicyNodes синхронизирует включённые ноды с политикой
+func (h *RoutingHandler) syncPolicyNodes(policyID uint) {
+	var nodes []models.Node
+	if err := h.db.Where("routing_policy_id = ? AND enabled = ?", policyID, true).Find(&nodes).Error; err != nil {
+		log.Printf("Routing: ошибка получения нод политики %d: %v", policyID, err)
+		return
+	}
+	for i := range nodes {
+		h.syncNode(&nodes[i])
+	}
+}
+
+// syncNode отправляет конфиг и перезапускает sing-box на ноде
+func (h *RoutingHandler) syncNode(node *models.Node) {
+	if err := h.syncer.Sync(node); err != nil {
+		log.Printf("Routing: ошибка синхронизации ноды %s: %v", node.Name, err)
+		return
+	}
+	log.Printf("Routing: конфиг ноды %s синхронизирован", node.Name)
+}
+
+// toResponse добавляет к политике список нод и заменяет nil на пустые списки
+func (h *RoutingHandler) toResponse(policy *models.RoutingPolicy) RoutingPolicyResponse {
+	if policy.Rules == nil {
+		policy.Rules = []models.RoutingRule{}
+	}
+	if policy.RuleSets == nil {
+		policy.RuleSets = []models.RoutingRuleSet{}
+	}
+	if policy.Egresses == nil {
+		policy.Egresses = []models.RoutingEgress{}
+	}
+
+	nodeIDs := []uint{}
+	h.db.Model(&models.Node{}).Where("routing_policy_id = ?", policy.ID).Order("id").Pluck("id", &nodeIDs)
+
+	return RoutingPolicyResponse{RoutingPolicy: *policy, NodeIDs: nodeIDs}
+}
+
+// findPolicy загружает политику по :id
+func (h *RoutingHandler) findPolicy(c *fiber.Ctx) (*models.RoutingPolicy, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Неверный ID политики")
+	}
+
+	var policy models.RoutingPolicy
+	if err := h.db.First(&policy, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, fiber.NewError(fiber.StatusNotFound, "Политика не найдена")
+		}
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Ошибка получения политики")
+	}
+	return &policy, nil
+}
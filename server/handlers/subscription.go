@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"zen-admin/models"
+	"zen-admin/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Форматы подписки (?format=)
+const (
+	SubFormatBase64  = "base64"  // Share ссылки в base64
+	SubFormatSingbox = "singbox" // JSON конфиг sing-box
+	SubFormatClash   = "clash"   // YAML Clash/Mihomo
+	SubFormatXray    = "xray"    // JSON массив конфигов Xray-core
+	SubFormatSIP008  = "sip008"  // SIP008 для Outline
+)
+
+// subscriptionClients - маркеры User-Agent клиентов (в нижнем регистре) и их формат.
+// Порядок важен: Hiddify присылает "HiddifyNext/... like ClashMeta v2ray sing-box"
+var subscriptionClients = []struct {
+	marker string
+	format string
+}{
+	{"hiddify", SubFormatSingbox},
+	{"clash", SubFormatClash}, // Clash.Meta, Clash Verge, FlClash, ClashX
+	{"mihomo", SubFormatClash},
+	{"stash", SubFormatClash},
+	{"sing-box", SubFormatSingbox}, // SFA, SFI, SFM присылают "sing-box <версия>"
+	// Приложения Xray и iOS клиенты понимают ссылки всех протоколов, в т.ч. Hysteria2,
+	// которого нет в Xray JSON
+	{"v2rayng", SubFormatBase64},
+	{"v2rayn", SubFormatBase64},
+	{"streisand", SubFormatBase64},
+	{"shadowrocket", SubFormatBase64},
+}
+
+// detectSubscriptionFormat определяет формат по User-Agent, ok=false - клиент неизвестен
+func detectSubscriptionFormat(userAgent string) (string, bool) {
+	ua := strings.ToLower(userAgent)
+	for _, client := range subscriptionClients {
+		if strings.Contains(ua, client.marker) {
+			return client.format, true
+		}
+	}
+	return SubFormatBase64, false
+}
+
+// isSubscriptionRequest - запрос от приложения (известный User-Agent или явный ?format=), а не из браузера
+func isSubscriptionRequest(c *fiber.Ctx) bool {
+	if c.Query("format") != "" {
+		return true
+	}
+	_, ok := detectSubscriptionFormat(c.Get(fiber.HeaderUserAgent))
+	return ok
+}
+
+// negotiateFormat выбирает формат подписки: ?format= важнее User-Agent
+func (h *PublicHandler) negotiateFormat(c *fiber.Ctx) string {
+	if format := c.Query("format"); format != "" {
+		return format
+	}
+	format, _ := detectSubscriptionFormat(c.Get(fiber.HeaderUserAgent))
+	return format
+}
+
+// negotiateSingboxProfile подбирает профиль sing-box по User-Agent; ?platform= и ?version= важнее
+func negotiateSingboxProfile(c *fiber.Ctx) (services.SingboxProfile, error) {
+	detected := services.SingboxProfileFromUserAgent(c.Get(fiber.HeaderUserAgent))
+	platform := c.Query("platform", detected.Platform)
+	version := c.Query("version", detected.Version)
+	return services.ParseSingboxProfile(platform, version)
+}
+
+// sendSubscription отдаёт подписку пользователя в заданном формате
+func (h *PublicHandler) sendSubscription(c *fiber.Ctx, format string) error {
+	if !h.checkSubPassword(c) {
+		return c.Status(fiber.StatusForbidden).SendString("Access denied")
+	}
+
+	userUUID := c.Params("uuid")
+	if userUUID == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid request")
+	}
+
+	var user models.User
+	if err := h.db.Preload("Inbounds.Node").Where("uuid = ?", userUUID).First(&user).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Not found")
+	}
+
+	if !user.Enabled {
+		return c.Status(fiber.StatusForbidden).SendString("Disabled")
+	}
+
+	routing, err := services.ClientRoutingFor(h.db, &user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Error")
+	}
+
+	switch format {
+	case SubFormatBase64:
+		subscription, err := h.configGen.GenerateSubscription(&user, user.Inbounds)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString("Error")
+		}
+		h.setSubscriptionHeaders(c, &user)
+		c.Set("Content-Type", "text/plain; charset=utf-8")
+		return c.SendString(subscription)
+
+	case SubFormatSingbox:
+		profile, err := negotiateSingboxProfile(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		config, err := h.configGen.GenerateSingboxConfig(&user, user.Inbounds, profile, routing)
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).SendString("Not found")
+		}
+		data, err := h.configGen.SerializeConfig(config)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString("Error")
+		}
+		h.setSubscriptionHeaders(c, &user)
+		c.Set("Content-Type", "application/json; charset=utf-8")
+		return c.SendString(data)
+
+	case SubFormatClash:
+		config, err := h.configGen.GenerateClashConfig(&user, user.Inbounds, routing)
+		if errors.Is(err, services.ErrUnsupportedClientRouting) {
+			return c.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+		}
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).SendString("Not found")
+		}
+		data, err := h.configGen.SerializeClashConfig(config)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString("Error")
+		}
+		h.setSubscriptionHeaders(c, &user)
+		c.Set("Content-Type", "text/yaml; charset=utf-8")
+		c.Set("Content-Disposition", `attachment; filename="zen.yaml"`)
+		return c.SendString(data)
+
+	case SubFormatXray:
+		configs, err := h.configGen.GenerateXrayConfigs(&user, user.Inbounds, routing)
+		if errors.Is(err, services.ErrUnsupportedClientRouting) {
+			return c.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+		}
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).SendString("Not found")
+		}
+		h.setSubscriptionHeaders(c, &user)
+		return c.JSON(configs)
+
+	case SubFormatSIP008:
+		h.setSubscriptionHeaders(c, &user)
+		return c.JSON(h.configGen.GenerateSIP008(&user, user.Inbounds))
+	}
+
+	return c.Status(fiber.StatusBadRequest).SendString("Unknown format")
+}
+
+// setSubscriptionHeaders выставляет заголовки, которые читают клиенты: трафик и срок,
+// название профиля (base64, чтобы не ломать заголовок не-ASCII символами),
+// интервал обновления в часах и ссылку поддержки
+func (h *PublicHandler) setSubscriptionHeaders(c *fiber.Ctx, user *models.User) {
+	userinfo := fmt.Sprintf("upload=0; download=%d; total=%d", user.DataUsed, user.DataLimit)
+	if user.ExpiresAt != nil {
+		userinfo += fmt.Sprintf("; expire=%d", user.ExpiresAt.Unix())
+	}
+	c.Set("Subscription-Userinfo", userinfo)
+	c.Set("Profile-Update-Interval", "12")
+
+	title := h.profileTitle
+	if title == "" {
+		title = user.Name
+	}
+	c.Set("Profile-Title", "base64:"+base64.StdEncoding.EncodeToString([]byte(title)))
+
+	if h.supportURL != "" {
+		c.Set("Support-URL", h.supportURL)
+	}
+}
@@ -4,11 +4,11 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	"zen-admin/models"
 	"zen-admin/services"
-	"zen-admin/singbox"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
@@ -17,63 +17,35 @@ import (
 
 // UserHandler обрабатывает запросы пользователей VPN
 type UserHandler struct {
-	db          *gorm.DB
-	configGen   *services.ConfigGenerator
-	nodeClient  *services.NodeClient
-	templateGen *singbox.TemplateGenerator
+	db        *gorm.DB
+	configGen *services.ConfigGenerator
+	syncer    *services.NodeSyncer
+	ipam      *services.WireGuardIPAM
 }
 
 // NewUserHandler создаёт новый обработчик пользователей
 func NewUserHandler(db *gorm.DB) *UserHandler {
 	return &UserHandler{
-		db:          db,
-		configGen:   services.NewConfigGenerator(),
-		nodeClient:  services.NewNodeClient(),
-		templateGen: singbox.NewTemplateGenerator(),
+		db:        db,
+		configGen: services.NewConfigGenerator(),
+		syncer:    services.NewNodeSyncer(db),
+		ipam:      services.NewWireGuardIPAM(db),
 	}
 }
 
 // syncAffectedNodes синхронизирует конфиг sing-box на всех нодах,
 // к которым привязаны инбаунды пользователя
 func (h *UserHandler) syncAffectedNodes() {
-	// Получаем все активные ноды с инбаундами
+	// Получаем все активные ноды (инбаунды и цепочку загружает syncer)
 	var nodes []models.Node
-	if err := h.db.Preload("Inbounds").Where("enabled = ?", true).Find(&nodes).Error; err != nil {
+	if err := h.db.Where("enabled = ?", true).Find(&nodes).Error; err != nil {
 		log.Printf("Auto-sync: ошибка получения нод: %v", err)
 		return
 	}
 
 	for _, node := range nodes {
-		usersByInbound := make(map[uint][]models.User)
-		for _, inbound := range node.Inbounds {
-			if !inbound.Enabled {
-				continue
-			}
-			var users []models.User
-			h.db.Model(&inbound).Association("Users").Find(&users)
-			// Фильтруем только включённых юзеров
-			var enabledUsers []models.User
-			for _, u := range users {
-				if u.Enabled {
-					enabledUsers = append(enabledUsers, u)
-				}
-			}
-			usersByInbound[inbound.ID] = enabledUsers
-		}
-
-		config, err := h.templateGen.GenerateServerConfig(node.Inbounds, usersByInbound)
-		if err != nil {
-			log.Printf("Auto-sync: ошибка генерации конфига для ноды %s: %v", node.Name, err)
-			continue
-		}
-
-		if err := h.nodeClient.PushConfig(&node, config); err != nil {
-			log.Printf("Auto-sync: ошибка отправки конфига на ноду %s: %v", node.Name, err)
-			continue
-		}
-
-		if err := h.nodeClient.RestartSingbox(&node); err != nil {
-			log.Printf("Auto-sync: ошибка перезапуска sing-box на ноде %s: %v", node.Name, err)
+		if err := h.syncer.Sync(&node); err != nil {
+			log.Printf("Auto-sync: ошибка синхронизации ноды %s: %v", node.Name, err)
 			continue
 		}
 
@@ -384,7 +356,7 @@ func (h *UserHandler) Delete(c *fiber.Ctx) error {
 
 // GetConfig - GET /api/users/:id/config
 // Генерация клиентского конфига
-// Query params: format=json|url|qr|subscription
+// Query params: format=json|url|qr|subscription|wireguard|clash|xray, platform и version для sing-box
 func (h *UserHandler) GetConfig(c *fiber.Ctx) error {
 	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
 	if err != nil {
@@ -415,16 +387,31 @@ func (h *UserHandler) GetConfig(c *fiber.Ctx) error {
 		})
 	}
 
+	routing, err := services.ClientRoutingFor(h.db, &user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   err.Error(),
+		})
+	}
+
 	format := c.Query("format", "all")
 
 	switch format {
 	case "all", "json":
 		// Возвращаем всё: sing-box конфиг + share URLs
-		config, err := h.configGen.GenerateSingboxConfig(&user, user.Inbounds)
+		profile, err := services.ParseSingboxProfile(c.Query("platform"), c.Query("version"))
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"success": false,
-				"error":   "Ошибка генерации конфига",
+				"error":   err.Error(),
+			})
+		}
+		config, err := h.configGen.GenerateSingboxConfig(&user, user.Inbounds, profile, routing)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
 			})
 		}
 
@@ -432,7 +419,7 @@ func (h *UserHandler) GetConfig(c *fiber.Ctx) error {
 		var shareURLs []map[string]string
 		var firstURL string
 		for _, inbound := range user.Inbounds {
-			if !inbound.Enabled {
+			if !inbound.ClientVisible() {
 				continue
 			}
 			shareURL, err := h.configGen.GenerateShareURL(&user, &inbound)
@@ -455,9 +442,66 @@ func (h *UserHandler) GetConfig(c *fiber.Ctx) error {
 				"singbox":    config,
 				"share_url":  firstURL,
 				"share_urls": shareURLs,
+				"wireguard":  h.wireGuardConfigs(&user),
 			},
 		})
 
+	case "wireguard":
+		configs := h.wireGuardConfigs(&user)
+
+		// С inbound_id отдаём сам .conf файлом — для импорта в штатный клиент
+		if inboundID := c.Query("inbound_id"); inboundID != "" {
+			for _, cfg := range configs {
+				if cfg["inbound_id"] == inboundID {
+					c.Set("Content-Type", "text/plain; charset=utf-8")
+					c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", cfg["file_name"]))
+					return c.SendString(cfg["conf"])
+				}
+			}
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "WireGuard инбаунд не найден у пользователя",
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"data":    configs,
+		})
+
+	case "clash":
+		// YAML для Clash/Mihomo
+		config, err := h.configGen.GenerateClashConfig(&user, user.Inbounds, routing)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		data, err := h.configGen.SerializeClashConfig(config)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"success": false,
+				"error":   "Ошибка генерации конфига",
+			})
+		}
+		c.Set("Content-Type", "text/yaml; charset=utf-8")
+		return c.SendString(data)
+
+	case "xray":
+		// JSON конфиги Xray-core, по одному на сервер
+		configs, err := h.configGen.GenerateXrayConfigs(&user, user.Inbounds, routing)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"data":    configs,
+		})
+
 	case "url":
 		// Share URLs для всех инбаундов
 		urls, err := h.configGen.GenerateAllShareURLs(&user, user.Inbounds)
@@ -476,7 +520,7 @@ func (h *UserHandler) GetConfig(c *fiber.Ctx) error {
 		// QR-коды для всех инбаундов (base64)
 		var qrCodes []map[string]string
 		for _, inbound := range user.Inbounds {
-			if !inbound.Enabled {
+			if !inbound.ClientVisible() {
 				continue
 			}
 			shareURL, err := h.configGen.GenerateShareURL(&user, &inbound)
@@ -514,9 +558,59 @@ func (h *UserHandler) GetConfig(c *fiber.Ctx) error {
 	default:
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"success": false,
-			"error":   "Неподдерживаемый формат. Используйте: all, json, url, qr, subscription",
+			"error":   "Неподдерживаемый формат. Используйте: all, json, url, qr, subscription, wireguard",
+		})
+	}
+}
+
+// wireGuardConfigs генерирует .conf и QR-код для каждого WireGuard инбаунда пользователя
+func (h *UserHandler) wireGuardConfigs(user *models.User) []map[string]string {
+	configs := []map[string]string{}
+	for i := range user.Inbounds {
+		inbound := &user.Inbounds[i]
+		if inbound.Protocol != models.ProtocolWireGuard || !inbound.ClientVisible() {
+			continue
+		}
+
+		peer, err := h.ipam.EnsurePeer(inbound, user)
+		if err != nil {
+			log.Printf("WireGuard: пир пользователя %s на инбаунде %s: %v", user.Name, inbound.Name, err)
+			continue
+		}
+		conf := h.configGen.GenerateWireGuardConf(inbound, peer)
+		qr, err := h.configGen.GenerateQRCodeBase64(conf)
+		if err != nil {
+			continue
+		}
+
+		configs = append(configs, map[string]string{
+			"inbound_id":   strconv.FormatUint(uint64(inbound.ID), 10),
+			"inbound_name": inbound.Name,
+			"node_name":    inbound.Node.Name,
+			"address":      peer.HostPrefix(),
+			"file_name":    confFileName(inbound),
+			"conf":         conf,
+			"qr":           qr,
 		})
 	}
+	return configs
+}
+
+// confFileName - имя .conf файла: клиенты WireGuard берут из него имя туннеля (латиница, до 15 символов)
+func confFileName(inbound *models.Inbound) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return -1
+	}, inbound.Name)
+	if name == "" {
+		name = fmt.Sprintf("wg%d", inbound.ID)
+	}
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	return name + ".conf"
 }
 
 // ResetUUID - POST /api/users/:id/reset-uuid
@@ -554,6 +648,9 @@ func (h *UserHandler) ResetUUID(c *fiber.Ctx) error {
 		})
 	}
 
+	// Ключи WireGuard не зависят от UUID — перевыпускаем их при синхронизации
+	h.db.Where("user_id = ?", user.ID).Delete(&models.WireGuardPeer{})
+
 	// Авто-синк конфигов на ноды
 	go h.syncAffectedNodes()
 
@@ -621,7 +718,12 @@ func (h *UserHandler) GetPublicConfig(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "No inbounds"})
 	}
 
-	config, err := h.configGen.GenerateSingboxConfig(&user, user.Inbounds)
+	routing, err := services.ClientRoutingFor(h.db, &user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error generating config"})
+	}
+
+	config, err := h.configGen.GenerateSingboxConfig(&user, user.Inbounds, services.DefaultSingboxProfile, routing)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error generating config"})
 	}
@@ -8,6 +8,7 @@ import (
 	"zen-admin/handlers"
 	"zen-admin/middleware"
 	"zen-admin/models"
+	"zen-admin/services"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -76,6 +77,19 @@ func main() {
 	statsHandler := handlers.NewStatsHandler(db)
 	dashboardHandler := handlers.NewDashboardHandler(db)
 	publicHandler := handlers.NewPublicHandler(db)
+	certHandler := handlers.NewCertificateHandler(db)
+	agentUpdateHandler := handlers.NewAgentUpdateHandler(db)
+	routingHandler := handlers.NewRoutingHandler(db)
+	clientRoutingHandler := handlers.NewClientRoutingHandler(db)
+
+	// Фоновая проверка сертификатов на нодах
+	services.NewCertMonitor(db).Start()
+
+	// Плановая ротация REALITY short_id
+	services.NewRealityRotator(db).Start()
+
+	// Поэтапная раскатка обновлений агентов
+	services.NewAgentUpdater(db).Start()
 
 	// === Публичные маршруты ===
 	api := app.Group("/api")
@@ -94,8 +108,11 @@ func main() {
 
 	// Public pages (для юзеров - без авторизации)
 	sub := api.Group("/sub")
-	sub.Get("/:uuid", publicHandler.UserConfigPage)      // Красивая HTML страница
-	sub.Get("/:uuid/raw", publicHandler.RawSubscription) // Raw для приложений
+	sub.Get("/:uuid", publicHandler.UserConfigPage)            // Красивая HTML страница
+	sub.Get("/:uuid/raw", publicHandler.RawSubscription)       // Raw для приложений
+	sub.Get("/:uuid/sip008", publicHandler.SIP008Subscription) // Shadowsocks SIP008 (Outline)
+	sub.Get("/:uuid/clash", publicHandler.ClashSubscription)   // Clash/Mihomo YAML
+	sub.Get("/:uuid/xray", publicHandler.XraySubscription)     // Xray-core JSON
 
 	// === Защищённые маршруты ===
 	protected := api.Group("", middleware.JWTMiddleware())
@@ -120,6 +137,7 @@ func main() {
 	users.Get("/:id/config", userHandler.GetConfig)
 	users.Post("/:id/reset-uuid", userHandler.ResetUUID)
 	users.Post("/:id/reset-traffic", userHandler.ResetTraffic)
+	users.Put("/:id/routing", clientRoutingHandler.AssignUser)
 
 	// Nodes
 	nodes := protected.Group("/nodes")
@@ -131,6 +149,18 @@ func main() {
 	nodes.Delete("/:id", nodeHandler.Delete)
 	nodes.Get("/:id/status", nodeHandler.GetStatus)
 	nodes.Post("/:id/sync", nodeHandler.Sync)
+	nodes.Post("/:id/maintenance", nodeHandler.EnterMaintenance)
+	nodes.Delete("/:id/maintenance", nodeHandler.ExitMaintenance)
+	nodes.Get("/:id/drain", nodeHandler.GetDrainStatus)
+	nodes.Get("/:id/ports", nodeHandler.GetPortMap)
+	nodes.Get("/:id/chain", nodeHandler.GetChain)
+	nodes.Put("/:id/upstream", nodeHandler.SetUpstream)
+	nodes.Put("/:id/routing", routingHandler.AssignNode)
+	nodes.Get("/:id/logs", nodeHandler.StreamLogs)
+	nodes.Get("/:id/certificates", certHandler.ListByNode)
+	nodes.Post("/:id/certificates", certHandler.Upload)
+	nodes.Get("/:id/version", agentUpdateHandler.GetNodeVersion)
+	nodes.Post("/:id/update", agentUpdateHandler.UpdateNodeAgent)
 	nodes.Get("/:id/inbounds", inboundHandler.ListByNode)
 	nodes.Post("/:id/inbounds", inboundHandler.Create)
 
@@ -141,6 +171,42 @@ func main() {
 	inbounds.Put("/:id", inboundHandler.Update)
 	inbounds.Delete("/:id", inboundHandler.Delete)
 	inbounds.Post("/:id/generate-keys", inboundHandler.GenerateKeys)
+	inbounds.Put("/:id/rotation", inboundHandler.SetRotationPolicy)
+	inbounds.Post("/:id/rotate", inboundHandler.Rotate)
+	inbounds.Post("/:id/certificate", certHandler.IssueForInbound)
+	inbounds.Get("/:id/ech", inboundHandler.ECH)
+
+	// Protocols
+	protected.Get("/protocols", inboundHandler.Protocols)
+
+	// Certificates
+	protected.Get("/certificates", certHandler.List)
+
+	// Agent updates
+	agent := protected.Group("/agent")
+	agent.Get("/releases", agentUpdateHandler.ListReleases)
+	agent.Post("/releases", agentUpdateHandler.CreateRelease)
+	agent.Delete("/releases/:id", agentUpdateHandler.DeleteRelease)
+	agent.Get("/rollouts", agentUpdateHandler.ListRollouts)
+	agent.Post("/rollouts", agentUpdateHandler.CreateRollout)
+	agent.Get("/rollouts/:id", agentUpdateHandler.GetRollout)
+	agent.Post("/rollouts/:id/halt", agentUpdateHandler.HaltRollout)
+	agent.Post("/rollouts/:id/resume", agentUpdateHandler.ResumeRollout)
+
+	// Routing policies
+	routing := protected.Group("/routing")
+	routing.Get("/policies", routingHandler.List)
+	routing.Post("/policies", routingHandler.Create)
+	routing.Get("/policies/:id", routingHandler.Get)
+	routing.Put("/policies/:id", routingHandler.Update)
+	routing.Delete("/policies/:id", routingHandler.Delete)
+
+	// Client routing templates
+	routing.Get("/templates", clientRoutingHandler.List)
+	routing.Post("/templates", clientRoutingHandler.Create)
+	routing.Get("/templates/:id", clientRoutingHandler.Get)
+	routing.Put("/templates/:id", clientRoutingHandler.Update)
+	routing.Delete("/templates/:id", clientRoutingHandler.Delete)
 
 	// Stats
 	stats := protected.Group("/stats")
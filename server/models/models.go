@@ -1,6 +1,13 @@
 package models
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -30,6 +37,9 @@ type User struct {
 	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
 
+	// Шаблон клиентской маршрутизации (nil - шаблон по умолчанию)
+	RoutingTemplateID *uint `gorm:"index" json:"routing_template_id,omitempty"`
+
 	// Связи
 	Inbounds []Inbound `gorm:"many2many:user_inbounds;" json:"inbounds,omitempty"`
 }
@@ -54,48 +64,183 @@ type Node struct {
 	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
 
+	// Режим обслуживания: нода пропадает из клиентских конфигов и подписок,
+	// но серверный конфиг продолжает работать, пока клиенты не разъедутся
+	Maintenance       bool       `gorm:"default:false" json:"maintenance"`
+	MaintenanceSince  *time.Time `json:"maintenance_since,omitempty"`
+	DrainGraceMinutes int        `gorm:"default:60" json:"drain_grace_minutes"` // Сколько ждём отключения клиентов
+
+	// Версия агента по данным последней проверки
+	AgentVersion   string     `gorm:"size:64" json:"agent_version,omitempty"`
+	AgentCheckedAt *time.Time `json:"agent_checked_at,omitempty"`
+
+	// Цепочка: нода-вход отправляет весь трафик клиентов на вышестоящую ноду (выход).
+	// ChainUUID - служебный VLESS пользователь этой ноды на вышестоящей
+	UpstreamNodeID *uint  `gorm:"index" json:"upstream_node_id,omitempty"`
+	ChainUUID      string `gorm:"size:36" json:"-"`
+
+	// Служебный REALITY инбаунд, на который приходят ноды-входы (заполняется, когда нода становится выходом)
+	ChainPort       int    `gorm:"default:0" json:"chain_port,omitempty"`
+	ChainSNI        string `gorm:"size:255" json:"chain_sni,omitempty"`
+	ChainPrivateKey string `gorm:"size:255" json:"-"`
+	ChainPublicKey  string `gorm:"size:255" json:"chain_public_key,omitempty"`
+	ChainShortID    string `gorm:"size:16" json:"-"`
+
+	// Серверная политика маршрутизации (одна политика может обслуживать группу нод)
+	RoutingPolicyID *uint `gorm:"index" json:"routing_policy_id,omitempty"`
+
 	// Связи
 	Inbounds []Inbound `gorm:"foreignKey:NodeID" json:"inbounds,omitempty"`
 }
 
+// Значения по умолчанию для служебного инбаунда цепочки
+const (
+	DefaultChainPort = 8444
+	DefaultChainSNI  = "www.microsoft.com"
+)
+
+// IsChainExit - нода принимает соединения от нод-входов
+func (n *Node) IsChainExit() bool {
+	return n.ChainPort != 0 && n.ChainPrivateKey != ""
+}
+
+// DrainDeadline возвращает момент окончания grace-периода (nil, если нода не на обслуживании)
+func (n *Node) DrainDeadline() *time.Time {
+	if !n.Maintenance || n.MaintenanceSince == nil {
+		return nil
+	}
+	deadline := n.MaintenanceSince.Add(time.Duration(n.DrainGraceMinutes) * time.Minute)
+	return &deadline
+}
+
 // Protocol - тип протокола инбаунда
 type Protocol string
 
 const (
-	ProtocolReality   Protocol = "reality"
-	ProtocolWSTLS     Protocol = "ws-tls"
-	ProtocolHysteria2 Protocol = "hysteria2"
+	ProtocolReality     Protocol = "reality"
+	ProtocolWSTLS       Protocol = "ws-tls"
+	ProtocolHysteria2   Protocol = "hysteria2"
+	ProtocolTrojan      Protocol = "trojan"      // Trojan поверх TCP+TLS
+	ProtocolVMess       Protocol = "vmess"       // VMess поверх WS+TLS
+	ProtocolShadowsocks Protocol = "shadowsocks" // Shadowsocks 2022, несколько пользователей
+	ProtocolTUIC        Protocol = "tuic"        // TUIC v5 поверх QUIC
+	ProtocolWireGuard   Protocol = "wireguard"   // WireGuard для штатных клиентов ОС
+	ProtocolShadowTLS   Protocol = "shadowtls"   // Shadowsocks 2022 за ShadowTLS v3
 )
 
+// UsesCertificate сообщает, терминирует ли sing-box TLS инбаунда своим сертификатом
+func (p Protocol) UsesCertificate() bool {
+	switch p {
+	case ProtocolWSTLS, ProtocolHysteria2, ProtocolTrojan, ProtocolVMess, ProtocolTUIC:
+		return true
+	}
+	return false
+}
+
 // Inbound - точка входа на ноде
 type Inbound struct {
 	ID         uint           `gorm:"primaryKey" json:"id"`
 	NodeID     uint           `gorm:"index;not null" json:"node_id"`
 	Name       string         `gorm:"size:255;not null" json:"name"`
-	Protocol   Protocol       `gorm:"size:50;not null" json:"protocol"` // reality, ws-tls, hysteria2
+	Protocol   Protocol       `gorm:"size:50;not null" json:"protocol"` // reality, ws-tls, hysteria2, trojan, vmess, shadowsocks, tuic
 	ListenPort int            `gorm:"default:443" json:"listen_port"`
 
 	// TLS/REALITY settings
 	SNI          string `gorm:"size:255" json:"sni,omitempty"`           // Домен для SNI
-	FallbackAddr string `gorm:"size:255;default:'127.0.0.1'" json:"fallback_addr,omitempty"`
-	FallbackPort int    `gorm:"default:8443" json:"fallback_port,omitempty"`
+	FallbackAddr string `gorm:"size:255" json:"fallback_addr,omitempty"` // REALITY: 127.0.0.1 по умолчанию; ShadowTLS: sni
+	FallbackPort int    `json:"fallback_port,omitempty"`                 // REALITY: 8443 по умолчанию; ShadowTLS: 443
 
 	// REALITY keys
 	PrivateKey string `gorm:"size:255" json:"private_key,omitempty"`
 	PublicKey  string `gorm:"size:255" json:"public_key,omitempty"`
-	ShortID    string `gorm:"size:16" json:"short_id,omitempty"`
+	ShortID    string `gorm:"size:16" json:"short_id,omitempty"` // Активный short_id — его получают клиенты
+
+	// Все short_id, которые принимает сервер (активный + старые на время ротации)
+	ShortIDs []string `gorm:"serializer:json;type:text" json:"short_ids,omitempty"`
+
+	// Дополнительные SNI маскировки: сервер принимает SNI и все ServerNames, пользователи
+	// распределяются между ними. sing-box принимает один server_name на REALITY инбаунд,
+	// поэтому при нескольких именах порт слушает direct инбаунд и по SNI отправляет
+	// соединение во внутренний REALITY инбаунд на SNIRelayPort, SNIRelayPort+1, ...
+	ServerNames  []string `gorm:"serializer:json;type:text" json:"server_names,omitempty"`
+	SNIRelayPort int      `gorm:"default:0" json:"sni_relay_port,omitempty"`
+
+	// short_id у каждого пользователя свой (выводится из секрета и UUID): утёкшую ссылку
+	// можно отозвать сбросом UUID одного пользователя, не меняя short_id остальным
+	PerUserShortIDs bool   `gorm:"default:false" json:"per_user_short_ids"`
+	ShortIDSeed     string `gorm:"size:64" json:"-"`
+
+	// Ротация REALITY: новый short_id сначала добавляется на сервер, затем выдаётся клиентам,
+	// старый удаляется после grace-периода. RotationIntervalHours = 0 - ротация выключена
+	RotationIntervalHours int        `gorm:"default:0" json:"rotation_interval_hours"`
+	RotationGraceHours    int        `gorm:"default:24" json:"rotation_grace_hours"`
+	RotationPhase         string     `gorm:"size:20" json:"rotation_phase,omitempty"`
+	RotationNextShortID   string     `gorm:"size:16" json:"rotation_next_short_id,omitempty"`
+	RotationGraceUntil    *time.Time `json:"rotation_grace_until,omitempty"`
+	RotationSyncPending   bool       `gorm:"default:false" json:"rotation_sync_pending"` // Изменения ещё не доехали до ноды
+	RotationError         string     `gorm:"type:text" json:"rotation_error,omitempty"`
+	LastRotatedAt         *time.Time `json:"last_rotated_at,omitempty"`
 
 	// Hysteria2 settings
 	UpMbps   int `gorm:"default:100" json:"up_mbps,omitempty"`
 	DownMbps int `gorm:"default:100" json:"down_mbps,omitempty"`
 
-	// WS settings
+	// Hysteria2 obfs (salamander) и port hopping: агент перенаправляет диапазон UDP портов на ListenPort
+	Obfs         string `gorm:"size:20" json:"obfs,omitempty"`
+	ObfsPassword string `gorm:"size:64" json:"obfs_password,omitempty"`
+	HopPortStart int    `gorm:"default:0" json:"hop_port_start,omitempty"`
+	HopPortEnd   int    `gorm:"default:0" json:"hop_port_end,omitempty"`
+
+	// TUIC settings
+	CongestionControl string   `gorm:"size:20" json:"congestion_control,omitempty"` // cubic, new_reno, bbr
+	ALPN              []string `gorm:"serializer:json;type:text" json:"alpn,omitempty"`
+
+	// WS settings (ws-tls, vmess). Для VLESS это путь любого HTTP транспорта (ws, httpupgrade, http)
 	WSPath string `gorm:"size:255" json:"ws_path,omitempty"`
 
-	// TLS certificate paths (для ws-tls и hysteria2)
+	// Транспорт VLESS (reality, ws-tls): пусто - tcp для REALITY и ws для ws-tls
+	Transport       string `gorm:"size:20" json:"transport,omitempty"`
+	GRPCServiceName string `gorm:"size:255" json:"grpc_service_name,omitempty"`
+	TransportHost   string `gorm:"size:255" json:"transport_host,omitempty"` // Host заголовок, по умолчанию SNI
+
+	// Multiplex (reality, ws-tls, trojan, vmess, shadowsocks, shadowtls): несколько соединений клиента в одном TCP
+	MuxEnabled        bool   `gorm:"default:false" json:"mux_enabled"`
+	MuxProtocol       string `gorm:"size:20" json:"mux_protocol,omitempty"` // smux, yamux, h2mux (по умолчанию)
+	MuxMaxConnections int    `gorm:"default:0" json:"mux_max_connections,omitempty"`
+	MuxPadding        bool   `gorm:"default:false" json:"mux_padding"`
+
+	// TCP Brutal поверх multiplex (скорость со стороны клиента), 0 - выключен
+	BrutalUpMbps   int `gorm:"default:0" json:"brutal_up_mbps,omitempty"`
+	BrutalDownMbps int `gorm:"default:0" json:"brutal_down_mbps,omitempty"`
+
+	// WireGuard: пул адресов туннеля (сервер берёт первый адрес) и ключи сервера.
+	// Пиры пользователей хранятся в WireGuardPeer
+	WGAddressPool string `gorm:"size:64" json:"wg_address_pool,omitempty"`
+	WGPrivateKey  string `gorm:"size:64" json:"-"`
+	WGPublicKey   string `gorm:"size:64" json:"wg_public_key,omitempty"`
+	WGMTU         int    `gorm:"default:0" json:"wg_mtu,omitempty"`
+	WGDNS         string `gorm:"size:255" json:"wg_dns,omitempty"` // DNS в клиентском .conf
+
+	// VMess settings: alterId > 0 нужен только старым клиентам без AEAD
+	AlterID int `gorm:"default:0" json:"alter_id,omitempty"`
+
+	// Shadowsocks 2022: общий PSK сервера и секрет, из которого выводятся ключи пользователей.
+	// Клиент получает пароль "<PSK сервера>:<ключ пользователя>"
+	SSMethod      string `gorm:"size:50" json:"ss_method,omitempty"`
+	SSServerKey   string `gorm:"size:64" json:"ss_server_key,omitempty"`
+	SSUserKeySeed string `gorm:"size:64" json:"-"`
+
+	// TLS certificate paths (для ws-tls, hysteria2, trojan, vmess и tuic)
 	CertPath string `gorm:"size:255" json:"cert_path,omitempty"`
 	KeyPath  string `gorm:"size:255" json:"key_path,omitempty"`
 
+	// ECH (Encrypted Client Hello) для инбаундов, где TLS терминирует sing-box.
+	// Ключ сервера и список ECHConfig генерирует панель, клиенты получают список в outbound
+	ECHEnabled    bool   `gorm:"default:false" json:"ech_enabled"`
+	ECHPublicName string `gorm:"size:255" json:"ech_public_name,omitempty"` // Внешний SNI, по умолчанию SNI
+	ECHKey        string `gorm:"type:text" json:"-"`
+	ECHConfig     string `gorm:"type:text" json:"ech_config,omitempty"` // PEM "ECH CONFIGS"
+
 	// Fingerprint для uTLS
 	Fingerprint string `gorm:"size:50;default:'chrome'" json:"fingerprint"`
 
@@ -108,12 +253,581 @@ type Inbound struct {
 	Users []User `gorm:"many2many:user_inbounds;" json:"users,omitempty"`
 }
 
+// Фазы ротации REALITY
+const (
+	RotationPhaseIdle   = ""
+	RotationPhaseStaged = "staged" // Новый short_id добавлен на сервер, клиенты получают старый
+	RotationPhaseGrace  = "grace"  // Клиенты получают новый, старый ещё принимается
+)
+
+// AcceptedShortIDs возвращает short_id, которые должен принимать сервер
+func (i *Inbound) AcceptedShortIDs() []string {
+	ids := []string{i.ShortID}
+	seen := map[string]bool{i.ShortID: true}
+	for _, id := range i.ShortIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// RotationDue сообщает, пора ли начинать очередную ротацию
+func (i *Inbound) RotationDue(now time.Time) bool {
+	if i.Protocol != ProtocolReality || i.PerUserShortIDs || i.RotationIntervalHours <= 0 || i.RotationPhase != RotationPhaseIdle {
+		return false
+	}
+	since := i.CreatedAt
+	if i.LastRotatedAt != nil {
+		since = *i.LastRotatedAt
+	}
+	return !now.Before(since.Add(time.Duration(i.RotationIntervalHours) * time.Hour))
+}
+
+// Транспорты VLESS
+const (
+	TransportTCP         = "tcp"
+	TransportWS          = "ws"
+	TransportGRPC        = "grpc"
+	TransportHTTPUpgrade = "httpupgrade"
+	TransportHTTP        = "http" // HTTP/2 (XHTTP-подобный режим)
+)
+
+// VLESSTransport возвращает транспорт VLESS инбаунда с учётом значения по умолчанию
+func (i *Inbound) VLESSTransport() string {
+	if i.Transport != "" {
+		return i.Transport
+	}
+	if i.Protocol == ProtocolWSTLS {
+		return TransportWS
+	}
+	return TransportTCP
+}
+
+// VLESSFlow возвращает flow пользователей: vision работает только поверх сырого TCP с REALITY
+func (i *Inbound) VLESSFlow() string {
+	if i.Protocol == ProtocolReality && i.VLESSTransport() == TransportTCP {
+		return "xtls-rprx-vision"
+	}
+	return ""
+}
+
+// TransportPath возвращает путь HTTP транспорта (/ws по умолчанию)
+func (i *Inbound) TransportPath() string {
+	if i.WSPath == "" {
+		return "/ws"
+	}
+	return i.WSPath
+}
+
+// GRPCService возвращает имя gRPC сервиса (grpc по умолчанию)
+func (i *Inbound) GRPCService() string {
+	if i.GRPCServiceName == "" {
+		return "grpc"
+	}
+	return i.GRPCServiceName
+}
+
+// TransportHostOrSNI возвращает Host заголовок транспорта
+func (i *Inbound) TransportHostOrSNI() string {
+	if i.TransportHost != "" {
+		return i.TransportHost
+	}
+	return i.SNI
+}
+
+// TransportRoute возвращает HTTP путь, по которому reverse proxy отличает инбаунд (для gRPC - /<сервис>)
+func (i *Inbound) TransportRoute() string {
+	switch i.VLESSTransport() {
+	case TransportTCP:
+		return ""
+	case TransportGRPC:
+		return "/" + i.GRPCService()
+	}
+	return i.TransportPath()
+}
+
+// ObfsSalamander - обфускация Hysteria2
+const ObfsSalamander = "salamander"
+
+// DefaultHopInterval - как часто клиент Hysteria2 меняет порт при port hopping
+const DefaultHopInterval = 30 * time.Second
+
+// PortHopping - у Hysteria2 инбаунда задан диапазон port hopping
+func (i *Inbound) PortHopping() bool {
+	return i.Protocol == ProtocolHysteria2 && i.HopPortStart > 0 && i.HopPortEnd > i.HopPortStart
+}
+
+// Протоколы multiplex sing-box
+const (
+	MuxSmux  = "smux"
+	MuxYamux = "yamux"
+	MuxH2Mux = "h2mux"
+)
+
+// DefaultMuxMaxConnections - максимум соединений multiplex клиента по умолчанию
+const DefaultMuxMaxConnections = 4
+
+// SupportsMultiplex - протокол работает поверх TCP потока и не использует vision
+// (QUIC протоколы мультиплексируют сами, vision несовместим с mux)
+func (i *Inbound) SupportsMultiplex() bool {
+	switch i.Protocol {
+	case ProtocolReality:
+		return i.VLESSFlow() == ""
+	case ProtocolWSTLS, ProtocolTrojan, ProtocolVMess, ProtocolShadowsocks, ProtocolShadowTLS:
+		return true
+	}
+	return false
+}
+
+// MultiplexActive - multiplex включён и поддерживается протоколом
+func (i *Inbound) MultiplexActive() bool {
+	return i.MuxEnabled && i.SupportsMultiplex()
+}
+
+// MuxProtocolOrDefault возвращает протокол multiplex (h2mux по умолчанию, как в sing-box)
+func (i *Inbound) MuxProtocolOrDefault() string {
+	if i.MuxProtocol == "" {
+		return MuxH2Mux
+	}
+	return i.MuxProtocol
+}
+
+// MuxMaxConnectionsOrDefault возвращает максимум соединений multiplex клиента
+func (i *Inbound) MuxMaxConnectionsOrDefault() int {
+	if i.MuxMaxConnections <= 0 {
+		return DefaultMuxMaxConnections
+	}
+	return i.MuxMaxConnections
+}
+
+// BrutalEnabled - TCP Brutal включён (нужны обе скорости)
+func (i *Inbound) BrutalEnabled() bool {
+	return i.BrutalUpMbps > 0 && i.BrutalDownMbps > 0
+}
+
+// Алгоритмы управления перегрузкой TUIC
+const (
+	CongestionCubic   = "cubic"
+	CongestionNewReno = "new_reno"
+	CongestionBBR     = "bbr"
+)
+
+// TUICALPN возвращает ALPN инбаунда TUIC (h3 по умолчанию)
+func (i *Inbound) TUICALPN() []string {
+	if len(i.ALPN) == 0 {
+		return []string{"h3"}
+	}
+	return i.ALPN
+}
+
+// Методы Shadowsocks 2022 с поддержкой нескольких пользователей на одном порту
+const (
+	SS2022AES128GCM = "2022-blake3-aes-128-gcm"
+	SS2022AES256GCM = "2022-blake3-aes-256-gcm"
+)
+
+// SSKeyLength возвращает длину ключа метода Shadowsocks 2022 (0 - метод не поддерживается)
+func SSKeyLength(method string) int {
+	switch method {
+	case SS2022AES128GCM:
+		return 16
+	case SS2022AES256GCM:
+		return 32
+	}
+	return 0
+}
+
+// SSUserKey выводит ключ пользователя из секрета инбаунда и UUID пользователя.
+// Ключ детерминирован, поэтому его не нужно хранить; сброс UUID меняет и ключ
+func (i *Inbound) SSUserKey(user *User) string {
+	mac := hmac.New(sha256.New, []byte(i.SSUserKeySeed))
+	mac.Write([]byte("ss2022-user:" + user.UUID.String()))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)[:SSKeyLength(i.SSMethod)])
+}
+
+// ShadowTLSPassword выводит пароль ShadowTLS пользователя из того же секрета, что и ключ Shadowsocks
+func (i *Inbound) ShadowTLSPassword(user *User) string {
+	mac := hmac.New(sha256.New, []byte(i.SSUserKeySeed))
+	mac.Write([]byte("shadowtls-user:" + user.UUID.String()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// SSClientPassword возвращает пароль пользователя для клиента Shadowsocks 2022
+func (i *Inbound) SSClientPassword(user *User) string {
+	return i.SSServerKey + ":" + i.SSUserKey(user)
+}
+
+// Несколько SNI REALITY инбаунда
+const (
+	DefaultSNIRelayPort   = 10443
+	MaxRealityServerNames = 8
+)
+
+// RealityServerNames возвращает все SNI, которые принимает REALITY инбаунд (основной SNI первым)
+func (i *Inbound) RealityServerNames() []string {
+	names := []string{i.SNI}
+	seen := map[string]bool{i.SNI: true}
+	for _, name := range i.ServerNames {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// SNIRelay - у инбаунда несколько SNI: порт слушает direct инбаунд с маршрутизацией по SNI
+func (i *Inbound) SNIRelay() bool {
+	return len(i.RealityServerNames()) > 1
+}
+
+// LocalFallback - fallback-сервер (REALITY handshake, ShadowTLS) слушает на самой ноде
+func (i *Inbound) LocalFallback() bool {
+	if i.FallbackPort == 0 {
+		return false
+	}
+	switch strings.Trim(i.FallbackAddr, "[]") {
+	case "127.0.0.1", "localhost", "::1", "0.0.0.0", "::":
+		return true
+	}
+	return false
+}
+
+// RealityServerNameFor возвращает SNI пользователя. Пользователи распределяются между
+// именами по UUID, поэтому добавление имени не меняет SNI тех, чьё имя осталось в списке
+func (i *Inbound) RealityServerNameFor(user *User) string {
+	names := i.RealityServerNames()
+	if len(names) == 1 {
+		return names[0]
+	}
+	sum := sha256.Sum256([]byte(user.UUID.String()))
+	return names[binary.BigEndian.Uint32(sum[:4])%uint32(len(names))]
+}
+
+// RealityShortIDFor возвращает short_id, который получает клиент пользователя
+func (i *Inbound) RealityShortIDFor(user *User) string {
+	if !i.PerUserShortIDs {
+		return i.ShortID
+	}
+	return i.UserShortID(user)
+}
+
+// UserShortID выводит short_id пользователя из секрета инбаунда и UUID (8 байт, hex)
+func (i *Inbound) UserShortID(user *User) string {
+	mac := hmac.New(sha256.New, []byte(i.ShortIDSeed))
+	mac.Write([]byte("reality-short-id:" + user.UUID.String()))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// ECHOuterName возвращает внешний SNI, который виден в ClientHello при ECH
+func (i *Inbound) ECHOuterName() string {
+	if i.ECHPublicName != "" {
+		return i.ECHPublicName
+	}
+	return i.SNI
+}
+
+// ClientVisible сообщает, можно ли отдавать инбаунд клиентам.
+// Выключенные инбаунды, а также инбаунды выключенных нод и нод на обслуживании
+// не попадают в клиентские конфиги и подписки. Если нода не подгружена, смотрим только на инбаунд.
+func (i *Inbound) ClientVisible() bool {
+	if !i.Enabled {
+		return false
+	}
+	if i.Node.ID == 0 {
+		return true
+	}
+	return i.Node.Enabled && !i.Node.Maintenance
+}
+
 // UserInbound - связь пользователя с инбаундом
 type UserInbound struct {
 	UserID    uint `gorm:"primaryKey"`
 	InboundID uint `gorm:"primaryKey"`
 }
 
+// Значения WireGuard по умолчанию
+const (
+	DefaultWGAddressPool = "10.66.0.0/24"
+	DefaultWGMTU         = 1408
+	DefaultWGDNS         = "1.1.1.1"
+)
+
+// WGMTUOrDefault возвращает MTU туннеля WireGuard
+func (i *Inbound) WGMTUOrDefault() int {
+	if i.WGMTU == 0 {
+		return DefaultWGMTU
+	}
+	return i.WGMTU
+}
+
+// WGDNSOrDefault возвращает DNS для клиентского конфига WireGuard
+func (i *Inbound) WGDNSOrDefault() string {
+	if i.WGDNS == "" {
+		return DefaultWGDNS
+	}
+	return i.WGDNS
+}
+
+// WGServerAddress возвращает адрес сервера в туннеле с маской пула (первый адрес пула)
+func (i *Inbound) WGServerAddress() string {
+	prefix, err := netip.ParsePrefix(i.WGAddressPool)
+	if err != nil {
+		return ""
+	}
+	prefix = prefix.Masked()
+	return netip.PrefixFrom(prefix.Addr().Next(), prefix.Bits()).String()
+}
+
+// WireGuardPeer - пир пользователя на WireGuard инбаунде: ключи и выделенный адрес туннеля.
+// Адрес закреплён за пользователем, пока он привязан к инбаунду
+type WireGuardPeer struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	InboundID  uint      `gorm:"uniqueIndex:idx_wg_peer_user;uniqueIndex:idx_wg_peer_address;not null" json:"inbound_id"`
+	UserID     uint      `gorm:"uniqueIndex:idx_wg_peer_user;not null" json:"user_id"`
+	Address    string    `gorm:"uniqueIndex:idx_wg_peer_address;size:64;not null" json:"address"` // Адрес без маски
+	PrivateKey string    `gorm:"size:64;not null" json:"-"`
+	PublicKey  string    `gorm:"size:64;not null" json:"public_key"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// HostPrefix возвращает адрес пира с маской /32 или /128 (AllowedIPs на сервере, Address у клиента)
+func (p *WireGuardPeer) HostPrefix() string {
+	addr, err := netip.ParseAddr(p.Address)
+	if err != nil {
+		return p.Address
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()).String()
+}
+
+// Источники сертификатов
+const (
+	CertSourceACME   = "acme"
+	CertSourceUpload = "upload"
+)
+
+// Статусы сертификатов
+const (
+	CertStatusOK            = "ok"
+	CertStatusExpiring      = "expiring"
+	CertStatusExpired       = "expired"
+	CertStatusRenewalFailed = "renewal_failed"
+	CertStatusMissing       = "missing"
+)
+
+// Certificate - TLS сертификат на ноде (состояние по данным агента)
+type Certificate struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	NodeID        uint       `gorm:"uniqueIndex:idx_cert_node_domain;not null" json:"node_id"`
+	Domain        string     `gorm:"uniqueIndex:idx_cert_node_domain;size:255;not null" json:"domain"`
+	Source        string     `gorm:"size:20" json:"source"` // acme, upload
+	CertPath      string     `gorm:"size:255" json:"cert_path"`
+	KeyPath       string     `gorm:"size:255" json:"key_path"`
+	Issuer        string     `gorm:"size:512" json:"issuer,omitempty"`
+	NotBefore     *time.Time `json:"not_before,omitempty"`
+	NotAfter      *time.Time `json:"not_after,omitempty"`
+	LastError     string     `gorm:"type:text" json:"last_error,omitempty"` // Ошибка последнего выпуска/продления
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+	CheckedAt     *time.Time `json:"checked_at,omitempty"` // Когда последний раз сверялись с агентом
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+
+	// Связи
+	Node Node `gorm:"foreignKey:NodeID" json:"node,omitempty"`
+}
+
+// Status возвращает состояние сертификата. warnBefore - за сколько до истечения предупреждать
+func (c *Certificate) Status(warnBefore time.Duration) string {
+	if c.NotAfter == nil {
+		return CertStatusMissing
+	}
+	now := time.Now()
+	if now.After(*c.NotAfter) {
+		return CertStatusExpired
+	}
+	if c.LastError != "" {
+		return CertStatusRenewalFailed
+	}
+	if now.Add(warnBefore).After(*c.NotAfter) {
+		return CertStatusExpiring
+	}
+	return CertStatusOK
+}
+
+// AgentRelease - подписанный релиз агента ноды.
+// Подпись ed25519 покрывает строку "zen-agent-update:<version>:<артефакт>[:downgrade]",
+// где артефакт - sha256 бинарника (hex) или ссылка на образ с дайджестом.
+// Агенты ставят только более новую версию, старую - лишь релиз, подписанный как downgrade
+type AgentRelease struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Version   string    `gorm:"uniqueIndex;size:64;not null" json:"version"`
+	BinaryURL string    `gorm:"size:512" json:"binary_url,omitempty"`
+	SHA256    string    `gorm:"size:64" json:"sha256,omitempty"`
+	ImageRef  string    `gorm:"size:512" json:"image,omitempty"` // name@sha256:...
+	Downgrade bool      `gorm:"default:false" json:"downgrade"`
+	Signature string    `gorm:"size:128;not null" json:"signature"`
+	Notes     string    `gorm:"type:text" json:"notes,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Статусы раскатки обновления агентов
+const (
+	RolloutStatusRunning   = "running"
+	RolloutStatusHalted    = "halted"
+	RolloutStatusCompleted = "completed"
+)
+
+// Статусы ноды в раскатке
+const (
+	RolloutNodePending  = "pending"
+	RolloutNodeUpdating = "updating"
+	RolloutNodeUpdated  = "updated"
+	RolloutNodeFailed   = "failed"
+	RolloutNodeSkipped  = "skipped"
+)
+
+// AgentRollout - поэтапная раскатка релиза агента по нодам.
+// Ноды обновляются партиями; если хоть одна нода партии не прошла health check, раскатка останавливается
+type AgentRollout struct {
+	ID                   uint       `gorm:"primaryKey" json:"id"`
+	ReleaseID            uint       `gorm:"index;not null" json:"release_id"`
+	Status               string     `gorm:"size:20;index;default:'running'" json:"status"`
+	BatchSize            int        `gorm:"default:1" json:"batch_size"`
+	BatchIntervalSeconds int        `gorm:"default:60" json:"batch_interval_seconds"` // Пауза между партиями
+	HealthTimeoutSeconds int        `gorm:"default:120" json:"health_timeout_seconds"`
+	HaltReason           string     `gorm:"type:text" json:"halt_reason,omitempty"`
+	LastBatchAt          *time.Time `json:"last_batch_at,omitempty"`
+	CompletedAt          *time.Time `json:"completed_at,omitempty"`
+	CreatedAt            time.Time  `json:"created_at"`
+	UpdatedAt            time.Time  `json:"updated_at"`
+
+	// Связи
+	Release AgentRelease       `gorm:"foreignKey:ReleaseID" json:"release,omitempty"`
+	Nodes   []AgentRolloutNode `gorm:"foreignKey:RolloutID" json:"nodes,omitempty"`
+}
+
+// AgentRolloutNode - нода в раскатке
+type AgentRolloutNode struct {
+	ID              uint       `gorm:"primaryKey" json:"id"`
+	RolloutID       uint       `gorm:"index;not null" json:"rollout_id"`
+	NodeID          uint       `gorm:"not null" json:"node_id"`
+	Position        int        `json:"position"` // Порядок обновления
+	Status          string     `gorm:"size:20;default:'pending'" json:"status"`
+	PreviousVersion string     `gorm:"size:64" json:"previous_version,omitempty"`
+	Error           string     `gorm:"type:text" json:"error,omitempty"`
+	UpdatedAt       *time.Time `json:"updated_at,omitempty"`
+
+	// Связи
+	Node Node `gorm:"foreignKey:NodeID" json:"node,omitempty"`
+}
+
+// Действия правил серверной маршрутизации
+const (
+	RoutingActionBlock  = "block"  // Отклонить соединение
+	RoutingActionDirect = "direct" // Выпустить напрямую с ноды (в обход цепочки)
+	RoutingActionEgress = "egress" // Отправить через альтернативный выход (WARP/WireGuard)
+)
+
+// Типы альтернативных выходов
+const (
+	EgressTypeWireGuard = "wireguard"
+)
+
+// RoutingPolicy - серверная политика маршрутизации: блокировки, rule-set'ы и альтернативные выходы.
+// Правила применяются по порядку, несовпавший трафик уходит в обычный выход ноды
+type RoutingPolicy struct {
+	ID          uint             `gorm:"primaryKey" json:"id"`
+	Name        string           `gorm:"uniqueIndex;size:255;not null" json:"name"`
+	Description string           `gorm:"type:text" json:"description,omitempty"`
+	Rules       []RoutingRule    `gorm:"serializer:json;type:text" json:"rules"`
+	RuleSets    []RoutingRuleSet `gorm:"serializer:json;type:text" json:"rule_sets"`
+	Egresses    []RoutingEgress  `gorm:"serializer:json;type:text" json:"egresses"`
+	CreatedAt   time.Time        `json:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+}
+
+// RoutingRule - правило маршрутизации. Условия внутри правила объединяются по И
+type RoutingRule struct {
+	Name           string   `json:"name,omitempty"`
+	Disabled       bool     `json:"disabled,omitempty"`
+	Action         string   `json:"action"`
+	Egress         string   `json:"egress,omitempty"` // Тег выхода для action=egress
+	Protocols      []string `json:"protocol,omitempty"`
+	Network        string   `json:"network,omitempty"` // tcp или udp
+	Domains        []string `json:"domain,omitempty"`
+	DomainSuffixes []string `json:"domain_suffix,omitempty"`
+	DomainKeywords []string `json:"domain_keyword,omitempty"`
+	IPCIDRs        []string `json:"ip_cidr,omitempty"`
+	Ports          []int    `json:"port,omitempty"`
+	RuleSets       []string `json:"rule_set,omitempty"`
+}
+
+// RoutingRuleSet - удалённый rule-set sing-box.
+// Для тегов geosite-* и geoip-* без URL используются rule-set'ы SagerNet
+type RoutingRuleSet struct {
+	Tag            string `json:"tag"`
+	URL            string `json:"url,omitempty"`
+	Format         string `json:"format,omitempty"`          // binary (по умолчанию) или source
+	UpdateInterval string `json:"update_interval,omitempty"` // Например 1d
+}
+
+// RoutingEgress - альтернативный выход ноды (WARP и другие WireGuard пиры)
+type RoutingEgress struct {
+	Tag           string   `json:"tag"`
+	Type          string   `json:"type"`
+	Address       []string `json:"address"` // Адреса интерфейса, например 172.16.0.2/32
+	PrivateKey    string   `json:"private_key"`
+	PeerAddress   string   `json:"peer_address"`
+	PeerPort      int      `json:"peer_port"`
+	PeerPublicKey string   `json:"peer_public_key"`
+	Reserved      []int    `json:"reserved,omitempty"` // Client ID WARP
+	MTU           int      `json:"mtu,omitempty"`
+}
+
+// Действия правил клиентской маршрутизации
+const (
+	ClientRoutingDirect = "direct" // Напрямую, мимо прокси (split tunnelling)
+	ClientRoutingProxy  = "proxy"  // Через прокси
+	ClientRoutingBlock  = "block"  // Заблокировать на клиенте
+)
+
+// ClientRoutingTemplate - шаблон клиентской маршрутизации: какие домены и сети клиент пускает
+// напрямую, через прокси или блокирует и через какой DNS их резолвит. Назначается пользователю;
+// шаблон с IsDefault действует для пользователей без своего шаблона
+type ClientRoutingTemplate struct {
+	ID          uint                `gorm:"primaryKey" json:"id"`
+	Name        string              `gorm:"uniqueIndex;size:255;not null" json:"name"`
+	Description string              `gorm:"type:text" json:"description,omitempty"`
+	IsDefault   bool                `gorm:"default:false" json:"is_default"`
+	Rules       []ClientRoutingRule `gorm:"serializer:json;type:text" json:"rules"`
+	RuleSets    []RoutingRuleSet    `gorm:"serializer:json;type:text" json:"rule_sets"`
+	DNSServers  []ClientDNSServer   `gorm:"serializer:json;type:text" json:"dns_servers"`
+	CreatedAt   time.Time           `json:"created_at"`
+	UpdatedAt   time.Time           `json:"updated_at"`
+}
+
+// ClientRoutingRule - правило клиентской маршрутизации. Правило срабатывает, если совпало любое условие
+type ClientRoutingRule struct {
+	Name           string   `json:"name,omitempty"`
+	Disabled       bool     `json:"disabled,omitempty"`
+	Action         string   `json:"action"`
+	Domains        []string `json:"domain,omitempty"`
+	DomainSuffixes []string `json:"domain_suffix,omitempty"`
+	DomainKeywords []string `json:"domain_keyword,omitempty"`
+	IPCIDRs        []string `json:"ip_cidr,omitempty"`
+	RuleSets       []string `json:"rule_set,omitempty"`
+	DNS            string   `json:"dns,omitempty"` // Тег DNS сервера для доменов правила
+}
+
+// ClientDNSServer - DNS сервер шаблона для отдельных правил (например, DNS провайдера для банков)
+type ClientDNSServer struct {
+	Tag     string `json:"tag"`
+	Address string `json:"address"`          // IP (UDP), https://host/path (DoH) или local (системный)
+	Detour  string `json:"detour,omitempty"` // direct (по умолчанию) или proxy
+}
+
 // TrafficStats - статистика трафика
 type TrafficStats struct {
 	ID         uint      `gorm:"primaryKey" json:"id"`
@@ -137,5 +851,12 @@ func AutoMigrate(db *gorm.DB) error {
 		&Inbound{},
 		&UserInbound{},
 		&TrafficStats{},
+		&Certificate{},
+		&AgentRelease{},
+		&AgentRollout{},
+		&AgentRolloutNode{},
+		&RoutingPolicy{},
+		&WireGuardPeer{},
+		&ClientRoutingTemplate{},
 	)
 }
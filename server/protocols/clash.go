@@ -0,0 +1,91 @@
+package protocols
+
+import (
+	"encoding/base64"
+
+	"zen-admin/models"
+	"zen-admin/pkg/ech"
+)
+
+// Прокси Clash/Mihomo описываются map'ами с ключами в формате конфига Mihomo
+
+// clashTransport добавляет в прокси VLESS параметры транспорта (network и *-opts)
+func clashTransport(proxy map[string]interface{}, inbound *models.Inbound) {
+	host := inbound.TransportHostOrSNI()
+
+	switch inbound.VLESSTransport() {
+	case models.TransportWS:
+		proxy["network"] = "ws"
+		proxy["ws-opts"] = clashWSOpts(inbound.TransportPath(), host)
+	case models.TransportHTTPUpgrade:
+		opts := clashWSOpts(inbound.TransportPath(), host)
+		opts["v2ray-http-upgrade"] = true
+		delete(opts, "max-early-data")
+		delete(opts, "early-data-header-name")
+		proxy["network"] = "ws"
+		proxy["ws-opts"] = opts
+	case models.TransportGRPC:
+		proxy["network"] = "grpc"
+		proxy["grpc-opts"] = map[string]interface{}{
+			"grpc-service-name": inbound.GRPCService(),
+		}
+	case models.TransportHTTP:
+		// HTTP транспорт sing-box - это HTTP/2 поверх TLS, в Mihomo он называется h2
+		proxy["network"] = "h2"
+		proxy["h2-opts"] = map[string]interface{}{
+			"host": []string{host},
+			"path": inbound.TransportPath(),
+		}
+	default:
+		proxy["network"] = "tcp"
+	}
+}
+
+// clashWSOpts - WebSocket с early data, как в outbound sing-box
+func clashWSOpts(path, host string) map[string]interface{} {
+	return map[string]interface{}{
+		"path": path,
+		"headers": map[string]interface{}{
+			"Host": host,
+		},
+		"max-early-data":         2048,
+		"early-data-header-name": "Sec-WebSocket-Protocol",
+	}
+}
+
+// clashMultiplex - multiplex sing-box в Mihomo называется smux и поддерживает те же протоколы
+func clashMultiplex(inbound *models.Inbound) map[string]interface{} {
+	if !inbound.MultiplexActive() {
+		return nil
+	}
+
+	smux := map[string]interface{}{
+		"enabled":         true,
+		"protocol":        inbound.MuxProtocolOrDefault(),
+		"max-connections": inbound.MuxMaxConnectionsOrDefault(),
+		"padding":         inbound.MuxPadding,
+	}
+	if inbound.BrutalEnabled() {
+		smux["brutal-opts"] = map[string]interface{}{
+			"enabled": true,
+			"up":      inbound.BrutalUpMbps,
+			"down":    inbound.BrutalDownMbps,
+		}
+	}
+	return smux
+}
+
+// clashECH - Mihomo принимает ECHConfigList в base64
+func clashECH(inbound *models.Inbound) map[string]interface{} {
+	if !inbound.ECHEnabled || inbound.ECHConfig == "" {
+		return nil
+	}
+	list, err := ech.ConfigList(inbound.ECHConfig)
+	if err != nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"enabled": true,
+		"config":  base64.StdEncoding.EncodeToString(list),
+	}
+}
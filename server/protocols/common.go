@@ -0,0 +1,301 @@
+package protocols
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"zen-admin/models"
+)
+
+// Поля, общие для нескольких протоколов
+var (
+	fieldSNI = Field{
+		Name:        "sni",
+		Type:        "string",
+		Required:    true,
+		Description: "Домен сертификата (для REALITY - домен маскировки)",
+	}
+	fieldCertPath = Field{
+		Name:        "cert_path",
+		Type:        "string",
+		Default:     "/etc/ssl/certs/cert.pem",
+		Description: "Путь к сертификату на ноде (по умолчанию - отслеживаемый сертификат SNI)",
+	}
+	fieldKeyPath = Field{
+		Name:        "key_path",
+		Type:        "string",
+		Default:     "/etc/ssl/private/key.pem",
+		Description: "Путь к приватному ключу на ноде",
+	}
+	fieldFingerprint = Field{
+		Name:        "fingerprint",
+		Type:        "string",
+		Default:     "chrome",
+		Description: "uTLS fingerprint клиента",
+	}
+	fieldWSPath = Field{
+		Name:        "ws_path",
+		Type:        "string",
+		Default:     "/ws",
+		Description: "Путь WebSocket/HTTP транспорта",
+	}
+	fieldGRPCServiceName = Field{
+		Name:        "grpc_service_name",
+		Type:        "string",
+		Default:     "grpc",
+		Description: "Имя gRPC сервиса",
+	}
+	fieldTransportHost = Field{
+		Name:        "transport_host",
+		Type:        "string",
+		Description: "Host транспорта (по умолчанию SNI)",
+	}
+	fieldALPN = Field{
+		Name:        "alpn",
+		Type:        "string[]",
+		Description: "ALPN",
+	}
+)
+
+// multiplexFields - поля multiplex и TCP Brutal для протоколов поверх TCP
+var multiplexFields = []Field{
+	{Name: "mux_enabled", Type: "bool", Description: "Включить multiplex"},
+	{Name: "mux_protocol", Type: "string", Default: models.MuxH2Mux, Options: []string{models.MuxSmux, models.MuxYamux, models.MuxH2Mux}, Description: "Протокол multiplex"},
+	{Name: "mux_max_connections", Type: "int", Default: models.DefaultMuxMaxConnections, Description: "Максимум соединений клиента (0-32)"},
+	{Name: "mux_padding", Type: "bool", Description: "Padding multiplex"},
+	{Name: "brutal_up_mbps", Type: "int", Description: "TCP Brutal: скорость отдачи клиента, Мбит/с"},
+	{Name: "brutal_down_mbps", Type: "int", Description: "TCP Brutal: скорость загрузки клиента, Мбит/с"},
+}
+
+// setDefault записывает в незаданное поле значение по умолчанию поля name из Spec
+func setDefault[T comparable](dst *T, spec Spec, name string) {
+	var zero T
+	if *dst != zero {
+		return
+	}
+	for _, field := range spec.Fields {
+		if field.Name == name {
+			if value, ok := field.Default.(T); ok {
+				*dst = value
+			}
+			return
+		}
+	}
+}
+
+// certificateDefaults - стандартные пути Let's Encrypt, если для SNI нет отслеживаемого сертификата
+func certificateDefaults(spec Spec, inbound *models.Inbound) {
+	setDefault(&inbound.CertPath, spec, "cert_path")
+	setDefault(&inbound.KeyPath, spec, "key_path")
+}
+
+// fallbackPorts - локальный fallback-сервер слушает свой порт, sing-box туда вставать не должен
+func fallbackPorts(inbound *models.Inbound, title string) []Port {
+	if !inbound.LocalFallback() {
+		return nil
+	}
+	return []Port{{
+		Port:        inbound.FallbackPort,
+		Network:     "tcp",
+		Fallback:    true,
+		Description: fmt.Sprintf("fallback веб-сервер %s инбаунда «%s»", title, inbound.Name),
+	}}
+}
+
+// transportField описывает поле transport с допустимыми для протокола значениями
+func transportField(protocol models.Protocol) Field {
+	allowed := vlessTransports[protocol]
+	return Field{
+		Name:        "transport",
+		Type:        "string",
+		Default:     allowed[0],
+		Options:     allowed,
+		Description: "Транспорт VLESS",
+	}
+}
+
+// exclusiveFields - поля, которые принимают не все протоколы. Если протокол
+// не описывает поле в Spec, заданное значение - ошибка, а не молчаливый игнор
+var exclusiveFields = []struct {
+	name string
+	set  func(inbound *models.Inbound) bool
+}{
+	{"transport", func(i *models.Inbound) bool { return i.Transport != "" }},
+	{"obfs", func(i *models.Inbound) bool { return i.Obfs != "" }},
+	{"hop_port_start", func(i *models.Inbound) bool { return i.HopPortStart != 0 || i.HopPortEnd != 0 }},
+	{"server_names", func(i *models.Inbound) bool { return len(i.ServerNames) > 0 }},
+	{"sni_relay_port", func(i *models.Inbound) bool { return i.SNIRelayPort != 0 }},
+	{"per_user_short_ids", func(i *models.Inbound) bool { return i.PerUserShortIDs }},
+	{"ech_enabled", func(i *models.Inbound) bool { return i.ECHEnabled }},
+	{"ech_public_name", func(i *models.Inbound) bool { return i.ECHPublicName != "" }},
+}
+
+// validateExclusiveFields проверяет, что заданы только поля, которые принимает протокол
+func validateExclusiveFields(spec Spec, inbound *models.Inbound) error {
+	for _, field := range exclusiveFields {
+		if field.set(inbound) && !spec.HasField(field.name) {
+			return invalid("%s не поддерживается протоколом %s", field.name, spec.Name)
+		}
+	}
+	return nil
+}
+
+// requireCertificate проверяет SNI и сертификат протоколов, где TLS терминирует сам sing-box
+func requireCertificate(inbound *models.Inbound) error {
+	if inbound.SNI == "" {
+		return invalid("Для %s нужен SNI (домен сертификата)", inbound.Protocol)
+	}
+	if inbound.CertPath == "" || inbound.KeyPath == "" {
+		return invalid("Для %s нужны cert_path и key_path", inbound.Protocol)
+	}
+	return nil
+}
+
+// Транспорты, допустимые для VLESS инбаундов
+var vlessTransports = map[models.Protocol][]string{
+	// Vision требует сырой TCP, но REALITY работает и поверх gRPC/HTTP/2
+	models.ProtocolReality: {models.TransportTCP, models.TransportGRPC, models.TransportHTTP},
+	models.ProtocolWSTLS:   {models.TransportWS, models.TransportGRPC, models.TransportHTTPUpgrade, models.TransportHTTP},
+}
+
+var grpcServiceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// validateTransport проверяет транспорт VLESS инбаунда
+func validateTransport(inbound *models.Inbound) error {
+	allowed := vlessTransports[inbound.Protocol]
+	if inbound.Transport != "" && !slices.Contains(allowed, inbound.Transport) {
+		return invalid("Для %s transport должен быть: %s", inbound.Protocol, strings.Join(allowed, ", "))
+	}
+	if !strings.HasPrefix(inbound.TransportPath(), "/") || strings.ContainsAny(inbound.TransportPath(), " ?#") {
+		return invalid("ws_path должен начинаться с / и не содержать пробелов, ? и #")
+	}
+	if !grpcServiceNamePattern.MatchString(inbound.GRPCService()) {
+		return invalid("grpc_service_name может содержать только латиницу, цифры, _, . и -")
+	}
+	if strings.ContainsAny(inbound.TransportHost, "/ ") {
+		return invalid("transport_host указывается без схемы и пути")
+	}
+	return nil
+}
+
+// clientTransport генерирует клиентский транспорт VLESS (nil для сырого TCP)
+func clientTransport(inbound *models.Inbound) map[string]interface{} {
+	host := inbound.TransportHostOrSNI()
+
+	switch inbound.VLESSTransport() {
+	case models.TransportWS:
+		return map[string]interface{}{
+			"type": "ws",
+			"path": inbound.TransportPath(),
+			"headers": map[string]interface{}{
+				"Host": host,
+			},
+			"early_data_header_name": "Sec-WebSocket-Protocol",
+			"max_early_data":         2048,
+		}
+	case models.TransportGRPC:
+		return map[string]interface{}{
+			"type":         "grpc",
+			"service_name": inbound.GRPCService(),
+		}
+	case models.TransportHTTPUpgrade:
+		return map[string]interface{}{
+			"type": "httpupgrade",
+			"host": host,
+			"path": inbound.TransportPath(),
+		}
+	case models.TransportHTTP:
+		return map[string]interface{}{
+			"type": "http",
+			"host": []string{host},
+			"path": inbound.TransportPath(),
+		}
+	}
+	return nil
+}
+
+// transportURLParams добавляет параметры транспорта VLESS в share URL (формат Xray)
+func transportURLParams(params url.Values, inbound *models.Inbound) {
+	transport := inbound.VLESSTransport()
+	params.Set("type", transport)
+
+	switch transport {
+	case models.TransportWS, models.TransportHTTPUpgrade, models.TransportHTTP:
+		params.Set("path", inbound.TransportPath())
+		params.Set("host", inbound.TransportHostOrSNI())
+	case models.TransportGRPC:
+		params.Set("serviceName", inbound.GRPCService())
+		params.Set("mode", "gun")
+	}
+}
+
+// validateMultiplex проверяет настройки multiplex и TCP Brutal
+func validateMultiplex(inbound *models.Inbound) error {
+	if !inbound.MuxEnabled {
+		return nil
+	}
+	if !inbound.SupportsMultiplex() {
+		return invalid("Multiplex не поддерживается для %s (QUIC протоколы и REALITY с xtls-rprx-vision)", inbound.Protocol)
+	}
+
+	switch inbound.MuxProtocol {
+	case "", models.MuxSmux, models.MuxYamux, models.MuxH2Mux:
+	default:
+		return invalid("mux_protocol должен быть smux, yamux или h2mux")
+	}
+	if inbound.MuxMaxConnections < 0 || inbound.MuxMaxConnections > 32 {
+		return invalid("mux_max_connections должен быть в диапазоне 0-32")
+	}
+	if inbound.BrutalUpMbps < 0 || inbound.BrutalDownMbps < 0 {
+		return invalid("Скорость Brutal не может быть отрицательной")
+	}
+	if (inbound.BrutalUpMbps > 0) != (inbound.BrutalDownMbps > 0) {
+		return invalid("Для Brutal нужны обе скорости: brutal_up_mbps и brutal_down_mbps")
+	}
+
+	return nil
+}
+
+// clientMultiplex генерирует клиентский multiplex (nil, если выключен)
+func clientMultiplex(inbound *models.Inbound) map[string]interface{} {
+	if !inbound.MultiplexActive() {
+		return nil
+	}
+
+	mux := map[string]interface{}{
+		"enabled":         true,
+		"protocol":        inbound.MuxProtocolOrDefault(),
+		"max_connections": inbound.MuxMaxConnectionsOrDefault(),
+		"padding":         inbound.MuxPadding,
+	}
+	if inbound.BrutalEnabled() {
+		mux["brutal"] = map[string]interface{}{
+			"enabled":   true,
+			"up_mbps":   inbound.BrutalUpMbps,
+			"down_mbps": inbound.BrutalDownMbps,
+		}
+	}
+	return mux
+}
+
+// multiplexURLParams добавляет multiplex в share URL. Стандарта нет — параметры
+// понимают клиенты на sing-box, остальные их игнорируют
+func multiplexURLParams(params url.Values, inbound *models.Inbound) {
+	if !inbound.MultiplexActive() {
+		return
+	}
+
+	params.Set("mux", inbound.MuxProtocolOrDefault())
+	params.Set("mux_max_connections", strconv.Itoa(inbound.MuxMaxConnectionsOrDefault()))
+	if inbound.MuxPadding {
+		params.Set("mux_padding", "1")
+	}
+	if inbound.BrutalEnabled() {
+		params.Set("mux_brutal_up", strconv.Itoa(inbound.BrutalUpMbps))
+		params.Set("mux_brutal_down", strconv.Itoa(inbound.BrutalDownMbps))
+	}
+}
@@ -0,0 +1,92 @@
+package protocols
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"zen-admin/models"
+	"zen-admin/pkg/ech"
+)
+
+// Поля ECH для протоколов, где TLS терминирует sing-box
+var (
+	fieldECHEnabled = Field{
+		Name:        "ech_enabled",
+		Type:        "bool",
+		Description: "Encrypted Client Hello (ключи генерирует панель)",
+	}
+	fieldECHPublicName = Field{
+		Name:        "ech_public_name",
+		Type:        "string",
+		Description: "Внешний SNI в ClientHello (по умолчанию sni)",
+	}
+)
+
+// applyECH генерирует ключи ECH при включении и перевыпускает их, если сменился внешний SNI:
+// он зашит в ECHConfig, который получили клиенты
+func applyECH(inbound *models.Inbound) error {
+	if !inbound.ECHEnabled {
+		return nil
+	}
+
+	outer := inbound.ECHOuterName()
+	if !serverNamePattern.MatchString(outer) {
+		return invalid("Для ECH нужен sni или ech_public_name")
+	}
+	if inbound.CertPath == "" || inbound.KeyPath == "" {
+		return invalid("ECH работает, только когда TLS терминирует sing-box: нужны cert_path и key_path")
+	}
+
+	if inbound.ECHKey != "" {
+		if name, err := ech.PublicName(inbound.ECHConfig); err == nil && name == outer {
+			return nil
+		}
+	}
+
+	keys, err := ech.GenerateKeyPair(outer)
+	if err != nil {
+		return fmt.Errorf("ошибка генерации ключей ECH: %w", err)
+	}
+	inbound.ECHKey = keys.Key
+	inbound.ECHConfig = keys.Config
+	return nil
+}
+
+// clientECH добавляет ECHConfig в TLS клиентского outbound.
+// uTLS в sing-box несовместим с ECH, поэтому fingerprint при ECH не задаётся
+func clientECH(outbound map[string]interface{}, inbound *models.Inbound) {
+	if !inbound.ECHEnabled || inbound.ECHConfig == "" {
+		return
+	}
+	tls, ok := outbound["tls"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	delete(tls, "utls")
+	tls["ech"] = map[string]interface{}{
+		"enabled": true,
+		"config":  strings.Split(strings.TrimSpace(inbound.ECHConfig), "\n"),
+	}
+}
+
+// ECHDNSRecord возвращает HTTPS запись (RFC 9460) с ECHConfigList для зоны домена инбаунда.
+// По ней ECH находят браузеры и клиенты, которым список не передан в конфиге
+func ECHDNSRecord(inbound *models.Inbound) (string, error) {
+	list, err := ech.ConfigList(inbound.ECHConfig)
+	if err != nil {
+		return "", fmt.Errorf("некорректный ECHConfig: %w", err)
+	}
+
+	owner := inbound.SNI + "."
+	if inbound.ListenPort != 443 {
+		owner = fmt.Sprintf("_%d._https.%s", inbound.ListenPort, owner)
+	}
+	alpn := "h2,http/1.1"
+	if p, ok := Get(inbound.Protocol); ok && p.Spec().Network == "udp" {
+		alpn = "h3"
+	}
+
+	return fmt.Sprintf(`%s 300 IN HTTPS 1 . alpn="%s" ech="%s"`, owner, alpn, base64.StdEncoding.EncodeToString(list)), nil
+}
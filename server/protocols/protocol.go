@@ -0,0 +1,304 @@
+// Package protocols - реестр протоколов инбаундов.
+// Каждая реализация отвечает за значения по умолчанию, проверку настроек,
+// серверный inbound sing-box, клиентский outbound и share URL своего протокола
+package protocols
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"zen-admin/models"
+	"zen-admin/singbox"
+)
+
+// Protocol - реализация протокола инбаунда
+type Protocol interface {
+	// Spec описывает протокол и его поля для UI
+	Spec() Spec
+	// ApplyDefaults заполняет незаданные поля значениями по умолчанию из Spec и генерирует ключи
+	ApplyDefaults(inbound *models.Inbound) error
+	// Validate проверяет настройки протокола
+	Validate(inbound *models.Inbound) error
+	// ServerInbound строит серверный inbound sing-box (nil - протокол рендерится отдельно)
+	ServerInbound(inbound *models.Inbound, users []models.User) interface{}
+	// ClientOutbound строит клиентский outbound sing-box
+	ClientOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error)
+	// ShareURL кодирует ссылку для импорта в клиент
+	ShareURL(user *models.User, inbound *models.Inbound) (string, error)
+	// ClashProxy строит прокси Clash/Mihomo с именем name
+	ClashProxy(user *models.User, inbound *models.Inbound, name string) (map[string]interface{}, error)
+	// XrayOutbound строит outbound Xray-core (ErrNoClientConfig - протокола нет в Xray)
+	XrayOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error)
+}
+
+// chainedClient - протокол, клиентский outbound которого идёт через вспомогательные
+// outbound'ы (detour). Они не попадают в селектор серверов
+type chainedClient interface {
+	DetourOutbounds(user *models.User, inbound *models.Inbound, tag string) ([]map[string]interface{}, error)
+}
+
+// extraPorts - протокол занимает на ноде порты помимо ListenPort в сети Spec().Network
+// (локальный fallback, внутренние порты, диапазон port hopping)
+type extraPorts interface {
+	ExtraPorts(inbound *models.Inbound) []Port
+}
+
+// Port - порт или диапазон портов, который инбаунд занимает на ноде
+type Port struct {
+	Port        int
+	PortEnd     int // Конец диапазона, 0 - одиночный порт
+	Network     string
+	Fallback    bool // Порт локального fallback-сервера: его могут делить несколько инбаундов
+	Description string
+}
+
+// Spec - описание протокола для /api/protocols
+type Spec struct {
+	Name        models.Protocol `json:"name"`
+	Title       string          `json:"title"`
+	Network     string          `json:"network"` // tcp или udp
+	DefaultPort int             `json:"default_port"`
+	Multiplex   bool            `json:"multiplex"`
+	ShareURL    bool            `json:"share_url"`
+	Fields      []Field         `json:"fields"`
+}
+
+// Field - поле запроса создания инбаунда, которое относится к протоколу
+type Field struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type"` // string, int, bool, string[]
+	Required    bool        `json:"required,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+	Options     []string    `json:"options,omitempty"`
+	Description string      `json:"description"`
+}
+
+// HasField - протокол принимает поле запроса
+func (s Spec) HasField(name string) bool {
+	for _, field := range s.Fields {
+		if field.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidationError - некорректные настройки инбаунда (ответ 400)
+type ValidationError string
+
+func (e ValidationError) Error() string {
+	return string(e)
+}
+
+func invalid(format string, args ...interface{}) error {
+	return ValidationError(fmt.Sprintf(format, args...))
+}
+
+// ErrNoClientConfig - для протокола нет клиентского outbound или share URL
+var ErrNoClientConfig = errors.New("протокол не поддерживает этот формат конфига")
+
+// Порядок реестра - порядок протоколов в /api/protocols и в сообщениях об ошибках
+var registry = []Protocol{
+	vlessReality{},
+	vlessTLS{},
+	hysteria2{},
+	tuic{},
+	trojan{},
+	vmess{},
+	shadowsocks{},
+	shadowTLS{},
+	wireguard{},
+}
+
+// Серверные inbound'ы строятся типизированными шаблонами sing-box
+var templates = singbox.NewTemplateGenerator()
+
+// Get возвращает реализацию протокола
+func Get(name models.Protocol) (Protocol, bool) {
+	for _, p := range registry {
+		if p.Spec().Name == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// All возвращает все зарегистрированные протоколы
+func All() []Protocol {
+	return registry
+}
+
+// Specs возвращает описания всех протоколов
+func Specs() []Spec {
+	specs := make([]Spec, len(registry))
+	for i, p := range registry {
+		specs[i] = p.Spec()
+	}
+	return specs
+}
+
+// Names возвращает имена протоколов через запятую
+func Names() string {
+	names := make([]string, len(registry))
+	for i, p := range registry {
+		names[i] = string(p.Spec().Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func lookup(name models.Protocol) (Protocol, error) {
+	p, ok := Get(name)
+	if !ok {
+		return nil, fmt.Errorf("неподдерживаемый протокол: %s", name)
+	}
+	return p, nil
+}
+
+// Prepare применяет значения по умолчанию протокола и проверяет настройки инбаунда.
+// Некорректные настройки возвращаются как ValidationError
+func Prepare(inbound *models.Inbound) error {
+	p, ok := Get(inbound.Protocol)
+	if !ok {
+		return invalid("Неподдерживаемый протокол. Используйте: %s", Names())
+	}
+
+	if inbound.ListenPort == 0 {
+		inbound.ListenPort = p.Spec().DefaultPort
+	}
+	if err := p.ApplyDefaults(inbound); err != nil {
+		return err
+	}
+	if err := validateExclusiveFields(p.Spec(), inbound); err != nil {
+		return err
+	}
+	if err := applyECH(inbound); err != nil {
+		return err
+	}
+	if err := validateMultiplex(inbound); err != nil {
+		return err
+	}
+	return p.Validate(inbound)
+}
+
+// Ports возвращает порты, которые инбаунд занимает на ноде: ListenPort и дополнительные порты протокола
+func Ports(inbound *models.Inbound) []Port {
+	p, ok := Get(inbound.Protocol)
+	if !ok {
+		return nil
+	}
+
+	spec := p.Spec()
+	ports := []Port{{
+		Port:        inbound.ListenPort,
+		Network:     spec.Network,
+		Description: fmt.Sprintf("%s инбаунд «%s»", spec.Title, inbound.Name),
+	}}
+	if extra, ok := p.(extraPorts); ok {
+		ports = append(ports, extra.ExtraPorts(inbound)...)
+	}
+	return ports
+}
+
+// ServerInbound строит серверный inbound инбаунда (подходит как singbox.InboundRenderer)
+func ServerInbound(inbound *models.Inbound, users []models.User) (interface{}, error) {
+	p, err := lookup(inbound.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	return p.ServerInbound(inbound, users), nil
+}
+
+// InboundJSON генерирует JSON серверного inbound одного инбаунда
+func InboundJSON(inbound *models.Inbound, users []models.User) (string, error) {
+	config, err := ServerInbound(inbound, users)
+	if err != nil {
+		return "", err
+	}
+	if config == nil {
+		return "", fmt.Errorf("протокол %s не рендерится как inbound", inbound.Protocol)
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("ошибка сериализации: %w", err)
+	}
+	return string(data), nil
+}
+
+// ClientOutbound строит клиентский outbound инбаунда вместе с multiplex
+func ClientOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
+	p, err := lookup(inbound.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	outbound, err := p.ClientOutbound(user, inbound, tag)
+	if err != nil {
+		return nil, err
+	}
+	if mux := clientMultiplex(inbound); mux != nil {
+		outbound["multiplex"] = mux
+	}
+	clientECH(outbound, inbound)
+	return outbound, nil
+}
+
+// ClientDetours строит вспомогательные outbound'ы, на которые ссылается outbound инбаунда
+// с тегом tag (nil, если протоколу они не нужны)
+func ClientDetours(user *models.User, inbound *models.Inbound, tag string) ([]map[string]interface{}, error) {
+	p, err := lookup(inbound.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	chained, ok := p.(chainedClient)
+	if !ok {
+		return nil, nil
+	}
+	return chained.DetourOutbounds(user, inbound, tag)
+}
+
+// ClashProxy строит прокси Clash/Mihomo инбаунда вместе с smux и ECH
+func ClashProxy(user *models.User, inbound *models.Inbound, name string) (map[string]interface{}, error) {
+	p, err := lookup(inbound.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := p.ClashProxy(user, inbound, name)
+	if err != nil {
+		return nil, err
+	}
+	if smux := clashMultiplex(inbound); smux != nil {
+		proxy["smux"] = smux
+	}
+	if echOpts := clashECH(inbound); echOpts != nil {
+		proxy["ech-opts"] = echOpts
+		delete(proxy, "client-fingerprint")
+	}
+	return proxy, nil
+}
+
+// XrayOutbound строит outbound Xray-core инбаунда. Multiplex sing-box в Xray нет:
+// сервер принимает и соединения без него, если не требует padding
+func XrayOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
+	p, err := lookup(inbound.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	if inbound.MultiplexActive() && inbound.MuxPadding {
+		return nil, ErrNoClientConfig
+	}
+	return p.XrayOutbound(user, inbound, tag)
+}
+
+// ShareURL генерирует ссылку для импорта (vless://, hysteria2://, tuic://, trojan://, vmess://, ss://)
+func ShareURL(user *models.User, inbound *models.Inbound) (string, error) {
+	p, err := lookup(inbound.Protocol)
+	if err != nil {
+		return "", err
+	}
+	return p.ShareURL(user, inbound)
+}
@@ -0,0 +1,169 @@
+package protocols
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"zen-admin/models"
+)
+
+// shadowsocks - Shadowsocks 2022 с несколькими пользователями на одном порту
+type shadowsocks struct{}
+
+func (shadowsocks) Spec() Spec {
+	return Spec{
+		Name:        models.ProtocolShadowsocks,
+		Title:       "Shadowsocks 2022",
+		Network:     "tcp",
+		DefaultPort: 443,
+		Multiplex:   true,
+		ShareURL:    true,
+		Fields: append([]Field{
+			{Name: "ss_method", Type: "string", Default: models.SS2022AES128GCM, Options: []string{models.SS2022AES128GCM, models.SS2022AES256GCM}, Description: "Метод шифрования"},
+			{Name: "ss_server_key", Type: "string", Description: "PSK сервера, base64 (генерируется, если не задан)"},
+		}, multiplexFields...),
+	}
+}
+
+// ApplyDefaults заполняет метод и генерирует PSK сервера и секрет ключей пользователей
+func (shadowsocks) ApplyDefaults(inbound *models.Inbound) error {
+	if inbound.SSMethod == "" {
+		inbound.SSMethod = models.SS2022AES128GCM
+	}
+	if models.SSKeyLength(inbound.SSMethod) == 0 {
+		return invalid("Неподдерживаемый метод shadowsocks. Используйте: %s, %s", models.SS2022AES128GCM, models.SS2022AES256GCM)
+	}
+
+	if inbound.SSServerKey == "" {
+		key, err := GenerateSSKey(inbound.SSMethod)
+		if err != nil {
+			return fmt.Errorf("ошибка генерации ключа: %w", err)
+		}
+		inbound.SSServerKey = key
+	}
+
+	if inbound.SSUserKeySeed == "" {
+		seed, err := GenerateSSSeed()
+		if err != nil {
+			return fmt.Errorf("ошибка генерации ключа: %w", err)
+		}
+		inbound.SSUserKeySeed = seed
+	}
+
+	return nil
+}
+
+// Validate проверяет, что PSK сервера подходит методу
+func (shadowsocks) Validate(inbound *models.Inbound) error {
+	if err := ValidateSSKey(inbound.SSMethod, inbound.SSServerKey); err != nil {
+		return invalid("Некорректный ss_server_key: %v", err)
+	}
+	return nil
+}
+
+// ExtraPorts - Shadowsocks слушает тот же порт и по UDP
+func (shadowsocks) ExtraPorts(inbound *models.Inbound) []Port {
+	return []Port{{
+		Port:        inbound.ListenPort,
+		Network:     "udp",
+		Description: fmt.Sprintf("Shadowsocks 2022 инбаунд «%s» (UDP)", inbound.Name),
+	}}
+}
+
+func (shadowsocks) ServerInbound(inbound *models.Inbound, users []models.User) interface{} {
+	return templates.GenerateShadowsocksInbound(inbound, users)
+}
+
+// ClientOutbound генерирует Shadowsocks 2022 outbound
+func (shadowsocks) ClientOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"type":        "shadowsocks",
+		"tag":         tag,
+		"server":      inbound.Node.Address,
+		"server_port": inbound.ListenPort,
+		"method":      inbound.SSMethod,
+		"password":    inbound.SSClientPassword(user),
+	}, nil
+}
+
+// ShareURL генерирует ss:// URL по SIP002.
+// Для методов 2022 userinfo не кодируется в base64, а percent-кодируется
+func (shadowsocks) ShareURL(user *models.User, inbound *models.Inbound) (string, error) {
+	// Формат: ss://method:password@server:port#name
+	name := url.QueryEscape(fmt.Sprintf("%s (ss)", user.Name))
+	shareURL := fmt.Sprintf("ss://%s:%s@%s:%d#%s",
+		url.QueryEscape(inbound.SSMethod),
+		url.QueryEscape(inbound.SSClientPassword(user)),
+		inbound.Node.Address,
+		inbound.ListenPort,
+		name,
+	)
+
+	return shareURL, nil
+}
+
+// ClashProxy генерирует прокси ss
+func (shadowsocks) ClashProxy(user *models.User, inbound *models.Inbound, name string) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"name":     name,
+		"type":     "ss",
+		"server":   inbound.Node.Address,
+		"port":     inbound.ListenPort,
+		"cipher":   inbound.SSMethod,
+		"password": inbound.SSClientPassword(user),
+		"udp":      true,
+	}, nil
+}
+
+// XrayOutbound генерирует Shadowsocks 2022 outbound Xray (пароль "<PSK сервера>:<ключ пользователя>")
+func (shadowsocks) XrayOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"tag":      tag,
+		"protocol": "shadowsocks",
+		"settings": map[string]interface{}{
+			"servers": []map[string]interface{}{{
+				"address":  inbound.Node.Address,
+				"port":     inbound.ListenPort,
+				"method":   inbound.SSMethod,
+				"password": inbound.SSClientPassword(user),
+			}},
+		},
+	}, nil
+}
+
+// GenerateSSKey генерирует случайный PSK нужной для метода длины (base64)
+func GenerateSSKey(method string) (string, error) {
+	length := models.SSKeyLength(method)
+	if length == 0 {
+		return "", fmt.Errorf("неподдерживаемый метод shadowsocks: %s", method)
+	}
+	return randomBase64(length)
+}
+
+// GenerateSSSeed генерирует секрет для вывода ключей пользователей
+func GenerateSSSeed() (string, error) {
+	return randomBase64(32)
+}
+
+// ValidateSSKey проверяет, что PSK сервера подходит методу
+func ValidateSSKey(method, key string) error {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return errors.New("ключ должен быть в base64")
+	}
+	if len(raw) != models.SSKeyLength(method) {
+		return fmt.Errorf("для %s нужен ключ длиной %d байт", method, models.SSKeyLength(method))
+	}
+	return nil
+}
+
+func randomBase64(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
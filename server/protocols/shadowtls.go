@@ -0,0 +1,114 @@
+package protocols
+
+import (
+	"zen-admin/models"
+)
+
+// shadowTLS - Shadowsocks 2022 за ShadowTLS v3: снаружи настоящий TLS handshake с чужим
+// сервером, внутри - Shadowsocks. Пароль ShadowTLS у каждого пользователя свой.
+// Клиенту нужны два outbound'а: shadowsocks с detour через shadowtls
+type shadowTLS struct{}
+
+func (shadowTLS) Spec() Spec {
+	return Spec{
+		Name:        models.ProtocolShadowTLS,
+		Title:       "ShadowTLS v3 + Shadowsocks 2022",
+		Network:     "tcp",
+		DefaultPort: 443,
+		Multiplex:   true,
+		Fields: append([]Field{
+			{Name: "sni", Type: "string", Required: true, Description: "Домен handshake сервера, его сертификат видит DPI"},
+			{Name: "fallback_addr", Type: "string", Description: "Адрес handshake сервера (по умолчанию sni)"},
+			{Name: "fallback_port", Type: "int", Default: 443, Description: "Порт handshake сервера"},
+			{Name: "ss_method", Type: "string", Default: models.SS2022AES128GCM, Options: []string{models.SS2022AES128GCM, models.SS2022AES256GCM}, Description: "Метод шифрования Shadowsocks"},
+			{Name: "ss_server_key", Type: "string", Description: "PSK сервера, base64 (генерируется, если не задан)"},
+			fieldFingerprint,
+		}, multiplexFields...),
+	}
+}
+
+// ApplyDefaults генерирует ключи Shadowsocks; из его секрета выводятся и пароли ShadowTLS
+func (p shadowTLS) ApplyDefaults(inbound *models.Inbound) error {
+	setDefault(&inbound.Fingerprint, p.Spec(), "fingerprint")
+	return shadowsocks{}.ApplyDefaults(inbound)
+}
+
+func (shadowTLS) Validate(inbound *models.Inbound) error {
+	if !serverNamePattern.MatchString(inbound.SNI) {
+		return invalid("Для shadowtls нужен sni - домен handshake сервера")
+	}
+	return shadowsocks{}.Validate(inbound)
+}
+
+// ExtraPorts - порт handshake сервера, если он запущен на самой ноде
+func (shadowTLS) ExtraPorts(inbound *models.Inbound) []Port {
+	return fallbackPorts(inbound, "ShadowTLS")
+}
+
+func (shadowTLS) ServerInbound(inbound *models.Inbound, users []models.User) interface{} {
+	return templates.GenerateShadowTLSInbounds(inbound, users)
+}
+
+// ClientOutbound генерирует Shadowsocks outbound, который ходит через shadowtls detour.
+// UDP идёт поверх TCP: ShadowTLS передаёт только TCP
+func (shadowTLS) ClientOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
+	outbound, err := shadowsocks{}.ClientOutbound(user, inbound, tag)
+	if err != nil {
+		return nil, err
+	}
+	outbound["detour"] = shadowTLSDetourTag(tag)
+	outbound["udp_over_tcp"] = true
+	return outbound, nil
+}
+
+// DetourOutbounds генерирует ShadowTLS v3 outbound, через который идёт Shadowsocks
+func (shadowTLS) DetourOutbounds(user *models.User, inbound *models.Inbound, tag string) ([]map[string]interface{}, error) {
+	return []map[string]interface{}{{
+		"type":        "shadowtls",
+		"tag":         shadowTLSDetourTag(tag),
+		"server":      inbound.Node.Address,
+		"server_port": inbound.ListenPort,
+		"version":     3,
+		"password":    inbound.ShadowTLSPassword(user),
+		"tls": map[string]interface{}{
+			"enabled":     true,
+			"server_name": inbound.SNI,
+			"utls": map[string]interface{}{
+				"enabled":     true,
+				"fingerprint": inbound.Fingerprint,
+			},
+		},
+	}}, nil
+}
+
+// ShareURL: общепринятой ссылки для ShadowTLS нет
+func (shadowTLS) ShareURL(user *models.User, inbound *models.Inbound) (string, error) {
+	return "", ErrNoClientConfig
+}
+
+// ClashProxy генерирует прокси ss с плагином shadow-tls: в Mihomo цепочка описывается одним прокси
+func (shadowTLS) ClashProxy(user *models.User, inbound *models.Inbound, name string) (map[string]interface{}, error) {
+	proxy, err := shadowsocks{}.ClashProxy(user, inbound, name)
+	if err != nil {
+		return nil, err
+	}
+	proxy["udp-over-tcp"] = true
+	proxy["udp-over-tcp-version"] = 2
+	proxy["client-fingerprint"] = inbound.Fingerprint
+	proxy["plugin"] = "shadow-tls"
+	proxy["plugin-opts"] = map[string]interface{}{
+		"host":     inbound.SNI,
+		"password": inbound.ShadowTLSPassword(user),
+		"version":  3,
+	}
+	return proxy, nil
+}
+
+// XrayOutbound: ShadowTLS в Xray-core нет
+func (shadowTLS) XrayOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
+	return nil, ErrNoClientConfig
+}
+
+func shadowTLSDetourTag(tag string) string {
+	return tag + "-shadowtls"
+}
@@ -0,0 +1,265 @@
+package protocols
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"zen-admin/models"
+)
+
+// trojan - Trojan поверх TCP + TLS. Пароль - UUID пользователя
+type trojan struct{}
+
+func (trojan) Spec() Spec {
+	return Spec{
+		Name:        models.ProtocolTrojan,
+		Title:       "Trojan",
+		Network:     "tcp",
+		DefaultPort: 443,
+		Multiplex:   true,
+		ShareURL:    true,
+		Fields:      append([]Field{fieldSNI, fieldCertPath, fieldKeyPath, fieldFingerprint, fieldECHEnabled, fieldECHPublicName}, multiplexFields...),
+	}
+}
+
+func (p trojan) ApplyDefaults(inbound *models.Inbound) error {
+	spec := p.Spec()
+	certificateDefaults(spec, inbound)
+	setDefault(&inbound.Fingerprint, spec, "fingerprint")
+	return nil
+}
+
+// Validate: TLS терминирует сам sing-box — нужны домен и сертификат
+func (trojan) Validate(inbound *models.Inbound) error {
+	return requireCertificate(inbound)
+}
+
+func (trojan) ServerInbound(inbound *models.Inbound, users []models.User) interface{} {
+	return templates.GenerateTrojanInbound(inbound, users)
+}
+
+// ClientOutbound генерирует Trojan outbound (пароль - UUID пользователя)
+func (trojan) ClientOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"type":        "trojan",
+		"tag":         tag,
+		"server":      inbound.Node.Address,
+		"server_port": inbound.ListenPort,
+		"password":    user.UUID.String(),
+		"tls": map[string]interface{}{
+			"enabled":     true,
+			"server_name": inbound.SNI,
+			"utls": map[string]interface{}{
+				"enabled":     true,
+				"fingerprint": inbound.Fingerprint,
+			},
+		},
+	}, nil
+}
+
+// ShareURL генерирует trojan:// URL
+func (trojan) ShareURL(user *models.User, inbound *models.Inbound) (string, error) {
+	// Формат: trojan://password@server:port?security=tls&sni=xxx#name
+	params := url.Values{}
+	params.Set("type", "tcp")
+	params.Set("security", "tls")
+	params.Set("sni", inbound.SNI)
+	params.Set("fp", inbound.Fingerprint)
+	multiplexURLParams(params, inbound)
+
+	name := url.QueryEscape(fmt.Sprintf("%s (trojan)", user.Name))
+	shareURL := fmt.Sprintf("trojan://%s@%s:%d?%s#%s",
+		user.UUID.String(),
+		inbound.Node.Address,
+		inbound.ListenPort,
+		params.Encode(),
+		name,
+	)
+
+	return shareURL, nil
+}
+
+// ClashProxy генерирует прокси trojan
+func (trojan) ClashProxy(user *models.User, inbound *models.Inbound, name string) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"name":               name,
+		"type":               "trojan",
+		"server":             inbound.Node.Address,
+		"port":               inbound.ListenPort,
+		"password":           user.UUID.String(),
+		"udp":                true,
+		"sni":                inbound.SNI,
+		"client-fingerprint": inbound.Fingerprint,
+	}, nil
+}
+
+// XrayOutbound генерирует Trojan outbound Xray
+func (trojan) XrayOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"tag":      tag,
+		"protocol": "trojan",
+		"settings": map[string]interface{}{
+			"servers": []map[string]interface{}{{
+				"address":  inbound.Node.Address,
+				"port":     inbound.ListenPort,
+				"password": user.UUID.String(),
+			}},
+		},
+		"streamSettings": map[string]interface{}{
+			"network":     "tcp",
+			"security":    "tls",
+			"tlsSettings": xrayTLS(inbound, inbound.SNI),
+		},
+	}, nil
+}
+
+// vmess - VMess поверх WebSocket + TLS. ID - UUID пользователя
+type vmess struct{}
+
+func (vmess) Spec() Spec {
+	return Spec{
+		Name:        models.ProtocolVMess,
+		Title:       "VMess + WS + TLS",
+		Network:     "tcp",
+		DefaultPort: 443,
+		Multiplex:   true,
+		ShareURL:    true,
+		Fields: append([]Field{
+			fieldSNI,
+			fieldWSPath,
+			{Name: "alter_id", Type: "int", Default: 0, Description: "alterId (0 - AEAD)"},
+			fieldCertPath,
+			fieldKeyPath,
+			fieldFingerprint,
+			fieldECHEnabled,
+			fieldECHPublicName,
+		}, multiplexFields...),
+	}
+}
+
+func (p vmess) ApplyDefaults(inbound *models.Inbound) error {
+	spec := p.Spec()
+	certificateDefaults(spec, inbound)
+	setDefault(&inbound.WSPath, spec, "ws_path")
+	setDefault(&inbound.Fingerprint, spec, "fingerprint")
+	return nil
+}
+
+func (vmess) Validate(inbound *models.Inbound) error {
+	if err := requireCertificate(inbound); err != nil {
+		return err
+	}
+	if inbound.AlterID < 0 || inbound.AlterID > 65535 {
+		return invalid("alter_id должен быть в диапазоне 0-65535")
+	}
+	return nil
+}
+
+func (vmess) ServerInbound(inbound *models.Inbound, users []models.User) interface{} {
+	return templates.GenerateVMessInbound(inbound, users)
+}
+
+// ClientOutbound генерирует VMess+WS+TLS outbound
+func (vmess) ClientOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"type":        "vmess",
+		"tag":         tag,
+		"server":      inbound.Node.Address,
+		"server_port": inbound.ListenPort,
+		"uuid":        user.UUID.String(),
+		"security":    "auto",
+		"alter_id":    inbound.AlterID,
+		"tls": map[string]interface{}{
+			"enabled":     true,
+			"server_name": inbound.SNI,
+			"utls": map[string]interface{}{
+				"enabled":     true,
+				"fingerprint": inbound.Fingerprint,
+			},
+		},
+		"transport": map[string]interface{}{
+			"type": "ws",
+			"path": inbound.TransportPath(),
+			"headers": map[string]interface{}{
+				"Host": inbound.SNI,
+			},
+			"early_data_header_name": "Sec-WebSocket-Protocol",
+			"max_early_data":         2048,
+		},
+	}, nil
+}
+
+// ShareURL генерирует vmess:// URL: base64 от JSON в формате v2rayN
+func (vmess) ShareURL(user *models.User, inbound *models.Inbound) (string, error) {
+	// Старые клиенты ждут числа строками
+	link := map[string]string{
+		"v":    "2",
+		"ps":   fmt.Sprintf("%s (vmess)", user.Name),
+		"add":  inbound.Node.Address,
+		"port": strconv.Itoa(inbound.ListenPort),
+		"id":   user.UUID.String(),
+		"aid":  strconv.Itoa(inbound.AlterID),
+		"scy":  "auto",
+		"net":  "ws",
+		"type": "none",
+		"host": inbound.SNI,
+		"path": inbound.TransportPath(),
+		"tls":  "tls",
+		"sni":  inbound.SNI,
+		"fp":   inbound.Fingerprint,
+	}
+
+	data, err := json.Marshal(link)
+	if err != nil {
+		return "", fmt.Errorf("ошибка сериализации vmess ссылки: %w", err)
+	}
+
+	return "vmess://" + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// ClashProxy генерирует прокси vmess поверх WebSocket + TLS
+func (vmess) ClashProxy(user *models.User, inbound *models.Inbound, name string) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"name":               name,
+		"type":               "vmess",
+		"server":             inbound.Node.Address,
+		"port":               inbound.ListenPort,
+		"uuid":               user.UUID.String(),
+		"alterId":            inbound.AlterID,
+		"cipher":             "auto",
+		"udp":                true,
+		"tls":                true,
+		"servername":         inbound.SNI,
+		"client-fingerprint": inbound.Fingerprint,
+		"network":            "ws",
+		"ws-opts":            clashWSOpts(inbound.TransportPath(), inbound.SNI),
+	}, nil
+}
+
+// XrayOutbound генерирует VMess+WS+TLS outbound Xray
+func (vmess) XrayOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"tag":      tag,
+		"protocol": "vmess",
+		"settings": map[string]interface{}{
+			"vnext": []map[string]interface{}{{
+				"address": inbound.Node.Address,
+				"port":    inbound.ListenPort,
+				"users": []map[string]interface{}{{
+					"id":       user.UUID.String(),
+					"alterId":  inbound.AlterID,
+					"security": "auto",
+				}},
+			}},
+		},
+		"streamSettings": map[string]interface{}{
+			"network":     "ws",
+			"security":    "tls",
+			"tlsSettings": xrayTLS(inbound, inbound.SNI),
+			"wsSettings":  xrayWSSettings(inbound.TransportPath(), inbound.SNI),
+		},
+	}, nil
+}
@@ -0,0 +1,413 @@
+package protocols
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+
+	"zen-admin/models"
+	"zen-admin/pkg/reality"
+)
+
+// vlessReality - VLESS + REALITY (xtls-rprx-vision на сыром TCP)
+type vlessReality struct{}
+
+func (vlessReality) Spec() Spec {
+	return Spec{
+		Name:        models.ProtocolReality,
+		Title:       "VLESS + REALITY",
+		Network:     "tcp",
+		DefaultPort: 443,
+		Multiplex:   true,
+		ShareURL:    true,
+		Fields: append([]Field{
+			fieldSNI,
+			{Name: "private_key", Type: "string", Description: "Приватный ключ X25519 (генерируется, если не задан)"},
+			{Name: "public_key", Type: "string", Description: "Публичный ключ (вычисляется из приватного)"},
+			{Name: "short_id", Type: "string", Description: "short_id, hex до 16 символов (генерируется)"},
+			{Name: "per_user_short_ids", Type: "bool", Description: "Свой short_id у каждого пользователя (отзыв - сброс UUID пользователя)"},
+			{Name: "server_names", Type: "string[]", Description: "Дополнительные SNI маскировки, пользователи распределяются между ними"},
+			{Name: "sni_relay_port", Type: "int", Default: models.DefaultSNIRelayPort, Description: "Первый локальный порт внутренних инбаундов при нескольких SNI"},
+			{Name: "fallback_addr", Type: "string", Default: "127.0.0.1", Description: "Адрес handshake сервера"},
+			{Name: "fallback_port", Type: "int", Default: 8443, Description: "Порт handshake сервера"},
+			transportField(models.ProtocolReality),
+			fieldWSPath,
+			fieldGRPCServiceName,
+			fieldTransportHost,
+		}, multiplexFields...),
+	}
+}
+
+// ApplyDefaults генерирует ключи и short_id, если они не заданы,
+// и вычисляет публичный ключ из приватного
+func (p vlessReality) ApplyDefaults(inbound *models.Inbound) error {
+	spec := p.Spec()
+	// Локальный fallback (Caddy на 8443) - только у REALITY: ShadowTLS без fallback_addr
+	// делает handshake с настоящим сервером sni:443
+	setDefault(&inbound.FallbackAddr, spec, "fallback_addr")
+	setDefault(&inbound.FallbackPort, spec, "fallback_port")
+	setDefault(&inbound.WSPath, spec, "ws_path")
+	// Поля fingerprint у REALITY нет: sing-box и Clash подключаются без uTLS, но Xray без fingerprint не работает
+	if inbound.Fingerprint == "" {
+		inbound.Fingerprint = fieldFingerprint.Default.(string)
+	}
+	if inbound.PerUserShortIDs && inbound.ShortIDSeed == "" {
+		seed, err := randomBase64(32)
+		if err != nil {
+			return fmt.Errorf("ошибка генерации секрета short_id: %w", err)
+		}
+		inbound.ShortIDSeed = seed
+	}
+	if inbound.SNIRelay() && inbound.SNIRelayPort == 0 {
+		inbound.SNIRelayPort = models.DefaultSNIRelayPort
+	}
+
+	if inbound.PrivateKey == "" && inbound.PublicKey == "" {
+		keys, shortID, err := GenerateRealityKeys()
+		if err != nil {
+			return fmt.Errorf("ошибка генерации ключей: %w", err)
+		}
+		inbound.PrivateKey = keys.PrivateKey
+		inbound.PublicKey = keys.PublicKey
+		if inbound.ShortID == "" {
+			inbound.ShortID = shortID
+		}
+	}
+	// Ключи в стандартном base64 приводим к виду, который читают sing-box и клиенты;
+	// некорректные ключи оставляем как есть - их отклонит Validate
+	for _, key := range []*string{&inbound.PrivateKey, &inbound.PublicKey} {
+		if normalized, err := reality.NormalizeKey(*key); err == nil {
+			*key = normalized
+		}
+	}
+	if inbound.PrivateKey != "" && inbound.PublicKey == "" {
+		publicKey, err := reality.PublicKeyFromPrivate(inbound.PrivateKey)
+		if err != nil {
+			return invalid("Неверный приватный ключ REALITY")
+		}
+		inbound.PublicKey = publicKey
+	}
+	return nil
+}
+
+// Validate проверяет пару ключей, short_id и транспорт
+func (vlessReality) Validate(inbound *models.Inbound) error {
+	if err := reality.ValidateKeyPair(inbound.PrivateKey, inbound.PublicKey); err != nil {
+		return invalid("Неверная пара ключей REALITY: %v", err)
+	}
+	if err := reality.ValidateShortID(inbound.ShortID); err != nil {
+		return invalid("Неверный short_id: %v", err)
+	}
+	if err := validateServerNames(inbound); err != nil {
+		return err
+	}
+	return validateTransport(inbound)
+}
+
+var serverNamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]{0,251}[A-Za-z0-9])?$`)
+
+// validateServerNames проверяет дополнительные SNI и диапазон внутренних портов
+func validateServerNames(inbound *models.Inbound) error {
+	if len(inbound.ServerNames) == 0 {
+		return nil
+	}
+	if inbound.SNI == "" {
+		return invalid("server_names задаются вместе с основным sni")
+	}
+	for _, name := range inbound.ServerNames {
+		if !serverNamePattern.MatchString(name) {
+			return invalid("Некорректное имя в server_names: %q", name)
+		}
+	}
+
+	names := inbound.RealityServerNames()
+	if len(names) > models.MaxRealityServerNames {
+		return invalid("Не больше %d SNI на инбаунд", models.MaxRealityServerNames)
+	}
+	if len(names) > 1 {
+		last := inbound.SNIRelayPort + len(names) - 1
+		if inbound.SNIRelayPort < 1024 || last > 65535 {
+			return invalid("Внутренние порты %d-%d должны быть в пределах 1024-65535", inbound.SNIRelayPort, last)
+		}
+		if inbound.ListenPort >= inbound.SNIRelayPort && inbound.ListenPort <= last {
+			return invalid("listen_port не должен входить в диапазон sni_relay_port")
+		}
+	}
+	return nil
+}
+
+// ExtraPorts - локальный fallback и внутренние REALITY инбаунды (по одному на SNI) на loopback
+func (vlessReality) ExtraPorts(inbound *models.Inbound) []Port {
+	ports := fallbackPorts(inbound, "REALITY")
+	if inbound.SNIRelay() {
+		ports = append(ports, Port{
+			Port:        inbound.SNIRelayPort,
+			PortEnd:     inbound.SNIRelayPort + len(inbound.RealityServerNames()) - 1,
+			Network:     "tcp",
+			Description: fmt.Sprintf("внутренние порты SNI REALITY инбаунда «%s»", inbound.Name),
+		})
+	}
+	return ports
+}
+
+func (vlessReality) ServerInbound(inbound *models.Inbound, users []models.User) interface{} {
+	return templates.GenerateRealityInbounds(inbound, users)
+}
+
+// ClientOutbound генерирует VLESS+REALITY outbound
+// Anti-TSPU: без uTLS fingerprint (дефолтный Go TLS) — менее детектируемый отпечаток
+// SNI обязателен для REALITY — без него handshake не работает
+func (vlessReality) ClientOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
+	outbound := map[string]interface{}{
+		"type":        "vless",
+		"tag":         tag,
+		"server":      inbound.Node.Address,
+		"server_port": inbound.ListenPort,
+		"uuid":        user.UUID.String(),
+		"tls": map[string]interface{}{
+			"enabled":     true,
+			"server_name": inbound.RealityServerNameFor(user),
+			"reality": map[string]interface{}{
+				"enabled":    true,
+				"public_key": inbound.PublicKey,
+				"short_id":   inbound.RealityShortIDFor(user),
+			},
+		},
+	}
+	if flow := inbound.VLESSFlow(); flow != "" {
+		outbound["flow"] = flow
+	}
+	if transport := clientTransport(inbound); transport != nil {
+		outbound["transport"] = transport
+	}
+	return outbound, nil
+}
+
+// ShareURL генерирует vless:// URL для REALITY
+func (vlessReality) ShareURL(user *models.User, inbound *models.Inbound) (string, error) {
+	// Формат: vless://uuid@server:port?params#name
+	params := url.Values{}
+	// Anti-TSPU: SNI обязателен для REALITY, но без uTLS fingerprint
+	transportURLParams(params, inbound)
+	params.Set("security", "reality")
+	params.Set("sni", inbound.RealityServerNameFor(user))
+	params.Set("pbk", inbound.PublicKey)
+	params.Set("sid", inbound.RealityShortIDFor(user))
+	if flow := inbound.VLESSFlow(); flow != "" {
+		params.Set("flow", flow)
+	}
+	multiplexURLParams(params, inbound)
+
+	name := url.QueryEscape(fmt.Sprintf("%s (reality)", user.Name))
+	shareURL := fmt.Sprintf("vless://%s@%s:%d?%s#%s",
+		user.UUID.String(),
+		inbound.Node.Address,
+		inbound.ListenPort,
+		params.Encode(),
+		name,
+	)
+
+	return shareURL, nil
+}
+
+// ClashProxy генерирует прокси vless с reality-opts (без client-fingerprint, как и outbound)
+func (vlessReality) ClashProxy(user *models.User, inbound *models.Inbound, name string) (map[string]interface{}, error) {
+	proxy := map[string]interface{}{
+		"name":       name,
+		"type":       "vless",
+		"server":     inbound.Node.Address,
+		"port":       inbound.ListenPort,
+		"uuid":       user.UUID.String(),
+		"udp":        true,
+		"tls":        true,
+		"servername": inbound.RealityServerNameFor(user),
+		"reality-opts": map[string]interface{}{
+			"public-key": inbound.PublicKey,
+			"short-id":   inbound.RealityShortIDFor(user),
+		},
+	}
+	if flow := inbound.VLESSFlow(); flow != "" {
+		proxy["flow"] = flow
+	}
+	clashTransport(proxy, inbound)
+	return proxy, nil
+}
+
+// XrayOutbound генерирует VLESS+REALITY outbound Xray. В отличие от sing-box,
+// Xray не подключается к REALITY без fingerprint
+func (vlessReality) XrayOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
+	stream, err := xrayStream(inbound)
+	if err != nil {
+		return nil, err
+	}
+	stream["security"] = "reality"
+	stream["realitySettings"] = map[string]interface{}{
+		"serverName":  inbound.RealityServerNameFor(user),
+		"fingerprint": inbound.Fingerprint,
+		"publicKey":   inbound.PublicKey,
+		"shortId":     inbound.RealityShortIDFor(user),
+	}
+
+	return map[string]interface{}{
+		"tag":            tag,
+		"protocol":       "vless",
+		"settings":       xrayVLESSSettings(inbound.Node.Address, inbound.ListenPort, user, inbound.VLESSFlow()),
+		"streamSettings": stream,
+	}, nil
+}
+
+// GenerateRealityKeys генерирует X25519 keypair и short_id для REALITY
+func GenerateRealityKeys() (*reality.KeyPair, string, error) {
+	keys, err := reality.GenerateKeyPair()
+	if err != nil {
+		return nil, "", err
+	}
+	shortID, err := reality.GenerateShortID(reality.MaxShortIDBytes)
+	if err != nil {
+		return nil, "", err
+	}
+	return keys, shortID, nil
+}
+
+// vlessTLS - VLESS + TLS (транспорт ws по умолчанию). TLS терминирует sing-box или nginx перед ним
+type vlessTLS struct{}
+
+func (vlessTLS) Spec() Spec {
+	return Spec{
+		Name:        models.ProtocolWSTLS,
+		Title:       "VLESS + TLS",
+		Network:     "tcp",
+		DefaultPort: 443,
+		Multiplex:   true,
+		ShareURL:    true,
+		Fields: append([]Field{
+			fieldSNI,
+			transportField(models.ProtocolWSTLS),
+			fieldWSPath,
+			fieldGRPCServiceName,
+			fieldTransportHost,
+			fieldCertPath,
+			fieldKeyPath,
+			fieldFingerprint,
+			fieldECHEnabled,
+			fieldECHPublicName,
+		}, multiplexFields...),
+	}
+}
+
+func (p vlessTLS) ApplyDefaults(inbound *models.Inbound) error {
+	spec := p.Spec()
+	setDefault(&inbound.WSPath, spec, "ws_path")
+	setDefault(&inbound.Fingerprint, spec, "fingerprint")
+	// Сохранённый инбаунд без сертификата стоит за nginx - пути получает только новый
+	if inbound.ID == 0 {
+		certificateDefaults(spec, inbound)
+	}
+	return nil
+}
+
+func (vlessTLS) Validate(inbound *models.Inbound) error {
+	return validateTransport(inbound)
+}
+
+func (vlessTLS) ServerInbound(inbound *models.Inbound, users []models.User) interface{} {
+	return templates.GenerateVLESSWSInbound(inbound, users)
+}
+
+// ClientOutbound генерирует VLESS+TLS outbound
+func (vlessTLS) ClientOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
+	server, port := tlsEndpoint(inbound)
+
+	return map[string]interface{}{
+		"type":        "vless",
+		"tag":         tag,
+		"server":      server,
+		"server_port": port,
+		"uuid":        user.UUID.String(),
+		"tls": map[string]interface{}{
+			"enabled":     true,
+			"server_name": inbound.SNI,
+			"utls": map[string]interface{}{
+				"enabled":     true,
+				"fingerprint": inbound.Fingerprint,
+			},
+		},
+		"transport": clientTransport(inbound),
+	}, nil
+}
+
+// ShareURL генерирует vless:// URL для VLESS+TLS
+func (vlessTLS) ShareURL(user *models.User, inbound *models.Inbound) (string, error) {
+	server, port := tlsEndpoint(inbound)
+
+	params := url.Values{}
+	transportURLParams(params, inbound)
+	params.Set("security", "tls")
+	params.Set("sni", inbound.SNI)
+	params.Set("fp", inbound.Fingerprint)
+	multiplexURLParams(params, inbound)
+
+	name := url.QueryEscape(fmt.Sprintf("%s (%s)", user.Name, inbound.VLESSTransport()))
+	shareURL := fmt.Sprintf("vless://%s@%s:%d?%s#%s",
+		user.UUID.String(),
+		server,
+		port,
+		params.Encode(),
+		name,
+	)
+
+	return shareURL, nil
+}
+
+// ClashProxy генерирует прокси vless с TLS
+func (vlessTLS) ClashProxy(user *models.User, inbound *models.Inbound, name string) (map[string]interface{}, error) {
+	server, port := tlsEndpoint(inbound)
+
+	proxy := map[string]interface{}{
+		"name":               name,
+		"type":               "vless",
+		"server":             server,
+		"port":               port,
+		"uuid":               user.UUID.String(),
+		"udp":                true,
+		"tls":                true,
+		"servername":         inbound.SNI,
+		"client-fingerprint": inbound.Fingerprint,
+	}
+	clashTransport(proxy, inbound)
+	return proxy, nil
+}
+
+// XrayOutbound генерирует VLESS+TLS outbound Xray
+func (vlessTLS) XrayOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
+	stream, err := xrayStream(inbound)
+	if err != nil {
+		return nil, err
+	}
+	stream["security"] = "tls"
+	stream["tlsSettings"] = xrayTLS(inbound, inbound.SNI)
+
+	server, port := tlsEndpoint(inbound)
+	return map[string]interface{}{
+		"tag":            tag,
+		"protocol":       "vless",
+		"settings":       xrayVLESSSettings(server, port, user, ""),
+		"streamSettings": stream,
+	}, nil
+}
+
+// tlsEndpoint возвращает адрес для клиента VLESS+TLS.
+// Без сертификатов на sing-box TLS терминирует nginx на 443.
+// Домен (SNI) вместо IP выглядит как обычный HTTPS трафик — менее палевно для DPI
+func tlsEndpoint(inbound *models.Inbound) (string, int) {
+	port := inbound.ListenPort
+	if inbound.CertPath == "" && inbound.KeyPath == "" {
+		port = 443
+	}
+
+	server := inbound.SNI
+	if server == "" {
+		server = inbound.Node.Address
+	}
+	return server, port
+}
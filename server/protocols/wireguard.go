@@ -0,0 +1,112 @@
+package protocols
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"zen-admin/models"
+)
+
+// wireguard - WireGuard для штатных клиентов ОС. В sing-box это endpoint, а не inbound:
+// его пиры берутся из выделенных адресов, поэтому он рендерится в NodeSyncer отдельно
+type wireguard struct{}
+
+func (wireguard) Spec() Spec {
+	return Spec{
+		Name:        models.ProtocolWireGuard,
+		Title:       "WireGuard",
+		Network:     "udp",
+		DefaultPort: 51820,
+		Fields: []Field{
+			{Name: "wg_address_pool", Type: "string", Default: models.DefaultWGAddressPool, Description: "Пул адресов туннеля (CIDR)"},
+			{Name: "wg_mtu", Type: "int", Default: models.DefaultWGMTU, Description: "MTU (1280-1500)"},
+			{Name: "wg_dns", Type: "string", Default: models.DefaultWGDNS, Description: "DNS клиента, IP через запятую"},
+		},
+	}
+}
+
+// ApplyDefaults заполняет пул адресов и генерирует ключи сервера
+func (wireguard) ApplyDefaults(inbound *models.Inbound) error {
+	if inbound.WGAddressPool == "" {
+		inbound.WGAddressPool = models.DefaultWGAddressPool
+	}
+	if inbound.WGPrivateKey == "" {
+		privateKey, publicKey, err := GenerateWireGuardKeyPair()
+		if err != nil {
+			return fmt.Errorf("ошибка генерации ключей WireGuard: %w", err)
+		}
+		inbound.WGPrivateKey = privateKey
+		inbound.WGPublicKey = publicKey
+	}
+	return nil
+}
+
+// Validate проверяет пул адресов, MTU и DNS
+func (wireguard) Validate(inbound *models.Inbound) error {
+	if err := ValidateWGAddressPool(inbound.WGAddressPool); err != nil {
+		return invalid("Некорректный wg_address_pool: %v", err)
+	}
+	if inbound.WGMTU != 0 && (inbound.WGMTU < 1280 || inbound.WGMTU > 1500) {
+		return invalid("wg_mtu должен быть в диапазоне 1280-1500")
+	}
+	if inbound.WGDNS != "" {
+		for _, dns := range strings.Split(inbound.WGDNS, ",") {
+			if _, err := netip.ParseAddr(strings.TrimSpace(dns)); err != nil {
+				return invalid("wg_dns - список IP адресов через запятую")
+			}
+		}
+	}
+	return nil
+}
+
+func (wireguard) ServerInbound(inbound *models.Inbound, users []models.User) interface{} {
+	return nil
+}
+
+// ClientOutbound: клиентам WireGuard отдаётся .conf, а не outbound sing-box
+func (wireguard) ClientOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
+	return nil, ErrNoClientConfig
+}
+
+func (wireguard) ShareURL(user *models.User, inbound *models.Inbound) (string, error) {
+	return "", ErrNoClientConfig
+}
+
+// ClashProxy: ключи пира хранятся в WireGuardPeer, клиентам отдаётся .conf
+func (wireguard) ClashProxy(user *models.User, inbound *models.Inbound, name string) (map[string]interface{}, error) {
+	return nil, ErrNoClientConfig
+}
+
+// XrayOutbound: как и в Clash, клиентам WireGuard отдаётся .conf
+func (wireguard) XrayOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
+	return nil, ErrNoClientConfig
+}
+
+// GenerateWireGuardKeyPair генерирует ключи WireGuard (X25519, стандартный base64 как у wg genkey)
+func GenerateWireGuardKeyPair() (privateKey, publicKey string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.Bytes()), base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// ValidateWGAddressPool проверяет пул адресов туннеля
+func ValidateWGAddressPool(pool string) error {
+	prefix, err := netip.ParsePrefix(pool)
+	if err != nil {
+		return errors.New("пул должен быть в формате CIDR, например 10.66.0.0/24")
+	}
+	if prefix.Addr().Is4() && (prefix.Bits() < 16 || prefix.Bits() > 29) {
+		return errors.New("для IPv4 маска пула должна быть от /16 до /29")
+	}
+	if prefix.Addr().Is6() && (prefix.Bits() < 64 || prefix.Bits() > 120) {
+		return errors.New("для IPv6 маска пула должна быть от /64 до /120")
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package protocols
+
+import (
+	"encoding/base64"
+
+	"zen-admin/models"
+	"zen-admin/pkg/ech"
+)
+
+// Outbound'ы Xray-core описываются map'ами в формате JSON конфига Xray
+
+// xrayTLS генерирует tlsSettings. ECHConfigList Xray принимает в base64;
+// как и в sing-box, uTLS fingerprint при ECH не задаётся
+func xrayTLS(inbound *models.Inbound, serverName string) map[string]interface{} {
+	settings := map[string]interface{}{
+		"serverName":  serverName,
+		"fingerprint": inbound.Fingerprint,
+	}
+	if inbound.ECHEnabled && inbound.ECHConfig != "" {
+		if list, err := ech.ConfigList(inbound.ECHConfig); err == nil {
+			settings["echConfigList"] = base64.StdEncoding.EncodeToString(list)
+			delete(settings, "fingerprint")
+		}
+	}
+	return settings
+}
+
+// xrayStream генерирует streamSettings VLESS для транспорта инбаунда.
+// HTTP/2 транспорта в Xray больше нет, такие инбаунды в формат не попадают
+func xrayStream(inbound *models.Inbound) (map[string]interface{}, error) {
+	host := inbound.TransportHostOrSNI()
+
+	switch inbound.VLESSTransport() {
+	case models.TransportWS:
+		return map[string]interface{}{
+			"network":    "ws",
+			"wsSettings": xrayWSSettings(inbound.TransportPath(), host),
+		}, nil
+	case models.TransportHTTPUpgrade:
+		return map[string]interface{}{
+			"network": "httpupgrade",
+			"httpupgradeSettings": map[string]interface{}{
+				"path": inbound.TransportPath(),
+				"host": host,
+			},
+		}, nil
+	case models.TransportGRPC:
+		return map[string]interface{}{
+			"network": "grpc",
+			"grpcSettings": map[string]interface{}{
+				"serviceName": inbound.GRPCService(),
+			},
+		}, nil
+	case models.TransportHTTP:
+		return nil, ErrNoClientConfig
+	}
+	return map[string]interface{}{"network": "tcp"}, nil
+}
+
+// xrayWSSettings - early data Xray задаётся в пути (?ed=) и идёт в Sec-WebSocket-Protocol,
+// как ждёт сервер sing-box
+func xrayWSSettings(path, host string) map[string]interface{} {
+	return map[string]interface{}{
+		"path": path + "?ed=2048",
+		"host": host,
+	}
+}
+
+// xrayVLESSSettings - один сервер vnext с пользователем VLESS
+func xrayVLESSSettings(server string, port int, user *models.User, flow string) map[string]interface{} {
+	xrayUser := map[string]interface{}{
+		"id":         user.UUID.String(),
+		"encryption": "none",
+	}
+	if flow != "" {
+		xrayUser["flow"] = flow
+	}
+	return map[string]interface{}{
+		"vnext": []map[string]interface{}{{
+			"address": server,
+			"port":    port,
+			"users":   []map[string]interface{}{xrayUser},
+		}},
+	}
+}
@@ -0,0 +1,255 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"zen-admin/models"
+	"zen-admin/pkg/agentupdate"
+
+	"gorm.io/gorm"
+)
+
+// AgentUpdater обновляет агентов на нодах подписанными релизами и ведёт поэтапные раскатки
+type AgentUpdater struct {
+	db         *gorm.DB
+	nodeClient *NodeClient
+	publicKey  ed25519.PublicKey
+	interval   time.Duration
+}
+
+// NewAgentUpdater создаёт сервис обновления агентов.
+// AGENT_UPDATE_PUBLIC_KEY (base64 ed25519) - если задан, подпись релиза проверяется ещё в панели,
+// до отправки на ноды. Окончательную проверку в любом случае делает агент
+func NewAgentUpdater(db *gorm.DB) *AgentUpdater {
+	u := &AgentUpdater{
+		db:         db,
+		nodeClient: NewNodeClient(),
+		interval:   10 * time.Second,
+	}
+
+	if key := os.Getenv("AGENT_UPDATE_PUBLIC_KEY"); key != "" {
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			log.Printf("Agent update: некорректный AGENT_UPDATE_PUBLIC_KEY, проверка подписи в панели отключена")
+		} else {
+			u.publicKey = ed25519.PublicKey(raw)
+		}
+	}
+
+	return u
+}
+
+// AgentSigningPayload возвращает строку, которую покрывает подпись релиза
+func AgentSigningPayload(release *models.AgentRelease) []byte {
+	artifact := strings.ToLower(release.SHA256)
+	if release.ImageRef != "" {
+		artifact = release.ImageRef
+	}
+	return agentupdate.SigningPayload(release.Version, artifact, release.Downgrade)
+}
+
+// VerifyRelease проверяет корректность релиза и, если задан ключ, его подпись
+func (u *AgentUpdater) VerifyRelease(release *models.AgentRelease) error {
+	if release.Version == "" {
+		return errors.New("не указана версия")
+	}
+	if err := agentupdate.ValidateVersion(release.Version); err != nil {
+		return fmt.Errorf("агенты сравнивают версии, нужен формат MAJOR.MINOR.PATCH: %w", err)
+	}
+	if (release.BinaryURL == "") == (release.ImageRef == "") {
+		return errors.New("нужно указать либо binary_url, либо image")
+	}
+	if release.BinaryURL != "" && len(release.SHA256) != 64 {
+		return errors.New("для бинарника нужен sha256 (hex)")
+	}
+	if release.ImageRef != "" && !strings.Contains(release.ImageRef, "@sha256:") {
+		return errors.New("образ должен быть закреплён по дайджесту (name@sha256:...)")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(release.Signature)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return errors.New("некорректная подпись")
+	}
+	if u.publicKey != nil && !ed25519.Verify(u.publicKey, AgentSigningPayload(release), signature) {
+		return errors.New("подпись не прошла проверку")
+	}
+
+	return nil
+}
+
+// UpdateNode отправляет релиз на ноду и ждёт, пока агент вернётся с новой версией
+// и работающим sing-box. Возвращает версию агента до обновления
+func (u *AgentUpdater) UpdateNode(node *models.Node, release *models.AgentRelease, healthTimeout time.Duration) (string, error) {
+	previous := node.AgentVersion
+	if current, err := u.nodeClient.GetVersion(node); err == nil {
+		previous = current.Version
+	}
+
+	if previous == release.Version {
+		u.saveAgentVersion(node, previous)
+		return previous, nil
+	}
+
+	// Агент всё равно отклонит откат без флага downgrade - не тратим на это раскатку
+	if err := agentupdate.CheckVersion(previous, release.Version, release.Downgrade); err != nil {
+		return previous, fmt.Errorf("агент %s не примет релиз: %w", previous, err)
+	}
+
+	err := u.nodeClient.PushUpdate(node, &AgentUpdate{
+		Version:   release.Version,
+		BinaryURL: release.BinaryURL,
+		SHA256:    strings.ToLower(release.SHA256),
+		Image:     release.ImageRef,
+		Downgrade: release.Downgrade,
+		Signature: release.Signature,
+	})
+	if err != nil {
+		return previous, err
+	}
+
+	// Агент перезапускается после ответа — ждём, пока он поднимется с новой версией
+	deadline := time.Now().Add(healthTimeout)
+	var status *NodeStatus
+	for time.Now().Before(deadline) {
+		time.Sleep(5 * time.Second)
+		status, _ = u.nodeClient.GetStatus(node)
+		if status.Online && status.Version == release.Version && status.SingboxUp {
+			u.saveAgentVersion(node, status.Version)
+			return previous, nil
+		}
+	}
+
+	switch {
+	case status == nil || !status.Online:
+		return previous, fmt.Errorf("агент не вернулся в течение %s", healthTimeout)
+	case status.Version != release.Version:
+		u.saveAgentVersion(node, status.Version)
+		return previous, fmt.Errorf("агент работает с версией %s вместо %s", status.Version, release.Version)
+	default:
+		u.saveAgentVersion(node, status.Version)
+		return previous, errors.New("sing-box не запущен после обновления")
+	}
+}
+
+// saveAgentVersion запоминает версию агента на ноде
+func (u *AgentUpdater) saveAgentVersion(node *models.Node, version string) {
+	now := time.Now()
+	node.AgentVersion = version
+	node.AgentCheckedAt = &now
+	u.db.Model(&models.Node{}).Where("id = ?", node.ID).Updates(map[string]interface{}{
+		"agent_version":    version,
+		"agent_checked_at": now,
+	})
+}
+
+// Start запускает обработку активных раскаток в фоне
+func (u *AgentUpdater) Start() {
+	go func() {
+		for {
+			u.ProcessRollouts()
+			time.Sleep(u.interval)
+		}
+	}()
+}
+
+// ProcessRollouts продвигает активные раскатки на одну партию, если пауза между партиями истекла
+func (u *AgentUpdater) ProcessRollouts() {
+	var rollouts []models.AgentRollout
+	if err := u.db.Preload("Release").Where("status = ?", models.RolloutStatusRunning).Find(&rollouts).Error; err != nil {
+		log.Printf("Rollout: ошибка получения раскаток: %v", err)
+		return
+	}
+
+	for i := range rollouts {
+		rollout := &rollouts[i]
+		if rollout.LastBatchAt != nil && time.Since(*rollout.LastBatchAt) < time.Duration(rollout.BatchIntervalSeconds)*time.Second {
+			continue
+		}
+		u.runBatch(rollout)
+	}
+}
+
+// runBatch обновляет следующую партию нод раскатки
+func (u *AgentUpdater) runBatch(rollout *models.AgentRollout) {
+	var batch []models.AgentRolloutNode
+	err := u.db.Preload("Node").
+		Where("rollout_id = ? AND status = ?", rollout.ID, models.RolloutNodePending).
+		Order("position").Limit(rollout.BatchSize).Find(&batch).Error
+	if err != nil {
+		log.Printf("Rollout #%d: ошибка получения нод: %v", rollout.ID, err)
+		return
+	}
+
+	now := time.Now()
+	if len(batch) == 0 {
+		u.db.Model(&models.AgentRollout{}).Where("id = ?", rollout.ID).Updates(map[string]interface{}{
+			"status":       models.RolloutStatusCompleted,
+			"completed_at": now,
+		})
+		log.Printf("Rollout #%d: версия %s раскатана на все ноды", rollout.ID, rollout.Release.Version)
+		return
+	}
+
+	healthTimeout := time.Duration(rollout.HealthTimeoutSeconds) * time.Second
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures []string
+	)
+	for i := range batch {
+		item := &batch[i]
+
+		// Удалённые и выключенные ноды пропускаем
+		if item.Node.ID == 0 || !item.Node.Enabled {
+			u.setRolloutNode(item, models.RolloutNodeSkipped, "", "нода удалена или выключена")
+			continue
+		}
+
+		u.setRolloutNode(item, models.RolloutNodeUpdating, "", "")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			previous, err := u.UpdateNode(&item.Node, &rollout.Release, healthTimeout)
+			if err != nil {
+				u.setRolloutNode(item, models.RolloutNodeFailed, previous, err.Error())
+				mu.Lock()
+				failures = append(failures, fmt.Sprintf("%s: %v", item.Node.Name, err))
+				mu.Unlock()
+				return
+			}
+			u.setRolloutNode(item, models.RolloutNodeUpdated, previous, "")
+		}()
+	}
+	wg.Wait()
+
+	updates := map[string]interface{}{"last_batch_at": time.Now()}
+	if len(failures) > 0 {
+		updates["status"] = models.RolloutStatusHalted
+		updates["halt_reason"] = "Health check не пройден: " + strings.Join(failures, "; ")
+		log.Printf("Rollout #%d: ВНИМАНИЕ! Раскатка остановлена: %s", rollout.ID, strings.Join(failures, "; "))
+	}
+	u.db.Model(&models.AgentRollout{}).Where("id = ?", rollout.ID).Updates(updates)
+}
+
+// setRolloutNode обновляет статус ноды в раскатке
+func (u *AgentUpdater) setRolloutNode(item *models.AgentRolloutNode, status, previous, errMsg string) {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"status":     status,
+		"error":      errMsg,
+		"updated_at": now,
+	}
+	if previous != "" {
+		updates["previous_version"] = previous
+	}
+	u.db.Model(&models.AgentRolloutNode{}).Where("id = ?", item.ID).Updates(updates)
+}
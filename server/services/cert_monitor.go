@@ -0,0 +1,148 @@
+package services
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"zen-admin/models"
+
+	"gorm.io/gorm"
+)
+
+// CertMonitor следит за сертификатами на нодах: сверяет их с агентами
+// и предупреждает, если сертификат скоро истечёт или не продлился
+type CertMonitor struct {
+	db         *gorm.DB
+	nodeClient *NodeClient
+	warnBefore time.Duration
+	interval   time.Duration
+}
+
+// NewCertMonitor создаёт монитор сертификатов.
+// CERT_WARN_DAYS - за сколько дней до истечения предупреждать (агент продлевает за 30,
+// значит к этому моменту продление уже не удалось), CERT_CHECK_HOURS - период проверки
+func NewCertMonitor(db *gorm.DB) *CertMonitor {
+	return &CertMonitor{
+		db:         db,
+		nodeClient: NewNodeClient(),
+		warnBefore: time.Duration(envInt("CERT_WARN_DAYS", 14)) * 24 * time.Hour,
+		interval:   time.Duration(envInt("CERT_CHECK_HOURS", 6)) * time.Hour,
+	}
+}
+
+// WarnBefore возвращает порог предупреждения об истечении
+func (m *CertMonitor) WarnBefore() time.Duration {
+	return m.warnBefore
+}
+
+// Start запускает периодическую проверку в фоне
+func (m *CertMonitor) Start() {
+	go func() {
+		for {
+			m.CheckAll()
+			time.Sleep(m.interval)
+		}
+	}()
+}
+
+// CheckAll сверяет сертификаты всех включённых нод и пишет предупреждения в лог
+func (m *CertMonitor) CheckAll() {
+	var nodes []models.Node
+	if err := m.db.Where("enabled = ?", true).Find(&nodes).Error; err != nil {
+		log.Printf("Certs: ошибка получения нод: %v", err)
+		return
+	}
+
+	for _, node := range nodes {
+		certs, err := m.SyncNode(&node)
+		if err != nil {
+			log.Printf("Certs: ошибка проверки сертификатов на ноде %s: %v", node.Name, err)
+			continue
+		}
+
+		for _, cert := range certs {
+			switch cert.Status(m.warnBefore) {
+			case models.CertStatusExpired:
+				log.Printf("Certs: ВНИМАНИЕ! Сертификат %s на ноде %s истёк %s", cert.Domain, node.Name, cert.NotAfter.Format(time.RFC3339))
+			case models.CertStatusRenewalFailed:
+				log.Printf("Certs: ВНИМАНИЕ! Не удалось продлить сертификат %s на ноде %s: %s", cert.Domain, node.Name, cert.LastError)
+			case models.CertStatusExpiring:
+				days := int(time.Until(*cert.NotAfter).Hours() / 24)
+				log.Printf("Certs: сертификат %s на ноде %s истекает через %d дн.", cert.Domain, node.Name, days)
+			}
+		}
+	}
+}
+
+// SyncNode получает сертификаты с агента и обновляет их в базе.
+// Сертификаты, которых больше нет на ноде, помечаются как отсутствующие
+func (m *CertMonitor) SyncNode(node *models.Node) ([]models.Certificate, error) {
+	infos, err := m.nodeClient.ListCerts(node)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		seen[info.Domain] = true
+		if _, err := m.SaveCertInfo(node.ID, &info); err != nil {
+			return nil, err
+		}
+	}
+
+	var certs []models.Certificate
+	if err := m.db.Where("node_id = ?", node.ID).Order("domain").Find(&certs).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range certs {
+		if seen[certs[i].Domain] {
+			continue
+		}
+		certs[i].NotBefore = nil
+		certs[i].NotAfter = nil
+		certs[i].CheckedAt = &now
+		m.db.Save(&certs[i])
+	}
+
+	return certs, nil
+}
+
+// SaveCertInfo сохраняет сертификат из ответа агента (создаёт или обновляет запись)
+func (m *CertMonitor) SaveCertInfo(nodeID uint, info *CertInfo) (*models.Certificate, error) {
+	now := time.Now()
+
+	var cert models.Certificate
+	err := m.db.Where("node_id = ? AND domain = ?", nodeID, info.Domain).First(&cert).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	cert.NodeID = nodeID
+	cert.Domain = info.Domain
+	cert.Source = info.Source
+	cert.CertPath = info.CertPath
+	cert.KeyPath = info.KeyPath
+	cert.Issuer = info.Issuer
+	cert.NotBefore = info.NotBefore
+	cert.NotAfter = info.NotAfter
+	cert.LastError = info.LastError
+	cert.LastAttemptAt = info.LastAttemptAt
+	cert.CheckedAt = &now
+
+	if err := m.db.Save(&cert).Error; err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// envInt читает целое положительное значение из окружения
+func envInt(key string, defaultValue int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil && v > 0 {
+		return v
+	}
+	return defaultValue
+}
@@ -0,0 +1,279 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"zen-admin/models"
+	"zen-admin/protocols"
+)
+
+// Группы прокси Clash/Mihomo
+const (
+	ClashGroupProxy = "PROXY" // Ручной выбор сервера, по умолчанию - AUTO
+	ClashGroupAuto  = "AUTO"  // Сервер с наименьшей задержкой
+
+	clashTestURL      = "https://www.gstatic.com/generate_204"
+	clashTestInterval = 300
+)
+
+// clashPrivateRules - локальные сети напрямую, в начале правил любого шаблона
+var clashPrivateRules = []string{
+	"IP-CIDR,10.0.0.0/8,DIRECT,no-resolve",
+	"IP-CIDR,172.16.0.0/12,DIRECT,no-resolve",
+	"IP-CIDR,192.168.0.0/16,DIRECT,no-resolve",
+	"IP-CIDR,127.0.0.0/8,DIRECT,no-resolve",
+}
+
+// DefaultClashRules - правила по умолчанию, те же, что в конфиге sing-box:
+// локальные сети напрямую, реклама блокируется, остальное через PROXY
+var DefaultClashRules = append(append([]string{}, clashPrivateRules...),
+	"GEOSITE,category-ads-all,REJECT",
+	"MATCH,"+ClashGroupProxy,
+)
+
+// ClashConfig - конфиг Clash/Mihomo (Clash Verge, ClashMi, FlClash и т.п.)
+type ClashConfig struct {
+	MixedPort   int                      `yaml:"mixed-port"`
+	AllowLAN    bool                     `yaml:"allow-lan"`
+	Mode        string                   `yaml:"mode"`
+	LogLevel    string                   `yaml:"log-level"`
+	IPv6        bool                     `yaml:"ipv6"`
+	DNS         ClashDNS                 `yaml:"dns"`
+	Proxies     []map[string]interface{} `yaml:"proxies"`
+	ProxyGroups []ClashProxyGroup        `yaml:"proxy-groups"`
+	Rules       []string                 `yaml:"rules"`
+}
+
+// ClashDNS - DNS Mihomo: fake-ip, как у TUN клиентов. NameserverPolicy - DNS правил шаблона
+type ClashDNS struct {
+	Enable           bool              `yaml:"enable"`
+	EnhancedMode     string            `yaml:"enhanced-mode"`
+	Nameserver       []string          `yaml:"nameserver"`
+	NameserverPolicy map[string]string `yaml:"nameserver-policy,omitempty"`
+}
+
+// ClashProxyGroup - группа прокси (select или url-test)
+type ClashProxyGroup struct {
+	Name      string   `yaml:"name"`
+	Type      string   `yaml:"type"`
+	Proxies   []string `yaml:"proxies"`
+	URL       string   `yaml:"url,omitempty"`
+	Interval  int      `yaml:"interval,omitempty"`
+	Tolerance int      `yaml:"tolerance,omitempty"`
+}
+
+// GenerateClashConfig генерирует конфиг Clash/Mihomo с группами PROXY (select) и AUTO (url-test).
+// Без шаблона маршрутизации используются правила из CLASH_RULES_FILE или встроенные
+func (g *ConfigGenerator) GenerateClashConfig(user *models.User, inbounds []models.Inbound, routing *models.ClientRoutingTemplate) (*ClashConfig, error) {
+	proxies := []map[string]interface{}{}
+	names := []string{}
+
+	for _, inbound := range inbounds {
+		if !inbound.ClientVisible() {
+			continue
+		}
+
+		name := fmt.Sprintf("%s-%s", inbound.Node.Name, inbound.Name)
+		proxy, err := protocols.ClashProxy(user, &inbound, name)
+		if err != nil {
+			continue
+		}
+		proxies = append(proxies, proxy)
+		names = append(names, name)
+	}
+
+	if len(proxies) == 0 {
+		return nil, fmt.Errorf("у пользователя нет инбаундов, доступных в Clash")
+	}
+
+	rules := g.clashRules
+	var policy map[string]string
+	if routing != nil {
+		if err := requireGeoRuleSets(routing, "Clash"); err != nil {
+			return nil, err
+		}
+		rules = clashTemplateRules(routing)
+		policy = clashNameserverPolicy(routing)
+	}
+
+	return &ClashConfig{
+		MixedPort: 7890,
+		Mode:      "rule",
+		LogLevel:  "info",
+		DNS: ClashDNS{
+			Enable:           true,
+			EnhancedMode:     "fake-ip",
+			Nameserver:       []string{"8.8.8.8", "1.1.1.1"},
+			NameserverPolicy: policy,
+		},
+		Proxies: proxies,
+		ProxyGroups: []ClashProxyGroup{
+			{
+				Name:    ClashGroupProxy,
+				Type:    "select",
+				Proxies: append(append([]string{ClashGroupAuto}, names...), "DIRECT"),
+			},
+			{
+				Name:      ClashGroupAuto,
+				Type:      "url-test",
+				Proxies:   names,
+				URL:       clashTestURL,
+				Interval:  clashTestInterval,
+				Tolerance: 50,
+			},
+		},
+		Rules: rules,
+	}, nil
+}
+
+// clashTemplateRules разворачивает правила шаблона в правила Mihomo: одно условие - одно правило.
+// Rule-set'ы со своим URL (форматы sing-box Mihomo не читает) отсекает requireGeoRuleSets
+func clashTemplateRules(routing *models.ClientRoutingTemplate) []string {
+	rules := append([]string{}, clashPrivateRules...)
+
+	for _, rule := range activeRules(routing) {
+		target := ClashGroupProxy
+		switch rule.Action {
+		case models.ClientRoutingDirect:
+			target = "DIRECT"
+		case models.ClientRoutingBlock:
+			target = "REJECT"
+		}
+
+		for _, domain := range rule.Domains {
+			rules = append(rules, fmt.Sprintf("DOMAIN,%s,%s", domain, target))
+		}
+		for _, suffix := range rule.DomainSuffixes {
+			rules = append(rules, fmt.Sprintf("DOMAIN-SUFFIX,%s,%s", suffix, target))
+		}
+		for _, keyword := range rule.DomainKeywords {
+			rules = append(rules, fmt.Sprintf("DOMAIN-KEYWORD,%s,%s", keyword, target))
+		}
+		for _, cidr := range rule.IPCIDRs {
+			kind := "IP-CIDR"
+			if strings.Contains(cidr, ":") {
+				kind = "IP-CIDR6"
+			}
+			rules = append(rules, fmt.Sprintf("%s,%s,%s,no-resolve", kind, cidr, target))
+		}
+		for _, tag := range rule.RuleSets {
+			kind, name, ok := geoRuleSet(routing, tag)
+			if !ok {
+				continue
+			}
+			if kind == "geosite" {
+				rules = append(rules, fmt.Sprintf("GEOSITE,%s,%s", name, target))
+			} else {
+				rules = append(rules, fmt.Sprintf("GEOIP,%s,%s,no-resolve", name, target))
+			}
+		}
+	}
+
+	return append(rules, "MATCH,"+ClashGroupProxy)
+}
+
+// clashNameserverPolicy - DNS серверы правил шаблона для их доменов.
+// DOMAIN-KEYWORD в nameserver-policy не выражается, такие условия резолвит общий DNS
+func clashNameserverPolicy(routing *models.ClientRoutingTemplate) map[string]string {
+	policy := map[string]string{}
+	set := func(key, server string) {
+		if _, exists := policy[key]; !exists {
+			policy[key] = server
+		}
+	}
+
+	for _, rule := range activeRules(routing) {
+		if rule.DNS == "" {
+			continue
+		}
+		server := findClientDNSServer(routing, rule.DNS)
+		if server == nil {
+			continue
+		}
+		address := server.Address
+		if address == clientDNSLocal {
+			address = "system"
+		} else if ip, err := netip.ParseAddr(address); err == nil && ip.Is6() {
+			// Mihomo разбирает адрес как URL - IPv6 нужен в скобках
+			address = "[" + address + "]"
+		}
+		if server.Detour == models.ClientRoutingProxy {
+			address += "#" + ClashGroupProxy
+		}
+
+		for _, domain := range rule.Domains {
+			set(domain, address)
+		}
+		for _, suffix := range rule.DomainSuffixes {
+			set("+."+suffix, address)
+		}
+		for _, tag := range rule.RuleSets {
+			if kind, name, ok := geoRuleSet(routing, tag); ok && kind == "geosite" {
+				set("geosite:"+name, address)
+			}
+		}
+	}
+
+	if len(policy) == 0 {
+		return nil
+	}
+	return policy
+}
+
+// SerializeClashConfig сериализует конфиг Clash в YAML
+func (g *ConfigGenerator) SerializeClashConfig(config *ClashConfig) (string, error) {
+	var b strings.Builder
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(config); err != nil {
+		return "", err
+	}
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// loadClashRules читает правила Clash из файла: по одному правилу на строку, # - комментарий.
+// Без файла или при ошибке используются DefaultClashRules. Последним правилом всегда идёт MATCH
+func loadClashRules(path string) []string {
+	if path == "" {
+		return DefaultClashRules
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("Clash: правила из %s не загружены, используются стандартные: %v", path, err)
+		return DefaultClashRules
+	}
+	defer file.Close()
+
+	var rules []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rules = append(rules, line)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Clash: правила из %s не загружены, используются стандартные: %v", path, err)
+		return DefaultClashRules
+	}
+	if len(rules) == 0 {
+		log.Printf("Clash: в %s нет правил, используются стандартные", path)
+		return DefaultClashRules
+	}
+
+	if !strings.HasPrefix(rules[len(rules)-1], "MATCH,") {
+		rules = append(rules, "MATCH,"+ClashGroupProxy)
+	}
+	return rules
+}
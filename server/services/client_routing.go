@@ -0,0 +1,288 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"gorm.io/gorm"
+	"zen-admin/models"
+)
+
+// DNS сервер "local" - системный резолвер устройства
+const clientDNSLocal = "local"
+
+// ErrUnsupportedClientRouting - шаблон нельзя перенести в формат конфига без потери правил
+var ErrUnsupportedClientRouting = errors.New("шаблон маршрутизации не поддерживается форматом")
+
+// Теги, которые генераторы клиентских конфигов используют сами
+var reservedClientRoutingTags = map[string]bool{
+	"direct":       true,
+	"block":        true,
+	"proxy":        true,
+	"proxy-dns":    true,
+	"local-dns":    true,
+	"dns-internal": true,
+}
+
+// DefaultClientRouting - встроенные правила для пользователей без шаблона: реклама блокируется.
+// Локальные сети идут напрямую в любом шаблоне, всё остальное - через прокси
+var DefaultClientRouting = &models.ClientRoutingTemplate{
+	Name: "built-in",
+	Rules: []models.ClientRoutingRule{
+		{Name: "ads", Action: models.ClientRoutingBlock, RuleSets: []string{"geosite-category-ads-all"}},
+	},
+	RuleSets: []models.RoutingRuleSet{
+		{Tag: "geosite-category-ads-all"},
+	},
+}
+
+// ClientRoutingFor возвращает шаблон маршрутизации пользователя: назначенный или шаблон по умолчанию.
+// nil - шаблонов нет, генераторы используют встроенные правила
+func ClientRoutingFor(db *gorm.DB, user *models.User) (*models.ClientRoutingTemplate, error) {
+	var template models.ClientRoutingTemplate
+	if user.RoutingTemplateID != nil {
+		// Без шаблона конфиг не отдаём: прямые маршруты не должны молча уйти в прокси
+		if err := db.First(&template, *user.RoutingTemplateID).Error; err != nil {
+			return nil, fmt.Errorf("шаблон маршрутизации не найден: %w", err)
+		}
+		return &template, nil
+	}
+
+	err := db.Where("is_default = ?", true).First(&template).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения шаблона маршрутизации: %w", err)
+	}
+	return &template, nil
+}
+
+// ValidateClientRoutingTemplate проверяет шаблон клиентской маршрутизации перед сохранением
+func ValidateClientRoutingTemplate(template *models.ClientRoutingTemplate) error {
+	if strings.TrimSpace(template.Name) == "" {
+		return errors.New("не указано название шаблона")
+	}
+
+	tags := map[string]bool{}
+	checkTag := func(kind, tag string) error {
+		if !routingTagPattern.MatchString(tag) {
+			return fmt.Errorf("%s: некорректный тег %q (латиница в нижнем регистре, цифры, - и _)", kind, tag)
+		}
+		if reservedClientRoutingTags[tag] {
+			return fmt.Errorf("%s: тег %q зарезервирован", kind, tag)
+		}
+		if tags[tag] {
+			return fmt.Errorf("%s: тег %q уже используется", kind, tag)
+		}
+		tags[tag] = true
+		return nil
+	}
+
+	dnsServers := map[string]bool{}
+	for i := range template.DNSServers {
+		server := &template.DNSServers[i]
+		if err := checkTag("DNS сервер", server.Tag); err != nil {
+			return err
+		}
+		if err := validateClientDNSServer(server); err != nil {
+			return fmt.Errorf("DNS сервер %s: %w", server.Tag, err)
+		}
+		dnsServers[server.Tag] = true
+	}
+
+	ruleSets := map[string]bool{}
+	for i := range template.RuleSets {
+		ruleSet := &template.RuleSets[i]
+		if err := checkTag("rule-set", ruleSet.Tag); err != nil {
+			return err
+		}
+		if err := validateRuleSet(ruleSet); err != nil {
+			return fmt.Errorf("rule-set %s: %w", ruleSet.Tag, err)
+		}
+		ruleSets[ruleSet.Tag] = true
+	}
+
+	for i := range template.Rules {
+		rule := &template.Rules[i]
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if err := validateClientRoutingRule(rule, ruleSets, dnsServers); err != nil {
+			return fmt.Errorf("правило %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// validateClientRoutingRule проверяет действие, условия и DNS правила
+func validateClientRoutingRule(rule *models.ClientRoutingRule, ruleSets, dnsServers map[string]bool) error {
+	switch rule.Action {
+	case models.ClientRoutingDirect, models.ClientRoutingProxy, models.ClientRoutingBlock:
+	default:
+		return fmt.Errorf("неизвестное действие %q (допустимо: direct, proxy, block)", rule.Action)
+	}
+
+	domainMatchers := len(rule.Domains) + len(rule.DomainSuffixes) + len(rule.DomainKeywords) + len(rule.RuleSets)
+	if domainMatchers+len(rule.IPCIDRs) == 0 {
+		return errors.New("нужно хотя бы одно условие")
+	}
+
+	for _, list := range [][]string{rule.Domains, rule.DomainSuffixes, rule.DomainKeywords} {
+		for _, domain := range list {
+			if domain == "" || strings.ContainsAny(domain, " /,") {
+				return fmt.Errorf("некорректный домен %q", domain)
+			}
+		}
+	}
+	for _, cidr := range rule.IPCIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			if _, err := netip.ParseAddr(cidr); err != nil {
+				return fmt.Errorf("некорректный IP/CIDR %q", cidr)
+			}
+		}
+	}
+	for _, tag := range rule.RuleSets {
+		if !ruleSets[tag] {
+			return fmt.Errorf("rule-set %q не найден в шаблоне", tag)
+		}
+	}
+
+	if rule.DNS != "" {
+		if !dnsServers[rule.DNS] {
+			return fmt.Errorf("DNS сервер %q не найден в шаблоне", rule.DNS)
+		}
+		if rule.Action == models.ClientRoutingBlock {
+			return errors.New("DNS не задаётся для блокируемых доменов")
+		}
+		// В rule-set'ах geoip-* нет доменов, DNS правило по ним ничего бы не поймало
+		if domainMatchers == countGeoIP(rule.RuleSets) {
+			return errors.New("DNS задаётся только для правил с доменами или доменными rule-set'ами")
+		}
+	}
+
+	return nil
+}
+
+// countGeoIP - число rule-set'ов geoip-*
+func countGeoIP(tags []string) int {
+	n := 0
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, "geoip-") {
+			n++
+		}
+	}
+	return n
+}
+
+// validateClientDNSServer проверяет адрес и выход DNS сервера
+func validateClientDNSServer(server *models.ClientDNSServer) error {
+	switch server.Detour {
+	case "", models.ClientRoutingDirect, models.ClientRoutingProxy:
+	default:
+		return errors.New("detour должен быть direct или proxy")
+	}
+
+	switch {
+	case server.Address == clientDNSLocal:
+		if server.Detour == models.ClientRoutingProxy {
+			return errors.New("системный резолвер не ходит через прокси")
+		}
+	case strings.HasPrefix(server.Address, "https://"):
+		u, err := url.Parse(server.Address)
+		if err != nil || u.Hostname() == "" {
+			return fmt.Errorf("некорректный адрес DoH %q", server.Address)
+		}
+	default:
+		if _, err := netip.ParseAddr(server.Address); err != nil {
+			return fmt.Errorf("некорректный адрес %q (IP, https://host/path или local)", server.Address)
+		}
+	}
+	return nil
+}
+
+// clientRoutingOrDefault - шаблон пользователя или встроенные правила
+func clientRoutingOrDefault(routing *models.ClientRoutingTemplate) *models.ClientRoutingTemplate {
+	if routing == nil {
+		return DefaultClientRouting
+	}
+	return routing
+}
+
+// activeRules - включённые правила шаблона
+func activeRules(routing *models.ClientRoutingTemplate) []models.ClientRoutingRule {
+	var rules []models.ClientRoutingRule
+	for _, rule := range routing.Rules {
+		if !rule.Disabled {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// geoRuleSet разбирает rule-set SagerNet без своего URL: geosite-<name> или geoip-<name>.
+// Clash и Xray понимают только такие rule-set'ы (встроенными GEOSITE/GEOIP),
+// rule-set'ы со своим URL доступны только в sing-box (см. requireGeoRuleSets)
+func geoRuleSet(routing *models.ClientRoutingTemplate, tag string) (kind, name string, ok bool) {
+	for _, ruleSet := range routing.RuleSets {
+		if ruleSet.Tag != tag {
+			continue
+		}
+		if ruleSet.URL != "" {
+			return "", "", false
+		}
+		if name, found := strings.CutPrefix(tag, "geosite-"); found {
+			return "geosite", name, true
+		}
+		if name, found := strings.CutPrefix(tag, "geoip-"); found {
+			return "geoip", name, true
+		}
+	}
+	return "", "", false
+}
+
+// ClientRoutingUnsupportedFormats - форматы подписки, которые откажутся отдавать конфиг по шаблону
+func ClientRoutingUnsupportedFormats(routing *models.ClientRoutingTemplate) []string {
+	if requireGeoRuleSets(routing, "") == nil {
+		return nil
+	}
+	return []string{"clash", "xray"}
+}
+
+// requireGeoRuleSets проверяет, что включённые правила используют только rule-set'ы, которые
+// Clash и Xray выражают встроенными GEOSITE/GEOIP. Иначе часть правила пропала бы, и трафик,
+// который шаблон отправляет напрямую, молча ушёл бы в прокси
+func requireGeoRuleSets(routing *models.ClientRoutingTemplate, format string) error {
+	for i, rule := range routing.Rules {
+		if rule.Disabled {
+			continue
+		}
+		for _, tag := range rule.RuleSets {
+			if _, _, ok := geoRuleSet(routing, tag); ok {
+				continue
+			}
+			name := rule.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			return fmt.Errorf("%w: правило %s использует rule-set %q со своим URL, %s понимает только geosite-*/geoip-* без URL",
+				ErrUnsupportedClientRouting, name, tag, format)
+		}
+	}
+	return nil
+}
+
+// findClientDNSServer ищет DNS сервер шаблона по тегу
+func findClientDNSServer(routing *models.ClientRoutingTemplate, tag string) *models.ClientDNSServer {
+	for i := range routing.DNSServers {
+		if routing.DNSServers[i].Tag == tag {
+			return &routing.DNSServers[i]
+		}
+	}
+	return nil
+}
@@ -4,106 +4,75 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"net/url"
+	"net"
+	"os"
+	"strconv"
 	"strings"
 
 	"github.com/skip2/go-qrcode"
 	"zen-admin/models"
+	"zen-admin/protocols"
 )
 
 // ConfigGenerator - генератор клиентских конфигов
-type ConfigGenerator struct{}
+type ConfigGenerator struct {
+	clashRules []string
+}
 
-// NewConfigGenerator создаёт новый генератор конфигов
+// NewConfigGenerator создаёт новый генератор конфигов.
+// Правила Clash читаются из файла CLASH_RULES_FILE, если он задан
 func NewConfigGenerator() *ConfigGenerator {
-	return &ConfigGenerator{}
+	return &ConfigGenerator{
+		clashRules: loadClashRules(os.Getenv("CLASH_RULES_FILE")),
+	}
 }
 
 // SingboxClientConfig - структура клиентского конфига sing-box
 type SingboxClientConfig struct {
-	Log       map[string]interface{}   `json:"log"`
-	DNS       map[string]interface{}   `json:"dns"`
-	Inbounds  []map[string]interface{} `json:"inbounds"`
-	Outbounds []map[string]interface{} `json:"outbounds"`
-	Route     map[string]interface{}   `json:"route"`
-}
-
-// GenerateSingboxConfig генерирует полный sing-box клиентский конфиг
-func (g *ConfigGenerator) GenerateSingboxConfig(user *models.User, inbounds []models.Inbound) (*SingboxClientConfig, error) {
+	Log          map[string]interface{}   `json:"log"`
+	DNS          map[string]interface{}   `json:"dns"`
+	Inbounds     []map[string]interface{} `json:"inbounds"`
+	Outbounds    []map[string]interface{} `json:"outbounds"`
+	Route        map[string]interface{}   `json:"route"`
+	Experimental map[string]interface{}   `json:"experimental,omitempty"`
+}
+
+// GenerateSingboxConfig генерирует полный sing-box клиентский конфиг для платформы и версии профиля
+// с маршрутизацией по шаблону (nil - встроенные правила).
+// Готовый конфиг проверяется на целостность ссылок между тегами
+func (g *ConfigGenerator) GenerateSingboxConfig(user *models.User, inbounds []models.Inbound, profile SingboxProfile, routing *models.ClientRoutingTemplate) (*SingboxClientConfig, error) {
+	routing = clientRoutingOrDefault(routing)
 	config := &SingboxClientConfig{
 		Log: map[string]interface{}{
 			"level":     "info",
 			"timestamp": true,
 		},
-		DNS: map[string]interface{}{
-			"servers": []map[string]interface{}{
-				{
-					"tag":     "proxy-dns",
-					"address": "8.8.8.8",
-					"detour":  "proxy",
-				},
-				{
-					"tag":     "direct-dns",
-					"address": "8.8.8.8",
-					"detour":  "direct",
-				},
-			},
-			"rules": []map[string]interface{}{
-				{
-					"outbound": "any",
-					"server":   "direct-dns",
-				},
-			},
-			"final": "proxy-dns",
-			"strategy": "prefer_ipv4",
-		},
-		Inbounds: []map[string]interface{}{
-			{
-				"type":                       "tun",
-				"tag":                        "tun-in",
-				"interface_name":             "tun0",
-				"inet4_address":              "172.19.0.1/30",
-				"mtu":                        9000,
-				"auto_route":                 true,
-				"strict_route":               true,
-				"stack":                      "system",
-				"sniff":                      true,
-				"sniff_override_destination": true,
-			},
-		},
-		Route: map[string]interface{}{
-			"auto_detect_interface": true,
-			"final":                 "proxy",
-			"rules": []map[string]interface{}{
-				{
-					"protocol": "dns",
-					"outbound": "dns-out",
-				},
-				{
-					"geoip":    []string{"private"},
-					"outbound": "direct",
-				},
-				{
-					"geosite":  []string{"category-ads-all"},
-					"outbound": "block",
-				},
-			},
-		},
+		DNS:          singboxDNS(profile, routing),
+		Inbounds:     singboxInbounds(profile),
+		Route:        singboxRoute(profile, routing),
+		Experimental: singboxExperimental(),
 	}
 
 	// Генерируем outbounds для каждого инбаунда
 	outbounds := []map[string]interface{}{}
+	// Вспомогательные outbounds (detour) не попадают в селектор
+	var detours []map[string]interface{}
 
 	for _, inbound := range inbounds {
-		if !inbound.Enabled {
+		if !inbound.ClientVisible() {
 			continue
 		}
 
-		outbound, err := g.generateOutbound(user, &inbound)
+		outbound, chained, err := g.generateOutbound(user, &inbound)
 		if err != nil {
 			continue
 		}
 		outbounds = append(outbounds, outbound)
+		detours = append(detours, chained...)
+	}
+
+	if len(outbounds) == 0 {
+		return nil, fmt.Errorf("у пользователя нет инбаундов, доступных в sing-box")
 	}
 
 	// Добавляем селектор если несколько серверов
@@ -124,218 +93,100 @@ func (g *ConfigGenerator) GenerateSingboxConfig(user *models.User, inbounds []mo
 		outbounds[0]["tag"] = "proxy"
 	}
 
-	// Добавляем стандартные outbounds
-	outbounds = append(outbounds,
-		map[string]interface{}{
-			"type": "direct",
-			"tag":  "direct",
-		},
-		map[string]interface{}{
-			"type": "dns",
-			"tag":  "dns-out",
-		},
-	)
+	// Добавляем detour и direct. Блокировка и DNS - действия маршрутизации, а не outbounds
+	outbounds = append(outbounds, detours...)
+	outbounds = append(outbounds, map[string]interface{}{
+		"type": "direct",
+		"tag":  "direct",
+	})
 
 	config.Outbounds = outbounds
 
+	if err := checkSingboxConfig(config); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
 
-// generateOutbound генерирует outbound для конкретного инбаунда
-func (g *ConfigGenerator) generateOutbound(user *models.User, inbound *models.Inbound) (map[string]interface{}, error) {
+// generateOutbound генерирует outbound для конкретного инбаунда и его detour outbounds
+func (g *ConfigGenerator) generateOutbound(user *models.User, inbound *models.Inbound) (map[string]interface{}, []map[string]interface{}, error) {
 	tag := fmt.Sprintf("%s-%s", inbound.Node.Name, inbound.Name)
-
-	switch inbound.Protocol {
-	case models.ProtocolReality:
-		return g.generateVLESSRealityOutbound(user, inbound, tag)
-	case models.ProtocolWSTLS:
-		return g.generateVLESSWSOutbound(user, inbound, tag)
-	case models.ProtocolHysteria2:
-		return g.generateHysteria2Outbound(user, inbound, tag)
-	default:
-		return nil, fmt.Errorf("неподдерживаемый протокол: %s", inbound.Protocol)
-	}
-}
-
-// generateVLESSRealityOutbound генерирует VLESS+REALITY outbound
-// Anti-TSPU: без uTLS fingerprint (дефолтный Go TLS) — менее детектируемый отпечаток
-// SNI обязателен для REALITY — без него handshake не работает
-func (g *ConfigGenerator) generateVLESSRealityOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
-	return map[string]interface{}{
-		"type":        "vless",
-		"tag":         tag,
-		"server":      inbound.Node.Address,
-		"server_port": inbound.ListenPort,
-		"uuid":        user.UUID.String(),
-		"flow":        "xtls-rprx-vision",
-		"tls": map[string]interface{}{
-			"enabled":     true,
-			"server_name": inbound.SNI,
-			"reality": map[string]interface{}{
-				"enabled":    true,
-				"public_key": inbound.PublicKey,
-				"short_id":   inbound.ShortID,
-			},
-		},
-	}, nil
-}
-
-// generateVLESSWSOutbound генерирует VLESS+WS+TLS outbound
-func (g *ConfigGenerator) generateVLESSWSOutbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
-	wsPath := inbound.WSPath
-	if wsPath == "" {
-		wsPath = "/ws"
-	}
-
-	// Если нет сертификатов на sing-box - TLS на nginx, порт 443
-	port := inbound.ListenPort
-	if inbound.CertPath == "" && inbound.KeyPath == "" {
-		port = 443
+	outbound, err := protocols.ClientOutbound(user, inbound, tag)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	// Для WS используем домен (SNI) вместо IP — выглядит как обычный HTTPS трафик
-	server := inbound.SNI
-	if server == "" {
-		server = inbound.Node.Address
+	detours, err := protocols.ClientDetours(user, inbound, tag)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	return map[string]interface{}{
-		"type":        "vless",
-		"tag":         tag,
-		"server":      server,
-		"server_port": port,
-		"uuid":        user.UUID.String(),
-		"tls": map[string]interface{}{
-			"enabled":     true,
-			"server_name": inbound.SNI,
-			"utls": map[string]interface{}{
-				"enabled":     true,
-				"fingerprint": inbound.Fingerprint,
-			},
-		},
-		"transport": map[string]interface{}{
-			"type": "ws",
-			"path": wsPath,
-			"headers": map[string]interface{}{
-				"Host": inbound.SNI,
-			},
-			"early_data_header_name": "Sec-WebSocket-Protocol",
-			"max_early_data":         2048,
-		},
-	}, nil
-}
-
-// generateHysteria2Outbound генерирует Hysteria2 outbound
-func (g *ConfigGenerator) generateHysteria2Outbound(user *models.User, inbound *models.Inbound, tag string) (map[string]interface{}, error) {
-	return map[string]interface{}{
-		"type":        "hysteria2",
-		"tag":         tag,
-		"server":      inbound.Node.Address,
-		"server_port": inbound.ListenPort,
-		"password":    user.UUID.String(),
-		"up_mbps":     inbound.UpMbps,
-		"down_mbps":   inbound.DownMbps,
-		"tls": map[string]interface{}{
-			"enabled":     true,
-			"server_name": inbound.SNI,
-			"insecure":    false,
-		},
-	}, nil
+	return outbound, detours, nil
 }
 
-// GenerateShareURL генерирует URL для шаринга (vless://, hysteria2://)
+// GenerateShareURL генерирует URL для шаринга (схема зависит от протокола инбаунда)
 func (g *ConfigGenerator) GenerateShareURL(user *models.User, inbound *models.Inbound) (string, error) {
-	switch inbound.Protocol {
-	case models.ProtocolReality:
-		return g.generateVLESSRealityURL(user, inbound)
-	case models.ProtocolWSTLS:
-		return g.generateVLESSWSURL(user, inbound)
-	case models.ProtocolHysteria2:
-		return g.generateHysteria2URL(user, inbound)
-	default:
-		return "", fmt.Errorf("неподдерживаемый протокол: %s", inbound.Protocol)
-	}
+	return protocols.ShareURL(user, inbound)
 }
 
-// generateVLESSRealityURL генерирует vless:// URL для REALITY
-func (g *ConfigGenerator) generateVLESSRealityURL(user *models.User, inbound *models.Inbound) (string, error) {
-	// Формат: vless://uuid@server:port?params#name
-	params := url.Values{}
-	// Anti-TSPU: SNI обязателен для REALITY, но без uTLS fingerprint
-	params.Set("type", "tcp")
-	params.Set("security", "reality")
-	params.Set("sni", inbound.SNI)
-	params.Set("pbk", inbound.PublicKey)
-	params.Set("sid", inbound.ShortID)
-	params.Set("flow", "xtls-rprx-vision")
-
-	name := url.QueryEscape(fmt.Sprintf("%s (reality)", user.Name))
-	shareURL := fmt.Sprintf("vless://%s@%s:%d?%s#%s",
-		user.UUID.String(),
-		inbound.Node.Address,
-		inbound.ListenPort,
-		params.Encode(),
-		name,
-	)
-
-	return shareURL, nil
+// SIP008Config - подписка Shadowsocks в формате SIP008 (Outline и совместимые клиенты)
+type SIP008Config struct {
+	Version        int            `json:"version"`
+	Servers        []SIP008Server `json:"servers"`
+	BytesUsed      int64          `json:"bytes_used,omitempty"`
+	BytesRemaining int64          `json:"bytes_remaining,omitempty"`
 }
 
-// generateVLESSWSURL генерирует vless:// URL для WS+TLS
-func (g *ConfigGenerator) generateVLESSWSURL(user *models.User, inbound *models.Inbound) (string, error) {
-	wsPath := inbound.WSPath
-	if wsPath == "" {
-		wsPath = "/ws"
-	}
+// SIP008Server - сервер в подписке SIP008
+type SIP008Server struct {
+	ID         string `json:"id"`
+	Remarks    string `json:"remarks"`
+	Server     string `json:"server"`
+	ServerPort int    `json:"server_port"`
+	Password   string `json:"password"`
+	Method     string `json:"method"`
+}
 
-	// Если нет сертификатов - значит TLS на nginx, используем порт 443
-	port := inbound.ListenPort
-	if inbound.CertPath == "" && inbound.KeyPath == "" {
-		port = 443
+// GenerateSIP008 собирает подписку SIP008 из Shadowsocks инбаундов пользователя
+func (g *ConfigGenerator) GenerateSIP008(user *models.User, inbounds []models.Inbound) *SIP008Config {
+	config := &SIP008Config{
+		Version:   1,
+		Servers:   []SIP008Server{},
+		BytesUsed: user.DataUsed,
 	}
-
-	params := url.Values{}
-	params.Set("type", "ws")
-	params.Set("security", "tls")
-	params.Set("sni", inbound.SNI)
-	params.Set("host", inbound.SNI)
-	params.Set("path", wsPath)
-	params.Set("fp", inbound.Fingerprint)
-
-	name := url.QueryEscape(fmt.Sprintf("%s (ws)", user.Name))
-	// Для WS используем домен (SNI) вместо IP — менее палевно для DPI
-	server := inbound.SNI
-	if server == "" {
-		server = inbound.Node.Address
+	if user.DataLimit > 0 && user.DataLimit > user.DataUsed {
+		config.BytesRemaining = user.DataLimit - user.DataUsed
 	}
 
-	shareURL := fmt.Sprintf("vless://%s@%s:%d?%s#%s",
-		user.UUID.String(),
-		server,
-		port,
-		params.Encode(),
-		name,
-	)
-
-	return shareURL, nil
-}
-
-// generateHysteria2URL генерирует hysteria2:// URL
-func (g *ConfigGenerator) generateHysteria2URL(user *models.User, inbound *models.Inbound) (string, error) {
-	// Формат: hysteria2://password@server:port?sni=xxx#name
-	params := url.Values{}
-	params.Set("sni", inbound.SNI)
-
-	name := url.QueryEscape(fmt.Sprintf("%s (hy2)", user.Name))
-	shareURL := fmt.Sprintf("hysteria2://%s@%s:%d?%s#%s",
-		user.UUID.String(),
-		inbound.Node.Address,
-		inbound.ListenPort,
-		params.Encode(),
-		name,
-	)
-
-	return shareURL, nil
+	for _, inbound := range inbounds {
+		if !inbound.ClientVisible() || inbound.Protocol != models.ProtocolShadowsocks {
+			continue
+		}
+		config.Servers = append(config.Servers, SIP008Server{
+			ID:         fmt.Sprintf("%s-%d", user.UUID.String(), inbound.ID),
+			Remarks:    fmt.Sprintf("%s-%s", inbound.Node.Name, inbound.Name),
+			Server:     inbound.Node.Address,
+			ServerPort: inbound.ListenPort,
+			Password:   inbound.SSClientPassword(user),
+			Method:     inbound.SSMethod,
+		})
+	}
+
+	return config
+}
+
+// GenerateWireGuardConf генерирует стандартный .conf WireGuard (wg-quick, штатные клиенты ОС)
+func (g *ConfigGenerator) GenerateWireGuardConf(inbound *models.Inbound, peer *models.WireGuardPeer) string {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", peer.PrivateKey)
+	fmt.Fprintf(&b, "Address = %s\n", peer.HostPrefix())
+	fmt.Fprintf(&b, "DNS = %s\n", inbound.WGDNSOrDefault())
+	fmt.Fprintf(&b, "MTU = %d\n", inbound.WGMTUOrDefault())
+	b.WriteString("\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", inbound.WGPublicKey)
+	b.WriteString("AllowedIPs = 0.0.0.0/0, ::/0\n")
+	fmt.Fprintf(&b, "Endpoint = %s\n", net.JoinHostPort(inbound.Node.Address, strconv.Itoa(inbound.ListenPort)))
+	b.WriteString("PersistentKeepalive = 25\n")
+	return b.String()
 }
 
 // GenerateQRCode генерирует QR-код PNG из URL
@@ -364,7 +215,7 @@ func (g *ConfigGenerator) GenerateAllShareURLs(user *models.User, inbounds []mod
 	var urls []string
 
 	for _, inbound := range inbounds {
-		if !inbound.Enabled {
+		if !inbound.ClientVisible() {
 			continue
 		}
 
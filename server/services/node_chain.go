@@ -0,0 +1,247 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"zen-admin/models"
+	"zen-admin/pkg/reality"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Ошибки настройки цепочки
+var (
+	ErrChainSelf         = errors.New("нода не может быть вышестоящей для самой себя")
+	ErrChainCycle        = errors.New("цепочка нод образует цикл")
+	ErrChainExitDisabled = errors.New("вышестоящая нода выключена")
+)
+
+// ChainExitSettings - параметры служебного инбаунда ноды-выхода (нулевые значения не меняют текущие)
+type ChainExitSettings struct {
+	Port int
+	SNI  string
+}
+
+// NodeChain управляет цепочками нод: нода-вход в стране пересылает трафик клиентов
+// на вышестоящую ноду (выход) по VLESS+REALITY со служебной учёткой
+type NodeChain struct {
+	db     *gorm.DB
+	syncer *NodeSyncer
+}
+
+// NewNodeChain создаёт сервис цепочек нод
+func NewNodeChain(db *gorm.DB) *NodeChain {
+	return &NodeChain{
+		db:     db,
+		syncer: NewNodeSyncer(db),
+	}
+}
+
+// Path возвращает цепочку от ноды до конечного выхода, начиная с самой ноды
+func (c *NodeChain) Path(node *models.Node) ([]models.Node, error) {
+	path := []models.Node{*node}
+	visited := map[uint]bool{node.ID: true}
+
+	current := node
+	for current.UpstreamNodeID != nil {
+		if visited[*current.UpstreamNodeID] {
+			return path, ErrChainCycle
+		}
+		var next models.Node
+		if err := c.db.First(&next, *current.UpstreamNodeID).Error; err != nil {
+			return path, fmt.Errorf("вышестоящая нода %d не найдена: %w", *current.UpstreamNodeID, err)
+		}
+		visited[next.ID] = true
+		path = append(path, next)
+		current = &path[len(path)-1]
+	}
+
+	return path, nil
+}
+
+// Entries возвращает ноды-входы, для которых нода является вышестоящей
+func (c *NodeChain) Entries(node *models.Node) ([]models.Node, error) {
+	var entries []models.Node
+	err := c.db.Where("upstream_node_id = ?", node.ID).Order("id").Find(&entries).Error
+	return entries, err
+}
+
+// SetUpstream назначает ноде вышестоящую ноду (nil - трафик снова уходит напрямую).
+// Затронутые ноды синхронизируются в фоне: сначала выход, чтобы он уже принимал служебную учётку входа
+func (c *NodeChain) SetUpstream(entry *models.Node, upstreamID *uint, settings ChainExitSettings) error {
+	var previous uint
+	if entry.UpstreamNodeID != nil {
+		previous = *entry.UpstreamNodeID
+	}
+
+	if upstreamID == nil {
+		entry.UpstreamNodeID = nil
+		entry.ChainUUID = ""
+		if err := c.db.Model(&models.Node{}).Where("id = ?", entry.ID).Updates(map[string]interface{}{
+			"upstream_node_id": nil,
+			"chain_uuid":       "",
+		}).Error; err != nil {
+			return err
+		}
+
+		// Вход перестаёт ходить на выход раньше, чем выход забудет его учётку
+		go c.resync(entry.ID, previous)
+		return nil
+	}
+
+	if *upstreamID == entry.ID {
+		return ErrChainSelf
+	}
+
+	var exit models.Node
+	if err := c.db.First(&exit, *upstreamID).Error; err != nil {
+		return err
+	}
+	if !exit.Enabled {
+		return ErrChainExitDisabled
+	}
+
+	// Вышестоящая нода не должна сама (через свою цепочку) вести обратно во вход
+	path, err := c.Path(&exit)
+	if err != nil {
+		return err
+	}
+	for _, n := range path {
+		if n.ID == entry.ID {
+			return ErrChainCycle
+		}
+	}
+
+	exitChanged, err := c.ensureExit(&exit, settings)
+	if err != nil {
+		return err
+	}
+
+	entry.UpstreamNodeID = &exit.ID
+	if entry.ChainUUID == "" {
+		entry.ChainUUID = uuid.NewString()
+	}
+	if err := c.db.Model(&models.Node{}).Where("id = ?", entry.ID).Updates(map[string]interface{}{
+		"upstream_node_id": exit.ID,
+		"chain_uuid":       entry.ChainUUID,
+	}).Error; err != nil {
+		return err
+	}
+
+	order := []uint{exit.ID}
+	if exitChanged {
+		// Адрес служебного инбаунда изменился — остальные входы тоже должны переключиться
+		entries, _ := c.Entries(&exit)
+		for _, e := range entries {
+			if e.ID != entry.ID {
+				order = append(order, e.ID)
+			}
+		}
+	}
+	order = append(order, entry.ID)
+	if previous != 0 && previous != exit.ID {
+		order = append(order, previous)
+	}
+
+	go c.resync(order...)
+	return nil
+}
+
+// ResyncEntries синхронизирует ноды-входы (например, после смены адреса ноды-выхода)
+func (c *NodeChain) ResyncEntries(exit *models.Node) {
+	entries, err := c.Entries(exit)
+	if err != nil || len(entries) == 0 {
+		return
+	}
+
+	ids := make([]uint, len(entries))
+	for i := range entries {
+		ids[i] = entries[i].ID
+	}
+	go c.resync(ids...)
+}
+
+// ensureExit готовит служебный инбаунд на ноде-выходе: ключи REALITY, short_id, порт и SNI.
+// Возвращает true, если у уже настроенного выхода изменились порт или SNI
+func (c *NodeChain) ensureExit(exit *models.Node, settings ChainExitSettings) (bool, error) {
+	configured := exit.IsChainExit()
+	oldPort, oldSNI := exit.ChainPort, exit.ChainSNI
+
+	if settings.Port != 0 {
+		exit.ChainPort = settings.Port
+	}
+	if settings.SNI != "" {
+		exit.ChainSNI = settings.SNI
+	}
+	if exit.ChainPort == 0 {
+		exit.ChainPort = models.DefaultChainPort
+	}
+	if exit.ChainSNI == "" {
+		exit.ChainSNI = models.DefaultChainSNI
+	}
+
+	if exit.ChainPrivateKey == "" {
+		keys, err := reality.GenerateKeyPair()
+		if err != nil {
+			return false, fmt.Errorf("ошибка генерации ключей цепочки: %w", err)
+		}
+		exit.ChainPrivateKey = keys.PrivateKey
+		exit.ChainPublicKey = keys.PublicKey
+	}
+	if exit.ChainShortID == "" {
+		shortID, err := reality.GenerateShortID(reality.MaxShortIDBytes)
+		if err != nil {
+			return false, fmt.Errorf("ошибка генерации short_id цепочки: %w", err)
+		}
+		exit.ChainShortID = shortID
+	}
+
+	changed := configured && (exit.ChainPort != oldPort || exit.ChainSNI != oldSNI)
+	if configured && !changed {
+		return false, nil
+	}
+
+	// Служебный порт не должен пересекаться с инбаундами выхода
+	if exit.ChainPort != oldPort {
+		var inbounds []models.Inbound
+		if err := c.db.Where("node_id = ?", exit.ID).Find(&inbounds).Error; err != nil {
+			return false, err
+		}
+		var conflicts []PortConflict
+		for _, conflict := range FindNodeConflicts(exit, inbounds) {
+			if conflict.Existing.Owner == PortOwnerChain {
+				conflicts = append(conflicts, conflict)
+			}
+		}
+		if len(conflicts) > 0 {
+			return false, &PortConflictsError{Conflicts: conflicts}
+		}
+	}
+
+	err := c.db.Model(&models.Node{}).Where("id = ?", exit.ID).Updates(map[string]interface{}{
+		"chain_port":        exit.ChainPort,
+		"chain_sni":         exit.ChainSNI,
+		"chain_private_key": exit.ChainPrivateKey,
+		"chain_public_key":  exit.ChainPublicKey,
+		"chain_short_id":    exit.ChainShortID,
+	}).Error
+	return changed, err
+}
+
+// resync последовательно синхронизирует ноды в заданном порядке
+func (c *NodeChain) resync(nodeIDs ...uint) {
+	for _, id := range nodeIDs {
+		var node models.Node
+		if err := c.db.First(&node, id).Error; err != nil || !node.Enabled {
+			continue
+		}
+		if err := c.syncer.Sync(&node); err != nil {
+			log.Printf("Chain: ошибка синхронизации ноды %s: %v", node.Name, err)
+			continue
+		}
+		log.Printf("Chain: конфиг ноды %s синхронизирован", node.Name)
+	}
+}
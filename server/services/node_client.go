@@ -3,17 +3,28 @@ package services
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"zen-admin/models"
+	"zen-admin/pkg/porthop"
 )
 
+// ErrClashAPIUnavailable - агент ответил, но не достучался до Clash API sing-box
+var ErrClashAPIUnavailable = errors.New("Clash API sing-box недоступен")
+
 // NodeClient - HTTP клиент для связи с агентами на нодах
 type NodeClient struct {
 	httpClient *http.Client
+	// Для долгоживущих потоков (логи) — без общего таймаута
+	streamClient *http.Client
+	// Для долгих операций (выпуск сертификатов через ACME)
+	longClient *http.Client
 }
 
 // NewNodeClient создаёт новый клиент для работы с нодами
@@ -22,6 +33,14 @@ func NewNodeClient() *NodeClient {
 		httpClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
+		streamClient: &http.Client{
+			Transport: &http.Transport{
+				ResponseHeaderTimeout: 10 * time.Second,
+			},
+		},
+		longClient: &http.Client{
+			Timeout: 5 * time.Minute,
+		},
 	}
 }
 
@@ -53,6 +72,48 @@ type NodeStats struct {
 	Users []UserTraffic `json:"users"`
 }
 
+// NodeConnections - активные соединения на ноде
+type NodeConnections struct {
+	Total    int            `json:"total"`
+	Inbounds map[string]int `json:"inbounds"` // tag инбаунда -> количество соединений
+}
+
+// CertInfo - сертификат на ноде (ответ агента)
+type CertInfo struct {
+	Domain        string     `json:"domain"`
+	Source        string     `json:"source"`
+	CertPath      string     `json:"cert_path"`
+	KeyPath       string     `json:"key_path"`
+	Issuer        string     `json:"issuer,omitempty"`
+	Subject       string     `json:"subject,omitempty"`
+	DNSNames      []string   `json:"dns_names,omitempty"`
+	NotBefore     *time.Time `json:"not_before,omitempty"`
+	NotAfter      *time.Time `json:"not_after,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+}
+
+// AgentVersion - версия агента и информация о сборке
+type AgentVersion struct {
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit,omitempty"`
+	BuildTime string    `json:"build_time,omitempty"`
+	GoVersion string    `json:"go_version"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// AgentUpdate - подписанный релиз для самообновления агента
+type AgentUpdate struct {
+	Version   string `json:"version"`
+	BinaryURL string `json:"binary_url,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	Image     string `json:"image,omitempty"`
+	Downgrade bool   `json:"downgrade,omitempty"`
+	Signature string `json:"signature"`
+}
+
 // getNodeURL формирует URL для запроса к ноде
 func (c *NodeClient) getNodeURL(node *models.Node, path string) string {
 	return fmt.Sprintf("http://%s:%d%s", node.Address, node.APIPort, path)
@@ -60,6 +121,11 @@ func (c *NodeClient) getNodeURL(node *models.Node, path string) string {
 
 // doRequest выполняет HTTP запрос к ноде с авторизацией
 func (c *NodeClient) doRequest(method, url string, body interface{}, token string) (*http.Response, error) {
+	return c.doRequestWith(c.httpClient, method, url, body, token)
+}
+
+// doRequestWith выполняет HTTP запрос к ноде указанным клиентом
+func (c *NodeClient) doRequestWith(client *http.Client, method, url string, body interface{}, token string) (*http.Response, error) {
 	var reqBody io.Reader
 	if body != nil {
 		jsonData, err := json.Marshal(body)
@@ -79,7 +145,7 @@ func (c *NodeClient) doRequest(method, url string, body interface{}, token strin
 		req.Header.Set("X-API-Token", token)
 	}
 
-	return c.httpClient.Do(req)
+	return client.Do(req)
 }
 
 // GetStatus проверяет статус ноды (health check)
@@ -132,6 +198,34 @@ func (c *NodeClient) PushConfig(node *models.Node, config interface{}) error {
 	return nil
 }
 
+// PushPortHopping заменяет правила port hopping на ноде.
+// Старые агенты без /port-hopping пропускаются, пока правил нет
+func (c *NodeClient) PushPortHopping(node *models.Node, rules []porthop.Rule) error {
+	if rules == nil {
+		rules = []porthop.Rule{}
+	}
+
+	url := c.getNodeURL(node, "/port-hopping")
+	resp, err := c.doRequest("POST", url, porthop.Request{Rules: rules}, node.APIToken)
+	if err != nil {
+		return fmt.Errorf("ошибка отправки правил port hopping: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && len(rules) == 0 {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("агент ноды не поддерживает port hopping, обновите агент")
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("ошибка применения правил port hopping: %s", string(body))
+	}
+
+	return nil
+}
+
 // RestartSingbox перезапускает sing-box на ноде
 func (c *NodeClient) RestartSingbox(node *models.Node) error {
 	url := c.getNodeURL(node, "/restart")
@@ -193,6 +287,173 @@ func (c *NodeClient) GenerateKeys(node *models.Node) (*RealityKeys, error) {
 	return &keys, nil
 }
 
+// GetConnections получает количество активных соединений на ноде
+func (c *NodeClient) GetConnections(node *models.Node) (*NodeConnections, error) {
+	url := c.getNodeURL(node, "/connections")
+	resp, err := c.doRequest("GET", url, nil, node.APIToken)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения соединений: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusBadGateway {
+			return nil, fmt.Errorf("%w: %s", ErrClashAPIUnavailable, string(body))
+		}
+		return nil, fmt.Errorf("ошибка соединений: %s", string(body))
+	}
+
+	var conns NodeConnections
+	if err := json.NewDecoder(resp.Body).Decode(&conns); err != nil {
+		return nil, fmt.Errorf("ошибка парсинга соединений: %w", err)
+	}
+
+	return &conns, nil
+}
+
+// ListCerts получает список сертификатов на ноде
+func (c *NodeClient) ListCerts(node *models.Node) ([]CertInfo, error) {
+	url := c.getNodeURL(node, "/certs")
+	resp, err := c.doRequest("GET", url, nil, node.APIToken)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения сертификатов: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("ошибка сертификатов: %s", string(body))
+	}
+
+	var certs []CertInfo
+	if err := json.NewDecoder(resp.Body).Decode(&certs); err != nil {
+		return nil, fmt.Errorf("ошибка парсинга сертификатов: %w", err)
+	}
+
+	return certs, nil
+}
+
+// UploadCert загружает сертификат и ключ на ноду
+func (c *NodeClient) UploadCert(node *models.Node, domain, certPEM, keyPEM string) (*CertInfo, error) {
+	url := c.getNodeURL(node, "/certs/upload")
+	body := map[string]string{
+		"domain":      domain,
+		"certificate": certPEM,
+		"private_key": keyPEM,
+	}
+	return c.certRequest(c.httpClient, url, body, node.APIToken)
+}
+
+// RequestACMECert просит агента выпустить сертификат через ACME (может занять несколько минут)
+func (c *NodeClient) RequestACMECert(node *models.Node, domain, email string) (*CertInfo, error) {
+	url := c.getNodeURL(node, "/certs/acme")
+	body := map[string]string{
+		"domain": domain,
+		"email":  email,
+	}
+	return c.certRequest(c.longClient, url, body, node.APIToken)
+}
+
+// certRequest отправляет запрос на выпуск/загрузку сертификата и разбирает ответ
+func (c *NodeClient) certRequest(client *http.Client, url string, body interface{}, token string) (*CertInfo, error) {
+	resp, err := c.doRequestWith(client, "POST", url, body, token)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка запроса сертификата: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("ошибка сертификата: %s", string(respBody))
+	}
+
+	var cert CertInfo
+	if err := json.NewDecoder(resp.Body).Decode(&cert); err != nil {
+		return nil, fmt.Errorf("ошибка парсинга сертификата: %w", err)
+	}
+
+	return &cert, nil
+}
+
+// GetVersion получает версию агента
+func (c *NodeClient) GetVersion(node *models.Node) (*AgentVersion, error) {
+	url := c.getNodeURL(node, "/version")
+	resp, err := c.doRequest("GET", url, nil, node.APIToken)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения версии: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("ошибка версии: %s", string(body))
+	}
+
+	var version AgentVersion
+	if err := json.NewDecoder(resp.Body).Decode(&version); err != nil {
+		return nil, fmt.Errorf("ошибка парсинга версии: %w", err)
+	}
+
+	return &version, nil
+}
+
+// PushUpdate отправляет агенту подписанный релиз. Агент проверяет подпись,
+// подменяет себя и перезапускается — новую версию нужно проверять отдельно
+func (c *NodeClient) PushUpdate(node *models.Node, update *AgentUpdate) error {
+	url := c.getNodeURL(node, "/update")
+	resp, err := c.doRequestWith(c.longClient, "POST", url, update, node.APIToken)
+	if err != nil {
+		return fmt.Errorf("ошибка отправки обновления: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("ошибка обновления: %s", string(body))
+	}
+
+	return nil
+}
+
+// LogOptions - параметры чтения логов sing-box
+type LogOptions struct {
+	Tail   int
+	Follow bool
+	Level  string
+}
+
+// StreamLogs открывает поток логов sing-box с ноды. Вызывающий обязан закрыть поток
+func (c *NodeClient) StreamLogs(node *models.Node, opts LogOptions) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("tail", strconv.Itoa(opts.Tail))
+	query.Set("follow", strconv.FormatBool(opts.Follow))
+	if opts.Level != "" {
+		query.Set("level", opts.Level)
+	}
+
+	req, err := http.NewRequest("GET", c.getNodeURL(node, "/logs?"+query.Encode()), nil)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания запроса: %w", err)
+	}
+	if node.APIToken != "" {
+		req.Header.Set("X-API-Token", node.APIToken)
+	}
+
+	resp, err := c.streamClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения логов: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("ошибка логов: %s", string(body))
+	}
+
+	return resp.Body, nil
+}
+
 // GetConfig получает текущий конфиг sing-box с ноды
 func (c *NodeClient) GetConfig(node *models.Node) (map[string]interface{}, error) {
 	url := c.getNodeURL(node, "/config")
@@ -0,0 +1,155 @@
+package services
+
+import (
+	"fmt"
+
+	"zen-admin/models"
+	"zen-admin/pkg/porthop"
+	"zen-admin/protocols"
+	"zen-admin/singbox"
+
+	"gorm.io/gorm"
+)
+
+// PortConflictsError - конфиг ноды не отправлен из-за конфликта портов
+type PortConflictsError struct {
+	Conflicts []PortConflict
+}
+
+func (e *PortConflictsError) Error() string {
+	return "конфликт портов: " + e.Conflicts[0].Error()
+}
+
+// NodeSyncer собирает серверный конфиг sing-box ноды и отправляет его агенту
+type NodeSyncer struct {
+	db          *gorm.DB
+	nodeClient  *NodeClient
+	templateGen *singbox.TemplateGenerator
+	ipam        *WireGuardIPAM
+}
+
+// NewNodeSyncer создаёт сервис синхронизации нод
+func NewNodeSyncer(db *gorm.DB) *NodeSyncer {
+	return &NodeSyncer{
+		db:          db,
+		nodeClient:  NewNodeClient(),
+		templateGen: singbox.NewTemplateGenerator(),
+		ipam:        NewWireGuardIPAM(db),
+	}
+}
+
+// PushConfig генерирует конфиг по инбаундам ноды и отправляет его агенту (без перезапуска sing-box).
+// При конфликте портов возвращает *PortConflictsError и ничего не отправляет
+func (s *NodeSyncer) PushConfig(node *models.Node) error {
+	var inbounds []models.Inbound
+	if err := s.db.Where("node_id = ?", node.ID).Find(&inbounds).Error; err != nil {
+		return fmt.Errorf("ошибка получения инбаундов: %w", err)
+	}
+
+	// sing-box не стартует, если два инбаунда делят порт — не отправляем такой конфиг
+	if conflicts := FindNodeConflicts(node, inbounds); len(conflicts) > 0 {
+		return &PortConflictsError{Conflicts: conflicts}
+	}
+
+	// Собираем включённых пользователей для каждого инбаунда
+	usersByInbound := make(map[uint][]models.User)
+	attachedByInbound := make(map[uint][]uint)
+	for _, inbound := range inbounds {
+		var users []models.User
+		s.db.Model(&inbound).Association("Users").Find(&users)
+		var enabledUsers []models.User
+		for _, u := range users {
+			attachedByInbound[inbound.ID] = append(attachedByInbound[inbound.ID], u.ID)
+			if u.Enabled {
+				enabledUsers = append(enabledUsers, u)
+			}
+		}
+		usersByInbound[inbound.ID] = enabledUsers
+	}
+
+	config, err := s.templateGen.GenerateServerConfig(inbounds, usersByInbound, protocols.ServerInbound)
+	if err != nil {
+		return fmt.Errorf("ошибка генерации конфига: %w", err)
+	}
+
+	// WireGuard: адреса выделяются до отправки конфига, чтобы клиентский .conf совпадал с сервером
+	for i := range inbounds {
+		inbound := &inbounds[i]
+		if inbound.Protocol != models.ProtocolWireGuard || !inbound.Enabled {
+			continue
+		}
+		peers, err := s.ipam.SyncPeers(inbound, attachedByInbound[inbound.ID], usersByInbound[inbound.ID])
+		if err != nil {
+			return fmt.Errorf("инбаунд %s: %w", inbound.Name, err)
+		}
+		if len(peers) > 0 {
+			s.templateGen.ApplyWireGuard(config, inbound, peers)
+		}
+	}
+
+	upstream, downstream, err := s.chainLinks(node)
+	if err != nil {
+		return err
+	}
+	s.templateGen.ApplyChain(config, node, upstream, downstream)
+
+	if node.RoutingPolicyID != nil {
+		var policy models.RoutingPolicy
+		// Без политики конфиг не отправляем: блокировки не должны молча пропасть
+		if err := s.db.First(&policy, *node.RoutingPolicyID).Error; err != nil {
+			return fmt.Errorf("политика маршрутизации не найдена: %w", err)
+		}
+		s.templateGen.ApplyRoutingPolicy(config, &policy)
+	}
+
+	if err := s.nodeClient.PushConfig(node, config); err != nil {
+		return err
+	}
+	return s.nodeClient.PushPortHopping(node, PortHoppingRules(inbounds))
+}
+
+// PortHoppingRules собирает правила port hopping по включённым Hysteria2 инбаундам
+func PortHoppingRules(inbounds []models.Inbound) []porthop.Rule {
+	var rules []porthop.Rule
+	for i := range inbounds {
+		if inbounds[i].Enabled && inbounds[i].PortHopping() {
+			rules = append(rules, porthop.Rule{
+				Start: inbounds[i].HopPortStart,
+				End:   inbounds[i].HopPortEnd,
+				Port:  inbounds[i].ListenPort,
+			})
+		}
+	}
+	return rules
+}
+
+// chainLinks загружает вышестоящую ноду и ноды-входы, для которых эта нода - выход
+func (s *NodeSyncer) chainLinks(node *models.Node) (*models.Node, []models.Node, error) {
+	var upstream *models.Node
+	if node.UpstreamNodeID != nil {
+		var n models.Node
+		// Без вышестоящей ноды конфиг не отправляем: трафик не должен молча пойти напрямую
+		if err := s.db.First(&n, *node.UpstreamNodeID).Error; err != nil {
+			return nil, nil, fmt.Errorf("вышестоящая нода цепочки не найдена: %w", err)
+		}
+		if !n.IsChainExit() {
+			return nil, nil, fmt.Errorf("вышестоящая нода %s не настроена как выход цепочки", n.Name)
+		}
+		upstream = &n
+	}
+
+	var downstream []models.Node
+	if err := s.db.Where("upstream_node_id = ? AND chain_uuid <> ''", node.ID).Find(&downstream).Error; err != nil {
+		return nil, nil, fmt.Errorf("ошибка получения нод-входов: %w", err)
+	}
+
+	return upstream, downstream, nil
+}
+
+// Sync отправляет конфиг и перезапускает sing-box
+func (s *NodeSyncer) Sync(node *models.Node) error {
+	if err := s.PushConfig(node); err != nil {
+		return err
+	}
+	return s.nodeClient.RestartSingbox(node)
+}
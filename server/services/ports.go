@@ -0,0 +1,244 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"zen-admin/models"
+	"zen-admin/protocols"
+	"zen-admin/singbox"
+)
+
+// Сетевые протоколы портов
+const (
+	NetworkTCP = "tcp"
+	NetworkUDP = "udp"
+)
+
+// Кто занимает порт на ноде
+const (
+	PortOwnerInbound  = "inbound"   // sing-box инбаунд
+	PortOwnerFallback = "fallback"  // Веб-сервер для REALITY fallback (Caddy/nginx)
+	PortOwnerProxy    = "proxy"     // nginx, терминирующий TLS для WS инбаундов
+	PortOwnerAgent    = "agent"     // API агента
+	PortOwnerClashAPI = "clash_api" // Clash API sing-box
+	PortOwnerACME     = "acme"      // HTTP-01 проверка ACME
+	PortOwnerChain    = "chain"     // Служебный инбаунд для нод-входов цепочки
+)
+
+// Порт, на котором nginx принимает WS инбаунды без собственного TLS
+const nginxPublicPort = 443
+
+// PortBinding - занятый порт на ноде
+type PortBinding struct {
+	Port        int    `json:"port"`
+	PortEnd     int    `json:"port_end,omitempty"` // Конец диапазона (port hopping Hysteria2)
+	Network     string `json:"network"`
+	Owner       string `json:"owner"`
+	InboundID   uint   `json:"inbound_id,omitempty"`
+	InboundName string `json:"inbound_name,omitempty"`
+	Protocol    string `json:"protocol,omitempty"`
+	Description string `json:"description"`
+}
+
+// PortConflict - два владельца одного порта
+type PortConflict struct {
+	Port     int         `json:"port"`
+	Network  string      `json:"network"`
+	Existing PortBinding `json:"existing"`
+	Incoming PortBinding `json:"incoming"`
+}
+
+// Error описывает конфликт для ответа API
+func (c PortConflict) Error() string {
+	return fmt.Sprintf("порт %d/%s уже занят: %s", c.Port, c.Network, c.Existing.Description)
+}
+
+// lastPort возвращает последний порт привязки (для диапазона - его конец)
+func (b PortBinding) lastPort() int {
+	if b.PortEnd > b.Port {
+		return b.PortEnd
+	}
+	return b.Port
+}
+
+// overlaps - привязки пересекаются по портам одного сетевого протокола
+func (b PortBinding) overlaps(other PortBinding) bool {
+	return b.Network == other.Network && b.Port <= other.lastPort() && other.Port <= b.lastPort()
+}
+
+// wsBehindNginx - WS инбаунд без сертификатов: TLS терминирует nginx на 443
+func wsBehindNginx(inbound *models.Inbound) bool {
+	return inbound.Protocol == models.ProtocolWSTLS && inbound.CertPath == "" && inbound.KeyPath == ""
+}
+
+// InboundBindings возвращает порты, которые инбаунд занимает на ноде
+func InboundBindings(inbound *models.Inbound) []PortBinding {
+	base := PortBinding{
+		Owner:       PortOwnerInbound,
+		InboundID:   inbound.ID,
+		InboundName: inbound.Name,
+		Protocol:    string(inbound.Protocol),
+	}
+
+	var bindings []PortBinding
+	for _, port := range protocols.Ports(inbound) {
+		b := base
+		b.Port = port.Port
+		b.PortEnd = port.PortEnd
+		b.Network = port.Network
+		b.Description = port.Description
+		if port.Fallback {
+			b.Owner = PortOwnerFallback
+		}
+		bindings = append(bindings, b)
+	}
+
+	return bindings
+}
+
+// NodeReservedBindings возвращает служебные порты ноды
+func NodeReservedBindings(node *models.Node) []PortBinding {
+	_, port, _ := net.SplitHostPort(singbox.ClashAPIListen)
+	clashPort, _ := strconv.Atoi(port)
+
+	bindings := []PortBinding{
+		{Port: node.APIPort, Network: NetworkTCP, Owner: PortOwnerAgent, Description: "API агента ноды"},
+		{Port: clashPort, Network: NetworkTCP, Owner: PortOwnerClashAPI, Description: "Clash API sing-box"},
+		{Port: 80, Network: NetworkTCP, Owner: PortOwnerACME, Description: "HTTP-01 проверка ACME"},
+	}
+	if node.ChainPort != 0 {
+		bindings = append(bindings, PortBinding{Port: node.ChainPort, Network: NetworkTCP, Owner: PortOwnerChain, Description: "служебный инбаунд цепочки нод"})
+	}
+	return bindings
+}
+
+// BuildPortMap собирает карту портов ноды по включённым инбаундам (как в серверном конфиге)
+func BuildPortMap(node *models.Node, inbounds []models.Inbound) []PortBinding {
+	bindings := NodeReservedBindings(node)
+
+	nginx, public := false, false
+	for i := range inbounds {
+		if !inbounds[i].Enabled {
+			continue
+		}
+		for _, b := range InboundBindings(&inbounds[i]) {
+			if b.Port == nginxPublicPort && b.Network == NetworkTCP {
+				public = true
+			}
+			bindings = append(bindings, b)
+		}
+		if wsBehindNginx(&inbounds[i]) {
+			nginx = true
+		}
+	}
+	// Если 443/tcp занят REALITY, nginx стоит за его fallback и отдельного порта не занимает
+	if nginx && !public {
+		bindings = append(bindings, PortBinding{
+			Port:        nginxPublicPort,
+			Network:     NetworkTCP,
+			Owner:       PortOwnerProxy,
+			Description: "nginx (TLS для WS инбаундов)",
+		})
+	}
+
+	sort.SliceStable(bindings, func(i, j int) bool {
+		if bindings[i].Port != bindings[j].Port {
+			return bindings[i].Port < bindings[j].Port
+		}
+		return bindings[i].Network < bindings[j].Network
+	})
+	return bindings
+}
+
+// FindPortConflicts проверяет, что инбаунд можно поставить на ноду рядом с остальными.
+// others - остальные инбаунды ноды (сам инбаунд среди них игнорируется по ID)
+func FindPortConflicts(node *models.Node, inbound *models.Inbound, others []models.Inbound) []PortConflict {
+	if !inbound.Enabled {
+		return nil
+	}
+
+	var existing []PortBinding
+	existing = append(existing, NodeReservedBindings(node)...)
+	for i := range others {
+		if (inbound.ID != 0 && others[i].ID == inbound.ID) || !others[i].Enabled {
+			continue
+		}
+		existing = append(existing, InboundBindings(&others[i])...)
+	}
+
+	var conflicts []PortConflict
+	for _, incoming := range InboundBindings(inbound) {
+		for _, b := range existing {
+			if !b.overlaps(incoming) {
+				continue
+			}
+			// Несколько REALITY инбаундов могут ссылаться на один и тот же fallback-сервер
+			if b.Owner == PortOwnerFallback && incoming.Owner == PortOwnerFallback {
+				continue
+			}
+			port := incoming.Port
+			if b.Port > port {
+				port = b.Port
+			}
+			conflicts = append(conflicts, PortConflict{Port: port, Network: incoming.Network, Existing: b, Incoming: incoming})
+		}
+	}
+
+	// Инбаунд не может отдавать fallback на собственный порт — получится петля
+	bindings := InboundBindings(inbound)
+	for _, fallback := range bindings {
+		if fallback.Owner == PortOwnerFallback && fallback.overlaps(bindings[0]) {
+			conflicts = append(conflicts, PortConflict{
+				Port:     inbound.ListenPort,
+				Network:  NetworkTCP,
+				Existing: PortBinding{Port: fallback.Port, Network: fallback.Network, Owner: PortOwnerFallback, Description: "fallback этого же инбаунда (петля)"},
+				Incoming: bindings[0],
+			})
+		}
+	}
+
+	// WS за nginx: клиенты ходят на 443, туда же нельзя ставить сам инбаунд без TLS
+	if wsBehindNginx(inbound) {
+		if inbound.ListenPort == nginxPublicPort {
+			b := InboundBindings(inbound)[0]
+			conflicts = append(conflicts, PortConflict{
+				Port:     nginxPublicPort,
+				Network:  NetworkTCP,
+				Existing: PortBinding{Port: nginxPublicPort, Network: NetworkTCP, Owner: PortOwnerProxy, Description: "nginx (WS без сертификата должен слушать внутренний порт)"},
+				Incoming: b,
+			})
+		}
+
+		// nginx маршрутизирует по SNI и пути (для gRPC — по имени сервиса) — два инбаунда с одинаковыми не различить
+		for i := range others {
+			other := &others[i]
+			if (inbound.ID != 0 && other.ID == inbound.ID) || !other.Enabled || !wsBehindNginx(other) {
+				continue
+			}
+			if strings.EqualFold(other.SNI, inbound.SNI) && other.TransportRoute() == inbound.TransportRoute() {
+				conflicts = append(conflicts, PortConflict{
+					Port:     nginxPublicPort,
+					Network:  NetworkTCP,
+					Existing: PortBinding{Port: nginxPublicPort, Network: NetworkTCP, Owner: PortOwnerInbound, InboundID: other.ID, InboundName: other.Name, Protocol: string(other.Protocol), Description: fmt.Sprintf("инбаунд «%s» с тем же SNI %s и путём %s", other.Name, other.SNI, other.TransportRoute())},
+					Incoming: InboundBindings(inbound)[0],
+				})
+			}
+		}
+	}
+
+	return conflicts
+}
+
+// FindNodeConflicts проверяет все включённые инбаунды ноды между собой (перед синхронизацией)
+func FindNodeConflicts(node *models.Node, inbounds []models.Inbound) []PortConflict {
+	var conflicts []PortConflict
+	for i := range inbounds {
+		// Сравниваем только с предыдущими, чтобы каждая пара попала один раз
+		conflicts = append(conflicts, FindPortConflicts(node, &inbounds[i], inbounds[:i])...)
+	}
+	return conflicts
+}
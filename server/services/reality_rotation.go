@@ -0,0 +1,205 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"zen-admin/models"
+	"zen-admin/pkg/reality"
+
+	"gorm.io/gorm"
+)
+
+// ErrRotationInProgress - у инбаунда уже идёт ротация
+var ErrRotationInProgress = errors.New("ротация уже идёт")
+
+// rotationMu сериализует проходы планировщика и внеплановые ротации: RealityRotator создаётся
+// и планировщиком, и обработчиком, а параллельные проходы могли бы дважды добавить
+// или выдать клиентам один и тот же short_id
+var rotationMu sync.Mutex
+
+// RealityRotator проводит REALITY инбаунды через фазы ротации short_id:
+//  1. staged - новый short_id добавляется в список на сервере, клиенты получают старый;
+//  2. grace  - после синхронизации клиенты получают новый, старый ещё принимается;
+//  3. по окончании grace-периода старые short_id удаляются с сервера.
+//
+// Изменения одной ноды за проход отправляются одной синхронизацией
+type RealityRotator struct {
+	db       *gorm.DB
+	syncer   *NodeSyncer
+	interval time.Duration
+}
+
+// NewRealityRotator создаёт планировщик ротации. REALITY_ROTATION_CHECK_MINUTES - период проверки
+func NewRealityRotator(db *gorm.DB) *RealityRotator {
+	return &RealityRotator{
+		db:       db,
+		syncer:   NewNodeSyncer(db),
+		interval: time.Duration(envInt("REALITY_ROTATION_CHECK_MINUTES", 5)) * time.Minute,
+	}
+}
+
+// Start запускает планировщик в фоне
+func (r *RealityRotator) Start() {
+	go func() {
+		for {
+			r.RunOnce()
+			time.Sleep(r.interval)
+		}
+	}()
+}
+
+// RotateNow начинает ротацию инбаунда вне расписания. Нода синхронизируется в фоне:
+// перезапуск sing-box может оборвать запрос, если он идёт через REALITY
+func (r *RealityRotator) RotateNow(inbound *models.Inbound) error {
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+
+	// Пока ждали блокировку, планировщик мог изменить инбаунд
+	if err := r.db.First(inbound, inbound.ID).Error; err != nil {
+		return err
+	}
+	if inbound.RotationPhase != models.RotationPhaseIdle {
+		return ErrRotationInProgress
+	}
+	if err := r.stage(inbound); err != nil {
+		return err
+	}
+
+	nodeID := inbound.NodeID
+	go func() {
+		rotationMu.Lock()
+		defer rotationMu.Unlock()
+		r.syncPending(nodeID)
+	}()
+	return nil
+}
+
+// RunOnce выполняет один проход планировщика
+func (r *RealityRotator) RunOnce() {
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+
+	var inbounds []models.Inbound
+	err := r.db.Where("protocol = ? AND (rotation_interval_hours > 0 OR rotation_phase <> '' OR rotation_sync_pending = ?)",
+		models.ProtocolReality, true).Find(&inbounds).Error
+	if err != nil {
+		log.Printf("Rotation: ошибка получения инбаундов: %v", err)
+		return
+	}
+
+	now := time.Now()
+	nodes := map[uint]bool{}
+	for i := range inbounds {
+		inbound := &inbounds[i]
+
+		switch {
+		case inbound.RotationDue(now):
+			if err := r.stage(inbound); err != nil {
+				log.Printf("Rotation: ошибка ротации инбаунда %s: %v", inbound.Name, err)
+				continue
+			}
+		case inbound.RotationPhase == models.RotationPhaseGrace && inbound.RotationGraceUntil != nil && now.After(*inbound.RotationGraceUntil):
+			r.finish(inbound)
+		}
+
+		if inbound.RotationSyncPending {
+			nodes[inbound.NodeID] = true
+		}
+	}
+
+	for nodeID := range nodes {
+		r.syncPending(nodeID)
+	}
+}
+
+// stage генерирует новый short_id и добавляет его в список сервера
+func (r *RealityRotator) stage(inbound *models.Inbound) error {
+	shortID, err := reality.GenerateShortID(reality.MaxShortIDBytes)
+	if err != nil {
+		return err
+	}
+
+	inbound.ShortIDs = append(inbound.AcceptedShortIDs(), shortID)
+	inbound.RotationNextShortID = shortID
+	inbound.RotationPhase = models.RotationPhaseStaged
+	inbound.RotationSyncPending = true
+	inbound.RotationError = ""
+
+	log.Printf("Rotation: инбаунд %s - новый short_id добавлен на сервер", inbound.Name)
+	return r.db.Save(inbound).Error
+}
+
+// promote отдаёт клиентам новый short_id. Вызывается после того, как сервер начал его принимать
+func (r *RealityRotator) promote(inbound *models.Inbound) {
+	now := time.Now()
+	graceUntil := now.Add(time.Duration(inbound.RotationGraceHours) * time.Hour)
+
+	inbound.ShortID = inbound.RotationNextShortID
+	inbound.RotationNextShortID = ""
+	inbound.RotationPhase = models.RotationPhaseGrace
+	inbound.RotationGraceUntil = &graceUntil
+	inbound.LastRotatedAt = &now
+
+	log.Printf("Rotation: инбаунд %s - клиенты получают новый short_id, старые принимаются до %s", inbound.Name, graceUntil.Format(time.RFC3339))
+	r.db.Save(inbound)
+}
+
+// finish удаляет старые short_id с сервера по окончании grace-периода
+func (r *RealityRotator) finish(inbound *models.Inbound) {
+	inbound.ShortIDs = []string{inbound.ShortID}
+	inbound.RotationPhase = models.RotationPhaseIdle
+	inbound.RotationGraceUntil = nil
+	inbound.RotationSyncPending = true
+
+	log.Printf("Rotation: инбаунд %s - grace-период истёк, старые short_id удаляются", inbound.Name)
+	r.db.Save(inbound)
+}
+
+// syncPending синхронизирует ноду и продвигает её инбаунды, ожидавшие синхронизации
+func (r *RealityRotator) syncPending(nodeID uint) {
+	var pending []models.Inbound
+	if err := r.db.Where("node_id = ? AND rotation_sync_pending = ?", nodeID, true).Find(&pending).Error; err != nil || len(pending) == 0 {
+		return
+	}
+
+	var node models.Node
+	if err := r.db.First(&node, nodeID).Error; err != nil {
+		return
+	}
+
+	// Выключенная нода не получает конфиг: новый short_id на сервер не попал, и выдавать его
+	// клиентам нельзя. Инбаунды ждут, пока ноду включат, и продвигаются следующим проходом
+	if !node.Enabled {
+		return
+	}
+
+	if err := r.syncer.Sync(&node); err != nil {
+		log.Printf("Rotation: ошибка синхронизации ноды %s: %v", node.Name, err)
+		for i := range pending {
+			r.db.Model(&models.Inbound{}).Where("id = ?", pending[i].ID).Update("rotation_error", "Ошибка синхронизации ноды: "+err.Error())
+		}
+		return
+	}
+
+	for i := range pending {
+		inbound := &pending[i]
+		inbound.RotationSyncPending = false
+		inbound.RotationError = ""
+		if inbound.RotationPhase == models.RotationPhaseStaged {
+			r.promote(inbound)
+			continue
+		}
+		r.db.Save(inbound)
+	}
+
+	// Смена keypair при promote требует ещё одной синхронизации
+	for i := range pending {
+		if pending[i].RotationSyncPending {
+			r.syncPending(nodeID)
+			return
+		}
+	}
+}
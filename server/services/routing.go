@@ -0,0 +1,221 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"zen-admin/models"
+	"zen-admin/singbox"
+)
+
+// Протоколы, которые sing-box определяет через sniff
+var sniffProtocols = map[string]bool{
+	"http":       true,
+	"tls":        true,
+	"quic":       true,
+	"stun":       true,
+	"dtls":       true,
+	"bittorrent": true,
+	"ssh":        true,
+	"rdp":        true,
+	"ntp":        true,
+}
+
+var routingTagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Теги, которые генератор конфига использует сам
+var reservedRoutingTags = map[string]bool{
+	"direct":                 true,
+	"block":                  true,
+	singbox.ChainInboundTag:  true,
+	singbox.ChainOutboundTag: true,
+}
+
+// ValidateRoutingPolicy проверяет политику маршрутизации перед сохранением
+func ValidateRoutingPolicy(policy *models.RoutingPolicy) error {
+	if strings.TrimSpace(policy.Name) == "" {
+		return errors.New("не указано название политики")
+	}
+
+	tags := map[string]bool{}
+	checkTag := func(kind, tag string) error {
+		if !routingTagPattern.MatchString(tag) {
+			return fmt.Errorf("%s: некорректный тег %q (латиница в нижнем регистре, цифры, - и _)", kind, tag)
+		}
+		if reservedRoutingTags[tag] {
+			return fmt.Errorf("%s: тег %q зарезервирован", kind, tag)
+		}
+		for _, prefix := range singbox.GeneratedTagPrefixes {
+			if strings.HasPrefix(tag, prefix) {
+				return fmt.Errorf("%s: префикс %q зарезервирован для тегов инбаундов", kind, prefix)
+			}
+		}
+		if tags[tag] {
+			return fmt.Errorf("%s: тег %q уже используется", kind, tag)
+		}
+		tags[tag] = true
+		return nil
+	}
+
+	egresses := map[string]bool{}
+	for i := range policy.Egresses {
+		egress := &policy.Egresses[i]
+		if err := checkTag("выход", egress.Tag); err != nil {
+			return err
+		}
+		if err := validateEgress(egress); err != nil {
+			return fmt.Errorf("выход %s: %w", egress.Tag, err)
+		}
+		egresses[egress.Tag] = true
+	}
+
+	ruleSets := map[string]bool{}
+	for i := range policy.RuleSets {
+		ruleSet := &policy.RuleSets[i]
+		if err := checkTag("rule-set", ruleSet.Tag); err != nil {
+			return err
+		}
+		if err := validateRuleSet(ruleSet); err != nil {
+			return fmt.Errorf("rule-set %s: %w", ruleSet.Tag, err)
+		}
+		ruleSets[ruleSet.Tag] = true
+	}
+
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if err := validateRoutingRule(rule, egresses, ruleSets); err != nil {
+			return fmt.Errorf("правило %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// validateRoutingRule проверяет действие и условия правила
+func validateRoutingRule(rule *models.RoutingRule, egresses, ruleSets map[string]bool) error {
+	switch rule.Action {
+	case models.RoutingActionBlock, models.RoutingActionDirect:
+		if rule.Egress != "" {
+			return fmt.Errorf("выход указывается только для действия %s", models.RoutingActionEgress)
+		}
+	case models.RoutingActionEgress:
+		if !egresses[rule.Egress] {
+			return fmt.Errorf("выход %q не найден в политике", rule.Egress)
+		}
+	default:
+		return fmt.Errorf("неизвестное действие %q (допустимо: block, direct, egress)", rule.Action)
+	}
+
+	matchers := len(rule.Protocols) + len(rule.Domains) + len(rule.DomainSuffixes) + len(rule.DomainKeywords) +
+		len(rule.IPCIDRs) + len(rule.Ports) + len(rule.RuleSets)
+	if matchers == 0 {
+		// Правило без условий перехватило бы весь трафик ноды
+		return errors.New("нужно хотя бы одно условие")
+	}
+
+	for _, protocol := range rule.Protocols {
+		if !sniffProtocols[protocol] {
+			return fmt.Errorf("неизвестный протокол %q", protocol)
+		}
+	}
+	if rule.Network != "" && rule.Network != NetworkTCP && rule.Network != NetworkUDP {
+		return errors.New("network должен быть tcp или udp")
+	}
+	for _, cidr := range rule.IPCIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			if _, err := netip.ParseAddr(cidr); err != nil {
+				return fmt.Errorf("некорректный IP/CIDR %q", cidr)
+			}
+		}
+	}
+	for _, port := range rule.Ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("порт %d вне диапазона 1-65535", port)
+		}
+	}
+	for _, tag := range rule.RuleSets {
+		if !ruleSets[tag] {
+			return fmt.Errorf("rule-set %q не найден в политике", tag)
+		}
+	}
+
+	return nil
+}
+
+// validateRuleSet проверяет источник rule-set'а
+func validateRuleSet(ruleSet *models.RoutingRuleSet) error {
+	switch ruleSet.Format {
+	case "", "binary", "source":
+	default:
+		return errors.New("формат должен быть binary или source")
+	}
+
+	source := singbox.RuleSetURL(ruleSet)
+	if source == "" {
+		return errors.New("не указан URL (без URL допустимы только теги geosite-* и geoip-*)")
+	}
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("некорректный URL %q", source)
+	}
+
+	return nil
+}
+
+// validateEgress проверяет параметры WireGuard выхода
+func validateEgress(egress *models.RoutingEgress) error {
+	if egress.Type != models.EgressTypeWireGuard {
+		return fmt.Errorf("неподдерживаемый тип %q (допустимо: wireguard)", egress.Type)
+	}
+	if len(egress.Address) == 0 {
+		return errors.New("не указан адрес интерфейса")
+	}
+	for _, addr := range egress.Address {
+		if _, err := netip.ParsePrefix(addr); err != nil {
+			return fmt.Errorf("некорректный адрес интерфейса %q (нужен CIDR)", addr)
+		}
+	}
+	if !isWireGuardKey(egress.PrivateKey) {
+		return errors.New("некорректный private_key")
+	}
+	if !isWireGuardKey(egress.PeerPublicKey) {
+		return errors.New("некорректный peer_public_key")
+	}
+	if egress.PeerAddress == "" || strings.ContainsAny(egress.PeerAddress, "/ ") {
+		return errors.New("некорректный peer_address")
+	}
+	if net.ParseIP(egress.PeerAddress) == nil && strings.Contains(egress.PeerAddress, ":") {
+		return errors.New("peer_address указывается без порта")
+	}
+	if egress.PeerPort < 1 || egress.PeerPort > 65535 {
+		return errors.New("peer_port вне диапазона 1-65535")
+	}
+	if len(egress.Reserved) != 0 && len(egress.Reserved) != 3 {
+		return errors.New("reserved должен содержать 3 байта")
+	}
+	for _, b := range egress.Reserved {
+		if b < 0 || b > 255 {
+			return errors.New("reserved должен содержать байты 0-255")
+		}
+	}
+	if egress.MTU != 0 && (egress.MTU < 576 || egress.MTU > 1500) {
+		return errors.New("mtu должен быть в диапазоне 576-1500")
+	}
+	return nil
+}
+
+// isWireGuardKey - ключ WireGuard: 32 байта в base64
+func isWireGuardKey(key string) bool {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(raw) == 32
+}
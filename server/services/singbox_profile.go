@@ -0,0 +1,463 @@
+package services
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"zen-admin/models"
+	"zen-admin/singbox"
+)
+
+// Платформы клиентского профиля sing-box
+const (
+	SingboxPlatformDesktop = "desktop" // TUN с strict_route (Windows, macOS, Linux)
+	SingboxPlatformAndroid = "android" // TUN через VpnService (SFA)
+	SingboxPlatformIOS     = "ios"     // TUN в Network Extension (SFI, SFT)
+	SingboxPlatformMixed   = "mixed"   // Только локальный HTTP/SOCKS прокси, без TUN
+)
+
+// Версии sing-box, под которые генерируется профиль. В 1.12 сменился формат DNS серверов,
+// а резолвер доменов серверов задаётся в route.default_domain_resolver
+const (
+	SingboxVersion111 = "1.11"
+	SingboxVersion112 = "1.12"
+
+	DefaultSingboxVersion = SingboxVersion112
+)
+
+// SingboxProfile - платформа и версия sing-box клиентского конфига
+type SingboxProfile struct {
+	Platform string
+	Version  string
+}
+
+// DefaultSingboxProfile - десктопный TUN профиль для последней поддерживаемой версии
+var DefaultSingboxProfile = SingboxProfile{Platform: SingboxPlatformDesktop, Version: DefaultSingboxVersion}
+
+// ParseSingboxProfile проверяет платформу и версию, пустые значения заменяются значениями по умолчанию
+func ParseSingboxProfile(platform, version string) (SingboxProfile, error) {
+	profile := DefaultSingboxProfile
+
+	switch platform {
+	case "":
+	case SingboxPlatformDesktop, SingboxPlatformAndroid, SingboxPlatformIOS, SingboxPlatformMixed:
+		profile.Platform = platform
+	default:
+		return profile, fmt.Errorf("неизвестная платформа sing-box: %s (desktop, android, ios, mixed)", platform)
+	}
+
+	switch version {
+	case "":
+	case SingboxVersion111, SingboxVersion112:
+		profile.Version = version
+	default:
+		return profile, fmt.Errorf("неподдерживаемая версия sing-box: %s (1.11, 1.12)", version)
+	}
+
+	return profile, nil
+}
+
+// singboxUAVersion - "sing-box 1.11.4" в User-Agent официальных клиентов и Hiddify
+var singboxUAVersion = regexp.MustCompile(`sing-box[ /]v?1\.(\d+)`)
+
+// SingboxProfileFromUserAgent подбирает профиль по User-Agent клиента.
+// Версии старше 1.12 получают профиль 1.12, младше 1.11 - профиль 1.11
+func SingboxProfileFromUserAgent(userAgent string) SingboxProfile {
+	profile := DefaultSingboxProfile
+	ua := strings.ToLower(userAgent)
+
+	switch {
+	case strings.HasPrefix(ua, "sfa/"), strings.Contains(ua, "android"):
+		profile.Platform = SingboxPlatformAndroid
+	case strings.HasPrefix(ua, "sfi/"), strings.HasPrefix(ua, "sft/"), strings.Contains(ua, "(ios"):
+		profile.Platform = SingboxPlatformIOS
+	}
+
+	if m := singboxUAVersion.FindStringSubmatch(ua); m != nil {
+		var minor int
+		fmt.Sscanf(m[1], "%d", &minor)
+		if minor < 12 {
+			profile.Version = SingboxVersion111
+		}
+	}
+
+	return profile
+}
+
+// singboxDNS - DNS через прокси, домены серверов резолвятся локально.
+// Домены правил с DNS шаблона резолвятся его серверами
+func singboxDNS(profile SingboxProfile, routing *models.ClientRoutingTemplate) map[string]interface{} {
+	legacy := profile.Version == SingboxVersion111
+
+	var servers, rules []map[string]interface{}
+	if legacy {
+		servers = []map[string]interface{}{
+			{
+				"tag":     "proxy-dns",
+				"address": "https://8.8.8.8/dns-query",
+				"detour":  "proxy",
+			},
+			{
+				"tag":     "local-dns",
+				"address": "local",
+			},
+		}
+		rules = []map[string]interface{}{
+			{
+				"outbound": "any",
+				"server":   "local-dns",
+			},
+		}
+	} else {
+		servers = []map[string]interface{}{
+			{
+				"type":   "https",
+				"tag":    "proxy-dns",
+				"server": "8.8.8.8",
+				"detour": "proxy",
+			},
+			{
+				"type": "local",
+				"tag":  "local-dns",
+			},
+		}
+	}
+
+	for i := range routing.DNSServers {
+		servers = append(servers, singboxDNSServer(&routing.DNSServers[i], legacy))
+	}
+	for _, rule := range activeRules(routing) {
+		if rule.DNS == "" {
+			continue
+		}
+		dnsRule := singboxDomainMatch(rule, routing)
+		if len(dnsRule) == 0 {
+			continue
+		}
+		dnsRule["server"] = rule.DNS
+		rules = append(rules, dnsRule)
+	}
+
+	dns := map[string]interface{}{
+		"servers":  servers,
+		"final":    "proxy-dns",
+		"strategy": "prefer_ipv4",
+	}
+	if len(rules) > 0 {
+		dns["rules"] = rules
+	}
+	return dns
+}
+
+// singboxDNSServer - DNS сервер шаблона. Домен DoH сервера резолвится системным резолвером
+func singboxDNSServer(server *models.ClientDNSServer, legacy bool) map[string]interface{} {
+	result := map[string]interface{}{"tag": server.Tag}
+	if server.Detour == models.ClientRoutingProxy {
+		result["detour"] = "proxy"
+	}
+
+	// IPv6 адрес url.Parse не разбирает, поэтому DoH определяем по схеме, а не по результату разбора
+	var doh *url.URL
+	if strings.HasPrefix(server.Address, "https://") {
+		doh, _ = url.Parse(server.Address)
+	}
+	isDoH := doh != nil
+	if isDoH {
+		if _, err := netip.ParseAddr(doh.Hostname()); err != nil {
+			if legacy {
+				result["address_resolver"] = "local-dns"
+			} else {
+				result["domain_resolver"] = "local-dns"
+			}
+		}
+	}
+
+	switch {
+	case legacy:
+		result["address"] = server.Address
+	case server.Address == clientDNSLocal:
+		result["type"] = "local"
+	case isDoH:
+		result["type"] = "https"
+		result["server"] = doh.Hostname()
+		if port, err := strconv.Atoi(doh.Port()); err == nil {
+			result["server_port"] = port
+		}
+		if doh.Path != "" && doh.Path != "/dns-query" {
+			result["path"] = doh.Path
+		}
+	default:
+		result["type"] = "udp"
+		result["server"] = server.Address
+	}
+	return result
+}
+
+// singboxDomainMatch - доменные условия правила (для DNS правил IP условия не нужны).
+// Rule-set'ы geoip-* в DNS правилах не используются
+func singboxDomainMatch(rule models.ClientRoutingRule, routing *models.ClientRoutingTemplate) map[string]interface{} {
+	match := map[string]interface{}{}
+	if len(rule.Domains) > 0 {
+		match["domain"] = rule.Domains
+	}
+	if len(rule.DomainSuffixes) > 0 {
+		match["domain_suffix"] = rule.DomainSuffixes
+	}
+	if len(rule.DomainKeywords) > 0 {
+		match["domain_keyword"] = rule.DomainKeywords
+	}
+	var ruleSets []string
+	for _, tag := range rule.RuleSets {
+		if kind, _, ok := geoRuleSet(routing, tag); ok && kind == "geoip" {
+			continue
+		}
+		ruleSets = append(ruleSets, tag)
+	}
+	if len(ruleSets) > 0 {
+		match["rule_set"] = ruleSets
+	}
+	return match
+}
+
+// singboxInbounds - TUN для платформы или локальный mixed прокси
+func singboxInbounds(profile SingboxProfile) []map[string]interface{} {
+	if profile.Platform == SingboxPlatformMixed {
+		return []map[string]interface{}{
+			{
+				"type":        "mixed",
+				"tag":         "mixed-in",
+				"listen":      "127.0.0.1",
+				"listen_port": 2080,
+			},
+		}
+	}
+
+	tun := map[string]interface{}{
+		"type":       "tun",
+		"tag":        "tun-in",
+		"address":    []string{"172.19.0.1/30", "fdfe:dcba:9876::1/126"},
+		"mtu":        9000,
+		"auto_route": true,
+		"stack":      "mixed",
+	}
+	switch profile.Platform {
+	case SingboxPlatformDesktop:
+		tun["strict_route"] = true
+	case SingboxPlatformIOS:
+		// gVisor в Network Extension упирается в лимит памяти iOS
+		tun["stack"] = "system"
+	}
+	return []map[string]interface{}{tun}
+}
+
+// singboxRoute - локальные сети напрямую, дальше правила шаблона, остальное через proxy.
+// Sniff и DNS - действиями маршрутизации вместо устаревших полей инбаунда
+func singboxRoute(profile SingboxProfile, routing *models.ClientRoutingTemplate) map[string]interface{} {
+	rules := []map[string]interface{}{
+		{
+			"action": "sniff",
+		},
+		{
+			"protocol": "dns",
+			"action":   "hijack-dns",
+		},
+		{
+			"ip_is_private": true,
+			"outbound":      "direct",
+		},
+	}
+	for _, rule := range activeRules(routing) {
+		routeRule := map[string]interface{}{}
+		if len(rule.Domains) > 0 {
+			routeRule["domain"] = rule.Domains
+		}
+		if len(rule.DomainSuffixes) > 0 {
+			routeRule["domain_suffix"] = rule.DomainSuffixes
+		}
+		if len(rule.DomainKeywords) > 0 {
+			routeRule["domain_keyword"] = rule.DomainKeywords
+		}
+		if len(rule.IPCIDRs) > 0 {
+			routeRule["ip_cidr"] = rule.IPCIDRs
+		}
+		if len(rule.RuleSets) > 0 {
+			routeRule["rule_set"] = rule.RuleSets
+		}
+		switch rule.Action {
+		case models.ClientRoutingBlock:
+			routeRule["action"] = "reject"
+		case models.ClientRoutingDirect:
+			routeRule["outbound"] = "direct"
+		default:
+			routeRule["outbound"] = "proxy"
+		}
+		rules = append(rules, routeRule)
+	}
+
+	route := map[string]interface{}{
+		"auto_detect_interface": true,
+		"final":                 "proxy",
+		"rules":                 rules,
+	}
+
+	// Rule-set'ы sing-box скачивает сам и кэширует в cache_file
+	var ruleSets []map[string]interface{}
+	for i := range routing.RuleSets {
+		ruleSet := &routing.RuleSets[i]
+		format := ruleSet.Format
+		if format == "" {
+			format = "binary"
+		}
+		remote := map[string]interface{}{
+			"tag":             ruleSet.Tag,
+			"type":            "remote",
+			"format":          format,
+			"url":             singbox.RuleSetURL(ruleSet),
+			"download_detour": "direct",
+		}
+		if ruleSet.UpdateInterval != "" {
+			remote["update_interval"] = ruleSet.UpdateInterval
+		}
+		ruleSets = append(ruleSets, remote)
+	}
+	if len(ruleSets) > 0 {
+		route["rule_set"] = ruleSets
+	}
+
+	if profile.Version != SingboxVersion111 {
+		route["default_domain_resolver"] = "local-dns"
+	}
+	if profile.Platform == SingboxPlatformAndroid {
+		route["override_android_vpn"] = true
+	}
+	return route
+}
+
+// singboxExperimental - cache_file хранит скачанные rule-set'ы и выбор в селекторе
+func singboxExperimental() map[string]interface{} {
+	return map[string]interface{}{
+		"cache_file": map[string]interface{}{
+			"enabled": true,
+		},
+	}
+}
+
+// checkSingboxConfig проверяет, что все ссылки на теги в конфиге ведут на существующие
+// outbounds, DNS серверы и rule-set'ы, а теги не повторяются
+func checkSingboxConfig(config *SingboxClientConfig) error {
+	outbounds, err := collectTags(config.Outbounds, "outbound")
+	if err != nil {
+		return err
+	}
+	if _, err := collectTags(config.Inbounds, "inbound"); err != nil {
+		return err
+	}
+	dnsServers, err := collectTags(mapSlice(config.DNS["servers"]), "DNS сервер")
+	if err != nil {
+		return err
+	}
+	ruleSets, err := collectTags(mapSlice(config.Route["rule_set"]), "rule-set")
+	if err != nil {
+		return err
+	}
+
+	check := func(refs []string, known map[string]bool, kind, where string) error {
+		for _, ref := range refs {
+			if !known[ref] {
+				return fmt.Errorf("некорректный конфиг sing-box: %s %q не найден (%s)", kind, ref, where)
+			}
+		}
+		return nil
+	}
+
+	for _, ob := range config.Outbounds {
+		where := fmt.Sprintf("outbound %v", ob["tag"])
+		if err := check(stringRefs(ob["outbounds"]), outbounds, "outbound", where); err != nil {
+			return err
+		}
+		if err := check(stringRefs(ob["default"]), outbounds, "outbound", where); err != nil {
+			return err
+		}
+		if err := check(stringRefs(ob["detour"]), outbounds, "outbound", where); err != nil {
+			return err
+		}
+	}
+
+	for _, server := range mapSlice(config.DNS["servers"]) {
+		if err := check(stringRefs(server["detour"]), outbounds, "outbound", "dns.servers"); err != nil {
+			return err
+		}
+		if err := check(stringRefs(server["domain_resolver"]), dnsServers, "DNS сервер", "dns.servers"); err != nil {
+			return err
+		}
+		if err := check(stringRefs(server["address_resolver"]), dnsServers, "DNS сервер", "dns.servers"); err != nil {
+			return err
+		}
+	}
+	for _, rule := range mapSlice(config.DNS["rules"]) {
+		if err := check(stringRefs(rule["server"]), dnsServers, "DNS сервер", "dns.rules"); err != nil {
+			return err
+		}
+		if err := check(stringRefs(rule["rule_set"]), ruleSets, "rule-set", "dns.rules"); err != nil {
+			return err
+		}
+	}
+	if err := check(stringRefs(config.DNS["final"]), dnsServers, "DNS сервер", "dns.final"); err != nil {
+		return err
+	}
+
+	for _, rule := range mapSlice(config.Route["rules"]) {
+		if err := check(stringRefs(rule["outbound"]), outbounds, "outbound", "route.rules"); err != nil {
+			return err
+		}
+		if err := check(stringRefs(rule["rule_set"]), ruleSets, "rule-set", "route.rules"); err != nil {
+			return err
+		}
+	}
+	for _, set := range mapSlice(config.Route["rule_set"]) {
+		if err := check(stringRefs(set["download_detour"]), outbounds, "outbound", "route.rule_set"); err != nil {
+			return err
+		}
+	}
+	if err := check(stringRefs(config.Route["final"]), outbounds, "outbound", "route.final"); err != nil {
+		return err
+	}
+	return check(stringRefs(config.Route["default_domain_resolver"]), dnsServers, "DNS сервер", "route.default_domain_resolver")
+}
+
+// collectTags собирает теги элементов и проверяет, что они заданы и уникальны
+func collectTags(items []map[string]interface{}, kind string) (map[string]bool, error) {
+	tags := map[string]bool{}
+	for _, item := range items {
+		tag, _ := item["tag"].(string)
+		if tag == "" {
+			return nil, fmt.Errorf("некорректный конфиг sing-box: %s без тега", kind)
+		}
+		if tags[tag] {
+			return nil, fmt.Errorf("некорректный конфиг sing-box: %s %q повторяется", kind, tag)
+		}
+		tags[tag] = true
+	}
+	return tags, nil
+}
+
+// mapSlice - список объектов из поля конфига (nil, если поля нет)
+func mapSlice(v interface{}) []map[string]interface{} {
+	items, _ := v.([]map[string]interface{})
+	return items
+}
+
+// stringRefs - ссылка на тег строкой или списком строк
+func stringRefs(v interface{}) []string {
+	switch refs := v.(type) {
+	case string:
+		return []string{refs}
+	case []string:
+		return refs
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"zen-admin/models"
+	"zen-admin/protocols"
+
+	"gorm.io/gorm"
+)
+
+// ErrWGPoolExhausted - в пуле инбаунда не осталось свободных адресов
+var ErrWGPoolExhausted = errors.New("в пуле адресов WireGuard нет свободных адресов")
+
+// Попытки выделить адрес, если параллельная синхронизация заняла тот же
+const wgAllocateAttempts = 3
+
+// WireGuardIPAM выделяет пользователям адреса и ключи на WireGuard инбаундах.
+// Выделенные адреса хранятся в WireGuardPeer и не меняются между синхронизациями
+type WireGuardIPAM struct {
+	db *gorm.DB
+}
+
+// NewWireGuardIPAM создаёт сервис выделения адресов WireGuard
+func NewWireGuardIPAM(db *gorm.DB) *WireGuardIPAM {
+	return &WireGuardIPAM{db: db}
+}
+
+// SyncPeers освобождает адреса отвязанных пользователей и выделяет недостающие.
+// attached - все привязанные к инбаунду пользователи (их адреса сохраняются),
+// enabled - включённые, для них возвращаются пиры
+func (a *WireGuardIPAM) SyncPeers(inbound *models.Inbound, attached []uint, enabled []models.User) ([]models.WireGuardPeer, error) {
+	query := a.db.Where("inbound_id = ?", inbound.ID)
+	if len(attached) > 0 {
+		query = query.Where("user_id NOT IN ?", attached)
+	}
+	if err := query.Delete(&models.WireGuardPeer{}).Error; err != nil {
+		return nil, fmt.Errorf("ошибка освобождения адресов: %w", err)
+	}
+
+	peers := make([]models.WireGuardPeer, 0, len(enabled))
+	for i := range enabled {
+		peer, err := a.EnsurePeer(inbound, &enabled[i])
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, *peer)
+	}
+	return peers, nil
+}
+
+// EnsurePeer возвращает пир пользователя, при необходимости выделяя адрес и ключи
+func (a *WireGuardIPAM) EnsurePeer(inbound *models.Inbound, user *models.User) (*models.WireGuardPeer, error) {
+	var peer models.WireGuardPeer
+	err := a.db.Where("inbound_id = ? AND user_id = ?", inbound.ID, user.ID).First(&peer).Error
+	if err == nil {
+		return &peer, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	privateKey, publicKey, err := protocols.GenerateWireGuardKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка генерации ключей WireGuard: %w", err)
+	}
+
+	// Уникальные индексы не дают двум синхронизациям занять один адрес — при конфликте пробуем снова
+	for attempt := 0; attempt < wgAllocateAttempts; attempt++ {
+		address, err := a.freeAddress(inbound)
+		if err != nil {
+			return nil, err
+		}
+
+		peer = models.WireGuardPeer{
+			InboundID:  inbound.ID,
+			UserID:     user.ID,
+			Address:    address,
+			PrivateKey: privateKey,
+			PublicKey:  publicKey,
+		}
+		if err := a.db.Create(&peer).Error; err == nil {
+			return &peer, nil
+		}
+
+		// Пир мог создать параллельный запрос
+		if a.db.Where("inbound_id = ? AND user_id = ?", inbound.ID, user.ID).First(&peer).Error == nil {
+			return &peer, nil
+		}
+	}
+
+	return nil, fmt.Errorf("не удалось выделить адрес WireGuard пользователю %s", user.Name)
+}
+
+// freeAddress ищет первый свободный адрес пула после адреса сервера
+func (a *WireGuardIPAM) freeAddress(inbound *models.Inbound) (string, error) {
+	prefix, err := netip.ParsePrefix(inbound.WGAddressPool)
+	if err != nil {
+		return "", fmt.Errorf("некорректный пул адресов WireGuard: %w", err)
+	}
+	prefix = prefix.Masked()
+
+	var used []string
+	if err := a.db.Model(&models.WireGuardPeer{}).Where("inbound_id = ?", inbound.ID).Pluck("address", &used).Error; err != nil {
+		return "", err
+	}
+	taken := make(map[string]bool, len(used))
+	for _, addr := range used {
+		taken[addr] = true
+	}
+
+	// Первый адрес - сеть, второй - сервер
+	for addr := prefix.Addr().Next().Next(); prefix.Contains(addr); addr = addr.Next() {
+		// Последний адрес IPv4 пула - broadcast
+		if addr.Is4() && !prefix.Contains(addr.Next()) {
+			break
+		}
+		if !taken[addr.String()] {
+			return addr.String(), nil
+		}
+	}
+
+	return "", ErrWGPoolExhausted
+}
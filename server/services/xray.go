@@ -0,0 +1,234 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"zen-admin/models"
+	"zen-admin/protocols"
+)
+
+// XrayClientConfig - клиентский конфиг Xray-core (v2rayNG, v2rayN и т.п.).
+// Селектора в Xray нет, поэтому на каждый сервер генерируется свой конфиг,
+// а подписка - JSON массив конфигов с remarks
+type XrayClientConfig struct {
+	Remarks   string                   `json:"remarks"`
+	Log       map[string]interface{}   `json:"log"`
+	DNS       map[string]interface{}   `json:"dns"`
+	Inbounds  []map[string]interface{} `json:"inbounds"`
+	Outbounds []map[string]interface{} `json:"outbounds"`
+	Routing   map[string]interface{}   `json:"routing"`
+}
+
+// GenerateXrayConfigs генерирует конфиги Xray для всех инбаундов пользователя, которые есть в Xray-core,
+// с маршрутизацией по шаблону (nil - встроенные правила)
+func (g *ConfigGenerator) GenerateXrayConfigs(user *models.User, inbounds []models.Inbound, routing *models.ClientRoutingTemplate) ([]XrayClientConfig, error) {
+	routing = clientRoutingOrDefault(routing)
+	if err := requireGeoRuleSets(routing, "Xray"); err != nil {
+		return nil, err
+	}
+	configs := []XrayClientConfig{}
+
+	for _, inbound := range inbounds {
+		if !inbound.ClientVisible() {
+			continue
+		}
+
+		outbound, err := protocols.XrayOutbound(user, &inbound, "proxy")
+		if err != nil {
+			continue
+		}
+		configs = append(configs, newXrayClientConfig(fmt.Sprintf("%s-%s", inbound.Node.Name, inbound.Name), outbound, routing))
+	}
+
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("у пользователя нет инбаундов, доступных в Xray")
+	}
+	return configs, nil
+}
+
+// newXrayClientConfig собирает конфиг с DNS и маршрутизацией как в конфиге sing-box:
+// DNS через прокси, локальные сети напрямую, дальше правила шаблона, остальное через proxy.
+// Неподошедший под правила трафик Xray отправляет в первый outbound - proxy
+func newXrayClientConfig(remarks string, proxy map[string]interface{}, routing *models.ClientRoutingTemplate) XrayClientConfig {
+	dnsServers, dnsRules := xrayDNS(routing)
+	sniffing := map[string]interface{}{
+		"enabled":      true,
+		"destOverride": []string{"http", "tls", "quic"},
+	}
+
+	return XrayClientConfig{
+		Remarks: remarks,
+		Log: map[string]interface{}{
+			"loglevel": "warning",
+		},
+		DNS: map[string]interface{}{
+			"tag":     "dns-internal",
+			"servers": dnsServers,
+		},
+		Inbounds: []map[string]interface{}{
+			{
+				"tag":      "socks-in",
+				"protocol": "socks",
+				"listen":   "127.0.0.1",
+				"port":     10808,
+				"settings": map[string]interface{}{"udp": true},
+				"sniffing": sniffing,
+			},
+			{
+				"tag":      "http-in",
+				"protocol": "http",
+				"listen":   "127.0.0.1",
+				"port":     10809,
+				"sniffing": sniffing,
+			},
+		},
+		Outbounds: []map[string]interface{}{
+			proxy,
+			{
+				"tag":      "direct",
+				"protocol": "freedom",
+			},
+			{
+				"tag":      "block",
+				"protocol": "blackhole",
+			},
+			{
+				"tag":      "dns-out",
+				"protocol": "dns",
+			},
+		},
+		Routing: map[string]interface{}{
+			"domainStrategy": "IPIfNonMatch",
+			"rules":          append(dnsRules, xrayRoutingRules(routing)...),
+		},
+	}
+}
+
+// xrayDNS - DNS серверы (первый - по умолчанию) и правила для запросов самого DNS модуля:
+// по умолчанию они идут через proxy, запросы к прямым UDP серверам шаблона - напрямую
+func xrayDNS(routing *models.ClientRoutingTemplate) ([]interface{}, []map[string]interface{}) {
+	servers := []interface{}{"8.8.8.8"}
+	var directIPs []string
+
+	for _, rule := range activeRules(routing) {
+		if rule.DNS == "" {
+			continue
+		}
+		server := findClientDNSServer(routing, rule.DNS)
+		domains := xrayDomains(rule, routing)
+		if server == nil || len(domains) == 0 {
+			continue
+		}
+
+		direct := server.Detour != models.ClientRoutingProxy
+		address := server.Address
+		switch {
+		case address == clientDNSLocal:
+			address = "localhost"
+		case strings.HasPrefix(address, "https://"):
+			// +local - запрос напрямую, мимо маршрутизации
+			if direct {
+				address = "https+local://" + strings.TrimPrefix(address, "https://")
+			}
+		case direct:
+			directIPs = append(directIPs, address)
+		}
+
+		servers = append(servers, map[string]interface{}{
+			"address":      address,
+			"domains":      domains,
+			"skipFallback": true,
+		})
+	}
+
+	var rules []map[string]interface{}
+	if len(directIPs) > 0 {
+		rules = append(rules, map[string]interface{}{
+			"type":        "field",
+			"inboundTag":  []string{"dns-internal"},
+			"ip":          directIPs,
+			"outboundTag": "direct",
+		})
+	}
+	rules = append(rules,
+		map[string]interface{}{
+			"type":        "field",
+			"inboundTag":  []string{"dns-internal"},
+			"outboundTag": "proxy",
+		},
+		map[string]interface{}{
+			"type":        "field",
+			"network":     "udp",
+			"port":        "53",
+			"outboundTag": "dns-out",
+		},
+	)
+	return servers, rules
+}
+
+// xrayRoutingRules - локальные сети напрямую и правила шаблона. Условия по доменам и по IP
+// в Xray объединяются по И, поэтому правило шаблона разбивается на два.
+// Rule-set'ы со своим URL (форматы sing-box Xray не читает) отсекает requireGeoRuleSets
+func xrayRoutingRules(routing *models.ClientRoutingTemplate) []map[string]interface{} {
+	rules := []map[string]interface{}{
+		{
+			"type":        "field",
+			"ip":          []string{"geoip:private"},
+			"outboundTag": "direct",
+		},
+	}
+
+	for _, rule := range activeRules(routing) {
+		outbound := "proxy"
+		switch rule.Action {
+		case models.ClientRoutingDirect:
+			outbound = "direct"
+		case models.ClientRoutingBlock:
+			outbound = "block"
+		}
+
+		if domains := xrayDomains(rule, routing); len(domains) > 0 {
+			rules = append(rules, map[string]interface{}{
+				"type":        "field",
+				"domain":      domains,
+				"outboundTag": outbound,
+			})
+		}
+
+		ips := append([]string{}, rule.IPCIDRs...)
+		for _, tag := range rule.RuleSets {
+			if kind, name, ok := geoRuleSet(routing, tag); ok && kind == "geoip" {
+				ips = append(ips, "geoip:"+name)
+			}
+		}
+		if len(ips) > 0 {
+			rules = append(rules, map[string]interface{}{
+				"type":        "field",
+				"ip":          ips,
+				"outboundTag": outbound,
+			})
+		}
+	}
+	return rules
+}
+
+// xrayDomains - доменные условия правила в синтаксисе Xray
+func xrayDomains(rule models.ClientRoutingRule, routing *models.ClientRoutingTemplate) []string {
+	var domains []string
+	for _, domain := range rule.Domains {
+		domains = append(domains, "full:"+domain)
+	}
+	for _, suffix := range rule.DomainSuffixes {
+		domains = append(domains, "domain:"+suffix)
+	}
+	for _, keyword := range rule.DomainKeywords {
+		domains = append(domains, "keyword:"+keyword)
+	}
+	for _, tag := range rule.RuleSets {
+		if kind, name, ok := geoRuleSet(routing, tag); ok && kind == "geosite" {
+			domains = append(domains, "geosite:"+name)
+		}
+	}
+	return domains
+}
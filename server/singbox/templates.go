@@ -3,21 +3,88 @@ package singbox
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"zen-admin/models"
 )
 
+// ClashAPIListen - адрес Clash API на ноде (агент читает через него активные соединения)
+const ClashAPIListen = "127.0.0.1:9095"
+
 // ServerConfig - конфигурация sing-box сервера
 type ServerConfig struct {
-	Log       LogConfig        `json:"log"`
-	Inbounds  []interface{}    `json:"inbounds"`
-	Outbounds []OutboundConfig `json:"outbounds"`
-	Route     *RouteConfig     `json:"route,omitempty"`
+	Log          LogConfig           `json:"log"`
+	Experimental *ExperimentalConfig `json:"experimental,omitempty"`
+	Inbounds     []interface{}       `json:"inbounds"`
+	Outbounds    []interface{}       `json:"outbounds"`
+	Endpoints    []interface{}       `json:"endpoints,omitempty"`
+	Route        *RouteConfig        `json:"route,omitempty"`
+}
+
+// ExperimentalConfig - экспериментальные API sing-box
+type ExperimentalConfig struct {
+	ClashAPI *ClashAPIConfig `json:"clash_api,omitempty"`
+}
+
+// ClashAPIConfig - настройки Clash API
+type ClashAPIConfig struct {
+	ExternalController string `json:"external_controller"`
 }
 
 // RouteConfig - настройки маршрутизации
 type RouteConfig struct {
-	Final string `json:"final"`
+	Rules   []RouteRule     `json:"rules,omitempty"`
+	RuleSet []RuleSetConfig `json:"rule_set,omitempty"`
+	Final   string          `json:"final"`
+}
+
+// RouteRule - правило маршрутизации sing-box (action: sniff, reject, route)
+type RouteRule struct {
+	Action          string   `json:"action"`
+	Outbound        string   `json:"outbound,omitempty"`
+	Inbound         []string `json:"inbound,omitempty"`
+	Protocol        []string `json:"protocol,omitempty"`
+	Network         string   `json:"network,omitempty"`
+	Domain          []string `json:"domain,omitempty"`
+	DomainSuffix    []string `json:"domain_suffix,omitempty"`
+	DomainKeyword   []string `json:"domain_keyword,omitempty"`
+	IPCIDR          []string `json:"ip_cidr,omitempty"`
+	Port            []int    `json:"port,omitempty"`
+	RuleSet         []string `json:"rule_set,omitempty"`
+	Sniffer         []string `json:"sniffer,omitempty"`          // action: sniff
+	OverrideAddress string   `json:"override_address,omitempty"` // action: route
+	OverridePort    int      `json:"override_port,omitempty"`
+}
+
+// RuleSetConfig - удалённый rule-set
+type RuleSetConfig struct {
+	Type           string `json:"type"`
+	Tag            string `json:"tag"`
+	Format         string `json:"format"`
+	URL            string `json:"url"`
+	DownloadDetour string `json:"download_detour,omitempty"`
+	UpdateInterval string `json:"update_interval,omitempty"`
+}
+
+// WireGuardEndpoint - WireGuard endpoint: альтернативный выход (например WARP)
+// или WireGuard инбаунд (с listen_port, пиры - пользователи)
+type WireGuardEndpoint struct {
+	Type       string          `json:"type"`
+	Tag        string          `json:"tag"`
+	Address    []string        `json:"address"`
+	PrivateKey string          `json:"private_key"`
+	ListenPort int             `json:"listen_port,omitempty"`
+	MTU        int             `json:"mtu,omitempty"`
+	Peers      []WireGuardPeer `json:"peers"`
+}
+
+// WireGuardPeer - пир WireGuard endpoint'а (у пиров-пользователей нет адреса и порта)
+type WireGuardPeer struct {
+	Address    string   `json:"address,omitempty"`
+	Port       int      `json:"port,omitempty"`
+	PublicKey  string   `json:"public_key"`
+	AllowedIPs []string `json:"allowed_ips"`
+	Reserved   []int    `json:"reserved,omitempty"`
 }
 
 // LogConfig - настройки логирования
@@ -32,6 +99,58 @@ type OutboundConfig struct {
 	Tag  string `json:"tag"`
 }
 
+// Теги служебного соединения между нодами цепочки
+const (
+	ChainInboundTag  = "chain-in"
+	ChainOutboundTag = "chain-out"
+)
+
+// Префиксы тегов, которые генератор строит из ID инбаунда (vless-reality-1, shadowtls-2-ss...).
+// Теги выходов и rule-set'ов политики маршрутизации не должны с ними совпадать
+var GeneratedTagPrefixes = []string{
+	"vless-reality-",
+	"vless-ws-",
+	"hysteria2-",
+	"tuic-",
+	"trojan-",
+	"vmess-",
+	"shadowsocks-",
+	"shadowtls-",
+	"wireguard-",
+}
+
+// VLESSRealityOutbound - VLESS + REALITY outbound (нода-вход -> вышестоящая нода)
+type VLESSRealityOutbound struct {
+	Type       string           `json:"type"`
+	Tag        string           `json:"tag"`
+	Server     string           `json:"server"`
+	ServerPort int              `json:"server_port"`
+	UUID       string           `json:"uuid"`
+	Flow       string           `json:"flow"`
+	TLS        RealityClientTLS `json:"tls"`
+}
+
+// RealityClientTLS - клиентские TLS настройки REALITY
+type RealityClientTLS struct {
+	Enabled    bool                `json:"enabled"`
+	ServerName string              `json:"server_name"`
+	UTLS       UTLSConfig          `json:"utls"`
+	Reality    RealityClientConfig `json:"reality"`
+}
+
+// UTLSConfig - отпечаток TLS клиента
+type UTLSConfig struct {
+	Enabled     bool   `json:"enabled"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// RealityClientConfig - клиентские настройки REALITY
+type RealityClientConfig struct {
+	Enabled   bool   `json:"enabled"`
+	PublicKey string `json:"public_key"`
+	ShortID   string `json:"short_id"`
+}
+
 // VLESSUser - пользователь VLESS
 type VLESSUser struct {
 	UUID string `json:"uuid"`
@@ -43,14 +162,73 @@ type Hysteria2User struct {
 	Password string `json:"password"`
 }
 
+// TrojanUser - пользователь Trojan
+type TrojanUser struct {
+	Password string `json:"password"`
+}
+
+// VMessUser - пользователь VMess
+type VMessUser struct {
+	UUID    string `json:"uuid"`
+	AlterID int    `json:"alterId"`
+}
+
+// TUICUser - пользователь TUIC
+type TUICUser struct {
+	UUID     string `json:"uuid"`
+	Password string `json:"password"`
+}
+
+// ShadowsocksUser - пользователь Shadowsocks 2022 (ключ выводится из UUID)
+type ShadowsocksUser struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// ShadowTLSInbound - ShadowTLS v3 inbound: проводит handshake с настоящим TLS сервером
+// и передаёт поток внутреннему инбаунду (detour)
+type ShadowTLSInbound struct {
+	Type       string          `json:"type"`
+	Tag        string          `json:"tag"`
+	Listen     string          `json:"listen"`
+	Port       int             `json:"listen_port"`
+	Version    int             `json:"version"`
+	Users      []ShadowTLSUser `json:"users"`
+	Handshake  HandshakeConfig `json:"handshake"`
+	StrictMode bool            `json:"strict_mode"`
+	Detour     string          `json:"detour"`
+}
+
+// ShadowTLSUser - пользователь ShadowTLS v3
+type ShadowTLSUser struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// DirectInbound - direct inbound: принимает TCP и отдаёт его в маршрутизацию
+type DirectInbound struct {
+	Type   string `json:"type"`
+	Tag    string `json:"tag"`
+	Listen string `json:"listen"`
+	Port   int    `json:"listen_port"`
+}
+
+// InboundSet - несколько inbound'ов и правила маршрутизации одного инбаунда панели
+type InboundSet struct {
+	Inbounds []interface{}
+	Rules    []RouteRule
+}
+
 // VLESSRealityInbound - VLESS + REALITY inbound конфиг
 type VLESSRealityInbound struct {
-	Type   string      `json:"type"`
-	Tag    string      `json:"tag"`
-	Listen string      `json:"listen"`
-	Port   int         `json:"listen_port"`
-	Users  []VLESSUser `json:"users"`
-	TLS    RealityTLS  `json:"tls"`
+	Type      string            `json:"type"`
+	Tag       string            `json:"tag"`
+	Listen    string            `json:"listen"`
+	Port      int               `json:"listen_port"`
+	Users     []VLESSUser       `json:"users"`
+	TLS       RealityTLS        `json:"tls"`
+	Transport interface{}       `json:"transport,omitempty"`
+	Multiplex *InboundMultiplex `json:"multiplex,omitempty"`
 }
 
 // RealityTLS - TLS настройки для REALITY
@@ -74,23 +252,46 @@ type HandshakeConfig struct {
 	ServerPort int    `json:"server_port"`
 }
 
-// VLESSWSInbound - VLESS + WS + TLS inbound конфиг
+// VLESSWSInbound - VLESS + TLS inbound конфиг (транспорт ws по умолчанию)
 type VLESSWSInbound struct {
-	Type      string       `json:"type"`
-	Tag       string       `json:"tag"`
-	Listen    string       `json:"listen"`
-	Port      int          `json:"listen_port"`
-	Users     []VLESSUser  `json:"users"`
-	TLS       *StandardTLS `json:"tls,omitempty"`
-	Transport WSTransport  `json:"transport"`
+	Type      string            `json:"type"`
+	Tag       string            `json:"tag"`
+	Listen    string            `json:"listen"`
+	Port      int               `json:"listen_port"`
+	Users     []VLESSUser       `json:"users"`
+	TLS       *StandardTLS      `json:"tls,omitempty"`
+	Transport interface{}       `json:"transport,omitempty"`
+	Multiplex *InboundMultiplex `json:"multiplex,omitempty"`
 }
 
 // StandardTLS - стандартные TLS настройки
 type StandardTLS struct {
-	Enabled    bool   `json:"enabled"`
-	ServerName string `json:"server_name"`
-	Certificate string `json:"certificate_path,omitempty"`
-	Key         string `json:"key_path,omitempty"`
+	Enabled     bool             `json:"enabled"`
+	ServerName  string           `json:"server_name"`
+	ALPN        []string         `json:"alpn,omitempty"`
+	Certificate string           `json:"certificate_path,omitempty"`
+	Key         string           `json:"key_path,omitempty"`
+	ECH         *ECHServerConfig `json:"ech,omitempty"`
+}
+
+// ECHServerConfig - ключ ECH сервера (строки PEM "ECH KEYS")
+type ECHServerConfig struct {
+	Enabled bool     `json:"enabled"`
+	Key     []string `json:"key"`
+}
+
+// InboundMultiplex - multiplex на стороне сервера (протокол mux выбирает клиент)
+type InboundMultiplex struct {
+	Enabled bool          `json:"enabled"`
+	Padding bool          `json:"padding,omitempty"`
+	Brutal  *BrutalConfig `json:"brutal,omitempty"`
+}
+
+// BrutalConfig - настройки TCP Brutal
+type BrutalConfig struct {
+	Enabled  bool `json:"enabled"`
+	UpMbps   int  `json:"up_mbps"`
+	DownMbps int  `json:"down_mbps"`
 }
 
 // WSTransport - WebSocket транспорт
@@ -101,16 +302,91 @@ type WSTransport struct {
 	MaxEarlyData        int    `json:"max_early_data,omitempty"`
 }
 
+// GRPCTransport - gRPC транспорт
+type GRPCTransport struct {
+	Type        string `json:"type"`
+	ServiceName string `json:"service_name"`
+}
+
+// HTTPUpgradeTransport - HTTPUpgrade транспорт
+type HTTPUpgradeTransport struct {
+	Type string `json:"type"`
+	Host string `json:"host,omitempty"`
+	Path string `json:"path"`
+}
+
+// HTTPTransport - HTTP транспорт (HTTP/2 поверх TLS)
+type HTTPTransport struct {
+	Type string   `json:"type"`
+	Host []string `json:"host,omitempty"`
+	Path string   `json:"path"`
+}
+
 // Hysteria2Inbound - Hysteria2 inbound конфиг
 type Hysteria2Inbound struct {
-	Type    string          `json:"type"`
-	Tag     string          `json:"tag"`
-	Listen  string          `json:"listen"`
-	Port    int             `json:"listen_port"`
-	UpMbps  int             `json:"up_mbps"`
-	DownMbps int            `json:"down_mbps"`
-	Users   []Hysteria2User `json:"users"`
-	TLS     StandardTLS     `json:"tls"`
+	Type     string          `json:"type"`
+	Tag      string          `json:"tag"`
+	Listen   string          `json:"listen"`
+	Port     int             `json:"listen_port"`
+	UpMbps   int             `json:"up_mbps"`
+	DownMbps int             `json:"down_mbps"`
+	Users    []Hysteria2User `json:"users"`
+	Obfs     *Hysteria2Obfs  `json:"obfs,omitempty"`
+	TLS      StandardTLS     `json:"tls"`
+}
+
+// Hysteria2Obfs - обфускация Hysteria2
+type Hysteria2Obfs struct {
+	Type     string `json:"type"`
+	Password string `json:"password"`
+}
+
+// TrojanInbound - Trojan inbound конфиг
+type TrojanInbound struct {
+	Type      string            `json:"type"`
+	Tag       string            `json:"tag"`
+	Listen    string            `json:"listen"`
+	Port      int               `json:"listen_port"`
+	Users     []TrojanUser      `json:"users"`
+	TLS       StandardTLS       `json:"tls"`
+	Multiplex *InboundMultiplex `json:"multiplex,omitempty"`
+}
+
+// VMessInbound - VMess + WS + TLS inbound конфиг
+type VMessInbound struct {
+	Type      string            `json:"type"`
+	Tag       string            `json:"tag"`
+	Listen    string            `json:"listen"`
+	Port      int               `json:"listen_port"`
+	Users     []VMessUser       `json:"users"`
+	TLS       StandardTLS       `json:"tls"`
+	Transport WSTransport       `json:"transport"`
+	Multiplex *InboundMultiplex `json:"multiplex,omitempty"`
+}
+
+// TUICInbound - TUIC v5 inbound конфиг
+type TUICInbound struct {
+	Type              string      `json:"type"`
+	Tag               string      `json:"tag"`
+	Listen            string      `json:"listen"`
+	Port              int         `json:"listen_port"`
+	Users             []TUICUser  `json:"users"`
+	CongestionControl string      `json:"congestion_control"`
+	AuthTimeout       string      `json:"auth_timeout"`
+	Heartbeat         string      `json:"heartbeat"`
+	TLS               StandardTLS `json:"tls"`
+}
+
+// ShadowsocksInbound - Shadowsocks 2022 inbound конфиг (multi-user: PSK сервера + ключи пользователей)
+type ShadowsocksInbound struct {
+	Type      string            `json:"type"`
+	Tag       string            `json:"tag"`
+	Listen    string            `json:"listen,omitempty"` // Пусто у внутреннего инбаунда ShadowTLS
+	Port      int               `json:"listen_port,omitempty"`
+	Method    string            `json:"method"`
+	Password  string            `json:"password"`
+	Users     []ShadowsocksUser `json:"users"`
+	Multiplex *InboundMultiplex `json:"multiplex,omitempty"`
 }
 
 // TemplateGenerator генерирует серверные конфиги sing-box
@@ -127,7 +403,7 @@ func (g *TemplateGenerator) GenerateVLESSRealityInbound(inbound *models.Inbound,
 	for i, user := range users {
 		vlessUsers[i] = VLESSUser{
 			UUID: user.UUID.String(),
-			Flow: "xtls-rprx-vision",
+			Flow: inbound.VLESSFlow(),
 		}
 	}
 
@@ -160,13 +436,114 @@ func (g *TemplateGenerator) GenerateVLESSRealityInbound(inbound *models.Inbound,
 					ServerPort: handshakePort,
 				},
 				PrivateKey: inbound.PrivateKey,
-				ShortID:    []string{inbound.ShortID},
+				ShortID:    realityShortIDs(inbound, users),
 			},
 		},
+		Transport: g.GenerateTransport(inbound),
+		Multiplex: g.GenerateMultiplex(inbound),
 	}
 }
 
-// GenerateVLESSWSInbound генерирует VLESS+WS+TLS inbound
+// realityShortIDs возвращает short_id, которые принимает сервер: по одному на пользователя
+// или общие (активный и старые на время ротации)
+func realityShortIDs(inbound *models.Inbound, users []models.User) []string {
+	if !inbound.PerUserShortIDs {
+		return inbound.AcceptedShortIDs()
+	}
+	ids := make([]string, len(users))
+	for i := range users {
+		ids[i] = inbound.UserShortID(&users[i])
+	}
+	return ids
+}
+
+// GenerateRealityInbounds генерирует REALITY инбаунд панели. При нескольких SNI порт слушает
+// direct инбаунд: после sniff соединение по SNI уходит во внутренний REALITY inbound с этим
+// server_name, а соединения с чужим SNI или без него - в основной, который проксирует их на handshake сервер
+func (g *TemplateGenerator) GenerateRealityInbounds(inbound *models.Inbound, users []models.User) interface{} {
+	base := g.GenerateVLESSRealityInbound(inbound, users)
+	if !inbound.SNIRelay() {
+		return base
+	}
+
+	front := base.Tag
+	set := &InboundSet{
+		Inbounds: []interface{}{&DirectInbound{
+			Type:   "direct",
+			Tag:    front,
+			Listen: base.Listen,
+			Port:   base.Port,
+		}},
+		Rules: []RouteRule{{
+			Action:  "sniff",
+			Inbound: []string{front},
+			Sniffer: []string{"tls"},
+		}},
+	}
+
+	var fallback RouteRule
+	for k, name := range inbound.RealityServerNames() {
+		inner := *base
+		inner.Tag = fmt.Sprintf("%s-%d", front, k)
+		inner.Listen = "127.0.0.1"
+		inner.Port = inbound.SNIRelayPort + k
+		inner.TLS.ServerName = name
+		// Без локального fallback handshake идёт на сам маскировочный домен
+		if inbound.FallbackAddr == "" {
+			inner.TLS.Reality.Handshake.Server = name
+		}
+		set.Inbounds = append(set.Inbounds, &inner)
+
+		rule := RouteRule{
+			Action:          "route",
+			Inbound:         []string{front},
+			Outbound:        "direct",
+			OverrideAddress: inner.Listen,
+			OverridePort:    inner.Port,
+		}
+		if k == 0 {
+			fallback = rule
+			continue
+		}
+		rule.Domain = []string{name}
+		set.Rules = append(set.Rules, rule)
+	}
+	set.Rules = append(set.Rules, fallback)
+
+	return set
+}
+
+// GenerateTransport генерирует транспорт VLESS инбаунда (nil для сырого TCP).
+// Host на сервере не проверяется: CDN может его переписывать
+func (g *TemplateGenerator) GenerateTransport(inbound *models.Inbound) interface{} {
+	switch inbound.VLESSTransport() {
+	case models.TransportWS:
+		return &WSTransport{
+			Type:                "ws",
+			Path:                inbound.TransportPath(),
+			EarlyDataHeaderName: "Sec-WebSocket-Protocol",
+			MaxEarlyData:        2048,
+		}
+	case models.TransportGRPC:
+		return &GRPCTransport{
+			Type:        "grpc",
+			ServiceName: inbound.GRPCService(),
+		}
+	case models.TransportHTTPUpgrade:
+		return &HTTPUpgradeTransport{
+			Type: "httpupgrade",
+			Path: inbound.TransportPath(),
+		}
+	case models.TransportHTTP:
+		return &HTTPTransport{
+			Type: "http",
+			Path: inbound.TransportPath(),
+		}
+	}
+	return nil
+}
+
+// GenerateVLESSWSInbound генерирует VLESS+TLS inbound с HTTP транспортом (ws по умолчанию)
 // Если CertPath и KeyPath пустые - TLS отключается (nginx терминирует)
 func (g *TemplateGenerator) GenerateVLESSWSInbound(inbound *models.Inbound, users []models.User) *VLESSWSInbound {
 	vlessUsers := make([]VLESSUser, len(users))
@@ -176,23 +553,14 @@ func (g *TemplateGenerator) GenerateVLESSWSInbound(inbound *models.Inbound, user
 		}
 	}
 
-	wsPath := inbound.WSPath
-	if wsPath == "" {
-		wsPath = "/ws"
-	}
-
 	result := &VLESSWSInbound{
-		Type:   "vless",
-		Tag:    fmt.Sprintf("vless-ws-%d", inbound.ID),
-		Listen: "::",
-		Port:   inbound.ListenPort,
-		Users:  vlessUsers,
-		Transport: WSTransport{
-			Type:                "ws",
-			Path:                wsPath,
-			EarlyDataHeaderName: "Sec-WebSocket-Protocol",
-			MaxEarlyData:        2048,
-		},
+		Type:      "vless",
+		Tag:       fmt.Sprintf("vless-ws-%d", inbound.ID),
+		Listen:    "::",
+		Port:      inbound.ListenPort,
+		Users:     vlessUsers,
+		Transport: g.GenerateTransport(inbound),
+		Multiplex: g.GenerateMultiplex(inbound),
 	}
 
 	// Если есть сертификаты - включаем TLS на sing-box
@@ -203,12 +571,24 @@ func (g *TemplateGenerator) GenerateVLESSWSInbound(inbound *models.Inbound, user
 			ServerName:  inbound.SNI,
 			Certificate: inbound.CertPath,
 			Key:         inbound.KeyPath,
+			ECH:         g.GenerateECH(inbound),
 		}
 	}
 
 	return result
 }
 
+// GenerateECH генерирует ECH сервера, если он включён и ключи уже сгенерированы панелью
+func (g *TemplateGenerator) GenerateECH(inbound *models.Inbound) *ECHServerConfig {
+	if !inbound.ECHEnabled || inbound.ECHKey == "" {
+		return nil
+	}
+	return &ECHServerConfig{
+		Enabled: true,
+		Key:     strings.Split(strings.TrimSpace(inbound.ECHKey), "\n"),
+	}
+}
+
 // GenerateHysteria2Inbound генерирует Hysteria2 inbound
 func (g *TemplateGenerator) GenerateHysteria2Inbound(inbound *models.Inbound, users []models.User) *Hysteria2Inbound {
 	hy2Users := make([]Hysteria2User, len(users))
@@ -227,7 +607,8 @@ func (g *TemplateGenerator) GenerateHysteria2Inbound(inbound *models.Inbound, us
 		downMbps = 100
 	}
 
-	return &Hysteria2Inbound{
+	// Port hopping на сервере не настраивается: диапазон перенаправляет на порт агент ноды
+	result := &Hysteria2Inbound{
 		Type:     "hysteria2",
 		Tag:      fmt.Sprintf("hysteria2-%d", inbound.ID),
 		Listen:   "::",
@@ -240,19 +621,225 @@ func (g *TemplateGenerator) GenerateHysteria2Inbound(inbound *models.Inbound, us
 			ServerName:  inbound.SNI,
 			Certificate: inbound.CertPath,
 			Key:         inbound.KeyPath,
+			ECH:         g.GenerateECH(inbound),
 		},
 	}
+	if inbound.Obfs == models.ObfsSalamander {
+		result.Obfs = &Hysteria2Obfs{
+			Type:     models.ObfsSalamander,
+			Password: inbound.ObfsPassword,
+		}
+	}
+	return result
 }
 
+// GenerateTUICInbound генерирует TUIC v5 inbound (UUID и пароль - UUID пользователя, как в Hysteria2)
+func (g *TemplateGenerator) GenerateTUICInbound(inbound *models.Inbound, users []models.User) *TUICInbound {
+	tuicUsers := make([]TUICUser, len(users))
+	for i, user := range users {
+		tuicUsers[i] = TUICUser{
+			UUID:     user.UUID.String(),
+			Password: user.UUID.String(),
+		}
+	}
+
+	congestion := inbound.CongestionControl
+	if congestion == "" {
+		congestion = models.CongestionBBR
+	}
+
+	return &TUICInbound{
+		Type:              "tuic",
+		Tag:               fmt.Sprintf("tuic-%d", inbound.ID),
+		Listen:            "::",
+		Port:              inbound.ListenPort,
+		Users:             tuicUsers,
+		CongestionControl: congestion,
+		AuthTimeout:       "3s",
+		Heartbeat:         "10s",
+		TLS: StandardTLS{
+			Enabled:     true,
+			ServerName:  inbound.SNI,
+			ALPN:        inbound.TUICALPN(),
+			Certificate: inbound.CertPath,
+			Key:         inbound.KeyPath,
+			ECH:         g.GenerateECH(inbound),
+		},
+	}
+}
+
+// GenerateTrojanInbound генерирует Trojan inbound (пароль - UUID пользователя)
+func (g *TemplateGenerator) GenerateTrojanInbound(inbound *models.Inbound, users []models.User) *TrojanInbound {
+	trojanUsers := make([]TrojanUser, len(users))
+	for i, user := range users {
+		trojanUsers[i] = TrojanUser{
+			Password: user.UUID.String(),
+		}
+	}
+
+	return &TrojanInbound{
+		Type:   "trojan",
+		Tag:    fmt.Sprintf("trojan-%d", inbound.ID),
+		Listen: "::",
+		Port:   inbound.ListenPort,
+		Users:  trojanUsers,
+		TLS: StandardTLS{
+			Enabled:     true,
+			ServerName:  inbound.SNI,
+			Certificate: inbound.CertPath,
+			Key:         inbound.KeyPath,
+			ECH:         g.GenerateECH(inbound),
+		},
+		Multiplex: g.GenerateMultiplex(inbound),
+	}
+}
+
+// GenerateVMessInbound генерирует VMess+WS+TLS inbound
+func (g *TemplateGenerator) GenerateVMessInbound(inbound *models.Inbound, users []models.User) *VMessInbound {
+	vmessUsers := make([]VMessUser, len(users))
+	for i, user := range users {
+		vmessUsers[i] = VMessUser{
+			UUID:    user.UUID.String(),
+			AlterID: inbound.AlterID,
+		}
+	}
+
+	wsPath := inbound.WSPath
+	if wsPath == "" {
+		wsPath = "/ws"
+	}
+
+	return &VMessInbound{
+		Type:   "vmess",
+		Tag:    fmt.Sprintf("vmess-%d", inbound.ID),
+		Listen: "::",
+		Port:   inbound.ListenPort,
+		Users:  vmessUsers,
+		TLS: StandardTLS{
+			Enabled:     true,
+			ServerName:  inbound.SNI,
+			Certificate: inbound.CertPath,
+			Key:         inbound.KeyPath,
+			ECH:         g.GenerateECH(inbound),
+		},
+		Transport: WSTransport{
+			Type:                "ws",
+			Path:                wsPath,
+			EarlyDataHeaderName: "Sec-WebSocket-Protocol",
+			MaxEarlyData:        2048,
+		},
+		Multiplex: g.GenerateMultiplex(inbound),
+	}
+}
+
+// GenerateShadowsocksInbound генерирует Shadowsocks 2022 inbound
+func (g *TemplateGenerator) GenerateShadowsocksInbound(inbound *models.Inbound, users []models.User) *ShadowsocksInbound {
+	ssUsers := make([]ShadowsocksUser, len(users))
+	for i := range users {
+		ssUsers[i] = ShadowsocksUser{
+			Name:     users[i].UUID.String(),
+			Password: inbound.SSUserKey(&users[i]),
+		}
+	}
+
+	return &ShadowsocksInbound{
+		Type:      "shadowsocks",
+		Tag:       fmt.Sprintf("shadowsocks-%d", inbound.ID),
+		Listen:    "::",
+		Port:      inbound.ListenPort,
+		Method:    inbound.SSMethod,
+		Password:  inbound.SSServerKey,
+		Users:     ssUsers,
+		Multiplex: g.GenerateMultiplex(inbound),
+	}
+}
+
+// GenerateShadowTLSInbounds генерирует ShadowTLS v3 инбаунд и внутренний Shadowsocks 2022,
+// который не слушает порт и получает соединения только через detour
+func (g *TemplateGenerator) GenerateShadowTLSInbounds(inbound *models.Inbound, users []models.User) *InboundSet {
+	stUsers := make([]ShadowTLSUser, len(users))
+	for i := range users {
+		stUsers[i] = ShadowTLSUser{
+			Name:     users[i].UUID.String(),
+			Password: inbound.ShadowTLSPassword(&users[i]),
+		}
+	}
+
+	// Handshake с настоящим сервером домена SNI, если не задан другой адрес
+	handshakeServer := inbound.SNI
+	handshakePort := 443
+	if inbound.FallbackAddr != "" {
+		handshakeServer = inbound.FallbackAddr
+	}
+	if inbound.FallbackPort != 0 {
+		handshakePort = inbound.FallbackPort
+	}
+
+	inner := g.GenerateShadowsocksInbound(inbound, users)
+	inner.Tag = fmt.Sprintf("shadowtls-%d-ss", inbound.ID)
+	inner.Listen = ""
+	inner.Port = 0
+
+	return &InboundSet{
+		Inbounds: []interface{}{
+			&ShadowTLSInbound{
+				Type:    "shadowtls",
+				Tag:     fmt.Sprintf("shadowtls-%d", inbound.ID),
+				Listen:  "::",
+				Port:    inbound.ListenPort,
+				Version: 3,
+				Users:   stUsers,
+				Handshake: HandshakeConfig{
+					Server:     handshakeServer,
+					ServerPort: handshakePort,
+				},
+				StrictMode: true,
+				Detour:     inner.Tag,
+			},
+			inner,
+		},
+	}
+}
+
+// GenerateMultiplex генерирует серверный multiplex (nil, если выключен).
+// Скорости Brutal хранятся со стороны клиента: отдача сервера - это загрузка клиента
+func (g *TemplateGenerator) GenerateMultiplex(inbound *models.Inbound) *InboundMultiplex {
+	if !inbound.MultiplexActive() {
+		return nil
+	}
+
+	mux := &InboundMultiplex{
+		Enabled: true,
+		Padding: inbound.MuxPadding,
+	}
+	if inbound.BrutalEnabled() {
+		mux.Brutal = &BrutalConfig{
+			Enabled:  true,
+			UpMbps:   inbound.BrutalDownMbps,
+			DownMbps: inbound.BrutalUpMbps,
+		}
+	}
+	return mux
+}
+
+// InboundRenderer строит серверный inbound инбаунда по его протоколу
+// (реестр протоколов - protocols.ServerInbound). nil - инбаунд рендерится отдельно
+type InboundRenderer func(inbound *models.Inbound, users []models.User) (interface{}, error)
+
 // GenerateServerConfig генерирует полный серверный конфиг для ноды
-func (g *TemplateGenerator) GenerateServerConfig(inbounds []models.Inbound, usersByInbound map[uint][]models.User) (*ServerConfig, error) {
+func (g *TemplateGenerator) GenerateServerConfig(inbounds []models.Inbound, usersByInbound map[uint][]models.User, render InboundRenderer) (*ServerConfig, error) {
 	config := &ServerConfig{
 		Log: LogConfig{
 			Level:     "info",
 			Timestamp: true,
 		},
-		Outbounds: []OutboundConfig{
-			{Type: "direct", Tag: "direct"},
+		Experimental: &ExperimentalConfig{
+			ClashAPI: &ClashAPIConfig{
+				ExternalController: ClashAPIListen,
+			},
+		},
+		Outbounds: []interface{}{
+			OutboundConfig{Type: "direct", Tag: "direct"},
 		},
 		Route: &RouteConfig{
 			Final: "direct",
@@ -269,51 +856,221 @@ func (g *TemplateGenerator) GenerateServerConfig(inbounds []models.Inbound, user
 			continue
 		}
 
-		var inboundConfig interface{}
-		switch inbound.Protocol {
-		case models.ProtocolReality:
-			inboundConfig = g.GenerateVLESSRealityInbound(&inbound, users)
-		case models.ProtocolWSTLS:
-			inboundConfig = g.GenerateVLESSWSInbound(&inbound, users)
-		case models.ProtocolHysteria2:
-			inboundConfig = g.GenerateHysteria2Inbound(&inbound, users)
-		default:
+		inboundConfig, err := render(&inbound, users)
+		if err != nil {
+			return nil, err
+		}
+		if inboundConfig == nil {
 			continue
 		}
 
+		if set, ok := inboundConfig.(*InboundSet); ok {
+			config.Inbounds = append(config.Inbounds, set.Inbounds...)
+			config.Route.Rules = append(config.Route.Rules, set.Rules...)
+			continue
+		}
 		config.Inbounds = append(config.Inbounds, inboundConfig)
 	}
 
 	return config, nil
 }
 
-// SerializeConfig сериализует конфиг в JSON строку
-func (g *TemplateGenerator) SerializeConfig(config *ServerConfig) (string, error) {
-	data, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		return "", fmt.Errorf("ошибка сериализации конфига: %w", err)
+// ApplyWireGuard добавляет WireGuard инбаунд. В sing-box 1.11+ WireGuard - это endpoint:
+// он принимает пиров пользователей и отдаёт их трафик в маршрутизацию как обычный инбаунд
+func (g *TemplateGenerator) ApplyWireGuard(config *ServerConfig, inbound *models.Inbound, peers []models.WireGuardPeer) {
+	wgPeers := make([]WireGuardPeer, len(peers))
+	for i := range peers {
+		wgPeers[i] = WireGuardPeer{
+			PublicKey:  peers[i].PublicKey,
+			AllowedIPs: []string{peers[i].HostPrefix()},
+		}
+	}
+
+	config.Endpoints = append(config.Endpoints, &WireGuardEndpoint{
+		Type:       "wireguard",
+		Tag:        fmt.Sprintf("wireguard-%d", inbound.ID),
+		Address:    []string{inbound.WGServerAddress()},
+		PrivateKey: inbound.WGPrivateKey,
+		ListenPort: inbound.ListenPort,
+		MTU:        inbound.WGMTUOrDefault(),
+		Peers:      wgPeers,
+	})
+}
+
+// GenerateChainInbound генерирует служебный REALITY inbound ноды-выхода.
+// Пользователи - служебные учётки нод-входов
+func (g *TemplateGenerator) GenerateChainInbound(exit *models.Node, entries []models.Node) *VLESSRealityInbound {
+	users := make([]VLESSUser, len(entries))
+	for i, entry := range entries {
+		users[i] = VLESSUser{
+			UUID: entry.ChainUUID,
+			Flow: "xtls-rprx-vision",
+		}
+	}
+
+	return &VLESSRealityInbound{
+		Type:   "vless",
+		Tag:    ChainInboundTag,
+		Listen: "::",
+		Port:   exit.ChainPort,
+		Users:  users,
+		TLS: RealityTLS{
+			Enabled:    true,
+			ServerName: exit.ChainSNI,
+			Reality: RealityConfig{
+				Enabled: true,
+				Handshake: HandshakeConfig{
+					Server:     exit.ChainSNI,
+					ServerPort: 443,
+				},
+				PrivateKey: exit.ChainPrivateKey,
+				ShortID:    []string{exit.ChainShortID},
+			},
+		},
+	}
+}
+
+// GenerateChainOutbound генерирует outbound ноды-входа к вышестоящей ноде
+func (g *TemplateGenerator) GenerateChainOutbound(entry *models.Node, exit *models.Node) *VLESSRealityOutbound {
+	return &VLESSRealityOutbound{
+		Type:       "vless",
+		Tag:        ChainOutboundTag,
+		Server:     exit.Address,
+		ServerPort: exit.ChainPort,
+		UUID:       entry.ChainUUID,
+		Flow:       "xtls-rprx-vision",
+		TLS: RealityClientTLS{
+			Enabled:    true,
+			ServerName: exit.ChainSNI,
+			UTLS: UTLSConfig{
+				Enabled:     true,
+				Fingerprint: "chrome",
+			},
+			Reality: RealityClientConfig{
+				Enabled:   true,
+				PublicKey: exit.ChainPublicKey,
+				ShortID:   exit.ChainShortID,
+			},
+		},
+	}
+}
+
+// ApplyChain добавляет в конфиг ноды звенья цепочки: служебный inbound для нод-входов
+// (downstream) и outbound на вышестоящую ноду (upstream), через который уходит весь трафик.
+// Промежуточная нода получает и то, и другое
+func (g *TemplateGenerator) ApplyChain(config *ServerConfig, node *models.Node, upstream *models.Node, downstream []models.Node) {
+	if len(downstream) > 0 && node.IsChainExit() {
+		config.Inbounds = append(config.Inbounds, g.GenerateChainInbound(node, downstream))
+	}
+
+	if upstream != nil {
+		config.Outbounds = append(config.Outbounds, g.GenerateChainOutbound(node, upstream))
+		config.Route.Final = ChainOutboundTag
 	}
-	return string(data), nil
 }
 
-// GenerateInboundJSON генерирует JSON для одного inbound
-func (g *TemplateGenerator) GenerateInboundJSON(inbound *models.Inbound, users []models.User) (string, error) {
-	var inboundConfig interface{}
+// Адреса rule-set'ов SagerNet для тегов geosite-* и geoip-* без явного URL
+const (
+	geositeRuleSetURL = "https://raw.githubusercontent.com/SagerNet/sing-geosite/rule-set/%s.srs"
+	geoipRuleSetURL   = "https://raw.githubusercontent.com/SagerNet/sing-geoip/rule-set/%s.srs"
+)
 
-	switch inbound.Protocol {
-	case models.ProtocolReality:
-		inboundConfig = g.GenerateVLESSRealityInbound(inbound, users)
-	case models.ProtocolWSTLS:
-		inboundConfig = g.GenerateVLESSWSInbound(inbound, users)
-	case models.ProtocolHysteria2:
-		inboundConfig = g.GenerateHysteria2Inbound(inbound, users)
-	default:
-		return "", fmt.Errorf("неподдерживаемый протокол: %s", inbound.Protocol)
+// RuleSetURL возвращает адрес rule-set'а с учётом адресов по умолчанию для geosite-*/geoip-*
+func RuleSetURL(ruleSet *models.RoutingRuleSet) string {
+	switch {
+	case ruleSet.URL != "":
+		return ruleSet.URL
+	case strings.HasPrefix(ruleSet.Tag, "geosite-"):
+		return fmt.Sprintf(geositeRuleSetURL, ruleSet.Tag)
+	case strings.HasPrefix(ruleSet.Tag, "geoip-"):
+		return fmt.Sprintf(geoipRuleSetURL, ruleSet.Tag)
 	}
+	return ""
+}
 
-	data, err := json.MarshalIndent(inboundConfig, "", "  ")
+// ApplyRoutingPolicy добавляет в конфиг правила политики маршрутизации,
+// её rule-set'ы и альтернативные выходы. Final ноды (direct или цепочка) не меняется
+func (g *TemplateGenerator) ApplyRoutingPolicy(config *ServerConfig, policy *models.RoutingPolicy) {
+	var rules []RouteRule
+	for _, rule := range policy.Rules {
+		if rule.Disabled {
+			continue
+		}
+
+		routeRule := RouteRule{
+			Protocol:      rule.Protocols,
+			Network:       rule.Network,
+			Domain:        rule.Domains,
+			DomainSuffix:  rule.DomainSuffixes,
+			DomainKeyword: rule.DomainKeywords,
+			IPCIDR:        rule.IPCIDRs,
+			Port:          rule.Ports,
+			RuleSet:       rule.RuleSets,
+		}
+		switch rule.Action {
+		case models.RoutingActionBlock:
+			routeRule.Action = "reject"
+		case models.RoutingActionDirect:
+			routeRule.Action = "route"
+			routeRule.Outbound = "direct"
+		case models.RoutingActionEgress:
+			routeRule.Action = "route"
+			routeRule.Outbound = rule.Egress
+		default:
+			continue
+		}
+		rules = append(rules, routeRule)
+	}
+	if len(rules) == 0 {
+		return
+	}
+
+	// Протокол (bittorrent, quic...) и домен при подключении по IP известны только после sniff
+	config.Route.Rules = append(config.Route.Rules, RouteRule{Action: "sniff"})
+	config.Route.Rules = append(config.Route.Rules, rules...)
+
+	for i := range policy.RuleSets {
+		ruleSet := &policy.RuleSets[i]
+		format := ruleSet.Format
+		if format == "" {
+			format = "binary"
+		}
+		config.Route.RuleSet = append(config.Route.RuleSet, RuleSetConfig{
+			Type:           "remote",
+			Tag:            ruleSet.Tag,
+			Format:         format,
+			URL:            RuleSetURL(ruleSet),
+			DownloadDetour: "direct",
+			UpdateInterval: ruleSet.UpdateInterval,
+		})
+	}
+
+	for _, egress := range policy.Egresses {
+		if egress.Type != models.EgressTypeWireGuard {
+			continue
+		}
+		config.Endpoints = append(config.Endpoints, &WireGuardEndpoint{
+			Type:       "wireguard",
+			Tag:        egress.Tag,
+			Address:    egress.Address,
+			PrivateKey: egress.PrivateKey,
+			MTU:        egress.MTU,
+			Peers: []WireGuardPeer{{
+				Address:    egress.PeerAddress,
+				Port:       egress.PeerPort,
+				PublicKey:  egress.PeerPublicKey,
+				AllowedIPs: []string{"0.0.0.0/0", "::/0"},
+				Reserved:   egress.Reserved,
+			}},
+		})
+	}
+}
+
+// SerializeConfig сериализует конфиг в JSON строку
+func (g *TemplateGenerator) SerializeConfig(config *ServerConfig) (string, error) {
+	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
-		return "", fmt.Errorf("ошибка сериализации: %w", err)
+		return "", fmt.Errorf("ошибка сериализации конфига: %w", err)
 	}
 	return string(data), nil
 }